@@ -1,11 +1,17 @@
 package railwayimages
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jaredLunde/railway-image-service/client/sign"
 )
@@ -18,6 +24,15 @@ type Options struct {
 	// If a signature secret key is provided, it will be used to sign URLs
 	// locally instead of making a request to the server to sign the request.
 	SignatureSecretKey string
+	// The tenant your API key belongs to. It's required to sign URLs locally
+	// as a tenant, in which case SignatureSecretKey is the tenant's secret.
+	Tenant string
+	// How many times requests that can safely be repeated are retried when
+	// they fail to connect or the server is unavailable. Zero doesn't retry.
+	MaxRetries int
+	// How long to wait before the first retry, doubling after each one.
+	// Defaults to 200ms.
+	RetryBackoff time.Duration
 }
 
 // Create a new API client.
@@ -35,10 +50,14 @@ func NewClient(opt Options) (*Client, error) {
 	if opt.SecretKey != "" {
 		transport = &SigningTransport{transport: transport, SecretKey: opt.SecretKey}
 	}
+	if opt.MaxRetries > 0 {
+		transport = &RetryTransport{transport: transport, MaxRetries: opt.MaxRetries, Backoff: opt.RetryBackoff}
+	}
 
 	return &Client{
 		URL:                u,
 		SignatureSecretKey: opt.SignatureSecretKey,
+		Tenant:             opt.Tenant,
 		transport:          transport,
 	}, nil
 }
@@ -57,22 +76,73 @@ func (t *SigningTransport) RoundTrip(req *http.Request) (*http.Response, error)
 type Client struct {
 	URL                *url.URL
 	SignatureSecretKey string
+	Tenant             string
 	transport          http.RoundTripper
+	ctx                context.Context
+}
+
+// Get a copy of the client that makes its requests with ctx, so they're
+// canceled along with it
+func (c *Client) WithContext(ctx context.Context) *Client {
+	if ctx == nil {
+		panic("nil context")
+	}
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
+}
+
+func (c *Client) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
 }
 
 // Get a signed URL for a given path. If a signature secret key is provided
 // in the client options, the URL will be signed locally. Otherwise, a request
 // will be made to the server to sign the URL.
 func (c *Client) Sign(path string) (string, error) {
+	return c.SignWithOptions(path, SignOptions{})
+}
+
+// Get a signed URL for a given path that stops being accepted after
+// expiresIn. Unlike Sign, this applies to /serve URLs as well, which
+// otherwise never expire.
+func (c *Client) SignWithExpiry(path string, expiresIn time.Duration) (string, error) {
+	if expiresIn <= 0 {
+		return "", fmt.Errorf("expiresIn must be positive")
+	}
+	return c.SignWithOptions(path, SignOptions{ExpiresIn: expiresIn})
+}
+
+type SignOptions struct {
+	// How long the URL is valid for. /blob URLs are valid for an hour by
+	// default and /serve URLs never expire.
+	ExpiresIn time.Duration
+	// Only accept the URL once. Single-use /serve URLs expire after an hour
+	// unless ExpiresIn is set.
+	SingleUse bool
+	// Only accept the URL from this IP address or CIDR, e.g. the IP of the
+	// user it's for
+	IP string
+}
+
+// Get a signed URL for a given path with options
+func (c *Client) SignWithOptions(path string, opts SignOptions) (string, error) {
+	if opts.ExpiresIn < 0 {
+		return "", fmt.Errorf("ExpiresIn can't be negative")
+	}
 	u := *c.URL
 
 	if c.SignatureSecretKey != "" {
 		u.Path = path
-		uri, err := sign.SignURL(&u, c.SignatureSecretKey)
-		if err != nil {
-			return "", err
+		signOpts := sign.Options{ExpireAt: time.Now().Add(time.Hour), SingleUse: opts.SingleUse, IP: opts.IP}
+		if opts.ExpiresIn > 0 {
+			signOpts.ExpireAt = time.Now().Add(opts.ExpiresIn)
+			signOpts.ExpireServe = true
 		}
-		return *uri, nil
+		return c.signLocally(&u, signOpts)
 	}
 
 	signPath, err := url.JoinPath("/sign", path)
@@ -81,7 +151,18 @@ func (c *Client) Sign(path string) (string, error) {
 	}
 
 	u.Path = signPath
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	q := u.Query()
+	if opts.ExpiresIn > 0 {
+		q.Set("expires_in", opts.ExpiresIn.String())
+	}
+	if opts.SingleUse {
+		q.Set("single_use", "true")
+	}
+	if opts.IP != "" {
+		q.Set("ip", opts.IP)
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(c.context(), http.MethodGet, u.String(), nil)
 	if err != nil {
 		return "", err
 	}
@@ -97,6 +178,223 @@ func (c *Client) Sign(path string) (string, error) {
 	return string(body), nil
 }
 
+// Sign a URL with the signature secret key, scoped to the client's tenant if
+// it has one
+func (c *Client) signLocally(u *url.URL, opts sign.Options) (string, error) {
+	if c.Tenant != "" {
+		q := u.Query()
+		q.Set("x-tenant", c.Tenant)
+		u.RawQuery = q.Encode()
+	}
+	uri, err := sign.SignURLWithOptions(u, c.SignatureSecretKey, opts)
+	if err != nil {
+		return "", err
+	}
+	return *uri, nil
+}
+
+type PresignedUpload struct {
+	// The signed URL to upload the file to
+	URL string `json:"url"`
+	// The HTTP method to upload the file with
+	Method string `json:"method"`
+	// Headers the upload request has to include
+	Headers map[string]string `json:"headers"`
+	// When the URL stops being accepted
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type SignUploadOptions struct {
+	// How long the URL is valid for. Defaults to an hour, and can be at most
+	// 7 days.
+	ExpiresIn time.Duration
+	// The content type the file will be uploaded with
+	ContentType string
+	// Only accept the URL once
+	SingleUse bool
+	// Only accept the URL from this IP address or CIDR
+	IP string
+}
+
+// Get a presigned URL that a browser can upload a file to directly, without
+// having the API key. If a signature secret key is provided in the client
+// options, the URL will be signed locally.
+func (c *Client) SignUpload(key string, opts SignUploadOptions) (*PresignedUpload, error) {
+	u := *c.URL
+
+	if c.SignatureSecretKey != "" {
+		expiresIn := opts.ExpiresIn
+		if expiresIn <= 0 {
+			expiresIn = time.Hour
+		}
+		blobPath, err := url.JoinPath("/blob", key)
+		if err != nil {
+			return nil, err
+		}
+		u.Path = blobPath
+		expiresAt := time.Now().Add(expiresIn)
+		uri, err := c.signLocally(&u, sign.Options{ExpireAt: expiresAt, SingleUse: opts.SingleUse, IP: opts.IP})
+		if err != nil {
+			return nil, err
+		}
+		headers := map[string]string{}
+		if opts.ContentType != "" {
+			headers["Content-Type"] = opts.ContentType
+		}
+		return &PresignedUpload{
+			URL:       uri,
+			Method:    http.MethodPut,
+			Headers:   headers,
+			ExpiresAt: time.UnixMilli(expiresAt.UnixMilli()).UTC(),
+		}, nil
+	}
+
+	signPath, err := url.JoinPath("/sign/upload", key)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = signPath
+	q := u.Query()
+	if opts.ExpiresIn > 0 {
+		q.Set("expires_in", opts.ExpiresIn.String())
+	}
+	if opts.ContentType != "" {
+		q.Set("content_type", opts.ContentType)
+	}
+	if opts.SingleUse {
+		q.Set("single_use", "true")
+	}
+	if opts.IP != "" {
+		q.Set("ip", opts.IP)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(c.context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	var result PresignedUpload
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+type PresignedPolicy struct {
+	// The URL to POST the form to
+	URL string `json:"url"`
+	// Form fields to send before the file
+	Fields map[string]string `json:"fields"`
+	// When the policy stops being accepted
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type SignPolicyOptions struct {
+	// How long the policy is valid for. Defaults to an hour, and can be at
+	// most 7 days.
+	ExpiresIn time.Duration
+	// The prefix the key of the upload has to start with
+	KeyPrefix string
+	// The largest file that can be uploaded in bytes
+	MaxSize int64
+	// The prefix the content type of the file has to start with, e.g. image/
+	ContentType string
+	// The ACL the file is uploaded with. The form can choose one if it's
+	// empty.
+	ACL string
+}
+
+// Get a signed upload policy that lets a browser POST a form with a file to
+// /blob, within the constraints of the policy. The file has to be the last
+// field of the form. If a signature secret key is provided in the client
+// options, the policy will be signed locally.
+func (c *Client) SignPolicy(opts SignPolicyOptions) (*PresignedPolicy, error) {
+	u := *c.URL
+
+	if c.SignatureSecretKey != "" {
+		expiresIn := opts.ExpiresIn
+		if expiresIn <= 0 {
+			expiresIn = time.Hour
+		}
+		policy := sign.UploadPolicy{
+			Expiration:  time.UnixMilli(time.Now().Add(expiresIn).UnixMilli()).UTC(),
+			KeyPrefix:   strings.TrimPrefix(opts.KeyPrefix, "/"),
+			MaxSize:     opts.MaxSize,
+			ContentType: opts.ContentType,
+			ACL:         opts.ACL,
+		}
+		encoded, signature, err := sign.SignPolicy(policy, c.SignatureSecretKey)
+		if err != nil {
+			return nil, err
+		}
+		fields := map[string]string{
+			"key":         policy.KeyPrefix + "${filename}",
+			"policy":      encoded,
+			"x-signature": signature,
+		}
+		if c.Tenant != "" {
+			fields["x-tenant"] = c.Tenant
+		}
+		u.Path = "/blob"
+		return &PresignedPolicy{
+			URL:       u.String(),
+			Fields:    fields,
+			ExpiresAt: policy.Expiration,
+		}, nil
+	}
+
+	u.Path = "/sign/policy"
+	q := u.Query()
+	if opts.ExpiresIn > 0 {
+		q.Set("expires_in", opts.ExpiresIn.String())
+	}
+	if opts.KeyPrefix != "" {
+		q.Set("key_prefix", opts.KeyPrefix)
+	}
+	if opts.MaxSize > 0 {
+		q.Set("max_size", strconv.FormatInt(opts.MaxSize, 10))
+	}
+	if opts.ContentType != "" {
+		q.Set("content_type", opts.ContentType)
+	}
+	if opts.ACL != "" {
+		q.Set("acl", opts.ACL)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(c.context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	var result PresignedPolicy
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
 // Get a file from the storage server
 func (c *Client) Get(key string) (*http.Response, error) {
 	u := *c.URL
@@ -105,7 +403,48 @@ func (c *Client) Get(key string) (*http.Response, error) {
 		return nil, err
 	}
 	u.Path = path
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	req, err := http.NewRequestWithContext(c.context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Download a file from the storage server into w
+func (c *Client) Download(key string, w io.Writer) error {
+	res, err := c.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unexpected status code %d: %s", res.StatusCode, string(body))
+	}
+
+	if _, err := io.Copy(w, res.Body); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	return nil
+}
+
+// Head gets the headers of a file from the storage server without its body.
+// It's a cheap way to check whether a file exists and how large it is.
+func (c *Client) Head(key string) (*http.Response, error) {
+	u := *c.URL
+	path, err := url.JoinPath("/blob", key)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path
+	req, err := http.NewRequestWithContext(c.context(), http.MethodHead, u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -120,16 +459,49 @@ func (c *Client) Get(key string) (*http.Response, error) {
 
 // Put a file to the storage server
 func (c *Client) Put(key string, r io.Reader) error {
+	return c.PutWithOptions(key, r, PutOptions{})
+}
+
+type PutOptions struct {
+	// Metadata to store with the file, e.g. an owner ID or alt text. It's
+	// returned in x-meta-* headers when getting the file.
+	Metadata map[string]string
+	// Delete the file automatically after this long. Zero means never.
+	ExpireAfter time.Duration
+	// Who can read the file, ACLPublic or ACLPrivate. Defaults to the
+	// service's DEFAULT_ACL.
+	ACL string
+}
+
+const (
+	// Private files can only be read with an API key or a signed URL
+	ACLPrivate = "private"
+	// Public files can be read by anyone
+	ACLPublic = "public"
+)
+
+// Put a file to the storage server with options
+func (c *Client) PutWithOptions(key string, r io.Reader, opts PutOptions) error {
 	// Create URL
 	u := *c.URL
 	u.Path = fmt.Sprintf("/blob/%s", key)
 
 	// Create request
-	req, err := http.NewRequest(http.MethodPut, u.String(), r)
+	req, err := http.NewRequestWithContext(c.context(), http.MethodPut, u.String(), r)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
+	for name, value := range opts.Metadata {
+		req.Header.Set("x-meta-"+name, value)
+	}
+	if opts.ExpireAfter > 0 {
+		req.Header.Set("x-expire-after", opts.ExpireAfter.String())
+	}
+	if opts.ACL != "" {
+		req.Header.Set("x-acl", opts.ACL)
+	}
+
 	// Set content type if possible
 	if rc, ok := r.(io.ReadCloser); ok {
 		defer rc.Close()
@@ -162,7 +534,33 @@ func (c *Client) Delete(key string) error {
 		return err
 	}
 	u.Path = path
-	req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+	req, err := http.NewRequestWithContext(c.context(), http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// Purge the processed images of a file from the service's result cache, so
+// they're processed again the next time they're served
+func (c *Client) Purge(key string) error {
+	u := *c.URL
+	path, err := url.JoinPath("/serve/cache", key)
+	if err != nil {
+		return err
+	}
+	u.Path = path
+	req, err := http.NewRequestWithContext(c.context(), http.MethodDelete, u.String(), nil)
 	if err != nil {
 		return err
 	}
@@ -171,6 +569,7 @@ func (c *Client) Delete(key string) error {
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusNoContent {
 		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
@@ -179,10 +578,417 @@ func (c *Client) Delete(key string) error {
 	return nil
 }
 
+// Change who can read a file on the storage server, ACLPublic or ACLPrivate
+func (c *Client) SetACL(key, acl string) (*ListObject, error) {
+	u := *c.URL
+	path, err := url.JoinPath("/blob", key)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path
+
+	req, err := http.NewRequestWithContext(c.context(), http.MethodPatch, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("x-acl", acl)
+
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	var result ListObject
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// Update the metadata of a file on the storage server. Names in set are
+// added or replaced and names in remove are deleted.
+func (c *Client) UpdateMetadata(key string, set map[string]string, remove ...string) (*ListObject, error) {
+	u := *c.URL
+	path, err := url.JoinPath("/blob", key)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path
+
+	patch := make(map[string]*string, len(set)+len(remove))
+	for _, name := range remove {
+		patch[name] = nil
+	}
+	for name, value := range set {
+		patch[name] = &value
+	}
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(c.context(), http.MethodPatch, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	var result ListObject
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// Restore a file that was unlinked (soft deleted) on the storage server.
+// Unlinked files can be listed with ListOptions.Unlinked.
+func (c *Client) Restore(key string) (*ListObject, error) {
+	u := *c.URL
+	path, err := url.JoinPath("/blob/restore", key)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path
+	req, err := http.NewRequestWithContext(c.context(), http.MethodPost, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	var result ListObject
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+type CopyOptions struct {
+	// If true, replace an existing file at the destination
+	Overwrite bool
+}
+
+// Copy a file to a new key on the storage server
+func (c *Client) Copy(src, dst string, opts CopyOptions) (*ListObject, error) {
+	return c.copy("/blob/copy", src, dst, opts)
+}
+
+// Move a file to a new key on the storage server
+func (c *Client) Move(src, dst string, opts CopyOptions) (*ListObject, error) {
+	return c.copy("/blob/move", src, dst, opts)
+}
+
+func (c *Client) copy(path, src, dst string, opts CopyOptions) (*ListObject, error) {
+	u := *c.URL
+	u.Path = path
+
+	body, err := json.Marshal(map[string]any{
+		"source":      src,
+		"destination": dst,
+		"overwrite":   opts.Overwrite,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(c.context(), http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	var result ListObject
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// Fetch a remote file and store it under a key on the storage server. The
+// URL's host has to be in the server's SERVE_ALLOWED_HTTP_SOURCES.
+func (c *Client) FetchURL(fileURL, key string) (*ListObject, error) {
+	u := *c.URL
+	u.Path = "/blob/fetch"
+
+	body, err := json.Marshal(map[string]string{
+		"url": fileURL,
+		"key": key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(c.context(), http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	var result ListObject
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+type BatchDeleteOptions struct {
+	// The keys to delete
+	Keys []string `json:"keys,omitempty"`
+	// Delete every key with this prefix instead of Keys. At most 1000 keys
+	// are deleted per request, so repeat the request while HasMore is true.
+	Prefix string `json:"prefix,omitempty"`
+	// If true, soft delete (unlink) the files instead of removing them
+	Unlink bool `json:"unlink,omitempty"`
+}
+
+type BatchDeleteResult struct {
+	Results []BatchResult `json:"results"`
+	Deleted int           `json:"deleted"`
+	HasMore bool          `json:"has_more"`
+}
+
+type BatchResult struct {
+	Key string `json:"key"`
+	// The status code deleting the key on its own would have returned
+	Status int `json:"status"`
+}
+
+// BatchDelete deletes many files from the storage server in one request
+func (c *Client) BatchDelete(opts BatchDeleteOptions) (*BatchDeleteResult, error) {
+	u := *c.URL
+	u.Path = "/blob/batch/delete"
+
+	body, err := json.Marshal(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(c.context(), http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	var result BatchDeleteResult
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
 type ListResult struct {
-	Keys     []string `json:"keys"`
-	NextPage string   `json:"next_page,omitempty"`
-	HasMore  bool     `json:"has_more"`
+	Keys       []string     `json:"keys"`
+	Objects    []ListObject `json:"objects"`
+	NextPage   string       `json:"next_page,omitempty"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+	HasMore    bool         `json:"has_more"`
+}
+
+type ListObject struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	ContentType  string            `json:"content_type"`
+	ModifiedTime time.Time         `json:"modified_time"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	// Who can read the file. Empty means the service's DEFAULT_ACL.
+	ACL string `json:"acl,omitempty"`
+	// A tiny version of an image as a data URI to show while it loads. It's
+	// empty for other files and until it's generated.
+	Placeholder string `json:"placeholder,omitempty"`
+}
+
+type StorageStats struct {
+	// The number of files that are served
+	Objects int64 `json:"objects"`
+	// The total size of the files that are served
+	Bytes int64 `json:"bytes"`
+	// The number of unlinked files that still take up space
+	DeletedObjects int64 `json:"deleted_objects"`
+	// The total size of the unlinked files
+	DeletedBytes int64 `json:"deleted_bytes"`
+}
+
+type StorageStatsResult struct {
+	StorageStats
+	// The totals broken down by the next path segment after the prefix
+	Prefixes []PrefixStats `json:"prefixes"`
+}
+
+type PrefixStats struct {
+	Prefix string `json:"prefix"`
+	StorageStats
+}
+
+// Get the number of files and bytes stored under a prefix, or in total if
+// the prefix is empty
+func (c *Client) Stats(prefix string) (*StorageStatsResult, error) {
+	u := *c.URL
+	u.Path = "/stats/storage"
+	if prefix != "" {
+		q := u.Query()
+		q.Set("prefix", prefix)
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(c.context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	var result StorageStatsResult
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// An event about a file
+type Event struct {
+	ID string `json:"id"`
+	// One of blob.created, blob.overwritten, blob.updated, blob.deleted,
+	// blob.restored or blob.quarantined
+	Type      string     `json:"type"`
+	CreatedAt time.Time  `json:"created_at"`
+	Object    ListObject `json:"object"`
+}
+
+// A stream of events returned by Client.Events
+type EventStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+// Next blocks until the next event arrives. It returns io.EOF when the
+// stream ends, which happens when the server restarts or the client falls
+// too far behind.
+func (s *EventStream) Next() (*Event, error) {
+	var data []byte
+	for s.scanner.Scan() {
+		line := s.scanner.Bytes()
+		if len(line) == 0 {
+			if len(data) == 0 {
+				continue
+			}
+			var event Event
+			if err := json.Unmarshal(data, &event); err != nil {
+				return nil, fmt.Errorf("failed to decode event: %w", err)
+			}
+			return &event, nil
+		}
+		// Lines other than data, like ids and comments, are ignored
+		if rest, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimPrefix(rest, []byte(" "))...)
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Close stops the stream
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
+
+// Follow the changes to files under a prefix, or to every file if the prefix
+// is empty, as they happen. Requires an API key with the read scope.
+func (c *Client) Events(prefix string) (*EventStream, error) {
+	u := *c.URL
+	u.Path = "/events"
+	if prefix != "" {
+		q := u.Query()
+		q.Set("prefix", prefix)
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(c.context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	// Events with a lot of metadata can be longer than the default
+	scanner.Buffer(nil, 1<<20)
+	return &EventStream{body: res.Body, scanner: scanner}, nil
 }
 
 type ListOptions struct {
@@ -190,8 +996,13 @@ type ListOptions struct {
 	Limit int
 	// A prefix to filter keys by
 	Prefix string
+	// A path.Match pattern to filter keys by, e.g. "avatars/*.png". Wildcards
+	// do not match "/".
+	Glob string
 	// The key to start listing from
 	StartingAt string
+	// The NextCursor of a previous page to continue listing from
+	Cursor string
 	// If true, list unlinked (soft deleted) files
 	Unlinked bool
 }
@@ -209,16 +1020,22 @@ func (c *Client) List(opts ListOptions) (*ListResult, error) {
 	if opts.Prefix != "" {
 		q.Set("prefix", opts.Prefix)
 	}
+	if opts.Glob != "" {
+		q.Set("glob", opts.Glob)
+	}
 	if opts.StartingAt != "" {
 		q.Set("starting_at", opts.StartingAt)
 	}
+	if opts.Cursor != "" {
+		q.Set("cursor", opts.Cursor)
+	}
 	if opts.Unlinked {
 		q.Set("unlinked", "true")
 	}
 	u.RawQuery = q.Encode()
 
 	// Create and send request
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	req, err := http.NewRequestWithContext(c.context(), http.MethodGet, u.String(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
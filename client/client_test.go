@@ -2,15 +2,22 @@ package railwayimages
 
 import (
 	"bytes"
+	"context"
 	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/client/sign"
 )
 
 func TestNewClient(t *testing.T) {
@@ -115,6 +122,268 @@ func TestClient_Sign(t *testing.T) {
 	}
 }
 
+func TestClient_SignUpload(t *testing.T) {
+	expiresAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	expectedResult := &PresignedUpload{
+		URL:       "signed-url",
+		Method:    http.MethodPut,
+		Headers:   map[string]string{"Content-Type": "image/png"},
+		ExpiresAt: expiresAt,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sign/upload/test.png" {
+			t.Errorf("expected path /sign/upload/test.png, got %s", r.URL.Path)
+		}
+		q := r.URL.Query()
+		if expiresIn := q.Get("expires_in"); expiresIn != "15m0s" {
+			t.Errorf("expected expires_in=15m0s, got %s", expiresIn)
+		}
+		if contentType := q.Get("content_type"); contentType != "image/png" {
+			t.Errorf("expected content_type=image/png, got %s", contentType)
+		}
+		json.NewEncoder(w).Encode(expectedResult)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	result, err := client.SignUpload("test.png", SignUploadOptions{
+		ExpiresIn:   15 * time.Minute,
+		ContentType: "image/png",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result, expectedResult) {
+		t.Errorf("expected %+v, got %+v", expectedResult, result)
+	}
+}
+
+func TestClient_SignUpload_Local(t *testing.T) {
+	serverURL, _ := url.Parse("http://localhost:3000")
+	client := &Client{
+		URL:                serverURL,
+		SignatureSecretKey: "secret",
+		transport:          http.DefaultTransport,
+	}
+
+	result, err := client.SignUpload("avatars/test.png", SignUploadOptions{ExpiresIn: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(result.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/blob/avatars/test.png" {
+		t.Errorf("expected path /blob/avatars/test.png, got %s", u.Path)
+	}
+	expireAt := u.Query().Get("x-expire")
+	if expireAt != strconv.FormatInt(result.ExpiresAt.UnixMilli(), 10) {
+		t.Errorf("expected x-expire to match ExpiresAt, got %s", expireAt)
+	}
+	expected := sign.URLSignature("/blob/avatars/test.png", expireAt, "", "", "secret")
+	if signature := u.Query().Get("x-signature"); signature != expected {
+		t.Errorf("expected signature %s, got %s", expected, signature)
+	}
+	if until := time.Until(result.ExpiresAt); until <= 0 || until > time.Minute {
+		t.Errorf("expected URL to expire within a minute, got %s", until)
+	}
+}
+
+func TestClient_SignPolicy_Local(t *testing.T) {
+	serverURL, _ := url.Parse("http://localhost:3000")
+	client := &Client{
+		URL:                serverURL,
+		SignatureSecretKey: "secret",
+		transport:          http.DefaultTransport,
+	}
+
+	result, err := client.SignPolicy(SignPolicyOptions{
+		ExpiresIn:   time.Minute,
+		KeyPrefix:   "avatars/",
+		MaxSize:     1024,
+		ContentType: "image/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.URL != "http://localhost:3000/blob" {
+		t.Errorf("expected URL http://localhost:3000/blob, got %s", result.URL)
+	}
+	if key := result.Fields["key"]; key != "avatars/${filename}" {
+		t.Errorf("expected key avatars/${filename}, got %s", key)
+	}
+	policy := result.Fields["policy"]
+	expected := sign.Sign(sign.PolicyPayload(policy), "secret")
+	if signature := result.Fields["x-signature"]; signature != expected {
+		t.Errorf("expected signature %s, got %s", expected, signature)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded sign.UploadPolicy
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	expectedPolicy := sign.UploadPolicy{
+		Expiration:  result.ExpiresAt,
+		KeyPrefix:   "avatars/",
+		MaxSize:     1024,
+		ContentType: "image/",
+	}
+	if !reflect.DeepEqual(decoded, expectedPolicy) {
+		t.Errorf("expected policy %+v, got %+v", expectedPolicy, decoded)
+	}
+}
+
+func TestClient_SignWithExpiry_Local(t *testing.T) {
+	serverURL, _ := url.Parse("http://localhost:3000")
+	client := &Client{
+		URL:                serverURL,
+		SignatureSecretKey: "secret",
+		transport:          http.DefaultTransport,
+	}
+
+	signedURL, err := client.SignWithExpiry("/serve/300x300/blob/test.jpg", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expireAt := u.Query().Get("x-expire")
+	if expireAt == "" {
+		t.Fatal("expected x-expire to be set")
+	}
+	expected := sign.URLSignature("/300x300/blob/test.jpg", expireAt, "", "", "secret")
+	if signature := u.Query().Get("x-signature"); signature != expected {
+		t.Errorf("expected signature %s, got %s", expected, signature)
+	}
+}
+
+func TestClient_SignWithOptions_LocalSingleUse(t *testing.T) {
+	serverURL, _ := url.Parse("http://localhost:3000")
+	client := &Client{
+		URL:                serverURL,
+		SignatureSecretKey: "secret",
+		transport:          http.DefaultTransport,
+	}
+
+	signedURL, err := client.SignWithOptions("/serve/300x300/blob/test.jpg", SignOptions{SingleUse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("x-expire") == "" || q.Get("x-nonce") == "" {
+		t.Fatalf("expected x-expire and x-nonce to be set, got %s", u.RawQuery)
+	}
+	expected := sign.URLSignature("/300x300/blob/test.jpg", q.Get("x-expire"), q.Get("x-nonce"), "", "secret")
+	if signature := q.Get("x-signature"); signature != expected {
+		t.Errorf("expected signature %s, got %s", expected, signature)
+	}
+
+	other, err := client.SignWithOptions("/serve/300x300/blob/test.jpg", SignOptions{SingleUse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == signedURL {
+		t.Error("expected every single-use URL to have its own nonce")
+	}
+}
+
+func TestClient_SignWithOptions_LocalIP(t *testing.T) {
+	serverURL, _ := url.Parse("http://localhost:3000")
+	client := &Client{
+		URL:                serverURL,
+		SignatureSecretKey: "secret",
+		transport:          http.DefaultTransport,
+	}
+
+	signedURL, err := client.SignWithOptions("/serve/300x300/blob/test.jpg", SignOptions{IP: "203.0.113.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := u.Query().Get("x-ip"); ip != "203.0.113.0/24" {
+		t.Errorf("expected x-ip 203.0.113.0/24, got %s", ip)
+	}
+	expected := sign.URLSignature("/300x300/blob/test.jpg", "", "", "203.0.113.0/24", "secret")
+	if signature := u.Query().Get("x-signature"); signature != expected {
+		t.Errorf("expected signature %s, got %s", expected, signature)
+	}
+
+	if _, err := client.SignWithOptions("/serve/300x300/blob/test.jpg", SignOptions{IP: "localhost"}); !errors.Is(err, sign.ErrInvalidIP) {
+		t.Errorf("expected ErrInvalidIP, got %v", err)
+	}
+}
+
+func TestURLSignature_Fields(t *testing.T) {
+	// A key ending in :{digits} doesn't sign the same as a shorter key with
+	// an expiry, and fields can't run into each other
+	pairs := [][2]string{
+		{sign.URLSignature("/blob/a.png:1700000000000", "", "", "", "secret"), sign.URLSignature("/blob/a.png", "1700000000000", "", "", "secret")},
+		{sign.URLSignature("/blob/a.png:1700000000000", "", "", "203.0.113.7", "secret"), sign.URLSignature("/blob/a.png", "1700000000000", "", "203.0.113.7", "secret")},
+		{sign.URLSignature("/blob/a.png", "1700000000000", "n:203.0.113.7", "", "secret"), sign.URLSignature("/blob/a.png", "1700000000000", "n", "203.0.113.7", "secret")},
+	}
+	for i, pair := range pairs {
+		if pair[0] == pair[1] {
+			t.Errorf("pair %d: expected different signatures", i)
+		}
+	}
+	if got := sign.URLSignature("/300x300/blob/test.jpg", "", "", "", "secret"); got != sign.Sign("/300x300/blob/test.jpg", "secret") {
+		t.Errorf("expected URLs without fields to sign their path, got %s", got)
+	}
+}
+
+func TestClient_Sign_LocalTenant(t *testing.T) {
+	serverURL, _ := url.Parse("http://localhost:3000")
+	tenantSecret := sign.TenantSecret("secret", "acme")
+	client := &Client{
+		URL:                serverURL,
+		SignatureSecretKey: tenantSecret,
+		Tenant:             "acme",
+		transport:          http.DefaultTransport,
+	}
+
+	signedURL, err := client.Sign("/serve/300x300/blob/test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tenant := u.Query().Get("x-tenant"); tenant != "acme" {
+		t.Errorf("expected x-tenant acme, got %s", tenant)
+	}
+	expected := sign.Sign("/300x300/blob/test.jpg", tenantSecret)
+	if signature := u.Query().Get("x-signature"); signature != expected {
+		t.Errorf("expected signature %s, got %s", expected, signature)
+	}
+}
+
 func TestClient_Sign_Local(t *testing.T) {
 	tests := []struct {
 		name               string
@@ -228,6 +497,40 @@ func TestClient_Get(t *testing.T) {
 	}
 }
 
+func TestClient_Head(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("expected HEAD request, got %s", r.Method)
+		}
+		if r.URL.Path != "/blob/test.jpg" {
+			t.Errorf("expected path /blob/test.jpg, got %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Length", "4")
+		w.Header().Set("ETag", `"abc"`)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	res, err := client.Head("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.ContentLength != 4 {
+		t.Errorf("expected content length 4, got %d", res.ContentLength)
+	}
+	if etag := res.Header.Get("ETag"); etag != `"abc"` {
+		t.Errorf("expected ETag \"abc\", got %s", etag)
+	}
+}
+
 func TestClient_Put(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -356,42 +659,56 @@ func (t *testReadCloser) Close() error {
 	return nil
 }
 
-func TestClient_Put_ReaderClose(t *testing.T) {
+func TestClient_PutWithOptions(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if owner := r.Header.Get("x-meta-owner"); owner != "123" {
+			t.Errorf("expected x-meta-owner header 123, got %q", owner)
+		}
+		if expireAfter := r.Header.Get("x-expire-after"); expireAfter != "1h30m0s" {
+			t.Errorf("expected x-expire-after header 1h30m0s, got %q", expireAfter)
+		}
+		if acl := r.Header.Get("x-acl"); acl != "public" {
+			t.Errorf("expected x-acl header public, got %q", acl)
+		}
 		w.WriteHeader(http.StatusCreated)
 	}))
 	defer server.Close()
 
-	serverURL, err := url.Parse(server.URL)
-	if err != nil {
-		t.Fatalf("failed to parse server URL: %v", err)
-	}
-
+	serverURL, _ := url.Parse(server.URL)
 	client := &Client{
 		URL:       serverURL,
 		transport: http.DefaultTransport,
 	}
 
-	reader := newTestReadCloser([]byte("test content"))
-	err = client.Put("test.txt", reader)
+	err := client.PutWithOptions("test.jpg", bytes.NewReader([]byte("test content")), PutOptions{
+		Metadata:    map[string]string{"owner": "123"},
+		ExpireAfter: 90 * time.Minute,
+		ACL:         ACLPublic,
+	})
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Fatal(err)
 	}
+}
 
-	if !reader.closed {
-		t.Error("reader was not closed")
+func TestClient_SetACL(t *testing.T) {
+	expectedResult := &ListObject{
+		Key:         "test.jpg",
+		Size:        10,
+		ContentType: "image/jpeg",
+		ACL:         ACLPublic,
 	}
-}
 
-func TestClient_Delete(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodDelete {
-			t.Errorf("expected DELETE request, got %s", r.Method)
+		if r.Method != http.MethodPatch {
+			t.Errorf("expected PATCH request, got %s", r.Method)
 		}
 		if r.URL.Path != "/blob/test.jpg" {
 			t.Errorf("expected path /blob/test.jpg, got %s", r.URL.Path)
 		}
-		w.WriteHeader(http.StatusNoContent)
+		if acl := r.Header.Get("x-acl"); acl != "public" {
+			t.Errorf("expected x-acl header public, got %q", acl)
+		}
+		json.NewEncoder(w).Encode(expectedResult)
 	}))
 	defer server.Close()
 
@@ -401,38 +718,40 @@ func TestClient_Delete(t *testing.T) {
 		transport: http.DefaultTransport,
 	}
 
-	err := client.Delete("/test.jpg")
+	result, err := client.SetACL("test.jpg", ACLPublic)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !reflect.DeepEqual(result, expectedResult) {
+		t.Errorf("expected %+v, got %+v", expectedResult, result)
+	}
 }
-func TestClient_List(t *testing.T) {
-	expectedResult := &ListResult{
-		Keys:     []string{"test1.jpg", "test2.jpg"},
-		NextPage: "next",
-		HasMore:  true,
+
+func TestClient_UpdateMetadata(t *testing.T) {
+	expectedResult := &ListObject{
+		Key:         "test.jpg",
+		Size:        10,
+		ContentType: "image/jpeg",
+		Metadata:    map[string]string{"alt": "A gopher"},
 	}
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			t.Errorf("expected GET request, got %s", r.Method)
+		if r.Method != http.MethodPatch {
+			t.Errorf("expected PATCH request, got %s", r.Method)
 		}
-		if r.URL.Path != "/blob" {
-			t.Errorf("expected path /blob, got %s", r.URL.Path)
+		if r.URL.Path != "/blob/test.jpg" {
+			t.Errorf("expected path /blob/test.jpg, got %s", r.URL.Path)
 		}
-
-		q := r.URL.Query()
-		if limit := q.Get("limit"); limit != "10" {
-			t.Errorf("expected limit=10, got %s", limit)
+		var patch map[string]*string
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			t.Fatal(err)
 		}
-		if start := q.Get("starting_at"); start != "start" {
-			t.Errorf("expected start=start, got %s", start)
+		if len(patch) != 2 || patch["alt"] == nil || *patch["alt"] != "A gopher" {
+			t.Errorf("unexpected patch %v", patch)
 		}
-		if unlinked := q.Get("unlinked"); unlinked != "true" {
-			t.Errorf("expected unlinked=true, got %s", unlinked)
+		if owner, ok := patch["owner"]; !ok || owner != nil {
+			t.Errorf("expected owner to be removed, got %v", owner)
 		}
-
-		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(expectedResult)
 	}))
 	defer server.Close()
@@ -443,11 +762,7 @@ func TestClient_List(t *testing.T) {
 		transport: http.DefaultTransport,
 	}
 
-	result, err := client.List(ListOptions{
-		Limit:      10,
-		StartingAt: "start",
-		Unlinked:   true,
-	})
+	result, err := client.UpdateMetadata("test.jpg", map[string]string{"alt": "A gopher"}, "owner")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -456,3 +771,603 @@ func TestClient_List(t *testing.T) {
 		t.Errorf("expected %+v, got %+v", expectedResult, result)
 	}
 }
+
+func TestClient_Put_ReaderClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	reader := newTestReadCloser([]byte("test content"))
+	err = client.Put("test.txt", reader)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if !reader.closed {
+		t.Error("reader was not closed")
+	}
+}
+
+func TestClient_Delete(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("expected DELETE request, got %s", r.Method)
+		}
+		if r.URL.Path != "/blob/test.jpg" {
+			t.Errorf("expected path /blob/test.jpg, got %s", r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	err := client.Delete("/test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+func TestClient_Purge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("expected DELETE request, got %s", r.Method)
+		}
+		if r.URL.Path != "/serve/cache/avatars/test.jpg" {
+			t.Errorf("expected path /serve/cache/avatars/test.jpg, got %s", r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	if err := client.Purge("avatars/test.jpg"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient_Move(t *testing.T) {
+	expectedResult := &ListObject{Key: "perm/test.jpg", Size: 10, ContentType: "image/jpeg"}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("expected POST request, got %s", r.Method)
+		}
+		if r.URL.Path != "/blob/move" {
+			t.Errorf("expected path /blob/move, got %s", r.URL.Path)
+		}
+		var body struct {
+			Source      string `json:"source"`
+			Destination string `json:"destination"`
+			Overwrite   bool   `json:"overwrite"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Source != "tmp/test.jpg" || body.Destination != "perm/test.jpg" || !body.Overwrite {
+			t.Errorf("unexpected request body %+v", body)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(expectedResult)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	result, err := client.Move("tmp/test.jpg", "perm/test.jpg", CopyOptions{Overwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result, expectedResult) {
+		t.Errorf("expected %+v, got %+v", expectedResult, result)
+	}
+}
+
+func TestClient_Restore(t *testing.T) {
+	expectedResult := &ListObject{Key: "test.jpg", Size: 10, ContentType: "image/jpeg"}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("expected POST request, got %s", r.Method)
+		}
+		if r.URL.Path != "/blob/restore/test.jpg" {
+			t.Errorf("expected path /blob/restore/test.jpg, got %s", r.URL.Path)
+		}
+		json.NewEncoder(w).Encode(expectedResult)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	result, err := client.Restore("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result, expectedResult) {
+		t.Errorf("expected %+v, got %+v", expectedResult, result)
+	}
+}
+
+func TestClient_Stats(t *testing.T) {
+	expectedResult := &StorageStatsResult{
+		StorageStats: StorageStats{Objects: 3, Bytes: 300, DeletedObjects: 1, DeletedBytes: 100},
+		Prefixes: []PrefixStats{
+			{Prefix: "users/1/", StorageStats: StorageStats{Objects: 3, Bytes: 300}},
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stats/storage" {
+			t.Errorf("expected path /stats/storage, got %s", r.URL.Path)
+		}
+		if prefix := r.URL.Query().Get("prefix"); prefix != "users/" {
+			t.Errorf("expected prefix users/, got %s", prefix)
+		}
+		json.NewEncoder(w).Encode(expectedResult)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	result, err := client.Stats("users/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result, expectedResult) {
+		t.Errorf("expected %+v, got %+v", expectedResult, result)
+	}
+}
+
+func TestClient_Events(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/events" {
+			t.Errorf("expected path /events, got %s", r.URL.Path)
+		}
+		if prefix := r.URL.Query().Get("prefix"); prefix != "users/" {
+			t.Errorf("expected prefix users/, got %s", prefix)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, ": connected\n\n")
+		io.WriteString(w, "id: evt_1\nevent: blob.created\ndata: {\"id\":\"evt_1\",\"type\":\"blob.created\",\"object\":{\"key\":\"users/1.png\",\"size\":70}}\n\n")
+		io.WriteString(w, ": ping\n\n")
+		io.WriteString(w, "id: evt_2\nevent: blob.deleted\ndata: {\"id\":\"evt_2\",\"type\":\"blob.deleted\",\"object\":{\"key\":\"users/1.png\",\"size\":70}}\n\n")
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	stream, err := client.Events("users/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	expected := []Event{
+		{ID: "evt_1", Type: "blob.created", Object: ListObject{Key: "users/1.png", Size: 70}},
+		{ID: "evt_2", Type: "blob.deleted", Object: ListObject{Key: "users/1.png", Size: 70}},
+	}
+	for _, want := range expected {
+		event, err := stream.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*event, want) {
+			t.Errorf("expected %+v, got %+v", want, *event)
+		}
+	}
+	if _, err := stream.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestClient_FetchURL(t *testing.T) {
+	expectedResult := &ListObject{Key: "remote/test.png", Size: 70, ContentType: "image/png"}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("expected POST request, got %s", r.Method)
+		}
+		if r.URL.Path != "/blob/fetch" {
+			t.Errorf("expected path /blob/fetch, got %s", r.URL.Path)
+		}
+		var body struct {
+			URL string `json:"url"`
+			Key string `json:"key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.URL != "https://example.com/test.png" || body.Key != "remote/test.png" {
+			t.Errorf("unexpected request body %+v", body)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(expectedResult)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	result, err := client.FetchURL("https://example.com/test.png", "remote/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result, expectedResult) {
+		t.Errorf("expected %+v, got %+v", expectedResult, result)
+	}
+}
+
+func TestClient_BatchDelete(t *testing.T) {
+	expectedResult := &BatchDeleteResult{
+		Results: []BatchResult{
+			{Key: "test1.jpg", Status: http.StatusNoContent},
+			{Key: "test2.jpg", Status: http.StatusNotFound},
+		},
+		Deleted: 1,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("expected POST request, got %s", r.Method)
+		}
+		if r.URL.Path != "/blob/batch/delete" {
+			t.Errorf("expected path /blob/batch/delete, got %s", r.URL.Path)
+		}
+		var opts BatchDeleteOptions
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(opts.Keys, []string{"test1.jpg", "test2.jpg"}) {
+			t.Errorf("expected keys [test1.jpg test2.jpg], got %v", opts.Keys)
+		}
+		if !opts.Unlink {
+			t.Error("expected unlink=true")
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(expectedResult)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	result, err := client.BatchDelete(BatchDeleteOptions{
+		Keys:   []string{"test1.jpg", "test2.jpg"},
+		Unlink: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result, expectedResult) {
+		t.Errorf("expected %+v, got %+v", expectedResult, result)
+	}
+}
+
+func TestClient_List(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	expectedResult := &ListResult{
+		Keys: []string{"test1.jpg", "test2.jpg"},
+		Objects: []ListObject{
+			{Key: "test1.jpg", Size: 10, ContentType: "image/jpeg", ModifiedTime: modified},
+			{Key: "test2.jpg", Size: 20, ContentType: "image/jpeg", ModifiedTime: modified},
+		},
+		NextPage:   "next",
+		NextCursor: "dGVzdDMuanBn",
+		HasMore:    true,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("expected GET request, got %s", r.Method)
+		}
+		if r.URL.Path != "/blob" {
+			t.Errorf("expected path /blob, got %s", r.URL.Path)
+		}
+
+		q := r.URL.Query()
+		if limit := q.Get("limit"); limit != "10" {
+			t.Errorf("expected limit=10, got %s", limit)
+		}
+		if start := q.Get("starting_at"); start != "start" {
+			t.Errorf("expected start=start, got %s", start)
+		}
+		if glob := q.Get("glob"); glob != "*.jpg" {
+			t.Errorf("expected glob=*.jpg, got %s", glob)
+		}
+		if cursor := q.Get("cursor"); cursor != "cursor" {
+			t.Errorf("expected cursor=cursor, got %s", cursor)
+		}
+		if unlinked := q.Get("unlinked"); unlinked != "true" {
+			t.Errorf("expected unlinked=true, got %s", unlinked)
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(expectedResult)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	result, err := client.List(ListOptions{
+		Limit:      10,
+		StartingAt: "start",
+		Glob:       "*.jpg",
+		Cursor:     "cursor",
+		Unlinked:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result, expectedResult) {
+		t.Errorf("expected %+v, got %+v", expectedResult, result)
+	}
+}
+
+func TestClient_Download(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blob/missing.jpg" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("test content"))
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	var buf bytes.Buffer
+	if err := client.Download("test.jpg", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "test content" {
+		t.Errorf("expected test content, got %s", buf.String())
+	}
+	if err := client.Download("missing.jpg", &buf); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestClient_WithContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.WithContext(ctx).Delete("test.jpg"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if err := client.Delete("test.jpg"); err != nil {
+		t.Errorf("expected the original client to be unaffected, got %v", err)
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "test content" {
+			t.Errorf("expected the body on attempt %d, got %q", attempts, body)
+		}
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: &RetryTransport{transport: http.DefaultTransport, MaxRetries: 2, Backoff: time.Millisecond},
+	}
+
+	if err := client.Put("test.jpg", strings.NewReader("test content")); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+
+	// Requests that can't be repeated aren't retried
+	attempts = 0
+	client.transport = &RetryTransport{transport: http.DefaultTransport, MaxRetries: 2, Backoff: time.Millisecond}
+	if err := client.Put("test.jpg", io.NopCloser(strings.NewReader("test content"))); err == nil {
+		t.Error("expected an error")
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestImageOptions_Path(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    ImageOptions
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "key only",
+			opts: ImageOptions{Key: "gopher.png"},
+			want: "/serve/blob/gopher.png",
+		},
+		{
+			name: "resize",
+			opts: ImageOptions{Key: "gopher.png", Width: 300, Height: 200, Fit: FitContain},
+			want: "/serve/fit-in/300x200/blob/gopher.png",
+		},
+		{
+			name: "every option",
+			opts: ImageOptions{
+				Key:     "avatars/gopher.png",
+				Width:   300,
+				Flip:    FlipBoth,
+				Crop:    &Crop{X: 10, Y: 20, Width: 100, Height: 50},
+				Padding: &Padding{Left: 1, Top: 2, Right: 3, Bottom: 4},
+				Trim:    true,
+				Smart:   true,
+				HAlign:  "left",
+				VAlign:  "top",
+				Filters: []Filter{Format("webp"), Quality(80), Blur(1.5), Grayscale()},
+			},
+			want: "/serve/trim/10x20:110x70/-300x-0/1x2:3x4/left/top/smart/filters:format(webp):quality(80):blur(1.5):grayscale()/blob/avatars/gopher.png",
+		},
+		{
+			name:    "missing key",
+			opts:    ImageOptions{Width: 300},
+			wantErr: true,
+		},
+		{
+			name:    "invalid fit",
+			opts:    ImageOptions{Key: "gopher.png", Fit: "fill"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.opts.Path()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Path() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestClient_ImageURL_Local(t *testing.T) {
+	serverURL, _ := url.Parse("http://example.com")
+	client := &Client{
+		URL:                serverURL,
+		SignatureSecretKey: "secret",
+		transport:          http.DefaultTransport,
+	}
+
+	signedURL, err := client.ImageURL(ImageOptions{Key: "gopher.png", Width: 300, Filters: []Filter{Format("webp")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/300x0/filters:format(webp)/blob/gopher.png"
+	want := "http://example.com/serve/300x0/filters:format%28webp%29/blob/gopher.png?x-signature=" + sign.Sign(path, "secret")
+	if signedURL != want {
+		t.Errorf("expected %s, got %s", want, signedURL)
+	}
+}
+
+func TestSignURLBuilder(t *testing.T) {
+	path := sign.URL("gopher.png").Resize(300, 300).Smart().Format(sign.WebP).Path()
+	if want := "/serve/300x300/smart/filters:format(webp)/blob/gopher.png"; path != want {
+		t.Errorf("expected %s, got %s", want, path)
+	}
+
+	signed, err := sign.URL("/gopher.png").Resize(300, 300).Smart().Format(sign.WebP).Sign("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != path {
+		t.Errorf("expected path %s, got %s", path, u.Path)
+	}
+	if sig := u.Query().Get("x-signature"); sig != sign.Sign(strings.TrimPrefix(path, "/serve"), "secret") {
+		t.Errorf("unexpected signature %s", sig)
+	}
+	if u.Query().Has("x-expire") {
+		t.Error("expected /serve URLs not to expire by default")
+	}
+
+	signed, err = sign.URL("gopher.png").FitIn().Resize(100, 0).Expire(time.Hour).Tenant("acme").Sign("tenant-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ = url.Parse(signed)
+	expire := u.Query().Get("x-expire")
+	if expire == "" {
+		t.Fatal("expected an x-expire parameter")
+	}
+	if tenant := u.Query().Get("x-tenant"); tenant != "acme" {
+		t.Errorf("expected x-tenant=acme, got %s", tenant)
+	}
+	if sig := u.Query().Get("x-signature"); sig != sign.URLSignature("/fit-in/100x0/blob/gopher.png", expire, "", "", "tenant-secret") {
+		t.Errorf("unexpected signature %s", sig)
+	}
+
+	if _, err := sign.URL("gopher.png").IP("not-an-ip").Sign("secret"); !errors.Is(err, sign.ErrInvalidIP) {
+		t.Errorf("expected ErrInvalidIP, got %v", err)
+	}
+	if _, err := sign.URL("").Sign("secret"); err == nil {
+		t.Error("expected an error without a key")
+	}
+}
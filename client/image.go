@@ -0,0 +1,174 @@
+package railwayimages
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jaredLunde/railway-image-service/client/sign"
+)
+
+// How an image is resized to fit its width and height
+const (
+	// Scale the image to fill the box, cropping it if necessary
+	FitCover = "cover"
+	// Scale the image to fit inside the box, keeping its aspect ratio
+	FitContain = "contain"
+	// Stretch or squash the image to fill the box exactly
+	FitStretch = "stretch"
+	// Fit the image inside the box, stretching it to fill it
+	FitContainStretch = "contain-stretch"
+)
+
+// Which way an image is flipped
+const (
+	FlipHorizontal = "horizontal"
+	FlipVertical   = "vertical"
+	FlipBoth       = "both"
+)
+
+type ImageOptions struct {
+	// The key of the image in blob storage
+	Key string
+	// The width of the image in pixels. Zero keeps the aspect ratio.
+	Width int
+	// The height of the image in pixels. Zero keeps the aspect ratio.
+	Height int
+	// How the image is resized, e.g. FitContain. Defaults to FitCover.
+	Fit string
+	// Flip the image, e.g. FlipHorizontal
+	Flip string
+	// Crop the image before it's resized
+	Crop *Crop
+	// Pad the image after it's resized
+	Padding *Padding
+	// Trim the edges of the image that are the same color
+	Trim bool
+	// Crop around the interesting part of the image
+	Smart bool
+	// Which part of the image is kept when it's cropped, "left", "center"
+	// or "right"
+	HAlign string
+	// Which part of the image is kept when it's cropped, "top", "middle" or
+	// "bottom"
+	VAlign string
+	// Filters to process the image with, e.g. Format("webp")
+	Filters []Filter
+}
+
+// A region of an image in pixels
+type Crop struct {
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
+
+// Padding around an image in pixels
+type Padding struct {
+	Left   int
+	Top    int
+	Right  int
+	Bottom int
+}
+
+// A filter an image is processed with, e.g. Filter{Name: "blur", Args:
+// []string{"2"}}
+type Filter struct {
+	Name string
+	Args []string
+}
+
+func (f Filter) String() string {
+	return f.Name + "(" + strings.Join(f.Args, ",") + ")"
+}
+
+// Encode the image in a format, e.g. "webp", "avif" or "jpeg"
+func Format(format string) Filter {
+	return Filter{Name: "format", Args: []string{format}}
+}
+
+// Encode the image with a quality from 0 to 100
+func Quality(quality int) Filter {
+	return Filter{Name: "quality", Args: []string{strconv.Itoa(quality)}}
+}
+
+// Blur the image with a Gaussian blur of sigma
+func Blur(sigma float64) Filter {
+	return Filter{Name: "blur", Args: []string{strconv.FormatFloat(sigma, 'f', -1, 64)}}
+}
+
+// Convert the image to grayscale
+func Grayscale() Filter {
+	return Filter{Name: "grayscale"}
+}
+
+// Fill the transparent parts of the image with a color, e.g. "white" or
+// "ff0000", or "blur" or "auto"
+func Fill(color string) Filter {
+	return Filter{Name: "fill", Args: []string{color}}
+}
+
+// Get the /serve path of an image processed with opts, e.g.
+// /serve/fit-in/300x200/filters:format(webp)/blob/gopher.png
+func (opts ImageOptions) Path() (string, error) {
+	if opts.Key == "" {
+		return "", fmt.Errorf("Key is required")
+	}
+	b := sign.URL(opts.Key)
+	if opts.Trim {
+		b.Trim()
+	}
+	if c := opts.Crop; c != nil {
+		b.Crop(c.X, c.Y, c.Width, c.Height)
+	}
+	switch opts.Fit {
+	case "", FitCover:
+	case FitContain:
+		b.FitIn()
+	case FitStretch:
+		b.Stretch()
+	case FitContainStretch:
+		b.FitIn().Stretch()
+	default:
+		return "", fmt.Errorf("invalid Fit %q", opts.Fit)
+	}
+	b.Resize(opts.Width, opts.Height)
+	switch opts.Flip {
+	case "":
+	case FlipHorizontal:
+		b.FlipH()
+	case FlipVertical:
+		b.FlipV()
+	case FlipBoth:
+		b.FlipH().FlipV()
+	default:
+		return "", fmt.Errorf("invalid Flip %q", opts.Flip)
+	}
+	if p := opts.Padding; p != nil {
+		b.Padding(p.Left, p.Top, p.Right, p.Bottom)
+	}
+	b.Align(opts.HAlign, opts.VAlign)
+	if opts.Smart {
+		b.Smart()
+	}
+	for _, f := range opts.Filters {
+		b.Filter(f.Name, f.Args...)
+	}
+	return b.Path(), nil
+}
+
+// Get a signed URL of an image processed with opts. If a signature secret
+// key is provided in the client options, the URL will be signed locally.
+func (c *Client) ImageURL(opts ImageOptions) (string, error) {
+	return c.ImageURLWithOptions(opts, SignOptions{})
+}
+
+// Get a signed URL of an image processed with opts, signed with options
+func (c *Client) ImageURLWithOptions(opts ImageOptions, signOpts SignOptions) (string, error) {
+	path, err := opts.Path()
+	if err != nil {
+		return "", err
+	}
+	return c.SignWithOptions(path, signOpts)
+}
@@ -0,0 +1,101 @@
+package railwayimages
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultRetryBackoff is how long RetryTransport waits before the first
+// retry when its Backoff isn't set
+const DefaultRetryBackoff = 200 * time.Millisecond
+
+// RetryTransport retries requests that can safely be repeated when they fail
+// to connect or the server responds with 429, 502, 503 or 504. The wait
+// doubles after each retry, and a Retry-After header is honored.
+type RetryTransport struct {
+	transport http.RoundTripper
+	// How many times a request is retried
+	MaxRetries int
+	// How long to wait before the first retry
+	Backoff time.Duration
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := t.Backoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.Body != nil && req.Body != http.NoBody {
+			// The body was read by the previous attempt
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		res, err := t.transport.RoundTrip(req)
+		if attempt >= t.MaxRetries || !retryable(req, res, err) {
+			return res, err
+		}
+
+		wait := backoff << min(attempt, 10)
+		if res != nil {
+			if after := retryAfter(res); after > 0 {
+				wait = after
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable returns true if req can be repeated and failed in a way that
+// might not happen again
+func retryable(req *http.Request, res *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+	default:
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns how long a Retry-After header asks to wait, or zero if
+// there isn't one
+func retryAfter(res *http.Response) time.Duration {
+	v := res.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
@@ -2,14 +2,23 @@ package sign
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// ErrInvalidIP is returned when a URL is bound to something that isn't an IP
+// address or CIDR
+var ErrInvalidIP = errors.New("invalid IP")
+
 // Get a signature for a given key and secret
 func Sign(key, secret string) string {
 	key = strings.TrimPrefix(key, "/")
@@ -18,30 +27,169 @@ func Sign(key, secret string) string {
 	return base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(h.Sum(nil))
 }
 
+// Get the signature of a URL signed for path, e.g. /blob/gopher.png or a
+// /serve path without the /serve prefix, bound to an expiry in Unix
+// milliseconds, a nonce and an IP address or CIDR, any of which can be empty.
+// Each field is tagged and length-prefixed, so none of them can run into
+// another or into the path, and URLs bound to any of them are signed with a
+// secret of their own, so they can't pass for the path of a URL that isn't.
+func URLSignature(path, expireAt, nonce, ip, secret string) string {
+	if expireAt == "" && nonce == "" && ip == "" {
+		return Sign(path, secret)
+	}
+	path = strings.TrimPrefix(path, "/")
+	payload := fmt.Sprintf("p=%d:%s;e=%d:%s;n=%d:%s;ip=%d:%s", len(path), path, len(expireAt), expireAt, len(nonce), nonce, len(ip), ip)
+	return Sign(payload, Sign("url-fields", secret))
+}
+
+// Get the secret the URLs of a tenant are signed with. It's derived from the
+// signature secret key, so a tenant can sign its own URLs without being able
+// to sign URLs for anyone else.
+func TenantSecret(secret, tenant string) string {
+	return Sign("tenant:"+tenant, secret)
+}
+
 // Add a signature to a URL with using the secret key
 func SignURL(url *url.URL, secret string) (*string, error) {
+	return SignURLWithExpiry(url, secret, time.Now().Add(time.Hour))
+}
+
+// Add a signature to a URL using the secret key. Signatures of /blob URLs
+// stop being accepted at expireAt, /serve signatures never expire.
+func SignURLWithExpiry(url *url.URL, secret string, expireAt time.Time) (*string, error) {
+	return SignURLWithOptions(url, secret, Options{ExpireAt: expireAt})
+}
+
+// Add a signature to a URL using the secret key that stops being accepted at
+// expireAt. Unlike SignURLWithExpiry, this applies to /serve URLs as well.
+func SignExpiringURL(url *url.URL, secret string, expireAt time.Time) (*string, error) {
+	return SignURLWithOptions(url, secret, Options{ExpireAt: expireAt, ExpireServe: true})
+}
+
+type Options struct {
+	// When the signature stops being accepted. Required for /blob URLs and
+	// single-use URLs.
+	ExpireAt time.Time
+	// Make /serve signatures expire at ExpireAt as well. They never expire
+	// otherwise.
+	ExpireServe bool
+	// Only accept the URL once. A random nonce is added to the URL, which
+	// the service records the first time the URL is used.
+	SingleUse bool
+	// Only accept the URL from this IP address or CIDR, e.g. 203.0.113.7 or
+	// 203.0.113.0/24, so it can't be replayed from anywhere else
+	IP string
+}
+
+// Add a signature to a URL using the secret key
+func SignURLWithOptions(url *url.URL, secret string, opts Options) (*string, error) {
 	nextURI := *url
 	path := nextURI.Path
 	p := strings.TrimPrefix(path, "/sign")
-	var signature string
 	if !strings.HasPrefix(p, "/blob") && !strings.HasPrefix(p, "/serve") {
 		return nil, fmt.Errorf("invalid path")
 	}
+	query := nextURI.Query()
+	// /serve signatures don't include the /serve prefix, and only expire
+	// when asked to
+	payload := p
+	expire := true
 	if strings.HasPrefix(p, "/serve") {
-		signature = Sign(strings.TrimPrefix(p, "/serve"), secret)
+		payload = strings.TrimPrefix(p, "/serve")
+		expire = opts.ExpireServe || opts.SingleUse
 	}
-
-	query := nextURI.Query()
-	if strings.HasPrefix(p, "/blob") {
-		expireAt := time.Now().Add(time.Hour).UnixMilli()
-		query.Set("x-expire", fmt.Sprintf("%d", expireAt))
-		nextURI.RawQuery = query.Encode()
-		signature = Sign(fmt.Sprintf("%s:%d", p, expireAt), secret)
+	var expireAt, nonce string
+	if expire {
+		if opts.ExpireAt.IsZero() {
+			return nil, fmt.Errorf("an expiry is required")
+		}
+		expireAt = strconv.FormatInt(opts.ExpireAt.UnixMilli(), 10)
+		query.Set("x-expire", expireAt)
+	}
+	if opts.SingleUse {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		nonce = base64.RawURLEncoding.EncodeToString(b)
+		query.Set("x-nonce", nonce)
+	}
+	if opts.IP != "" {
+		if !validIP(opts.IP) {
+			return nil, ErrInvalidIP
+		}
+		query.Set("x-ip", opts.IP)
 	}
 
 	nextURI.Path = p
-	query.Set("x-signature", signature)
+	query.Set("x-signature", URLSignature(payload, expireAt, nonce, opts.IP, secret))
 	nextURI.RawQuery = query.Encode()
 	nextFullURI := nextURI.String()
 	return &nextFullURI, nil
 }
+
+func validIP(ip string) bool {
+	if strings.Contains(ip, "/") {
+		_, _, err := net.ParseCIDR(ip)
+		return err == nil
+	}
+	return net.ParseIP(ip) != nil
+}
+
+// UploadPolicy constrains the files a browser can upload by POSTing a form to
+// /blob. The zero value of each constraint allows anything.
+type UploadPolicy struct {
+	// When the policy stops being accepted
+	Expiration time.Time `json:"expiration"`
+	// The prefix the key of the upload has to start with, e.g. users/1/
+	KeyPrefix string `json:"key_prefix,omitempty"`
+	// The largest file that can be uploaded in bytes
+	MaxSize int64 `json:"max_size,omitempty"`
+	// The prefix the detected content type of the file has to start with,
+	// e.g. image/ or image/png
+	ContentType string `json:"content_type,omitempty"`
+	// The ACL the file is uploaded with, public or private. The form can
+	// choose one with an x-acl field if it's empty.
+	ACL string `json:"acl,omitempty"`
+}
+
+// Sign an upload policy using the secret key. It returns the encoded policy
+// and its signature, which are sent with the form in the policy and
+// x-signature fields.
+func SignPolicy(policy UploadPolicy, secret string) (string, string, error) {
+	if policy.Expiration.IsZero() {
+		return "", "", fmt.Errorf("an expiry is required")
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return "", "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+	return encoded, Sign(PolicyPayload(encoded), secret), nil
+}
+
+// Get the payload the signature of an encoded upload policy is made over.
+// It's prefixed so a policy signature can never be used as a URL signature.
+func PolicyPayload(encoded string) string {
+	return "policy:" + encoded
+}
+
+// Get the signature of the body of a webhook sent at timestamp, a Unix time
+// in seconds. The service sends it in the x-webhook-signature header, with
+// the timestamp in x-webhook-timestamp.
+func SignWebhook(timestamp string, body []byte, secret string) string {
+	return Sign("webhook:"+timestamp+"."+string(body), secret)
+}
+
+// Verify the signature of a webhook, and that it was sent no longer than
+// tolerance ago so it can't be replayed later
+func VerifyWebhook(timestamp string, body []byte, signature, secret string, tolerance time.Duration) bool {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(SignWebhook(timestamp, body, secret)))
+}
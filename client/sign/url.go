@@ -0,0 +1,226 @@
+package sign
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An image format for URLBuilder.Format
+type Format string
+
+const (
+	JPEG Format = "jpeg"
+	PNG  Format = "png"
+	GIF  Format = "gif"
+	WebP Format = "webp"
+	AVIF Format = "avif"
+	JXL  Format = "jxl"
+)
+
+// URLBuilder builds and signs the /serve URL of an image in blob storage,
+// e.g. URL("gopher.png").Resize(300, 300).Smart().Format(WebP).Sign(secret)
+type URLBuilder struct {
+	key       string
+	trim      bool
+	crop      []int
+	fitIn     bool
+	stretch   bool
+	width     int
+	height    int
+	flipH     bool
+	flipV     bool
+	padding   []int
+	hAlign    string
+	vAlign    string
+	smart     bool
+	filters   []string
+	expiresIn time.Duration
+	singleUse bool
+	ip        string
+	tenant    string
+}
+
+// Start building the /serve URL of the image at key in blob storage
+func URL(key string) *URLBuilder {
+	return &URLBuilder{key: strings.TrimPrefix(key, "/")}
+}
+
+// Resize the image to width and height in pixels. Zero keeps the aspect
+// ratio. The image is cropped to fill the box unless FitIn is used.
+func (b *URLBuilder) Resize(width, height int) *URLBuilder {
+	b.width, b.height = width, height
+	return b
+}
+
+// Fit the image inside the box instead of cropping it
+func (b *URLBuilder) FitIn() *URLBuilder {
+	b.fitIn = true
+	return b
+}
+
+// Stretch or squash the image to fill the box exactly
+func (b *URLBuilder) Stretch() *URLBuilder {
+	b.stretch = true
+	return b
+}
+
+// Trim the edges of the image that are the same color
+func (b *URLBuilder) Trim() *URLBuilder {
+	b.trim = true
+	return b
+}
+
+// Crop a region of the image in pixels before it's resized
+func (b *URLBuilder) Crop(x, y, width, height int) *URLBuilder {
+	b.crop = []int{x, y, x + width, y + height}
+	return b
+}
+
+// Pad the image in pixels after it's resized
+func (b *URLBuilder) Padding(left, top, right, bottom int) *URLBuilder {
+	b.padding = []int{left, top, right, bottom}
+	return b
+}
+
+// Keep this part of the image when it's cropped. horizontal is "left",
+// "center" or "right" and vertical is "top", "middle" or "bottom". Either
+// can be empty.
+func (b *URLBuilder) Align(horizontal, vertical string) *URLBuilder {
+	b.hAlign, b.vAlign = horizontal, vertical
+	return b
+}
+
+// Crop around the interesting part of the image
+func (b *URLBuilder) Smart() *URLBuilder {
+	b.smart = true
+	return b
+}
+
+// Flip the image horizontally
+func (b *URLBuilder) FlipH() *URLBuilder {
+	b.flipH = true
+	return b
+}
+
+// Flip the image vertically
+func (b *URLBuilder) FlipV() *URLBuilder {
+	b.flipV = true
+	return b
+}
+
+// Encode the image in a format
+func (b *URLBuilder) Format(format Format) *URLBuilder {
+	return b.Filter("format", string(format))
+}
+
+// Encode the image with a quality from 0 to 100
+func (b *URLBuilder) Quality(quality int) *URLBuilder {
+	return b.Filter("quality", strconv.Itoa(quality))
+}
+
+// Blur the image with a Gaussian blur of sigma
+func (b *URLBuilder) Blur(sigma float64) *URLBuilder {
+	return b.Filter("blur", strconv.FormatFloat(sigma, 'f', -1, 64))
+}
+
+// Process the image with a filter, e.g. Filter("round_corner", "20")
+func (b *URLBuilder) Filter(name string, args ...string) *URLBuilder {
+	b.filters = append(b.filters, name+"("+strings.Join(args, ",")+")")
+	return b
+}
+
+// Stop accepting the URL after d. /serve URLs never expire otherwise.
+func (b *URLBuilder) Expire(d time.Duration) *URLBuilder {
+	b.expiresIn = d
+	return b
+}
+
+// Only accept the URL once. Single-use URLs expire after an hour unless
+// Expire is used.
+func (b *URLBuilder) SingleUse() *URLBuilder {
+	b.singleUse = true
+	return b
+}
+
+// Only accept the URL from this IP address or CIDR
+func (b *URLBuilder) IP(ip string) *URLBuilder {
+	b.ip = ip
+	return b
+}
+
+// Sign the URL as a tenant, in which case the secret is the tenant's
+func (b *URLBuilder) Tenant(tenant string) *URLBuilder {
+	b.tenant = tenant
+	return b
+}
+
+// Get the unsigned /serve path of the image, e.g.
+// /serve/fit-in/300x200/filters:format(webp)/blob/gopher.png
+func (b *URLBuilder) Path() string {
+	segments := []string{"serve"}
+	if b.trim {
+		segments = append(segments, "trim")
+	}
+	if b.crop != nil {
+		segments = append(segments, fmt.Sprintf("%dx%d:%dx%d", b.crop[0], b.crop[1], b.crop[2], b.crop[3]))
+	}
+	if b.fitIn {
+		segments = append(segments, "fit-in")
+	}
+	if b.stretch {
+		segments = append(segments, "stretch")
+	}
+	if b.width != 0 || b.height != 0 || b.flipH || b.flipV {
+		w, h := strconv.Itoa(b.width), strconv.Itoa(b.height)
+		if b.flipH {
+			w = "-" + w
+		}
+		if b.flipV {
+			h = "-" + h
+		}
+		segments = append(segments, w+"x"+h)
+	}
+	if b.padding != nil {
+		segments = append(segments, fmt.Sprintf("%dx%d:%dx%d", b.padding[0], b.padding[1], b.padding[2], b.padding[3]))
+	}
+	if b.hAlign != "" {
+		segments = append(segments, b.hAlign)
+	}
+	if b.vAlign != "" {
+		segments = append(segments, b.vAlign)
+	}
+	if b.smart {
+		segments = append(segments, "smart")
+	}
+	if len(b.filters) > 0 {
+		segments = append(segments, "filters:"+strings.Join(b.filters, ":"))
+	}
+	segments = append(segments, "blob", b.key)
+	return "/" + strings.Join(segments, "/")
+}
+
+// Sign the URL with the secret key. It returns the path and query of the
+// URL, e.g. /serve/300x300/blob/gopher.png?x-signature=..., to add to the
+// URL of the service.
+func (b *URLBuilder) Sign(secret string) (string, error) {
+	if b.key == "" {
+		return "", fmt.Errorf("a key is required")
+	}
+	u := &url.URL{Path: b.Path()}
+	if b.tenant != "" {
+		u.RawQuery = url.Values{"x-tenant": {b.tenant}}.Encode()
+	}
+	opts := Options{ExpireAt: time.Now().Add(time.Hour), SingleUse: b.singleUse, IP: b.ip}
+	if b.expiresIn > 0 {
+		opts.ExpireAt = time.Now().Add(b.expiresIn)
+		opts.ExpireServe = true
+	}
+	signed, err := SignURLWithOptions(u, secret, opts)
+	if err != nil {
+		return "", err
+	}
+	return *signed, nil
+}
@@ -0,0 +1,301 @@
+// Command railway-image manages the files of a deployed image service from
+// the command line, e.g. in ops and migration scripts.
+//
+//	go build -o railway-image ./cmd/cli
+//	export IMAGE_SERVICE_URL=https://images.example.com IMAGE_SERVICE_API_KEY=...
+//	railway-image ls -prefix avatars/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	railwayimages "github.com/jaredLunde/railway-image-service/client"
+)
+
+const usage = `Usage: railway-image [-url URL] [-key API_KEY] <command> [arguments]
+
+Commands:
+  ls [-prefix P] [-glob G] [-limit N] [-trash] [-json]     List files
+  put [-acl A] [-meta k=v] [-expire-after D] <file> <key>  Upload a file, - reads stdin
+  get <key> [file]                                         Download a file, to stdout without a file
+  rm <key>...                                              Delete files
+  sign [-expires-in D] [-single-use] [-ip IP] <path>       Sign a /blob or /serve URL
+  purge <key>...                                           Purge the processed images of files from the cache
+  gc [-prefix P] [-dry-run]                                Permanently delete the files in the trash
+  stats [prefix]                                           Print the number and size of files stored
+
+The URL and API key default to IMAGE_SERVICE_URL and IMAGE_SERVICE_API_KEY. URLs
+are signed locally when IMAGE_SERVICE_SIGNATURE_SECRET_KEY is set, and tenants
+set IMAGE_SERVICE_TENANT to sign them with their own secret.
+`
+
+var commands = map[string]func(c *railwayimages.Client, args []string) error{
+	"ls":    list,
+	"put":   put,
+	"get":   get,
+	"rm":    remove,
+	"sign":  signURL,
+	"purge": purge,
+	"gc":    gc,
+	"stats": stats,
+}
+
+func main() {
+	fs := flag.NewFlagSet("railway-image", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	serviceURL := fs.String("url", os.Getenv("IMAGE_SERVICE_URL"), "The URL of the service")
+	apiKey := fs.String("key", os.Getenv("IMAGE_SERVICE_API_KEY"), "The API key")
+	fs.Parse(os.Args[1:])
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "railway-image: unknown command %q\n\n", fs.Arg(0))
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client, err := railwayimages.NewClient(railwayimages.Options{
+		URL:                *serviceURL,
+		SecretKey:          *apiKey,
+		SignatureSecretKey: os.Getenv("IMAGE_SERVICE_SIGNATURE_SECRET_KEY"),
+		Tenant:             os.Getenv("IMAGE_SERVICE_TENANT"),
+		MaxRetries:         3,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "railway-image:", err)
+		os.Exit(1)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := cmd(client.WithContext(ctx), fs.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "railway-image %s: %s\n", fs.Arg(0), err)
+		stop()
+		os.Exit(1)
+	}
+}
+
+func list(c *railwayimages.Client, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "Only list keys with this prefix")
+	glob := fs.String("glob", "", "Only list keys matching this pattern, e.g. avatars/*.png")
+	limit := fs.Int("limit", 0, "The most keys to list. Zero lists all of them.")
+	trash := fs.Bool("trash", false, "List the files in the trash instead")
+	asJSON := fs.Bool("json", false, "Print each file as a line of JSON")
+	fs.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	enc := json.NewEncoder(os.Stdout)
+	listed := 0
+	return eachPage(c, railwayimages.ListOptions{Prefix: *prefix, Glob: *glob, Unlinked: *trash}, func(objects []railwayimages.ListObject) bool {
+		for _, obj := range objects {
+			if *limit > 0 && listed == *limit {
+				return false
+			}
+			listed++
+			if *asJSON {
+				enc.Encode(obj)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", obj.Key, obj.Size, obj.ContentType, obj.ModifiedTime.Format(time.RFC3339))
+		}
+		return *limit == 0 || listed < *limit
+	})
+}
+
+func put(c *railwayimages.Client, args []string) error {
+	fs := flag.NewFlagSet("put", flag.ExitOnError)
+	acl := fs.String("acl", "", "Who can read the file, public or private")
+	expireAfter := fs.Duration("expire-after", 0, "Delete the file automatically after this long")
+	meta := metadataFlag{}
+	fs.Var(meta, "meta", "Metadata to store with the file as name=value. It can be repeated.")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("expected a file and a key")
+	}
+
+	var r io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	return c.PutWithOptions(fs.Arg(1), r, railwayimages.PutOptions{Metadata: meta, ExpireAfter: *expireAfter, ACL: *acl})
+}
+
+func get(c *railwayimages.Client, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("expected a key and an optional file")
+	}
+	if len(args) == 1 {
+		return c.Download(args[0], os.Stdout)
+	}
+
+	f, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	if err := c.Download(args[0], f); err != nil {
+		f.Close()
+		os.Remove(args[1])
+		return err
+	}
+	return f.Close()
+}
+
+func remove(c *railwayimages.Client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected at least one key")
+	}
+	for _, key := range args {
+		if err := c.Delete(key); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func signURL(c *railwayimages.Client, args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	expiresIn := fs.Duration("expires-in", 0, "How long the URL is valid for")
+	singleUse := fs.Bool("single-use", false, "Only accept the URL once")
+	ip := fs.String("ip", "", "Only accept the URL from this IP address or CIDR")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expected a path, e.g. /serve/300x300/blob/gopher.png")
+	}
+
+	uri, err := c.SignWithOptions(fs.Arg(0), railwayimages.SignOptions{ExpiresIn: *expiresIn, SingleUse: *singleUse, IP: *ip})
+	if err != nil {
+		return err
+	}
+	fmt.Println(uri)
+	return nil
+}
+
+func purge(c *railwayimages.Client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected at least one key")
+	}
+	for _, key := range args {
+		if err := c.Purge(key); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// gc permanently deletes the files in the trash, which soft deleted files
+// stay in, taking up space, until they're restored or deleted
+func gc(c *railwayimages.Client, args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "Only delete files with this prefix")
+	dryRun := fs.Bool("dry-run", false, "Print the files that would be deleted without deleting them")
+	fs.Parse(args)
+
+	// Every page is collected first, since deleting files while listing them
+	// would move the cursor
+	var keys []string
+	var size int64
+	err := eachPage(c, railwayimages.ListOptions{Prefix: *prefix, Unlinked: true}, func(objects []railwayimages.ListObject) bool {
+		for _, obj := range objects {
+			keys = append(keys, obj.Key)
+			size += obj.Size
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if *dryRun {
+			fmt.Println(key)
+			continue
+		}
+		if err := c.Delete(key); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	verb := "deleted"
+	if *dryRun {
+		verb = "would delete"
+	}
+	fmt.Fprintf(os.Stderr, "%s %d files, %d bytes\n", verb, len(keys), size)
+	return nil
+}
+
+func stats(c *railwayimages.Client, args []string) error {
+	if len(args) > 1 {
+		return errors.New("expected an optional prefix")
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+
+	result, err := c.Stats(prefix)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PREFIX\tOBJECTS\tBYTES\tDELETED OBJECTS\tDELETED BYTES")
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", prefix, result.Objects, result.Bytes, result.DeletedObjects, result.DeletedBytes)
+	for _, p := range result.Prefixes {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", p.Prefix, p.Objects, p.Bytes, p.DeletedObjects, p.DeletedBytes)
+	}
+	return w.Flush()
+}
+
+// eachPage calls fn with each page of files until there are no more or fn
+// returns false
+func eachPage(c *railwayimages.Client, opts railwayimages.ListOptions, fn func([]railwayimages.ListObject) bool) error {
+	for {
+		page, err := c.List(opts)
+		if err != nil {
+			return err
+		}
+		if !fn(page.Objects) || !page.HasMore || page.NextCursor == "" {
+			return nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// metadataFlag collects repeated -meta name=value flags
+type metadataFlag map[string]string
+
+func (m metadataFlag) String() string {
+	pairs := make([]string, 0, len(m))
+	for name, value := range m {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m metadataFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", v)
+	}
+	m[name] = value
+	return nil
+}
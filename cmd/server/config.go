@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/caarlos0/env/v11"
@@ -12,36 +15,355 @@ type Config struct {
 	Port        int    `env:"PORT" envDefault:"3000"`
 	CertFile    string `env:"CERT_FILE" envDefault:""`
 	CertKeyFile string `env:"CERT_KEY_FILE" envDefault:""`
+	// How often CERT_FILE and CERT_KEY_FILE are checked for changes, so a
+	// renewed certificate is served without a restart. Zero disables it.
+	CertReloadInterval time.Duration `env:"CERT_RELOAD_INTERVAL" envDefault:"1m"`
+	// The port the gRPC API listens on. It isn't served if it's zero, and the
+	// service has to be built with the grpc tag.
+	GRPCPort int `env:"GRPC_PORT" envDefault:"0"`
+	// Serve HTTP/3 on the UDP port with the same number as PORT. It needs
+	// CERT_FILE and CERT_KEY_FILE, and the service has to be built with the
+	// http3 tag.
+	HTTP3 bool `env:"HTTP3" envDefault:"false"`
+	// The port of the internal listener, for Railway's private network. It
+	// serves the admin routes without auth and isn't started if it's zero.
+	InternalPort int `env:"INTERNAL_PORT" envDefault:"0"`
+	// A unix domain socket the server also listens on, e.g. for a reverse
+	// proxy in the same container
+	ListenSocket string `env:"LISTEN_SOCKET" envDefault:""`
 	// The maximum duration for reading the entire request, including the body
 	RequestTimeout time.Duration `env:"REQUEST_TIMEOUT" envDefault:"30s"`
+	// How long the server keeps handling requests after it's told to shut
+	// down, while /health/ready fails so load balancers stop routing to it
+	ShutdownDrainDelay time.Duration `env:"SHUTDOWN_DRAIN_DELAY" envDefault:"5s"`
 	// Allowed origins for CORS
 	CORSAllowedOrigins string `env:"CORS_ALLOWED_ORIGINS" envDefault:"*"`
-	Public        string `env:"PUBLIC" envDefault:"false"`
+	// A comma-separated list of IPs and CIDRs requests are allowed from. Every
+	// IP is allowed if it's empty.
+	AllowedIPs string `env:"ALLOWED_IPS" envDefault:""`
+	// A comma-separated list of IPs and CIDRs requests are rejected from
+	BlockedIPs string `env:"BLOCKED_IPS" envDefault:""`
+	// Deprecated: use DefaultACL. PUBLIC=true is the same as DEFAULT_ACL=public.
+	Public string `env:"PUBLIC" envDefault:"false"`
+	// Who can read files uploaded without an x-acl header, public or private
+	DefaultACL string `env:"DEFAULT_ACL" envDefault:""`
 	// The maximum size of a request body in bytes
 	MaxUploadSize int `env:"MAX_UPLOAD_SIZE" envDefault:"10485760"` // 10MB
+	// A comma-separated list of the prefixes of the MIME types that can be
+	// uploaded. video/ is added when FFMPEG_PATH is set.
+	AllowedMimeTypes string `env:"ALLOWED_MIME_TYPES" envDefault:"image/,application/pdf"`
+	// A semicolon-separated list of prefix=types rules that replace
+	// ALLOWED_MIME_TYPES for the keys under a prefix, e.g.
+	// docs/=application/pdf,text/plain. The longest prefix that matches
+	// applies.
+	MimeTypeRules string `env:"MIME_TYPE_RULES" envDefault:""`
+	// The name of the form field files are uploaded in with multipart/form-data
+	UploadFormField string `env:"UPLOAD_FORM_FIELD" envDefault:"file"`
+	// What to do with uploads whose content isn't the type they were declared
+	// with, e.g. HTML uploaded as image/png: reject them with 415, or rewrite
+	// their content type to the detected one
+	UploadContentTypeMismatch string `env:"UPLOAD_CONTENT_TYPE_MISMATCH" envDefault:"reject"`
+	// What uploads are scanned for malware with before they're stored:
+	// clamav or http. Uploads aren't scanned if it's empty.
+	UploadScanner UploadScanner `env:"UPLOAD_SCANNER" envDefault:""`
+	// The address of clamd, e.g. tcp://clamav:3310, or the URL of the HTTP
+	// scanner uploads are POSTed to
+	UploadScannerURL string `env:"UPLOAD_SCANNER_URL" envDefault:""`
+	// The URL of the classifier uploaded images are POSTed to for
+	// moderation, e.g. an NSFW detector. Images aren't moderated if it's
+	// empty.
+	ModerationURL string `env:"MODERATION_URL" envDefault:""`
+	// What's done with the images the classifier flags: block rejects them,
+	// flag stores them with their labels in the moderation metadata field,
+	// and quarantine rejects them and keeps them aside
+	ModerationAction string `env:"MODERATION_ACTION" envDefault:"block"`
+	// Classify images after they're stored, so uploads don't wait on the
+	// classifier. Blocked images are unlinked instead of rejected.
+	ModerationAsync bool `env:"MODERATION_ASYNC" envDefault:"false"`
 	// The path to the directory where uploaded files are stored
 	UploadPath string `env:"UPLOAD_PATH" envDefault:"/app/data/uploads"`
+	// The backend uploaded files are stored in
+	StorageDriver StorageDriver `env:"STORAGE_DRIVER" envDefault:"file"`
+	// The S3 bucket uploaded files are stored in when using the s3 driver
+	S3Bucket string `env:"S3_BUCKET" envDefault:""`
+	// A custom S3 endpoint, e.g. for MinIO or Cloudflare R2
+	S3Endpoint string `env:"S3_ENDPOINT" envDefault:""`
+	// The region of the S3 bucket
+	S3Region string `env:"S3_REGION" envDefault:"us-east-1"`
+	// The access key ID used to authenticate with S3
+	S3AccessKeyID string `env:"S3_ACCESS_KEY_ID" envDefault:""`
+	// The secret access key used to authenticate with S3
+	S3SecretAccessKey string `env:"S3_SECRET_ACCESS_KEY" envDefault:""`
+	// Address the bucket as a path segment instead of a subdomain
+	S3ForcePathStyle bool `env:"S3_FORCE_PATH_STYLE" envDefault:"false"`
+	// A prefix prepended to every key stored in the bucket
+	S3PathPrefix string `env:"S3_PATH_PREFIX" envDefault:""`
+	// The GCS bucket uploaded files are stored in when using the gcs driver
+	GCSBucket string `env:"GCS_BUCKET" envDefault:""`
+	// The path to a service account JSON key. Workload identity is used if
+	// neither this nor GCSCredentialsJSON are set.
+	GCSCredentialsFile string `env:"GCS_CREDENTIALS_FILE" envDefault:""`
+	// The contents of a service account JSON key
+	GCSCredentialsJSON string `env:"GCS_CREDENTIALS_JSON" envDefault:""`
+	// A prefix prepended to every key stored in the bucket
+	GCSPathPrefix string `env:"GCS_PATH_PREFIX" envDefault:""`
+	// The Azure storage account uploaded files are stored in when using the azure driver
+	AzureStorageAccount string `env:"AZURE_STORAGE_ACCOUNT" envDefault:""`
+	// The Azure container uploaded files are stored in
+	AzureStorageContainer string `env:"AZURE_STORAGE_CONTAINER" envDefault:""`
+	// The storage account key used for Shared Key authorization
+	AzureStorageAccountKey string `env:"AZURE_STORAGE_ACCOUNT_KEY" envDefault:""`
+	// A shared access signature used instead of the account key
+	AzureStorageSASToken string `env:"AZURE_STORAGE_SAS_TOKEN" envDefault:""`
+	// A custom blob service endpoint, e.g. for Azurite
+	AzureStorageEndpoint string `env:"AZURE_STORAGE_ENDPOINT" envDefault:""`
+	// A prefix prepended to every key stored in the container
+	AzureStoragePathPrefix string `env:"AZURE_STORAGE_PATH_PREFIX" envDefault:""`
+	// How long a file can go unread before it's offloaded to the bucket when
+	// using the tiered driver. Zero only offloads files above TierHotMaxBytes.
+	TierColdAfter time.Duration `env:"TIER_COLD_AFTER" envDefault:"720h"` // 30 days
+	// The most bytes kept on the local volume when using the tiered driver.
+	// Zero means no limit.
+	TierHotMaxBytes int64 `env:"TIER_HOT_MAX_BYTES" envDefault:"0"`
+	// How often cold files are offloaded when using the tiered driver
+	TierOffloadInterval time.Duration `env:"TIER_OFFLOAD_INTERVAL" envDefault:"1h"`
+	// The path to the directory where unfinished resumable uploads are kept
+	TusUploadPath string `env:"TUS_UPLOAD_PATH" envDefault:"/app/data/tus"`
+	// How long a resumable upload can take before it's discarded
+	TusUploadExpiry time.Duration `env:"TUS_UPLOAD_EXPIRY" envDefault:"24h"`
+	// A comma-separated list of prefix:bytes:objects quotas, e.g.
+	// users/*/:524288000:1000 limits every user to 500MB and 1000 files
+	Quotas string `env:"QUOTAS" envDefault:""`
+	// How often keys uploaded with an x-expire-after header are checked for
+	// expiry
+	ExpiryInterval time.Duration `env:"EXPIRY_INTERVAL" envDefault:"1m"`
 	// The path to the LevelDB database
 	LevelDBPath string `env:"LEVELDB_PATH" envDefault:"/app/data/db"`
-	// Used for securing the key value storage API
+	// The store the metadata of uploaded files is kept in
+	MetadataDriver MetadataDriver `env:"METADATA_DRIVER" envDefault:"leveldb"`
+	// The Postgres connection string used by the postgres metadata driver
+	DatabaseURL string `env:"DATABASE_URL" envDefault:""`
+	// The Redis connection string used by the redis metadata driver
+	RedisURL string `env:"REDIS_URL" envDefault:""`
+	// Store identical files once under their content hash. It needs the
+	// leveldb metadata driver.
+	Dedup bool `env:"DEDUP" envDefault:"false"`
+	// Used for securing the key value storage API. It has every scope.
 	SecretKey string `env:"SECRET_KEY" envDefault:"password"`
+	// The secret key being rotated out. It's accepted alongside SecretKey
+	// until SecretKeyPreviousExpiresAt, or until it's removed if that's unset.
+	SecretKeyPrevious string `env:"SECRET_KEY_PREVIOUS" envDefault:""`
+	// When SecretKeyPrevious stops being accepted, as an RFC 3339 timestamp
+	SecretKeyPreviousExpiresAt time.Time `env:"SECRET_KEY_PREVIOUS_EXPIRES_AT" envDefault:""`
+	// A comma-separated list of apikey:scopes pairs for additional API keys,
+	// e.g. sk_reader:read,sk_uploader:read+write
+	APIKeys string `env:"API_KEYS" envDefault:""`
 	// Used for signing URLs
 	SignatureSecretKey string `env:"SIGNATURE_SECRET_KEY" envDefault:"secret"`
+	// A comma-separated list of name:apikey or name:apikey:scopes tenants.
+	// Each tenant's keys are stored under its name and only reachable with
+	// its own API key.
+	Tenants string `env:"TENANTS" envDefault:""`
 
+	// How many requests a second each client IP can make without an API key.
+	// Zero is unlimited.
+	RateLimitIP float64 `env:"RATE_LIMIT_IP" envDefault:"0"`
+	// How many requests each client IP can make at once
+	RateLimitIPBurst int `env:"RATE_LIMIT_IP_BURST" envDefault:"0"`
+	// How many requests a second each API key can make. Zero is unlimited.
+	RateLimitAPIKey float64 `env:"RATE_LIMIT_API_KEY" envDefault:"0"`
+	// How many requests each API key can make at once
+	RateLimitAPIKeyBurst int `env:"RATE_LIMIT_API_KEY_BURST" envDefault:"0"`
+	// How many uploads each API key or client IP can make at once. Zero is
+	// unlimited.
+	RateLimitUploads int `env:"RATE_LIMIT_UPLOADS" envDefault:"0"`
+	// The Redis connection string rate limits are shared through. They're
+	// kept in memory by each replica if it's unset.
+	RateLimitRedisURL string `env:"RATE_LIMIT_REDIS_URL" envDefault:""`
+
+	// A comma-separated list of URLs that are sent a signed POST when a file
+	// is created, overwritten, updated, deleted or restored
+	WebhookURLs string `env:"WEBHOOK_URLS" envDefault:""`
+	// The secret webhooks are signed with
+	WebhookSecret string `env:"WEBHOOK_SECRET" envDefault:""`
+	// The message broker every change to a file and every processed image is
+	// published to. Events aren't published if it's empty.
+	EventsDriver EventsDriver `env:"EVENTS_DRIVER" envDefault:""`
+	// The URL of the NATS server, or of the Kafka REST proxy
+	EventsURL string `env:"EVENTS_URL" envDefault:""`
+	// The prefix of the subject or topic each event is published to, followed
+	// by its type
+	EventsTopicPrefix string `env:"EVENTS_TOPIC_PREFIX" envDefault:"image-service."`
+	// The CDN whose cache is purged when a file is overwritten, updated or
+	// deleted. Nothing is purged if it's empty.
+	CDNPurgeProvider CDNProvider `env:"CDN_PURGE_PROVIDER" envDefault:""`
+	// The Cloudflare zone ID, Fastly service ID or BunnyCDN pull zone ID
+	CDNPurgeZone string `env:"CDN_PURGE_ZONE" envDefault:""`
+	// The API token or key purges are authorized with
+	CDNPurgeToken string `env:"CDN_PURGE_TOKEN" envDefault:""`
+	// The base URL of the OTLP/HTTP collector traces are exported to, e.g.
+	// http://localhost:4318. Requests aren't traced if it's empty.
+	OTLPEndpoint string `env:"OTEL_EXPORTER_OTLP_ENDPOINT" envDefault:""`
+	// A comma-separated list of key=value headers sent to the collector
+	OTLPHeaders string `env:"OTEL_EXPORTER_OTLP_HEADERS" envDefault:""`
+	// The name of the service in traces
+	OTelServiceName string `env:"OTEL_SERVICE_NAME" envDefault:"railway-image-service"`
+	// Where every authenticated request that changes blobs is recorded.
+	// Nothing is recorded if it's empty.
+	AuditLogDriver AuditLogDriver `env:"AUDIT_LOG_DRIVER" envDefault:""`
+	// The path of the audit log file when using the file driver
+	AuditLogPath string `env:"AUDIT_LOG_PATH" envDefault:"/app/data/audit.log"`
+	// Where transform jobs are queued. The redis driver shares them between
+	// replicas and keeps them across restarts.
+	JobsDriver JobsDriver `env:"JOBS_DRIVER" envDefault:"memory"`
+	// The Redis connection string used by the redis jobs driver
+	JobsRedisURL string `env:"JOBS_REDIS_URL" envDefault:""`
+	// How many jobs each replica runs at once
+	JobsWorkers int `env:"JOBS_WORKERS" envDefault:"2"`
+	// When the index and blobs are backed up, as a cron expression, e.g.
+	// "0 3 * * *". Nothing is backed up if it's empty.
+	BackupSchedule string `env:"BACKUP_SCHEDULE" envDefault:""`
+	// The S3 bucket backups are uploaded to
+	BackupS3Bucket string `env:"BACKUP_S3_BUCKET" envDefault:""`
+	// A custom S3 endpoint for backups, e.g. for MinIO or Cloudflare R2
+	BackupS3Endpoint string `env:"BACKUP_S3_ENDPOINT" envDefault:""`
+	// The region of the backup bucket
+	BackupS3Region string `env:"BACKUP_S3_REGION" envDefault:"us-east-1"`
+	// The access key ID used to upload backups
+	BackupS3AccessKeyID string `env:"BACKUP_S3_ACCESS_KEY_ID" envDefault:""`
+	// The secret access key used to upload backups
+	BackupS3SecretAccessKey string `env:"BACKUP_S3_SECRET_ACCESS_KEY" envDefault:""`
+	// Address the backup bucket as a path segment instead of a subdomain
+	BackupS3ForcePathStyle bool `env:"BACKUP_S3_FORCE_PATH_STYLE" envDefault:"false"`
+	// A prefix prepended to the name of every backup
+	BackupS3PathPrefix string `env:"BACKUP_S3_PATH_PREFIX" envDefault:"backups"`
+	// How many backups are kept. Zero keeps every backup.
+	BackupRetention int `env:"BACKUP_RETENTION" envDefault:"7"`
+	// How long backups are kept. Zero keeps them regardless of age.
+	BackupRetentionAge time.Duration `env:"BACKUP_RETENTION_AGE" envDefault:"0"`
+	// Serve pprof profiles at /debug/pprof/ and runtime stats at /debug/vars
+	// to admin API keys
+	DebugEndpoints bool `env:"DEBUG_ENDPOINTS" envDefault:"false"`
+	// Serve a UI at /admin/ for browsing, uploading and deleting files with
+	// an API key
+	AdminUI bool `env:"ADMIN_UI" envDefault:"false"`
+
+	// Reject /serve signatures that don't expire
+	ServeRequireExpiry bool `env:"SERVE_REQUIRE_EXPIRY" envDefault:"false"`
+	// A semicolon-separated list of name=operations presets served at
+	// /serve/preset/{name}/{key}, e.g. thumb=200x200/smart/filters:quality(80)
+	ServePresets string `env:"SERVE_PRESETS" envDefault:""`
+	// The widest and tallest images can be made, including padding. Zero
+	// doesn't limit them.
+	ServeMaxWidth  int `env:"SERVE_MAX_WIDTH" envDefault:"0"`
+	ServeMaxHeight int `env:"SERVE_MAX_HEIGHT" envDefault:"0"`
+	// A comma-separated list of the filters images can be processed with.
+	// Every filter is allowed if it's empty.
+	ServeAllowedFilters string `env:"SERVE_ALLOWED_FILTERS" envDefault:""`
+	// How the smart operation picks the region to crop: attention or entropy
+	ServeSmartCrop string `env:"SERVE_SMART_CROP" envDefault:"attention"`
+	// The URL of a service that finds the faces in images for the faces
+	// gravity. Images are smart cropped without one.
+	ServeFaceDetectorURL string `env:"SERVE_FACE_DETECTOR_URL" envDefault:""`
+	// How animated GIFs and WebPs are processed: animate resizes every frame,
+	// flatten keeps only the first
+	ServeAnimation string `env:"SERVE_ANIMATION" envDefault:"animate"`
+	// The most frames of an animated image that are processed. Zero doesn't
+	// limit them.
+	ServeMaxFrames int `env:"SERVE_MAX_FRAMES" envDefault:"0"`
+	// The most pixels a frame of a source image can have before it's
+	// rejected with 422. Zero doesn't limit it.
+	ServeMaxSourcePixels int64 `env:"SERVE_MAX_SOURCE_PIXELS" envDefault:"100000000"` // 100 megapixels
+	// The most frames an animated source image can have before it's rejected
+	// with 422. Zero doesn't limit them.
+	ServeMaxSourceFrames int `env:"SERVE_MAX_SOURCE_FRAMES" envDefault:"1000"`
+	// The most bytes the frames of a source image that are processed can take
+	// up once they're decoded before it's rejected with 422. Zero doesn't
+	// limit it.
+	ServeMaxDecodeMemory int64 `env:"SERVE_MAX_DECODE_MEMORY" envDefault:"1073741824"` // 1GB
+	// How fast AVIFs are encoded, from 0, the slowest and smallest, to 9
+	ServeAvifSpeed int `env:"SERVE_AVIF_SPEED" envDefault:"5"`
+	// Encode progressive JPEGs with mozjpeg's settings
+	ServeJPEGProgressive bool `env:"SERVE_JPEG_PROGRESSIVE" envDefault:"false"`
+	// The zlib compression level of PNGs from 1 to 9. Zero uses libvips'
+	// default.
+	ServePNGCompression int `env:"SERVE_PNG_COMPRESSION" envDefault:"0"`
+	// Strip the EXIF, XMP and other metadata, like GPS coordinates, from
+	// served images unless they're processed with the keep_exif filter
+	StripMetadata bool `env:"STRIP_METADATA" envDefault:"true"`
+	// The path of the ffmpeg binary poster frames are extracted from videos
+	// with. Videos can't be uploaded without it.
+	FFmpegPath string `env:"FFMPEG_PATH" envDefault:""`
+	// Generate a tiny placeholder for every image uploaded, returned with its
+	// metadata
+	ServePlaceholders bool `env:"SERVE_PLACEHOLDERS" envDefault:"true"`
+	// Compute a perceptual hash of every image uploaded, so near-duplicates
+	// can be found with /blob/similar
+	ServeImageHashes bool `env:"SERVE_IMAGE_HASHES" envDefault:"true"`
 	// A comma-separated list of allowed URL sources
 	ServeAllowedHTTPSources string `env:"SERVE_ALLOWED_HTTP_SOURCES" envDefault:"*"`
+	// Block fetching from loopback, private, link-local and cloud metadata
+	// addresses, whatever the allowed host names resolve to
+	ServeBlockPrivateNetworks bool `env:"SERVE_BLOCK_PRIVATE_NETWORKS" envDefault:"true"`
+	// A comma-separated list of other networks to block fetching from, e.g.
+	// 203.0.113.0/24
+	ServeBlockNetworks string `env:"SERVE_BLOCK_NETWORKS" envDefault:""`
+	// A semicolon-separated list of source=credentials rules for protected
+	// HTTP sources, e.g. https://api.foobar.com=bearer abc123. Credentials are
+	// bearer <token>, basic <user>:<password>, header <name>: <value>, or
+	// sigv4 <region> <service> <access key ID> <secret access key>.
+	ServeHTTPSourceAuth string `env:"SERVE_HTTP_SOURCE_AUTH" envDefault:""`
+	// The proxy images and files are fetched from HTTP sources through, e.g.
+	// http://proxy.internal:3128. The HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables are used if it's empty.
+	SourceProxyURL string `env:"SOURCE_PROXY_URL" envDefault:""`
+	// How many times an image that fails to load from an HTTP source with a
+	// network error or a 429, 502, 503 or 504 is fetched again
+	ServeHTTPRetries int `env:"SERVE_HTTP_RETRIES" envDefault:"2"`
+	// How long to wait before fetching an image again, doubled after every
+	// retry
+	ServeHTTPRetryBackoff time.Duration `env:"SERVE_HTTP_RETRY_BACKOFF" envDefault:"200ms"`
+	// How many fetches from a host can fail in a row before images from it
+	// fail right away. Zero never stops fetching from a host.
+	ServeHTTPBreakerFailures int `env:"SERVE_HTTP_BREAKER_FAILURES" envDefault:"5"`
+	// How long images from a failing host fail right away before it's
+	// fetched from again
+	ServeHTTPBreakerCooldown time.Duration `env:"SERVE_HTTP_BREAKER_COOLDOWN" envDefault:"30s"`
 	// Automatically convert images to WebP
 	ServeAutoWebP bool `env:"SERVE_AUTO_WEBP" envDefault:"true"`
 	// Automatically convert images to AVIF
 	ServeAutoAVIF bool `env:"SERVE_AUTO_AVIF" envDefault:"true"`
+	// Automatically convert images to JPEG XL. The service has to be built
+	// with the jxl tag.
+	ServeAutoJXL bool `env:"SERVE_AUTO_JXL" envDefault:"false"`
+	// Scale images by the Sec-CH-DPR and Sec-CH-Width client hints of
+	// requests, and lower their quality when they have Save-Data: on
+	ServeClientHints bool `env:"SERVE_CLIENT_HINTS" envDefault:"true"`
 	// The max number of images to process concurrently
 	ServeConcurrency int `env:"SERVE_CONCURRENCY" envDefault:"20"`
 	// The duration to cache processed images
 	ServeCacheTTL time.Duration `env:"SERVE_RESULT_CACHE_TTL" envDefault:"24h"`
+	// How long after SERVE_RESULT_CACHE_TTL a processed image is kept and
+	// served when its source can't be loaded. Zero serves the error instead.
+	ServeStaleIfError time.Duration `env:"SERVE_STALE_IF_ERROR" envDefault:"0"`
+	// How much space processed images can take up on disk before the least
+	// recently used ones are removed. Zero doesn't limit it.
+	ResultCacheMaxBytes int64 `env:"RESULT_CACHE_MAX_BYTES" envDefault:"1073741824"` // 1GB
+	// Where processed images are cached. The redis driver shares them between
+	// replicas.
+	ServeResultCacheDriver ResultCacheDriver `env:"SERVE_RESULT_CACHE_DRIVER" envDefault:"file"`
+	// The Redis connection string used by the redis result cache driver
+	ServeResultCacheRedisURL string `env:"SERVE_RESULT_CACHE_REDIS_URL" envDefault:""`
+	// The largest processed image that is cached in Redis, in bytes
+	ServeResultCacheMaxSize int64 `env:"SERVE_RESULT_CACHE_MAX_SIZE" envDefault:"10485760"` // 10MB
 	// The TTL for the Cache-Control header
 	ServeCacheControlTTL time.Duration `env:"SERVE_CACHE_CONTROL_TTL" envDefault:"8760h"`
 	// The SWR time for the Cache-Control header
 	ServeCacheControlSWR time.Duration `env:"SERVE_CACHE_CONTROL_SWR" envDefault:"24h"`
+	// A semicolon-separated list of pattern=value rules that override the
+	// Cache-Control header by path, e.g. /blob/*=no-store. The first rule
+	// that matches applies.
+	CacheControlRules string `env:"CACHE_CONTROL_RULES" envDefault:""`
 
 	Environment Environment     `env:"ENVIRONMENT" envDefault:"production"`
 	LogLevel    logger.LogLevel `env:"LOG_LEVEL" envDefault:"info"`
@@ -54,9 +376,103 @@ const (
 	EnvironmentProduction  Environment = "production"
 )
 
-func LoadConfig() (cfg Config, err error) {
+type StorageDriver string
+
+const (
+	StorageDriverFile  StorageDriver = "file"
+	StorageDriverS3    StorageDriver = "s3"
+	StorageDriverGCS   StorageDriver = "gcs"
+	StorageDriverAzure StorageDriver = "azure"
+	// StorageDriverTiered keeps recently read files on the local volume and
+	// offloads the rest to an S3 bucket
+	StorageDriverTiered StorageDriver = "tiered"
+)
+
+type EventsDriver string
+
+const (
+	EventsDriverNone  EventsDriver = ""
+	EventsDriverNATS  EventsDriver = "nats"
+	EventsDriverKafka EventsDriver = "kafka"
+)
+
+type CDNProvider string
+
+const (
+	CDNProviderNone       CDNProvider = ""
+	CDNProviderCloudflare CDNProvider = "cloudflare"
+	CDNProviderFastly     CDNProvider = "fastly"
+	CDNProviderBunny      CDNProvider = "bunny"
+)
+
+type ResultCacheDriver string
+
+const (
+	ResultCacheDriverFile  ResultCacheDriver = "file"
+	ResultCacheDriverRedis ResultCacheDriver = "redis"
+)
+
+type UploadScanner string
+
+const (
+	UploadScannerNone   UploadScanner = ""
+	UploadScannerClamAV UploadScanner = "clamav"
+	UploadScannerHTTP   UploadScanner = "http"
+)
+
+type AuditLogDriver string
+
+const (
+	AuditLogDriverNone    AuditLogDriver = ""
+	AuditLogDriverFile    AuditLogDriver = "file"
+	AuditLogDriverLevelDB AuditLogDriver = "leveldb"
+)
+
+type JobsDriver string
+
+const (
+	JobsDriverMemory JobsDriver = "memory"
+	JobsDriverRedis  JobsDriver = "redis"
+)
+
+type MetadataDriver string
+
+const (
+	MetadataDriverLevelDB  MetadataDriver = "leveldb"
+	MetadataDriverPostgres MetadataDriver = "postgres"
+	MetadataDriverRedis    MetadataDriver = "redis"
+)
+
+// LoadConfig loads the config from the environment, on top of the settings in
+// the YAML or TOML config file at path if it isn't empty
+func LoadConfig(path string) (cfg Config, err error) {
 	cfg = Config{}
-	if err = env.ParseWithOptions(&cfg, env.Options{RequiredIfNoDef: true}); err != nil {
+	environment := map[string]string{}
+	if path != "" {
+		if environment, err = readConfigFile(path); err != nil {
+			return
+		}
+		params, err := env.GetFieldParams(&cfg)
+		if err != nil {
+			return cfg, err
+		}
+		known := make(map[string]bool, len(params))
+		for _, p := range params {
+			known[p.Key] = true
+		}
+		for key := range environment {
+			if !known[key] {
+				return cfg, fmt.Errorf("%s: unknown setting %s", path, key)
+			}
+		}
+	}
+	// Environment variables override the config file
+	for _, kv := range os.Environ() {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			environment[key] = value
+		}
+	}
+	if err = env.ParseWithOptions(&cfg, env.Options{RequiredIfNoDef: true, Environment: environment}); err != nil {
 		return
 	}
 
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// readConfigFile reads the settings in a YAML or TOML config file as the
+// environment variables they set. Keys are the names of the variables in any
+// case, with - or _ between words, and the keys of nested maps and TOML
+// tables are joined to their parent's, so s3: {bucket: images} sets
+// S3_BUCKET. Lists are joined with commas.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := map[string]string{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml", ".json":
+		err = readYAML(b, settings)
+	case ".toml":
+		err = readTOML(b, settings)
+	default:
+		return nil, fmt.Errorf("unsupported config file format %q, expected .yaml, .yml, .json or .toml", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return settings, nil
+}
+
+func readYAML(b []byte, settings map[string]string) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	return flattenYAML(doc.Content[0], "", settings)
+}
+
+// flattenYAML sets the settings of node. Scalars are read as they're written,
+// so durations and sizes like 30s aren't reinterpreted.
+func flattenYAML(node *yaml.Node, key string, settings map[string]string) error {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if err := flattenYAML(node.Content[i+1], settingKey(key, node.Content[i].Value), settings); err != nil {
+				return err
+			}
+		}
+		return nil
+	case yaml.SequenceNode:
+		values := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: lists can only contain values", item.Line)
+			}
+			values = append(values, item.Value)
+		}
+		settings[key] = strings.Join(values, ",")
+		return nil
+	case yaml.ScalarNode:
+		if key == "" {
+			return fmt.Errorf("line %d: expected a map of settings", node.Line)
+		}
+		if node.Tag == "!!null" {
+			settings[key] = ""
+		} else {
+			settings[key] = node.Value
+		}
+		return nil
+	}
+	return fmt.Errorf("line %d: unexpected %s", node.Line, node.Tag)
+}
+
+// readTOML reads the subset of TOML config files need: tables, and keys set
+// to strings, numbers, booleans or single-line arrays of them
+func readTOML(b []byte, settings map[string]string) error {
+	table := ""
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			name, ok := strings.CutSuffix(stripTOMLComment(line), "]")
+			if !ok || strings.HasPrefix(name, "[[") {
+				return fmt.Errorf("line %d: invalid table %s", n, line)
+			}
+			table = ""
+			for _, part := range strings.Split(name[1:], ".") {
+				table = settingKey(table, unquoteTOMLKey(part))
+			}
+			continue
+		}
+
+		name, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := table
+		for _, part := range strings.Split(strings.TrimSpace(name), ".") {
+			key = settingKey(key, unquoteTOMLKey(part))
+		}
+		value, err := parseTOMLValue(stripTOMLComment(strings.TrimSpace(raw)))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		settings[key] = value
+	}
+	return scanner.Err()
+}
+
+func parseTOMLValue(raw string) (string, error) {
+	switch {
+	case raw == "":
+		return "", fmt.Errorf("missing value")
+	case strings.HasPrefix(raw, `"""`) || strings.HasPrefix(raw, "'''"):
+		return "", fmt.Errorf("multi-line strings aren't supported")
+	case raw[0] == '"':
+		return strconv.Unquote(raw)
+	case raw[0] == '\'':
+		if len(raw) < 2 || raw[len(raw)-1] != '\'' {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw[0] == '[':
+		if raw[len(raw)-1] != ']' {
+			return "", fmt.Errorf("arrays have to be on one line")
+		}
+		var values []string
+		for _, item := range splitTOMLArray(raw[1 : len(raw)-1]) {
+			value, err := parseTOMLValue(item)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, ","), nil
+	}
+	// Numbers, booleans and dates are read as they're written
+	return strings.ReplaceAll(raw, "_", ""), nil
+}
+
+// splitTOMLArray splits the items of an array at the commas outside of
+// strings, dropping a trailing comma
+func splitTOMLArray(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
+
+// stripTOMLComment removes a # comment that isn't inside a string
+func stripTOMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return strings.TrimSpace(s[:i])
+		}
+	}
+	return s
+}
+
+func unquoteTOMLKey(key string) string {
+	key = strings.TrimSpace(key)
+	if unquoted, err := strconv.Unquote(key); err == nil {
+		return unquoted
+	}
+	return strings.Trim(key, "'")
+}
+
+// settingKey returns the environment variable name of key, nested under
+// parent
+func settingKey(parent, key string) string {
+	key = strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+	if parent == "" {
+		return key
+	}
+	return parent + "_" + key
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/jaredLunde/railway-image-service/internal/app/importer"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+// importObjects imports the objects at uri into kvService. uri is an
+// s3://bucket/prefix or gs://bucket/prefix URL, or the path of a local
+// directory. The keys of objects in buckets are kept as they are, prefix only
+// limits which are imported.
+func importObjects(ctx context.Context, cfg Config, kvService *keyval.KeyVal, uri string, concurrency int, log *slog.Logger) error {
+	var source importer.Source
+	var prefix string
+	if bucketPrefix, ok := strings.CutPrefix(uri, "s3://"); ok {
+		// The rest of the S3_* settings are used to reach the bucket
+		cfg.StorageDriver = StorageDriverS3
+		cfg.S3Bucket, prefix, _ = strings.Cut(bucketPrefix, "/")
+		cfg.S3PathPrefix = ""
+		s, err := newStorage(cfg, log)
+		if err != nil {
+			return err
+		}
+		source = s
+	} else if bucketPrefix, ok := strings.CutPrefix(uri, "gs://"); ok {
+		// The rest of the GCS_* settings are used to reach the bucket
+		cfg.StorageDriver = StorageDriverGCS
+		cfg.GCSBucket, prefix, _ = strings.Cut(bucketPrefix, "/")
+		cfg.GCSPathPrefix = ""
+		s, err := newStorage(cfg, log)
+		if err != nil {
+			return err
+		}
+		source = s
+	} else {
+		source = importer.NewDirSource(uri)
+	}
+
+	info, err := importer.Run(ctx, importer.Config{
+		Source:      source,
+		KeyVal:      kvService,
+		Prefix:      prefix,
+		Concurrency: concurrency,
+		Logger:      log,
+	})
+	log.Info("imported objects", "imported", info.Imported, "skipped", info.Skipped, "unsupported", info.Unsupported, "failed", info.Failed, "bytes", info.Bytes)
+	return err
+}
@@ -2,41 +2,76 @@ package main
 
 import (
 	"context"
-	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
 	"slices"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/goccy/go-json"
 	"github.com/gofiber/fiber/v3"
 	"github.com/gofiber/fiber/v3/middleware/adaptor"
-	"github.com/gofiber/fiber/v3/middleware/cors"
+	fiberexpvar "github.com/gofiber/fiber/v3/middleware/expvar"
 	"github.com/gofiber/fiber/v3/middleware/favicon"
 	"github.com/gofiber/fiber/v3/middleware/healthcheck"
 	"github.com/gofiber/fiber/v3/middleware/helmet"
+	"github.com/gofiber/fiber/v3/middleware/pprof"
 	fiberrecover "github.com/gofiber/fiber/v3/middleware/recover"
 	"github.com/gofiber/fiber/v3/middleware/requestid"
 	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/app/admin"
+	"github.com/jaredLunde/railway-image-service/internal/app/backup"
+	"github.com/jaredLunde/railway-image-service/internal/app/grpcapi"
 	"github.com/jaredLunde/railway-image-service/internal/app/imagor"
+	"github.com/jaredLunde/railway-image-service/internal/app/imagor/facedetect"
+	"github.com/jaredLunde/railway-image-service/internal/app/importer"
+	"github.com/jaredLunde/railway-image-service/internal/app/jobs"
 	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval/tieredstorage"
+	"github.com/jaredLunde/railway-image-service/internal/app/openapi"
 	"github.com/jaredLunde/railway-image-service/internal/app/signature"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/audit"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/cdn"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/events"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/health"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/http3"
 	"github.com/jaredLunde/railway-image-service/internal/pkg/logger"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/metrics"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/moderation"
 	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw/redisratelimit"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/sourceauth"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/ssrf"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/tlscert"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/tracing"
 	"golang.org/x/sync/errgroup"
 )
 
 func main() {
-	ctx := context.Background()
-	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	// Cancelled once the server stops accepting requests, after draining
+	ctx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
 
-	cfg, err := LoadConfig()
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "The path of a YAML or TOML config file. Environment variables override its settings.")
+	restore := flag.String("restore", "", "Restore a backup and exit: the path of an archive, an s3://bucket/key URL, or the name of a backup in BACKUP_S3_BUCKET, or latest")
+	restoreForce := flag.Bool("restore-force", false, "Restore into an index or storage that isn't empty, replacing the keys in the backup")
+	importFrom := flag.String("import", "", "Import the objects in an s3://bucket/prefix or gs://bucket/prefix URL, or a local directory, and exit. Objects that were already imported are skipped.")
+	importConcurrency := flag.Int("import-concurrency", importer.DefaultConcurrency, "How many objects are imported at a time")
+	flag.Parse()
+	cfg, err := LoadConfig(*configFile)
 	if err != nil {
 		panic(err)
 	}
@@ -47,67 +82,516 @@ func main() {
 		Pretty:   debug,
 	})
 
+	storage, err := newStorage(cfg, log)
+	if err != nil {
+		log.Error("invalid storage configuration", "error", err)
+		os.Exit(1)
+	}
+
+	index, err := newIndex(cfg)
+	if err != nil {
+		log.Error("metadata store failed to start", "error", err)
+		os.Exit(1)
+	}
+	if *restore != "" {
+		err := restoreBackup(signalCtx, cfg, storage, index, *restore, *restoreForce, log.With("source", "restore"))
+		index.Close()
+		if err != nil {
+			log.Error("failed to restore backup", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	auditLog, err := newAuditLog(cfg, index)
+	if err != nil {
+		log.Error("audit log failed to start", "error", err)
+		os.Exit(1)
+	}
+	if auditLog != nil {
+		defer auditLog.Close()
+	}
+
+	quotas, err := keyval.ParseQuotas(cfg.Quotas)
+	if err != nil {
+		log.Error("invalid quota configuration", "error", err)
+		os.Exit(1)
+	}
+	mimeTypeRules, err := keyval.ParseMimeTypeRules(cfg.MimeTypeRules)
+	if err != nil {
+		log.Error("invalid MIME type rule configuration", "error", err)
+		os.Exit(1)
+	}
+
+	parsedPresets, err := imagor.ParsePresets(cfg.ServePresets)
+	if err != nil {
+		log.Error("invalid preset configuration", "error", err)
+		os.Exit(1)
+	}
+	var presets atomic.Pointer[imagor.Presets]
+	presets.Store(&parsedPresets)
+
+	parsedCacheControl, err := mw.ParseCacheControlRules(cfg.CacheControlRules)
+	if err != nil {
+		log.Error("invalid cache control configuration", "error", err)
+		os.Exit(1)
+	}
+	var cacheControl atomic.Pointer[mw.CacheControlRules]
+	cacheControl.Store(&parsedCacheControl)
+
+	blockNetworks, err := ssrf.ParseNetworks(cfg.ServeBlockNetworks)
+	if err != nil {
+		log.Error("invalid blocked networks", "error", err)
+		os.Exit(1)
+	}
+	if cfg.ServeBlockPrivateNetworks {
+		blockNetworks = append(blockNetworks, ssrf.PrivateNetworks...)
+	}
+
+	parsedSourceAuth, err := sourceauth.ParseRules(cfg.ServeHTTPSourceAuth)
+	if err != nil {
+		log.Error("invalid HTTP source auth configuration", "error", err)
+		os.Exit(1)
+	}
+	var sourceAuth atomic.Pointer[sourceauth.Rules]
+	sourceAuth.Store(&parsedSourceAuth)
+	sourceProxy, err := ssrf.ParseProxy(cfg.SourceProxyURL)
+	if err != nil {
+		log.Error("invalid source proxy configuration", "error", err)
+		os.Exit(1)
+	}
+
+	apiKeys, err := parseAPIKeys(cfg)
+	if err != nil {
+		log.Error("invalid API key configuration", "error", err)
+		os.Exit(1)
+	}
+	keyRing := mw.NewKeyRing(apiKeys)
+
+	allowedIPs, err := mw.ParseIPNetworks(cfg.AllowedIPs)
+	if err != nil {
+		log.Error("invalid allowed IP configuration", "error", err)
+		os.Exit(1)
+	}
+	blockedIPs, err := mw.ParseIPNetworks(cfg.BlockedIPs)
+	if err != nil {
+		log.Error("invalid blocked IP configuration", "error", err)
+		os.Exit(1)
+	}
+
+	defaultACL := cfg.DefaultACL
+	if defaultACL == "" && cfg.Public == "true" {
+		log.Warn("PUBLIC is deprecated, set DEFAULT_ACL=public instead")
+		defaultACL = keyval.ACLPublic
+	}
+	publisher, err := newEventPublisher(cfg)
+	if err != nil {
+		log.Error("event publisher failed to start", "error", err)
+		os.Exit(1)
+	}
+	var eventQueue *events.Queue
+	if publisher != nil {
+		defer publisher.Close()
+		eventQueue = events.NewQueue(publisher, cfg.EventsTopicPrefix, log)
+		go eventQueue.Run(ctx)
+	}
+	purger, err := newCDNPurger(cfg)
+	if err != nil {
+		log.Error("CDN purger failed to start", "error", err)
+		os.Exit(1)
+	}
+	var purgeQueue *cdn.Queue
+	if purger != nil {
+		purgeQueue = cdn.NewQueue(purger, log)
+		go purgeQueue.Run(ctx)
+	}
+	cacheTagHeaders := cdn.TagHeaders(purger)
+
+	registry := metrics.NewRegistry()
+	var tracer *tracing.Tracer
+	if cfg.OTLPEndpoint != "" {
+		headers := map[string]string{}
+		for _, h := range strings.Split(cfg.OTLPHeaders, ",") {
+			if k, v, ok := strings.Cut(h, "="); ok {
+				headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+		tracer = tracing.New(tracing.Config{
+			Endpoint:    cfg.OTLPEndpoint,
+			Headers:     headers,
+			ServiceName: cfg.OTelServiceName,
+			Logger:      log.With("source", "tracing"),
+		})
+		go tracer.Run(ctx)
+	}
+
+	var webhookURLs []string
+	for _, u := range strings.Split(cfg.WebhookURLs, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			webhookURLs = append(webhookURLs, u)
+		}
+	}
+	scanner, err := newUploadScanner(cfg)
+	if err != nil {
+		log.Error("invalid upload scanner configuration", "error", err)
+		os.Exit(1)
+	}
+	moderationConfig := keyval.Moderation{Action: cfg.ModerationAction, Async: cfg.ModerationAsync}
+	if cfg.ModerationURL != "" {
+		moderationConfig.Classifier = moderation.NewHTTP(cfg.ModerationURL, cfg.RequestTimeout)
+	}
+	allowedMimeTypes := keyval.ParseMimeTypes(cfg.AllowedMimeTypes)
+	if cfg.FFmpegPath != "" && !slices.Contains(allowedMimeTypes, "video/") {
+		allowedMimeTypes = append(allowedMimeTypes, "video/")
+	}
 	kvService, err := keyval.New(keyval.Config{
-		BasePath:         "/blob",
-		UploadPath:       cfg.UploadPath,
-		LevelDBPath:      cfg.LevelDBPath,
-		SoftDelete:       true,
-		SignSecret:       cfg.SignatureSecretKey,
-		MaxSize:          cfg.MaxUploadSize,
-		AllowedMimeTypes: []string{"image/"},
-		Logger:           log,
-		Debug:            debug,
+		Storage:             storage,
+		Index:               index,
+		BasePath:            "/blob",
+		UploadPath:          cfg.UploadPath,
+		LevelDBPath:         cfg.LevelDBPath,
+		SoftDelete:          true,
+		SignSecret:          cfg.SignatureSecretKey,
+		MaxSize:             cfg.MaxUploadSize,
+		AllowedMimeTypes:    allowedMimeTypes,
+		MimeTypeRules:       mimeTypeRules,
+		ContentTypeMismatch: cfg.UploadContentTypeMismatch,
+		Logger:              log,
+		Debug:               debug,
+		FormField:           cfg.UploadFormField,
+		TusPath:             cfg.TusUploadPath,
+		TusExpiry:           cfg.TusUploadExpiry,
+		AllowedHTTPSources:  cfg.ServeAllowedHTTPSources,
+		BlockNetworks:       blockNetworks,
+		SourceAuth:          &sourceAuth,
+		SourceProxy:         sourceProxy,
+		RequestTimeout:      cfg.RequestTimeout,
+		Quotas:              quotas,
+		DefaultACL:          defaultACL,
+		WebhookURLs:         webhookURLs,
+		WebhookSecret:       cfg.WebhookSecret,
+		Events:              eventQueue,
+		Metrics:             registry,
+		Tracer:              tracer,
+		Dedup:               cfg.Dedup,
+		CacheTagHeaders:     cacheTagHeaders,
+		Scanner:             scanner,
+		Moderation:          moderationConfig,
 	})
 	if err != nil {
 		log.Error("keyval app failed to start", "error", err)
 		os.Exit(1)
 	}
 	defer kvService.Close()
+	if *importFrom != "" {
+		err := importObjects(signalCtx, cfg, kvService, *importFrom, *importConcurrency, log.With("source", "import"))
+		if err != nil {
+			log.Error("failed to import objects", "error", err)
+			kvService.Close()
+			os.Exit(1)
+		}
+		return
+	}
+	go kvService.RunExpiry(ctx, cfg.ExpiryInterval)
+	if tiered, ok := storage.(*tieredstorage.TieredStorage); ok {
+		go tiered.RunOffload(ctx, cfg.TierOffloadInterval)
+	}
+	go kvService.RunWebhooks(ctx)
+	go kvService.RunModeration(ctx)
+	if cfg.BackupSchedule != "" {
+		schedule, err := backup.ParseSchedule(cfg.BackupSchedule)
+		if err != nil {
+			log.Error("invalid backup schedule", "error", err)
+			os.Exit(1)
+		}
+		backups := newBackup(cfg, storage, index, registry, log.With("source", "backup"))
+		if backups == nil {
+			log.Error("BACKUP_S3_BUCKET is required when BACKUP_SCHEDULE is set")
+			os.Exit(1)
+		}
+		go backups.RunSchedule(ctx, schedule)
+	}
 
+	resultStorage, err := newResultStorage(cfg)
+	if err != nil {
+		log.Error("result cache failed to start", "error", err)
+		os.Exit(1)
+	}
+	jobStore, err := newJobStore(cfg)
+	if err != nil {
+		log.Error("job queue failed to start", "error", err)
+		os.Exit(1)
+	}
+	jobService := jobs.New(jobs.Config{
+		Store:   jobStore,
+		Workers: cfg.JobsWorkers,
+		Logger:  log.With("source", "jobs"),
+	})
+	defer jobService.Close()
+	var faceDetector imagor.FaceDetector
+	if cfg.ServeFaceDetectorURL != "" {
+		faceDetector = facedetect.New(cfg.ServeFaceDetectorURL, facedetect.WithTimeout(cfg.RequestTimeout))
+	}
 	imagorService, err := imagor.New(ctx, imagor.Config{
 		KeyVal:             kvService,
-		UploadPath:         cfg.UploadPath,
 		MaxUploadSize:      cfg.MaxUploadSize,
 		SignSecret:         cfg.SignatureSecretKey,
 		AllowedHTTPSources: cfg.ServeAllowedHTTPSources,
-		AutoWebP:           cfg.ServeAutoWebP,
-		AutoAVIF:           cfg.ServeAutoAVIF,
-		ResultCacheTTL:     cfg.ServeCacheTTL,
-		Concurrency:        cfg.ServeConcurrency,
-		CacheControlTTL:    cfg.ServeCacheControlTTL,
-		CacheControlSWR:    cfg.ServeCacheControlSWR,
-		RequestTimeout:     cfg.RequestTimeout,
-		Debug:              debug,
+		BlockNetworks:      blockNetworks,
+		SourceAuth:         &sourceAuth,
+		SourceProxy:        sourceProxy,
+		SourcePolicy: imagor.SourcePolicy{
+			Retries:         cfg.ServeHTTPRetries,
+			RetryBackoff:    cfg.ServeHTTPRetryBackoff,
+			BreakerFailures: cfg.ServeHTTPBreakerFailures,
+			BreakerCooldown: cfg.ServeHTTPBreakerCooldown,
+		},
+		AutoWebP:            cfg.ServeAutoWebP,
+		AutoAVIF:            cfg.ServeAutoAVIF,
+		AutoJXL:             cfg.ServeAutoJXL,
+		ClientHints:         cfg.ServeClientHints,
+		ResultCacheTTL:      cfg.ServeCacheTTL,
+		StaleIfError:        cfg.ServeStaleIfError,
+		Concurrency:         cfg.ServeConcurrency,
+		CacheControlTTL:     cfg.ServeCacheControlTTL,
+		CacheControlSWR:     cfg.ServeCacheControlSWR,
+		RequestTimeout:      cfg.RequestTimeout,
+		Debug:               debug,
+		Events:              eventQueue,
+		Metrics:             registry,
+		Tracer:              tracer,
+		ResultStorage:       resultStorage,
+		ResultCacheMaxBytes: cfg.ResultCacheMaxBytes,
+		Limits: imagor.Limits{
+			MaxWidth:       cfg.ServeMaxWidth,
+			MaxHeight:      cfg.ServeMaxHeight,
+			AllowedFilters: imagor.ParseFilters(cfg.ServeAllowedFilters),
+		},
+		SmartCrop:    cfg.ServeSmartCrop,
+		FaceDetector: faceDetector,
+		Animation:    cfg.ServeAnimation,
+		MaxFrames:    cfg.ServeMaxFrames,
+		SourceLimits: imagor.SourceLimits{
+			MaxPixels:       cfg.ServeMaxSourcePixels,
+			MaxFrames:       cfg.ServeMaxSourceFrames,
+			MaxDecodeMemory: cfg.ServeMaxDecodeMemory,
+		},
+		AvifSpeed:       cfg.ServeAvifSpeed,
+		JPEGProgressive: cfg.ServeJPEGProgressive,
+		PNGCompression:  cfg.ServePNGCompression,
+		StripMetadata:   cfg.StripMetadata,
+		FFmpegPath:      cfg.FFmpegPath,
+		Jobs:            jobService,
+		Logger:          log.With("source", "imagor"),
 	})
 	if err != nil {
 		log.Error("imagor app failed to start", "error", err)
 		os.Exit(1)
 	}
+	// The handlers of the jobs are registered by the services that queue them
+	go jobService.Run(ctx)
+	// Presets in the x-derive header of uploads are rendered right after
+	kvService.SetDeriver(imagor.NewDeriver(imagorService, func() imagor.Presets {
+		return *presets.Load()
+	}))
+	// The processed images of a blob are stale once it's replaced or deleted
+	kvService.OnChange(func(eventType, key string) {
+		if eventType != keyval.EventBlobOverwritten && eventType != keyval.EventBlobDeleted {
+			return
+		}
+		if err := imagorService.Purge(ctx, key); err != nil && !errors.Is(err, imagor.ErrPurgeNotSupported) {
+			log.Error("failed to purge result cache", "key", key, "error", err)
+		}
+	})
+	// CDNs cache blobs and processed images under the tag of the blob
+	if purgeQueue != nil {
+		kvService.OnChange(func(eventType, key string) {
+			if eventType == keyval.EventBlobOverwritten || eventType == keyval.EventBlobUpdated || eventType == keyval.EventBlobDeleted {
+				purgeQueue.Push(key)
+			}
+		})
+	}
+	if cfg.ServePlaceholders {
+		kvService.OnChange(func(eventType, key string) {
+			if eventType != keyval.EventBlobCreated && eventType != keyval.EventBlobOverwritten {
+				return
+			}
+			rec := kvService.GetRecord([]byte(key))
+			if rec.Placeholder != "" || !strings.HasPrefix(rec.ContentType, "image/") {
+				return
+			}
+			// The key is still locked by the upload
+			go func() {
+				placeholder, err := imagorService.Placeholder(ctx, key)
+				if err == nil {
+					err = kvService.SetPlaceholder([]byte(key), rec.Hash, placeholder)
+				}
+				if err != nil {
+					log.Error("failed to generate placeholder", "key", key, "error", err)
+				}
+			}()
+		})
+	}
+	if cfg.ServeImageHashes {
+		kvService.OnChange(func(eventType, key string) {
+			if eventType != keyval.EventBlobCreated && eventType != keyval.EventBlobOverwritten {
+				return
+			}
+			rec := kvService.GetRecord([]byte(key))
+			if rec.DHash != "" || !strings.HasPrefix(rec.ContentType, "image/") {
+				return
+			}
+			// The key is still locked by the upload
+			go func() {
+				dHash, err := imagorService.DHash(ctx, key)
+				if err == nil {
+					err = kvService.SetDHash([]byte(key), rec.Hash, dHash)
+				}
+				if err != nil {
+					log.Error("failed to hash image", "key", key, "error", err)
+				}
+			}()
+		})
+	}
 
 	signatureService := signature.New(cfg.SignatureSecretKey)
+	var grpcServer *grpcapi.Server
+	if cfg.GRPCPort != 0 {
+		grpcServer, err = grpcapi.New(grpcapi.Config{
+			KeyVal:     kvService,
+			APIKeys:    keyRing,
+			SignSecret: cfg.SignatureSecretKey,
+			Logger:     log.With("source", "grpc"),
+		})
+		if err != nil {
+			log.Error("failed to create gRPC server", "error", err)
+			os.Exit(1)
+		}
+	}
 
-	app := fiber.New(fiber.Config{
+	fiberConfig := fiber.Config{
 		StrictRouting:     true,
 		BodyLimit:         cfg.MaxUploadSize, // This doesn't actually work with StreamBodyRequest, but it's here for good times
 		WriteTimeout:      cfg.RequestTimeout,
 		ReadTimeout:       cfg.RequestTimeout,
 		StreamRequestBody: true,
+		// Multipart uploads are streamed to storage by keyval instead
+		DisablePreParseMultipartForm: true,
 		JSONEncoder: func(v interface{}) ([]byte, error) {
 			return json.MarshalWithOption(v, json.DisableHTMLEscape())
 		},
 		JSONDecoder: json.Unmarshal,
-	})
+	}
+	app := fiber.New(fiberConfig)
+	// The certificate is reloaded when it's renewed, without a restart
+	var certs *tlscert.Reloader
+	if cfg.CertFile != "" && cfg.CertKeyFile != "" {
+		certs, err = tlscert.New(cfg.CertFile, cfg.CertKeyFile, log.With("source", "tls"))
+		if err != nil {
+			log.Error("failed to load TLS certificate", "error", err)
+			os.Exit(1)
+		}
+		if cfg.CertReloadInterval > 0 {
+			go certs.Watch(ctx, cfg.CertReloadInterval)
+		}
+	}
+	var http3Server *http3.Server
+	if cfg.HTTP3 && certs == nil {
+		log.Warn("HTTP/3 needs CERT_FILE and CERT_KEY_FILE, only serving HTTP/1.1")
+	} else if cfg.HTTP3 {
+		http3Server, err = http3.New(http3.Config{
+			Addr:           fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
+			GetCertificate: certs.GetCertificate,
+			App:            app,
+			Logger:         log.With("source", "http3"),
+		})
+		if err != nil {
+			log.Error("failed to create HTTP/3 server", "error", err)
+			os.Exit(1)
+		}
+		app.Use(http3.NewAltSvc(cfg.Port))
+	}
 
 	if cfg.Environment == EnvironmentDevelopment {
 		log.Warn("running in development mode, signed URLs are not required")
 	}
 	if cfg.SecretKey == "" {
-		log.Warn("no secret key provided, API key verification is disabled")
+		log.Warn("no secret key provided, requests can't be authorized with an API key")
+	}
+	if cfg.SecretKeyPrevious != "" && cfg.SecretKeyPreviousExpiresAt.IsZero() {
+		log.Warn("the previous secret key is accepted until it is removed, set SECRET_KEY_PREVIOUS_EXPIRES_AT to expire it")
 	}
 
-	
-	verifyAccess := mw.NewVerifyAccess(cfg.SecretKey, cfg.SignatureSecretKey)
+	signatures := &mw.SignatureVerifier{
+		Keys:   keyRing,
+		Secret: cfg.SignatureSecretKey,
+		Nonces: kvService,
+	}
+	verifyRead := mw.NewVerifyAccess(signatures, mw.ScopeRead)
+	verifyWrite := mw.NewVerifyAccess(signatures, mw.ScopeWrite)
+	verifyDelete := mw.NewVerifyAccess(signatures, mw.ScopeDelete)
+	// Moving deletes the source, so it needs both scopes
+	verifyMove := mw.NewVerifyAccess(signatures, mw.ScopeWrite|mw.ScopeDelete)
+	verifySign := mw.NewVerifyAPIKey(keyRing, mw.ScopeSign)
+	// Event streams can't be followed with a signed URL
+	verifyReadKey := mw.NewVerifyAPIKey(keyRing, mw.ScopeRead)
+	verifyWriteKey := mw.NewVerifyAPIKey(keyRing, mw.ScopeWrite)
+	verifyAdmin := mw.NewVerifyAPIKey(keyRing, mw.ScopeAdmin)
+	var rateLimitStore mw.RateLimitStore
+	if cfg.RateLimitRedisURL != "" {
+		redisStore, err := redisratelimit.New(cfg.RateLimitRedisURL, redisratelimit.WithUploadTimeout(cfg.RequestTimeout))
+		if err != nil {
+			log.Error("rate limit store failed to start", "error", err)
+			os.Exit(1)
+		}
+		defer redisStore.Close()
+		rateLimitStore = redisStore
+	}
+	rateLimiter := mw.NewRateLimiter(mw.RateLimiterConfig{
+		Keys:    keyRing,
+		IP:      mw.RateLimit{Rate: cfg.RateLimitIP, Burst: cfg.RateLimitIPBurst},
+		APIKey:  mw.RateLimit{Rate: cfg.RateLimitAPIKey, Burst: cfg.RateLimitAPIKeyBurst},
+		Uploads: cfg.RateLimitUploads,
+		Store:   rateLimitStore,
+	})
+	corsHandler, err := newCORS(cfg.CORSAllowedOrigins)
+	if err != nil {
+		log.Error("invalid CORS configuration", "error", err)
+		os.Exit(1)
+	}
+	// The CORS middleware is replaced when the config is reloaded
+	var corsMiddleware atomic.Pointer[fiber.Handler]
+	corsMiddleware.Store(&corsHandler)
+	reload := &reloader{
+		configFile:   *configFile,
+		log:          log,
+		keys:         keyRing,
+		presets:      &presets,
+		cacheControl: &cacheControl,
+		sourceAuth:   &sourceAuth,
+		cors:         &corsMiddleware,
+		rateLimiter:  rateLimiter,
+		kv:           kvService,
+		imagor:       imagorService,
+		certs:        certs,
+	}
+	// SIGHUP reloads the settings that can change without a restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reload.Reload(); err != nil {
+				log.Error("failed to reload configuration", "error", err)
+			}
+		}
+	}()
 	app.Use(mw.NewRealIP())
+	if tracer != nil {
+		app.Use(mw.NewTracing(tracer))
+	}
+	if len(allowedIPs) > 0 || len(blockedIPs) > 0 {
+		app.Use(mw.NewIPFilter(allowedIPs, blockedIPs))
+	}
 	app.Use(helmet.New(helmet.Config{
 		HSTSPreloadEnabled:        true,
 		HSTSMaxAge:                31536000,
@@ -116,62 +600,274 @@ func main() {
 	app.Use(fiberrecover.New(fiberrecover.Config{EnableStackTrace: cfg.Environment == EnvironmentDevelopment}))
 	app.Use(favicon.New())
 	app.Use(requestid.New())
-	corsAllowedOrigins := strings.Split(cfg.CORSAllowedOrigins, ",")
-	app.Use(cors.New(cors.Config{
-		AllowOrigins:        corsAllowedOrigins,
-		AllowMethods:        []string{fiber.MethodGet, fiber.MethodHead, fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete, fiber.MethodOptions},
-		AllowHeaders:        []string{"Origin", "Content-Type", "Accept", "Cache-Control", "If-Match", "If-None-Match", "x-api-key", "x-signature", "x-expire"},
-		ExposeHeaders:       []string{"Content-Disposition", "X-Request-ID", "Content-Md5", "Content-Range", "Accept-Ranges", "ETag"},
-		AllowPrivateNetwork: true,
-		MaxAge:              int(time.Hour),
-		AllowCredentials:    !slices.Contains(corsAllowedOrigins, "*"),
-	}))
+	app.Use(func(c fiber.Ctx) error {
+		return (*corsMiddleware.Load())(c)
+	})
+	app.Use(mw.NewCacheControl(&cacheControl))
+	healthChecker := health.New(map[string]health.Check{
+		"index":   kvService.CheckIndex,
+		"storage": kvService.CheckStorage,
+		"imagor":  imagor.CheckProcessing,
+	})
+	// Liveness checks keep passing while the server drains
 	app.Get(mw.HealthCheckEndpoint, healthcheck.NewHealthChecker())
+	app.Get(mw.LiveCheckEndpoint, healthcheck.NewHealthChecker())
+	app.Get(mw.ReadyCheckEndpoint, healthChecker.ReadyHandler)
+	app.Get(openapi.Endpoint, openapi.Handler)
+	go func() {
+		<-signalCtx.Done()
+		// A second signal kills the process right away
+		stop()
+		healthChecker.Drain()
+		log.Info("draining before shutdown", "delay", cfg.ShutdownDrainDelay.String())
+		time.Sleep(cfg.ShutdownDrainDelay)
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+		if http3Server != nil {
+			http3Server.Close()
+		}
+		shutdown()
+	}()
 	app.Use(mw.NewLogger(log.With("source", "http"), slog.LevelInfo))
-	app.Get("/serve/*", adaptor.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	app.Use(mw.NewMetrics(registry))
+	if auditLog != nil {
+		app.Use(mw.NewAudit(auditLog))
+	}
+	app.Use(rateLimiter.Limit)
+	// Registered first so they aren't taken for images
+	app.Post("/serve/warm", imagorService.WarmHandler, verifyWriteKey)
+	app.Get("/serve/warm/:id", imagorService.WarmJobHandler, verifyWriteKey)
+	app.Post("/jobs/transform", imagorService.TransformHandler, verifyWriteKey)
+	app.Post("/jobs/reencode", imagorService.ReencodeHandler, verifyAdmin)
+	app.Get("/jobs/:id", jobService.JobHandler, verifyWriteKey)
+	app.Post("/serve/variants", imagorService.VariantsHandler, verifySign)
+	app.Post(imagor.TransformEndpoint, imagorService.TransformBodyHandler, verifyWriteKey, rateLimiter.LimitUploads)
+	app.Get(imagor.ExifEndpoint+"*", imagorService.ExifHandler, verifyReadKey)
+	serve := adaptor.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		q := r.URL.Query()
-		sig := q.Get("x-signature")
-		if sig == "" {
-			sig = r.Header.Get("x-signature")
+		p := strings.TrimPrefix(r.URL.Path, "/serve")
+		param := func(key string) string {
+			if v := q.Get(key); v != "" {
+				return v
+			}
+			return r.Header.Get(key)
 		}
-		if sig == "" {
-			sig = "unsafe"
+		sig := ""
+		tenant := ""
+		apiKey := r.Header.Get("x-api-key")
+		switch {
+		case param("x-signature") != "":
+			// Signatures are verified here rather than by imagor, which only
+			// knows static signatures made with the signature secret key
+			var err *mw.SignatureError
+			// The adaptor passes fiber's locals through the request context
+			clientIP, _ := r.Context().Value(mw.RealIPKey).(string)
+			tenant, err = signatures.Verify(p, clientIP, param, cfg.ServeRequireExpiry)
+			if err != nil {
+				w.WriteHeader(err.Status)
+				w.Write([]byte(err.Message))
+				return
+			}
+		case apiKey != "":
 			// Fallback to an API key if there is one. If it's a valid key, generate the signature
 			// on the fly so the request can succeed.
-			apiKey := r.Header.Get("x-api-key")
-			if apiKey != "" {
-				if subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.SecretKey)) != 1 {
-					w.WriteHeader(fiber.StatusUnauthorized)
-					w.Write([]byte("unauthorized"))
-					return
+			key, ok := keyRing.Find(apiKey)
+			if !ok {
+				w.WriteHeader(fiber.StatusUnauthorized)
+				w.Write([]byte("unauthorized"))
+				return
+			}
+			if !key.Scopes.Has(mw.ScopeRead) {
+				w.WriteHeader(fiber.StatusForbidden)
+				w.Write([]byte("forbidden"))
+				return
+			}
+			tenant = key.Tenant
+		case debug:
+			sig = "unsafe"
+		default:
+			w.WriteHeader(fiber.StatusUnauthorized)
+			w.Write([]byte("unauthorized"))
+			return
+		}
+		if key, ok := strings.CutPrefix(p, imagor.BlurHashPrefix); ok {
+			if tenant != "" {
+				key = tenant + "/" + key
+			}
+			hash, err := imagorService.BlurHash(r.Context(), key)
+			if err != nil {
+				status := imagor.ErrorStatus(err)
+				if status >= fiber.StatusInternalServerError {
+					log.Error("failed to compute blurhash", "key", key, "error", err)
 				}
-
-				sig = sign.Sign(r.URL.Path, cfg.SignatureSecretKey)
+				w.WriteHeader(status)
+				w.Write([]byte(http.StatusText(status)))
+				return
+			}
+			w.Header().Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+			w.Header().Set(fiber.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", int(cfg.ServeCacheControlTTL.Seconds())))
+			for _, header := range cacheTagHeaders {
+				w.Header().Set(header, cdn.Tag(key))
 			}
+			w.Write([]byte(hash))
+			return
+		}
+		if strings.HasPrefix(p, imagor.PresetPrefix) {
+			// Presets are signed by name, so they're expanded after the
+			// signature is verified
+			var ok bool
+			if p, ok = presets.Load().Expand(p); !ok {
+				w.WriteHeader(fiber.StatusNotFound)
+				w.Write([]byte("preset not found"))
+				return
+			}
+		}
+		p = imagor.ExpandFaces(imagor.ExpandBlobRefs(imagor.ExpandFrame(imagor.ExpandMeta(p))))
+		if err := imagorService.CheckPath(p); err != nil {
+			w.WriteHeader(fiber.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if tenant != "" {
+			// Scope the image, and any blobs filters load like watermarks, to
+			// the tenant's keys
+			p = imagor.TenantPath(p, tenant)
+			// Blobs are loaded only from the tenant's keys. A path that
+			// decodes to another tenant's isn't served from the result
+			// cache either.
+			if !imagor.TenantPathAllowed(p, tenant) {
+				w.WriteHeader(fiber.StatusNotFound)
+				w.Write([]byte(http.StatusText(fiber.StatusNotFound)))
+				return
+			}
+			r = r.WithContext(imagor.WithTenant(r.Context(), tenant))
+		}
+		if key, ok := imagor.SourceKey(p); ok {
+			for _, header := range cacheTagHeaders {
+				w.Header().Set(header, cdn.Tag(key))
+			}
+		}
+		// Pages aren't signed, so any page of a document can be requested
+		// with the URL of one
+		var err error
+		if p, err = imagor.PagePath(p, q.Get("page")); err != nil {
+			w.WriteHeader(fiber.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		q.Del("page")
+		var vary bool
+		if p, vary = imagorService.AutoFormat(p, r.Header.Get("Accept")); vary {
+			w.Header().Add("Vary", "Accept")
+		}
+		var hints []string
+		if p, hints = imagorService.ClientHints(p, r.Header); len(hints) > 0 {
+			w.Header().Set("Accept-CH", imagor.AcceptCH)
+			w.Header().Add("Vary", strings.Join(hints, ", "))
+		}
+		// Revalidating doesn't need the image to be processed again
+		if etag, ok := imagorService.ETag(p); ok {
+			if imagorService.NotModified(w, r, etag) {
+				return
+			}
+			w = imagor.WithETag(w, etag)
+		}
+		if sig == "" {
+			sig = sign.Sign(p, cfg.SignatureSecretKey)
 		}
-		r.URL.Path = fmt.Sprintf("/%s%s", sig, strings.TrimPrefix(r.URL.Path, "/serve"))
+		r.URL.Path = fmt.Sprintf("/%s%s", sig, p)
+		r.URL.RawPath = ""
 		q.Del("x-signature")
+		q.Del("x-expire")
+		q.Del("x-nonce")
+		q.Del("x-ip")
+		q.Del("x-tenant")
 		r.URL.RawQuery = q.Encode()
 		imagorService.ServeHTTP(w, r)
-	})))
-	app.Get("/blob", kvService.ServeHTTP)
-	// use verfyAccess if cfg.Public is false!
-	if cfg.Public == "true" {
-		app.Get("/blob/*", kvService.ServeHTTP)
-	} else {
-		app.Get("/blob/*", kvService.ServeHTTP, verifyAccess)
-	}
-	app.Put("/blob/*", kvService.ServeHTTP, verifyAccess)
-	app.Delete("/blob/*", kvService.ServeHTTP, verifyAccess)
-	app.Get("/sign/*", signatureService.ServeHTTP)
+	}))
+	app.Get("/serve/*", serve)
+	app.Delete(imagor.PurgeEndpoint+"*", imagorService.PurgeHandler, verifyWriteKey)
+	app.Get("/stats/storage", kvService.StatsHandler, verifyRead)
+	app.Get("/events", kvService.EventsHandler, verifyReadKey)
+
+	// With an internal port, the operational routes are only served on it,
+	// without auth, and it can read and write every blob. It must only be
+	// reachable on a private network.
+	var internalApp *fiber.App
+	ops, verifyOpsRead, verifyOpsAdmin := app, fiber.Handler(verifyReadKey), fiber.Handler(verifyAdmin)
+	if cfg.InternalPort != 0 {
+		internalApp = fiber.New(fiberConfig)
+		internalApp.Use(mw.NewRealIP())
+		internalApp.Use(fiberrecover.New(fiberrecover.Config{EnableStackTrace: cfg.Environment == EnvironmentDevelopment}))
+		internalApp.Use(requestid.New())
+		internalApp.Use(mw.NewCacheControl(&cacheControl))
+		internalApp.Get(mw.HealthCheckEndpoint, healthcheck.NewHealthChecker())
+		internalApp.Get(mw.LiveCheckEndpoint, healthcheck.NewHealthChecker())
+		internalApp.Get(mw.ReadyCheckEndpoint, healthChecker.ReadyHandler)
+		internalApp.Use(mw.NewLogger(log.With("source", "http", "listener", "internal"), slog.LevelInfo))
+		internalApp.Use(mw.NewMetrics(registry))
+		if auditLog != nil {
+			internalApp.Use(mw.NewAudit(auditLog))
+		}
+		internalApp.Get("/stats/storage", kvService.StatsHandler, mw.NewTrustInternal())
+		internalApp.Get("/events", kvService.EventsHandler, mw.NewTrustInternal())
+		// Signed image URLs work on either port
+		internalApp.Get("/serve/*", serve)
+		registerBlobRoutes(internalApp, kvService, signatureService, signatures, trustAll())
+		ops, verifyOpsRead, verifyOpsAdmin = internalApp, mw.NewTrustInternal(), mw.NewTrustInternal()
+	}
+	ops.Get("/metrics", func(c fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, metrics.ContentType)
+		_, err := registry.WriteTo(c)
+		return err
+	}, verifyOpsRead)
+	if auditLog != nil {
+		ops.Get("/audit", audit.QueryHandler(auditLog, log.With("source", "audit")), verifyOpsAdmin)
+	}
+	ops.Post("/config/reload", reload.Handler, verifyOpsAdmin)
+	if cfg.DebugEndpoints {
+		expvar.Publish("goroutines", expvar.Func(func() any {
+			return runtime.NumGoroutine()
+		}))
+		expvar.Publish("vips", expvar.Func(func() any {
+			return imagor.ReadVipsStats()
+		}))
+		// Profiles expose the internals of the process, so they need an admin key
+		ops.Use("/debug", verifyOpsAdmin, pprof.New(), fiberexpvar.New())
+	}
+	if cfg.AdminUI {
+		// The UI itself is public, the APIs it calls need an API key
+		ops.Get(admin.Endpoint, admin.Handler)
+		ops.Get(admin.Endpoint+"/*", admin.Handler)
+	}
+	// Listings include private files, so they always need access. Public
+	// files can be read by anyone.
+	registerBlobRoutes(app, kvService, signatureService, signatures, blobAuth{
+		read:         verifyRead,
+		blobRead:     kvService.NewVerifyReadAccess(keyRing, verifyRead),
+		write:        verifyWrite,
+		delete:       verifyDelete,
+		move:         verifyMove,
+		sign:         verifySign,
+		limitUploads: rateLimiter.LimitUploads,
+	})
 
+	listenerNetwork := fiber.NetworkTCP4
+	if cfg.Host == "[::]" {
+		listenerNetwork = fiber.NetworkTCP6
+	}
+	var socket net.Listener
+	if cfg.ListenSocket != "" {
+		socket, err = listenSocket(cfg.ListenSocket)
+		if err != nil {
+			log.Error("failed to listen on socket", "error", err)
+			os.Exit(1)
+		}
+	}
 	g := errgroup.Group{}
 	g.Go(func() error {
 		addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
-		listenerNetwork := fiber.NetworkTCP4
-		if cfg.Host == "[::]" {
-			listenerNetwork = fiber.NetworkTCP6
-		}
 		// NOTE: We cannot use prefork because LevelDB uses a single file lock
 		listenConfig := fiber.ListenConfig{
 			GracefulContext:       ctx,
@@ -179,6 +875,23 @@ func main() {
 			DisableStartupMessage: true,
 			CertFile:              cfg.CertFile,
 			CertKeyFile:           cfg.CertKeyFile,
+			TLSConfigFunc: func(tlsConfig *tls.Config) {
+				if tlsConfig != nil && certs != nil {
+					tlsConfig.Certificates = nil
+					tlsConfig.GetCertificate = certs.GetCertificate
+				}
+			},
+			// The socket is served by the same server once its routes are
+			// built, so shutting the server down closes it too
+			BeforeServeFunc: func(app *fiber.App) error {
+				if socket != nil {
+					g.Go(func() error {
+						log.Info("starting server", "socket", cfg.ListenSocket)
+						return app.Server().Serve(socket)
+					})
+				}
+				return nil
+			},
 			OnShutdownError: func(err error) {
 				log.Error("error shutting down objects server", "error", err)
 			},
@@ -199,6 +912,37 @@ func main() {
 		return nil
 	})
 
+	if internalApp != nil {
+		g.Go(func() error {
+			addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.InternalPort)
+			log.Info("starting internal server", "address", addr)
+			return internalApp.Listen(addr, fiber.ListenConfig{
+				GracefulContext:       ctx,
+				ListenerNetwork:       listenerNetwork,
+				DisableStartupMessage: true,
+				OnShutdownError: func(err error) {
+					log.Error("error shutting down internal server", "error", err)
+				},
+			})
+		})
+	}
+
+	if http3Server != nil {
+		g.Go(http3Server.Serve)
+	}
+
+	if grpcServer != nil {
+		g.Go(func() error {
+			addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.GRPCPort)
+			lis, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			log.Info("starting gRPC server", "address", addr)
+			return grpcServer.Serve(lis)
+		})
+	}
+
 	if err := g.Wait(); err != nil {
 		log.Error("error starting application", "error", err)
 		os.Exit(1)
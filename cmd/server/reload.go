@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/cors"
+	"github.com/jaredLunde/railway-image-service/internal/app/imagor"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/sourceauth"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/tlscert"
+)
+
+// reloader applies the settings that can change while the server is running:
+// CORS_ALLOWED_ORIGINS, SERVE_ALLOWED_HTTP_SOURCES, the API keys, tenants and
+// secret keys, SERVE_PRESETS, CACHE_CONTROL_RULES, SERVE_HTTP_SOURCE_AUTH and
+// the RATE_LIMIT_* limits. The TLS certificate is loaded again from its
+// files. Other settings need a restart.
+type reloader struct {
+	configFile   string
+	mu           sync.Mutex
+	log          *slog.Logger
+	keys         *mw.KeyRing
+	presets      *atomic.Pointer[imagor.Presets]
+	cacheControl *atomic.Pointer[mw.CacheControlRules]
+	sourceAuth   *atomic.Pointer[sourceauth.Rules]
+	cors         *atomic.Pointer[fiber.Handler]
+	rateLimiter  *mw.RateLimiter
+	kv           *keyval.KeyVal
+	imagor       *imagor.Imagor
+	certs        *tlscert.Reloader
+}
+
+// Reload loads the config again and applies its reloadable settings. If any
+// of them are invalid, none are applied.
+func (r *reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := LoadConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+	keys, err := parseAPIKeys(cfg)
+	if err != nil {
+		return err
+	}
+	presets, err := imagor.ParsePresets(cfg.ServePresets)
+	if err != nil {
+		return fmt.Errorf("invalid presets: %w", err)
+	}
+	cacheControl, err := mw.ParseCacheControlRules(cfg.CacheControlRules)
+	if err != nil {
+		return err
+	}
+	sourceAuth, err := sourceauth.ParseRules(cfg.ServeHTTPSourceAuth)
+	if err != nil {
+		return err
+	}
+	handler, err := newCORS(cfg.CORSAllowedOrigins)
+	if err != nil {
+		return err
+	}
+	if r.certs != nil {
+		if err := r.certs.Reload(); err != nil {
+			return err
+		}
+	}
+
+	r.keys.Store(keys)
+	r.presets.Store(&presets)
+	r.cacheControl.Store(&cacheControl)
+	r.sourceAuth.Store(&sourceAuth)
+	r.cors.Store(&handler)
+	r.rateLimiter.SetLimits(
+		mw.RateLimit{Rate: cfg.RateLimitIP, Burst: cfg.RateLimitIPBurst},
+		mw.RateLimit{Rate: cfg.RateLimitAPIKey, Burst: cfg.RateLimitAPIKeyBurst},
+		cfg.RateLimitUploads,
+	)
+	r.kv.SetAllowedHTTPSources(cfg.ServeAllowedHTTPSources)
+	r.imagor.SetAllowedHTTPSources(cfg.ServeAllowedHTTPSources)
+	r.log.Info("reloaded configuration", "api_keys", len(keys), "presets", len(presets))
+	return nil
+}
+
+// Handler reloads the config, e.g. POST /config/reload
+func (r *reloader) Handler(c fiber.Ctx) error {
+	if err := r.Reload(); err != nil {
+		r.log.Error("failed to reload configuration", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// parseAPIKeys returns every key that can access the service: the API keys,
+// the tenants' keys and the secret keys
+func parseAPIKeys(cfg Config) (mw.APIKeys, error) {
+	keys, err := mw.ParseAPIKeys(cfg.APIKeys)
+	if err != nil {
+		return nil, err
+	}
+	tenants, err := mw.ParseTenants(cfg.Tenants)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenants: %w", err)
+	}
+	// An empty key would match requests without an x-api-key header, so other
+	// keys can't be scoped without a secret key
+	if cfg.SecretKey == "" && (len(keys) > 0 || len(tenants) > 0) {
+		return nil, fmt.Errorf("SECRET_KEY is required when API_KEYS or TENANTS are set")
+	}
+	// The secret key is always an admin key, and so is the previous one until
+	// it expires
+	if cfg.SecretKey != "" {
+		keys = append(keys, mw.APIKey{Key: cfg.SecretKey, Scopes: mw.ScopeAdmin})
+	}
+	if cfg.SecretKeyPrevious != "" {
+		keys = append(keys, mw.APIKey{Key: cfg.SecretKeyPrevious, Scopes: mw.ScopeAdmin, ExpiresAt: cfg.SecretKeyPreviousExpiresAt})
+	}
+	return append(keys, tenants...), nil
+}
+
+// newCORS returns the CORS middleware for a comma-separated list of allowed
+// origins
+func newCORS(origins string) (handler fiber.Handler, err error) {
+	// The middleware panics if an origin is invalid
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid CORS allowed origins: %v", r)
+		}
+	}()
+	allowedOrigins := strings.Split(origins, ",")
+	return cors.New(cors.Config{
+		AllowOrigins:        allowedOrigins,
+		AllowMethods:        []string{fiber.MethodGet, fiber.MethodHead, fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete, fiber.MethodOptions},
+		AllowHeaders:        []string{"Origin", "Content-Type", "Accept", "Cache-Control", "If-Match", "If-None-Match", "If-Modified-Since", "Content-MD5", "x-checksum-sha256", "x-expire-after", "x-acl", "x-derive", "x-api-key", "x-signature", "x-expire", "x-nonce", "x-ip", "x-tenant", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata"},
+		ExposeHeaders:       []string{"Content-Disposition", "X-Request-ID", "Content-Md5", "x-checksum-sha256", "x-acl", "x-placeholder", "x-derive-job", "Content-Range", "Accept-Ranges", "ETag", "Location", "Retry-After", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length", "Upload-Expires", "Upload-Metadata"},
+		AllowPrivateNetwork: true,
+		MaxAge:              int(time.Hour),
+		AllowCredentials:    !slices.Contains(allowedOrigins, "*"),
+	}), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jaredLunde/railway-image-service/internal/app/backup"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+// restoreBackup restores a backup into storage and index. uri is the path of
+// an archive, an s3://bucket/key URL, or the name of a backup in the backup
+// bucket, e.g. backup-20241016T030000Z.tar, or "latest".
+func restoreBackup(ctx context.Context, cfg Config, storage keyval.Storage, index keyval.Index, uri string, force bool, log *slog.Logger) error {
+	var r io.ReadCloser
+	var err error
+	if bucketKey, ok := strings.CutPrefix(uri, "s3://"); ok {
+		bucket, key, _ := strings.Cut(bucketKey, "/")
+		// The rest of the BACKUP_S3_* settings are used to reach the bucket
+		cfg.BackupS3Bucket = bucket
+		cfg.BackupS3PathPrefix = strings.TrimPrefix(path.Dir(key), ".")
+		r, err = newBackup(cfg, nil, nil, nil, log).Open(ctx, path.Base(key))
+	} else if uri == "latest" || (strings.HasPrefix(uri, "backup-") && !strings.Contains(uri, "/")) {
+		backups := newBackup(cfg, nil, nil, nil, log)
+		if backups == nil {
+			return fmt.Errorf("BACKUP_S3_BUCKET is required to restore %s", uri)
+		}
+		r, err = backups.Open(ctx, uri)
+	} else {
+		r, err = os.Open(uri)
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	restoreCfg := backup.RestoreConfig{Storage: storage, Force: force, Logger: log}
+	if levelDB, ok := index.(*keyval.LevelDBIndex); ok {
+		restoreCfg.DB = levelDB.DB()
+	}
+	info, err := backup.Restore(ctx, r, restoreCfg)
+	if err != nil {
+		return err
+	}
+	log.Info("restored backup", "created_at", info.Manifest.CreatedAt, "records", info.Records, "blobs", info.Blobs, "bytes", info.Bytes)
+	return nil
+}
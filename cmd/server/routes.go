@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/jaredLunde/railway-image-service/internal/app/signature"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+// blobAuth are the middlewares that authorize the blob routes
+type blobAuth struct {
+	read, blobRead, write, delete, move, sign fiber.Handler
+	limitUploads                              fiber.Handler
+}
+
+// trustAll authorizes every request, for the routes of the internal listener
+func trustAll() blobAuth {
+	trust := mw.NewTrustInternal()
+	next := func(c fiber.Ctx) error { return c.Next() }
+	return blobAuth{read: trust, blobRead: trust, write: trust, delete: trust, move: trust, sign: trust, limitUploads: next}
+}
+
+// registerBlobRoutes registers the routes that store, list and sign blobs
+func registerBlobRoutes(r fiber.Router, kvService *keyval.KeyVal, signatureService *signature.Signature, signatures *mw.SignatureVerifier, auth blobAuth) {
+	r.Options("/blob/tus/*", kvService.TusHandler)
+	r.Add([]string{fiber.MethodPost, fiber.MethodHead, fiber.MethodPatch, fiber.MethodDelete}, "/blob/tus/*", kvService.TusHandler, auth.write, auth.limitUploads)
+	r.Get("/blob/trash", kvService.TrashHandler, auth.read)
+	r.Get("/blob/export", kvService.ExportHandler, auth.read)
+	r.Get("/blob/similar", kvService.SimilarHandler, auth.read)
+	r.Post("/blob/restore/*", kvService.RestoreHandler, auth.write)
+	r.Get("/blob", kvService.ServeHTTP, auth.read)
+	r.Get("/files", kvService.ListHandler, auth.read)
+	r.Get("/blob/*", kvService.ServeHTTP, auth.blobRead)
+	r.Head("/blob/*", kvService.ServeHTTP, auth.blobRead)
+	r.Post("/blob/batch/delete", kvService.BatchDeleteHandler, auth.delete)
+	r.Post("/blob/copy", kvService.CopyHandler, auth.write)
+	r.Post("/blob/move", kvService.MoveHandler, auth.move)
+	r.Post("/blob/fetch", kvService.FetchHandler, auth.write, auth.limitUploads)
+	r.Put("/blob/*", kvService.ServeHTTP, auth.write, auth.limitUploads)
+	// Uploads with a signed policy are authorized by the policy
+	r.Post("/blob", kvService.PolicyUploadHandler(signatures), auth.limitUploads)
+	r.Post("/blob/*", kvService.ServeHTTP, auth.write, auth.limitUploads)
+	r.Patch("/blob/*", kvService.ServeHTTP, auth.write)
+	r.Delete("/blob/*", kvService.ServeHTTP, auth.delete)
+	r.Get("/sign/policy", signatureService.PolicyHandler, auth.sign)
+	r.Get("/sign/upload/*", signatureService.UploadHandler, auth.sign)
+	r.Get("/sign/*", signatureService.ServeHTTP, auth.sign)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	i "github.com/cshum/imagor"
+	"github.com/jaredLunde/railway-image-service/internal/app/backup"
+	"github.com/jaredLunde/railway-image-service/internal/app/imagor/redisstorage"
+	"github.com/jaredLunde/railway-image-service/internal/app/jobs"
+	"github.com/jaredLunde/railway-image-service/internal/app/jobs/redisstore"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval/azurestorage"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval/gcloudstorage"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval/pgindex"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval/redisindex"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval/s3storage"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval/tieredstorage"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/audit"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/cdn"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/events"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/metrics"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/scan"
+)
+
+func newStorage(cfg Config, log *slog.Logger) (keyval.Storage, error) {
+	switch cfg.StorageDriver {
+	case StorageDriverFile:
+		return keyval.NewFileStorage(cfg.UploadPath), nil
+	case StorageDriverS3:
+		if cfg.S3Bucket == "" {
+			return nil, fmt.Errorf("S3_BUCKET is required when STORAGE_DRIVER=s3")
+		}
+		return newS3Storage(cfg), nil
+	case StorageDriverGCS:
+		if cfg.GCSBucket == "" {
+			return nil, fmt.Errorf("GCS_BUCKET is required when STORAGE_DRIVER=gcs")
+		}
+		credentialsJSON := []byte(cfg.GCSCredentialsJSON)
+		if cfg.GCSCredentialsFile != "" {
+			b, err := os.ReadFile(cfg.GCSCredentialsFile)
+			if err != nil {
+				return nil, err
+			}
+			credentialsJSON = b
+		}
+		return gcloudstorage.New(cfg.GCSBucket,
+			gcloudstorage.WithCredentialsJSON(credentialsJSON),
+			gcloudstorage.WithPathPrefix(cfg.GCSPathPrefix),
+		)
+	case StorageDriverAzure:
+		if cfg.AzureStorageAccount == "" || cfg.AzureStorageContainer == "" {
+			return nil, fmt.Errorf("AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_CONTAINER are required when STORAGE_DRIVER=azure")
+		}
+		return azurestorage.New(cfg.AzureStorageAccount, cfg.AzureStorageContainer,
+			azurestorage.WithEndpoint(cfg.AzureStorageEndpoint),
+			azurestorage.WithAccountKey(cfg.AzureStorageAccountKey),
+			azurestorage.WithSASToken(cfg.AzureStorageSASToken),
+			azurestorage.WithPathPrefix(cfg.AzureStoragePathPrefix),
+		)
+	case StorageDriverTiered:
+		if cfg.S3Bucket == "" {
+			return nil, fmt.Errorf("S3_BUCKET is required when STORAGE_DRIVER=tiered")
+		}
+		return tieredstorage.New(keyval.NewFileStorage(cfg.UploadPath), newS3Storage(cfg),
+			tieredstorage.WithColdAfter(cfg.TierColdAfter),
+			tieredstorage.WithMaxHotBytes(cfg.TierHotMaxBytes),
+			tieredstorage.WithLogger(log),
+		), nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.StorageDriver)
+	}
+}
+
+func newS3Storage(cfg Config) *s3storage.S3Storage {
+	return s3storage.New(cfg.S3Bucket,
+		s3storage.WithEndpoint(cfg.S3Endpoint),
+		s3storage.WithRegion(cfg.S3Region),
+		s3storage.WithCredentials(cfg.S3AccessKeyID, cfg.S3SecretAccessKey, ""),
+		s3storage.WithForcePathStyle(cfg.S3ForcePathStyle),
+		s3storage.WithPathPrefix(cfg.S3PathPrefix),
+	)
+}
+
+func newIndex(cfg Config) (keyval.Index, error) {
+	switch cfg.MetadataDriver {
+	case MetadataDriverLevelDB:
+		return keyval.NewLevelDBIndex(cfg.LevelDBPath)
+	case MetadataDriverPostgres:
+		if cfg.DatabaseURL == "" {
+			return nil, fmt.Errorf("DATABASE_URL is required when METADATA_DRIVER=postgres")
+		}
+		return pgindex.New(cfg.DatabaseURL)
+	case MetadataDriverRedis:
+		if cfg.RedisURL == "" {
+			return nil, fmt.Errorf("REDIS_URL is required when METADATA_DRIVER=redis")
+		}
+		return redisindex.New(cfg.RedisURL)
+	default:
+		return nil, fmt.Errorf("unknown metadata driver %q", cfg.MetadataDriver)
+	}
+}
+
+func newEventPublisher(cfg Config) (events.Publisher, error) {
+	if cfg.EventsDriver != EventsDriverNone && cfg.EventsURL == "" {
+		return nil, fmt.Errorf("EVENTS_URL is required when EVENTS_DRIVER=%s", cfg.EventsDriver)
+	}
+	switch cfg.EventsDriver {
+	case EventsDriverNone:
+		return nil, nil
+	case EventsDriverNATS:
+		return events.NewNATS(cfg.EventsURL)
+	case EventsDriverKafka:
+		return events.NewKafkaREST(cfg.EventsURL, cfg.RequestTimeout)
+	default:
+		return nil, fmt.Errorf("unknown events driver %q", cfg.EventsDriver)
+	}
+}
+
+func newCDNPurger(cfg Config) (cdn.Purger, error) {
+	if cfg.CDNPurgeProvider != CDNProviderNone && (cfg.CDNPurgeZone == "" || cfg.CDNPurgeToken == "") {
+		return nil, fmt.Errorf("CDN_PURGE_ZONE and CDN_PURGE_TOKEN are required when CDN_PURGE_PROVIDER=%s", cfg.CDNPurgeProvider)
+	}
+	switch cfg.CDNPurgeProvider {
+	case CDNProviderNone:
+		return nil, nil
+	case CDNProviderCloudflare:
+		return cdn.NewCloudflare(cfg.CDNPurgeZone, cfg.CDNPurgeToken, cfg.RequestTimeout), nil
+	case CDNProviderFastly:
+		return cdn.NewFastly(cfg.CDNPurgeZone, cfg.CDNPurgeToken, cfg.RequestTimeout), nil
+	case CDNProviderBunny:
+		return cdn.NewBunny(cfg.CDNPurgeZone, cfg.CDNPurgeToken, cfg.RequestTimeout), nil
+	default:
+		return nil, fmt.Errorf("unknown CDN purge provider %q", cfg.CDNPurgeProvider)
+	}
+}
+
+func newUploadScanner(cfg Config) (scan.Scanner, error) {
+	if cfg.UploadScanner != UploadScannerNone && cfg.UploadScannerURL == "" {
+		return nil, fmt.Errorf("UPLOAD_SCANNER_URL is required when UPLOAD_SCANNER=%s", cfg.UploadScanner)
+	}
+	switch cfg.UploadScanner {
+	case UploadScannerNone:
+		return nil, nil
+	case UploadScannerClamAV:
+		return scan.NewClamAV(strings.TrimPrefix(cfg.UploadScannerURL, "tcp://"), cfg.RequestTimeout), nil
+	case UploadScannerHTTP:
+		return scan.NewHTTP(cfg.UploadScannerURL, cfg.RequestTimeout), nil
+	default:
+		return nil, fmt.Errorf("unknown upload scanner %q", cfg.UploadScanner)
+	}
+}
+
+func newAuditLog(cfg Config, index keyval.Index) (audit.Log, error) {
+	switch cfg.AuditLogDriver {
+	case AuditLogDriverNone:
+		return nil, nil
+	case AuditLogDriverFile:
+		return audit.NewFileLog(cfg.AuditLogPath)
+	case AuditLogDriverLevelDB:
+		levelDB, ok := index.(*keyval.LevelDBIndex)
+		if !ok {
+			return nil, fmt.Errorf("METADATA_DRIVER=leveldb is required when AUDIT_LOG_DRIVER=leveldb")
+		}
+		return audit.NewLevelDBLog(levelDB.DB()), nil
+	default:
+		return nil, fmt.Errorf("unknown audit log driver %q", cfg.AuditLogDriver)
+	}
+}
+
+// newBackup returns the backups of storage and index, or nil if there's no
+// backup bucket
+func newBackup(cfg Config, storage keyval.Storage, index keyval.Index, registry *metrics.Registry, log *slog.Logger) *backup.Backup {
+	if cfg.BackupS3Bucket == "" {
+		return nil
+	}
+	cfgBackup := backup.Config{
+		Storage: storage,
+		Destination: s3storage.New(cfg.BackupS3Bucket,
+			s3storage.WithEndpoint(cfg.BackupS3Endpoint),
+			s3storage.WithRegion(cfg.BackupS3Region),
+			s3storage.WithCredentials(cfg.BackupS3AccessKeyID, cfg.BackupS3SecretAccessKey, ""),
+			s3storage.WithForcePathStyle(cfg.BackupS3ForcePathStyle),
+			s3storage.WithPathPrefix(cfg.BackupS3PathPrefix),
+		),
+		Keep:     cfg.BackupRetention,
+		MaxAge:   cfg.BackupRetentionAge,
+		Registry: registry,
+		Logger:   log,
+	}
+	// Postgres and Redis are backed up on their own
+	if levelDB, ok := index.(*keyval.LevelDBIndex); ok {
+		cfgBackup.DB = levelDB.DB()
+	}
+	return backup.New(cfgBackup)
+}
+
+func newResultStorage(cfg Config) (i.Storage, error) {
+	switch cfg.ServeResultCacheDriver {
+	case ResultCacheDriverFile:
+		// The imagor service caches them in a temporary directory
+		return nil, nil
+	case ResultCacheDriverRedis:
+		if cfg.ServeResultCacheRedisURL == "" {
+			return nil, fmt.Errorf("SERVE_RESULT_CACHE_REDIS_URL is required when SERVE_RESULT_CACHE_DRIVER=redis")
+		}
+		// Expired images are kept to be served when they fail to process
+		expiration := cfg.ServeCacheTTL
+		if expiration > 0 {
+			expiration += cfg.ServeStaleIfError
+		}
+		return redisstorage.New(cfg.ServeResultCacheRedisURL,
+			redisstorage.WithExpiration(expiration),
+			redisstorage.WithMaxSize(cfg.ServeResultCacheMaxSize),
+		)
+	default:
+		return nil, fmt.Errorf("unknown result cache driver %q", cfg.ServeResultCacheDriver)
+	}
+}
+
+func newJobStore(cfg Config) (jobs.Store, error) {
+	switch cfg.JobsDriver {
+	case JobsDriverMemory:
+		return jobs.NewMemoryStore(), nil
+	case JobsDriverRedis:
+		if cfg.JobsRedisURL == "" {
+			return nil, fmt.Errorf("JOBS_REDIS_URL is required when JOBS_DRIVER=redis")
+		}
+		return redisstore.New(cfg.JobsRedisURL)
+	default:
+		return nil, fmt.Errorf("unknown jobs driver %q", cfg.JobsDriver)
+	}
+}
@@ -0,0 +1,45 @@
+package admin
+
+import (
+	"embed"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// Endpoint is where the admin UI is served
+const Endpoint = "/admin"
+
+// The UI is static, and asks for an API key to call the blob, sign and stats
+// APIs with from the browser. Serving it doesn't reveal anything.
+//
+//go:embed ui
+var ui embed.FS
+
+// contentSecurityPolicy only lets the UI load its own scripts and styles, and
+// images from the service or the object URLs of uploads
+const contentSecurityPolicy = "default-src 'self'; img-src 'self' blob: data:; object-src 'none'; base-uri 'none'; frame-ancestors 'none'"
+
+// Handler serves the admin UI, e.g. GET /admin/
+func Handler(c fiber.Ctx) error {
+	name := strings.TrimPrefix(c.Path(), Endpoint)
+	if name == "" {
+		// The UI's assets are relative to the directory
+		return c.Redirect().Status(fiber.StatusMovedPermanently).To(Endpoint + "/")
+	}
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		name = "index.html"
+	}
+
+	b, err := ui.ReadFile(path.Join("ui", path.Clean(name)))
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	c.Set(fiber.HeaderContentType, mime.TypeByExtension(path.Ext(name)))
+	c.Set(fiber.HeaderContentSecurityPolicy, contentSecurityPolicy)
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	return c.Send(b)
+}
@@ -0,0 +1,225 @@
+// The admin UI calls the service's APIs with the API key the user signs in
+// with. It's kept in sessionStorage, so it's forgotten when the tab closes.
+const storageKey = "railway-image-service:api-key";
+const pageSize = 100;
+
+const $ = (id) => document.getElementById(id);
+const state = { cursor: "", selected: null };
+
+function apiKey() {
+  return sessionStorage.getItem(storageKey) ?? "";
+}
+
+async function api(path, init = {}) {
+  const res = await fetch(path, {
+    ...init,
+    headers: { ...init.headers, "x-api-key": apiKey() },
+  });
+  if (res.status === 401) {
+    signOut();
+    throw new Error("The API key was rejected");
+  }
+  if (!res.ok) {
+    const body = await res.text();
+    throw new Error(`${res.status} ${res.statusText}${body ? `: ${body}` : ""}`);
+  }
+  return res;
+}
+
+// blobPath escapes each segment of a key, keeping its slashes
+function blobPath(key) {
+  return key.split("/").map(encodeURIComponent).join("/");
+}
+
+async function signURL(path) {
+  const res = await api(`/sign${path}`);
+  return res.text();
+}
+
+function formatBytes(n) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return `${i === 0 ? n : n.toFixed(1)} ${units[i]}`;
+}
+
+function showError(err) {
+  $("error").textContent = err ? err.message : "";
+}
+
+async function loadStats() {
+  const stats = await (await api("/stats/storage")).json();
+  const entries = [
+    ["Files", stats.objects.toLocaleString()],
+    ["Size", formatBytes(stats.bytes)],
+    ["In trash", stats.deleted_objects.toLocaleString()],
+    ["Trash size", formatBytes(stats.deleted_bytes)],
+  ];
+  $("stats").replaceChildren(
+    ...entries.map(([name, value]) => {
+      const div = document.createElement("div");
+      const dt = document.createElement("dt");
+      const dd = document.createElement("dd");
+      dt.textContent = name;
+      dd.textContent = value;
+      div.append(dt, dd);
+      return div;
+    }),
+  );
+}
+
+async function loadObjects(append = false) {
+  const form = $("search").elements;
+  const q = new URLSearchParams({ limit: pageSize });
+  if (form.prefix.value) q.set("prefix", form.prefix.value);
+  if (form.glob.value) q.set("glob", form.glob.value);
+  if (form.trash.checked) q.set("unlinked", "");
+  if (append && state.cursor) q.set("cursor", state.cursor);
+
+  const page = await (await api(`/blob?${q}`)).json();
+  state.cursor = page.next_cursor ?? "";
+  $("more").hidden = !page.has_more;
+
+  const rows = page.objects.map((obj) => {
+    const tr = document.createElement("tr");
+    for (const value of [
+      obj.key,
+      formatBytes(obj.size),
+      obj.content_type,
+      obj.acl || "default",
+      new Date(obj.modified_time).toLocaleString(),
+    ]) {
+      const td = document.createElement("td");
+      td.textContent = value;
+      tr.append(td);
+    }
+    tr.addEventListener("click", () => {
+      document.querySelector("tr.selected")?.classList.remove("selected");
+      tr.classList.add("selected");
+      select(obj).catch(showError);
+    });
+    return tr;
+  });
+  if (append) {
+    $("objects").append(...rows);
+  } else {
+    $("objects").replaceChildren(...rows);
+  }
+}
+
+async function select(obj) {
+  state.selected = obj;
+  const inTrash = $("search").elements.trash.checked;
+  $("detail").hidden = false;
+  $("detail-key").textContent = obj.key;
+  $("metadata").textContent = JSON.stringify(
+    { content_type: obj.content_type, size: obj.size, acl: obj.acl, metadata: obj.metadata ?? {} },
+    null,
+    2,
+  );
+  $("restore").hidden = !inTrash;
+  $("delete").textContent = inTrash ? "Delete permanently" : "Delete";
+  $("transform").hidden = inTrash;
+  $("preview").hidden = inTrash;
+  $("preview-url").hidden = inTrash;
+  if (!inTrash) {
+    await preview();
+  }
+}
+
+async function preview() {
+  const ops = $("transform").elements.ops.value.replace(/^\/+|\/+$/g, "");
+  const path = `/serve/${ops ? `${ops}/` : ""}blob/${blobPath(state.selected.key)}`;
+  const url = await signURL(path);
+  $("preview").src = url;
+  $("preview-url").href = url;
+  $("preview-url").textContent = url;
+}
+
+async function upload(event) {
+  event.preventDefault();
+  const form = event.target.elements;
+  const prefix = form.prefix.value;
+  for (const file of form.files.files) {
+    const headers = { "Content-Type": file.type || "application/octet-stream" };
+    if (form.acl.value) headers["x-acl"] = form.acl.value;
+    await api(`/blob/${blobPath(prefix + file.name)}`, { method: "PUT", headers, body: file });
+  }
+  event.target.reset();
+  await Promise.all([loadObjects(), loadStats()]);
+}
+
+async function download() {
+  const url = await signURL(`/blob/${blobPath(state.selected.key)}`);
+  window.open(url, "_blank", "noopener");
+}
+
+async function remove() {
+  const inTrash = $("search").elements.trash.checked;
+  const key = state.selected.key;
+  const message = inTrash
+    ? `Permanently delete ${key}? It can't be restored.`
+    : `Delete ${key}? It can be restored from the trash.`;
+  if (!confirm(message)) return;
+  await api(`/blob/${blobPath(key)}${inTrash ? "" : "?unlink"}`, { method: "DELETE" });
+  $("detail").hidden = true;
+  await Promise.all([loadObjects(), loadStats()]);
+}
+
+async function restore() {
+  await api(`/blob/restore/${blobPath(state.selected.key)}`, { method: "POST" });
+  $("detail").hidden = true;
+  await Promise.all([loadObjects(), loadStats()]);
+}
+
+async function signIn(key) {
+  sessionStorage.setItem(storageKey, key);
+  await loadStats();
+  $("login").hidden = true;
+  $("app").hidden = false;
+  await loadObjects();
+}
+
+function signOut() {
+  sessionStorage.removeItem(storageKey);
+  $("app").hidden = true;
+  $("detail").hidden = true;
+  $("login").hidden = false;
+}
+
+function handle(fn) {
+  return (event) => {
+    event?.preventDefault();
+    showError(null);
+    Promise.resolve(fn(event)).catch(showError);
+  };
+}
+
+$("login").addEventListener("submit", (event) => {
+  event.preventDefault();
+  $("login-error").textContent = "";
+  signIn(event.target.elements.key.value).catch((err) => {
+    signOut();
+    $("login-error").textContent = err.message;
+  });
+});
+$("logout").addEventListener("click", signOut);
+$("search").addEventListener("submit", handle(() => loadObjects()));
+$("more").addEventListener("click", handle(() => loadObjects(true)));
+$("upload").addEventListener("submit", (event) => {
+  showError(null);
+  upload(event).catch(showError);
+});
+$("transform").addEventListener("submit", handle(preview));
+$("download").addEventListener("click", handle(download));
+$("delete").addEventListener("click", handle(remove));
+$("restore").addEventListener("click", handle(restore));
+
+if (apiKey()) {
+  signIn(apiKey()).catch(signOut);
+} else {
+  signOut();
+}
@@ -0,0 +1,361 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/metrics"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// The entries of a backup archive, in the order they're written. The blobs
+// come after the index, so their checksums can be verified against their
+// records as they're restored.
+const (
+	// ManifestEntry describes the backup
+	ManifestEntry = "backup.json"
+	// IndexEntry is a dump of every key and value in the LevelDB database
+	IndexEntry = "index"
+	// BlobsDir holds the blobs under their storage keys
+	BlobsDir = "blobs/"
+	// ChecksumsEntry lists the SHA-256 digest of every blob in the format of
+	// sha256sum
+	ChecksumsEntry = "SHA256SUMS"
+)
+
+// Version is the version of the archive format
+const Version = 1
+
+const (
+	namePrefix = "backup-"
+	nameSuffix = ".tar"
+	timeFormat = "20060102T150405Z"
+)
+
+// ErrRunning is returned when a backup is started while another one runs
+var ErrRunning = errors.New("a backup is already running")
+
+// Manifest describes a backup
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	// Index is true if the archive has an IndexEntry
+	Index bool `json:"index"`
+}
+
+// Info is the result of a backup
+type Info struct {
+	Name      string        `json:"name"`
+	CreatedAt time.Time     `json:"created_at"`
+	Blobs     int           `json:"blobs"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"duration"`
+}
+
+type Config struct {
+	// Storage is where blobs are backed up from
+	Storage keyval.Storage
+	// DB is the LevelDB database of the index. It isn't backed up if it's
+	// nil, e.g. with the postgres and redis metadata drivers, which are
+	// backed up on their own.
+	DB *leveldb.DB
+	// Destination is where backups are uploaded to
+	Destination keyval.Storage
+	// Keep is how many backups are kept. Zero keeps every backup.
+	Keep int
+	// MaxAge is how long backups are kept. Zero keeps them regardless of age.
+	// The latest backup is always kept.
+	MaxAge   time.Duration
+	Registry *metrics.Registry
+	Logger   *slog.Logger
+}
+
+// Backup archives the index and blobs to object storage
+type Backup struct {
+	cfg         Config
+	running     atomic.Bool
+	lastSuccess *metrics.Gauge
+	failures    *metrics.Counter
+}
+
+func New(cfg Config) *Backup {
+	return &Backup{
+		cfg:         cfg,
+		lastSuccess: cfg.Registry.NewGauge("backup_last_success_timestamp_seconds", "When the last backup finished successfully, as a Unix timestamp"),
+		failures:    cfg.Registry.NewCounter("backup_failures_total", "Backups that failed"),
+	}
+}
+
+// RunSchedule backs up at the times of schedule until ctx is done
+func (b *Backup) RunSchedule(ctx context.Context, schedule Schedule) {
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			b.cfg.Logger.Error("backup schedule never runs")
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		info, err := b.Run(ctx)
+		if err != nil {
+			b.cfg.Logger.Error("backup failed", "error", err)
+			continue
+		}
+		b.cfg.Logger.Info("backup finished", "name", info.Name, "blobs", info.Blobs, "bytes", info.Bytes, "duration", info.Duration.String())
+	}
+}
+
+// Run creates a backup and then removes the backups that are past retention
+func (b *Backup) Run(ctx context.Context) (Info, error) {
+	if !b.running.CompareAndSwap(false, true) {
+		return Info{}, ErrRunning
+	}
+	defer b.running.Store(false)
+
+	start := time.Now().UTC()
+	info := Info{Name: namePrefix + start.Format(timeFormat) + nameSuffix, CreatedAt: start}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(b.writeArchive(ctx, pw, &info))
+	}()
+	err := b.cfg.Destination.Put(ctx, info.Name, pr, -1)
+	// Stops the archive if the upload failed
+	pr.CloseWithError(err)
+	if err != nil {
+		b.failures.Inc()
+		return Info{}, fmt.Errorf("failed to upload %s: %w", info.Name, err)
+	}
+	info.Duration = time.Since(start)
+	b.lastSuccess.Set(float64(time.Now().Unix()))
+
+	if err := b.Prune(ctx); err != nil {
+		b.cfg.Logger.Error("failed to remove old backups", "error", err)
+	}
+	return info, nil
+}
+
+// List returns the names of the backups in Destination, latest first
+func (b *Backup) List(ctx context.Context) ([]string, error) {
+	var names []string
+	err := b.cfg.Destination.List(ctx, namePrefix, func(obj keyval.ObjectInfo) error {
+		if _, ok := backupTime(obj.Key); ok {
+			names = append(names, obj.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The names sort by the time they were created
+	slices.Sort(names)
+	slices.Reverse(names)
+	return names, nil
+}
+
+// Open opens the backup called name in Destination for reading. "latest" is
+// the latest backup.
+func (b *Backup) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if name == "latest" {
+		names, err := b.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, errors.New("there are no backups")
+		}
+		name = names[0]
+	}
+	b.cfg.Logger.Info("restoring backup", "name", name)
+	r, _, err := b.cfg.Destination.Get(ctx, name)
+	if errors.Is(err, keyval.ErrNotFound) {
+		return nil, fmt.Errorf("backup %s doesn't exist", name)
+	}
+	return r, err
+}
+
+// Prune removes the backups that are past Keep or MaxAge
+func (b *Backup) Prune(ctx context.Context) error {
+	names, err := b.List(ctx)
+	if err != nil {
+		return err
+	}
+	for i, name := range names {
+		if i == 0 {
+			continue
+		}
+		createdAt, _ := backupTime(name)
+		if (b.cfg.Keep > 0 && i >= b.cfg.Keep) || (b.cfg.MaxAge > 0 && time.Since(createdAt) > b.cfg.MaxAge) {
+			if err := b.cfg.Destination.Delete(ctx, name); err != nil {
+				return err
+			}
+			b.cfg.Logger.Info("removed old backup", "name", name)
+		}
+	}
+	return nil
+}
+
+func backupTime(name string) (time.Time, bool) {
+	ts, ok := strings.CutPrefix(name, namePrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	ts, ok = strings.CutSuffix(ts, nameSuffix)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(timeFormat, ts)
+	return t, err == nil
+}
+
+// writeArchive writes a backup to w
+func (b *Backup) writeArchive(ctx context.Context, w io.Writer, info *Info) error {
+	tw := tar.NewWriter(w)
+	manifest, err := json.Marshal(Manifest{Version: Version, CreatedAt: info.CreatedAt, Index: b.cfg.DB != nil})
+	if err != nil {
+		return err
+	}
+	if err := writeEntry(tw, ManifestEntry, info.CreatedAt, int64(len(manifest)), strings.NewReader(string(manifest))); err != nil {
+		return err
+	}
+
+	if b.cfg.DB != nil {
+		if err := b.writeIndex(tw, info.CreatedAt); err != nil {
+			return fmt.Errorf("failed to back up the index: %w", err)
+		}
+	}
+
+	// The checksums are spooled to disk, there's one line per blob
+	checksums, err := os.CreateTemp("", "backup-checksums-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(checksums.Name())
+	defer checksums.Close()
+	err = b.cfg.Storage.List(ctx, "", func(obj keyval.ObjectInfo) error {
+		r, stat, err := b.cfg.Storage.Get(ctx, obj.Key)
+		if errors.Is(err, keyval.ErrNotFound) {
+			// Deleted since it was listed
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read %s: %w", obj.Key, err)
+		}
+		defer r.Close()
+		if stat != nil {
+			obj = *stat
+		}
+		h := sha256.New()
+		if err := writeEntry(tw, BlobsDir+obj.Key, obj.ModifiedTime, obj.Size, io.TeeReader(r, h)); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", obj.Key, err)
+		}
+		info.Blobs++
+		info.Bytes += obj.Size
+		_, err = fmt.Fprintf(checksums, "%s  %s%s\n", hex.EncodeToString(h.Sum(nil)), BlobsDir, obj.Key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	size, err := checksums.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := checksums.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := writeEntry(tw, ChecksumsEntry, time.Now(), size, checksums); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeIndex writes a dump of a snapshot of the database. Each key and value
+// is written as its length as a uvarint followed by its bytes.
+func (b *Backup) writeIndex(tw *tar.Writer, modTime time.Time) error {
+	snapshot, err := b.cfg.DB.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+
+	// The size of the entry has to be known before it's written
+	dump, err := os.CreateTemp("", "backup-index-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dump.Name())
+	defer dump.Close()
+	iter := snapshot.NewIterator(nil, nil)
+	var size int64
+	for iter.Next() {
+		n, err := writeRecord(dump, iter.Key(), iter.Value())
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		size += n
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if _, err := dump.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return writeEntry(tw, IndexEntry, modTime, size, dump)
+}
+
+func writeRecord(w io.Writer, key, value []byte) (int64, error) {
+	var written int64
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, b := range [][]byte{key, value} {
+		n := binary.PutUvarint(buf, uint64(len(b)))
+		if _, err := w.Write(buf[:n]); err != nil {
+			return 0, err
+		}
+		if _, err := w.Write(b); err != nil {
+			return 0, err
+		}
+		written += int64(n + len(b))
+	}
+	return written, nil
+}
+
+func writeEntry(tw *tar.Writer, name string, modTime time.Time, size int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	n, err := io.CopyN(tw, r, size)
+	if err == io.EOF {
+		return fmt.Errorf("%s changed while it was backed up, expected %d bytes but read %d", name, size, n)
+	}
+	return err
+}
@@ -0,0 +1,243 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// restoreBatchSize is how many records are written to the index at a time
+const restoreBatchSize = 1000
+
+// errNotEmpty stops listing a storage backend at its first blob
+var errNotEmpty = errors.New("not empty")
+
+type RestoreConfig struct {
+	// Storage is where blobs are restored to
+	Storage keyval.Storage
+	// DB is the LevelDB database the index is restored to. The index isn't
+	// restored if it's nil.
+	DB *leveldb.DB
+	// Force restores into a database or storage backend that isn't empty,
+	// replacing the keys and blobs in the backup
+	Force  bool
+	Logger *slog.Logger
+}
+
+// RestoreInfo is the result of a restore
+type RestoreInfo struct {
+	Manifest Manifest
+	Records  int
+	Blobs    int
+	Bytes    int64
+}
+
+// Restore restores the backup archive in r. The SHA-256 digest of every blob
+// is checked against its record in the index and against the checksums in
+// the archive. Blobs that don't match are still restored, and an error lists
+// them once every blob has been restored.
+func Restore(ctx context.Context, r io.Reader, cfg RestoreConfig) (RestoreInfo, error) {
+	var info RestoreInfo
+	if !cfg.Force {
+		if err := checkEmpty(ctx, cfg); err != nil {
+			return info, err
+		}
+	}
+
+	// The checksums of the blobs restored are compared to ChecksumsEntry at
+	// the end. They're in the same order, so they're spooled to disk instead
+	// of kept in memory.
+	checksums, err := os.CreateTemp("", "restore-checksums-*")
+	if err != nil {
+		return info, err
+	}
+	defer os.Remove(checksums.Name())
+	defer checksums.Close()
+
+	var corrupt []string
+	verified := false
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return info, fmt.Errorf("failed to read the backup: %w", err)
+		}
+
+		switch name := h.Name; {
+		case name == ManifestEntry:
+			if err := json.NewDecoder(tr).Decode(&info.Manifest); err != nil {
+				return info, fmt.Errorf("invalid %s: %w", ManifestEntry, err)
+			}
+			if info.Manifest.Version > Version {
+				return info, fmt.Errorf("the backup is version %d, this build can only restore version %d", info.Manifest.Version, Version)
+			}
+		case name == IndexEntry:
+			if cfg.DB == nil {
+				cfg.Logger.Warn("skipping the index, the metadata driver isn't leveldb")
+				continue
+			}
+			n, err := restoreIndex(cfg.DB, tr)
+			if err != nil {
+				return info, fmt.Errorf("failed to restore the index: %w", err)
+			}
+			info.Records = n
+			cfg.Logger.Info("restored the index", "records", n)
+		case strings.HasPrefix(name, BlobsDir):
+			key := strings.TrimPrefix(name, BlobsDir)
+			hash := sha256.New()
+			if err := cfg.Storage.Put(ctx, key, io.TeeReader(tr, hash), h.Size); err != nil {
+				return info, fmt.Errorf("failed to restore %s: %w", key, err)
+			}
+			sum := hex.EncodeToString(hash.Sum(nil))
+			if expected := recordChecksum(cfg.DB, key); expected != "" && expected != sum {
+				corrupt = append(corrupt, key)
+			}
+			if _, err := fmt.Fprintf(checksums, "%s  %s\n", sum, name); err != nil {
+				return info, err
+			}
+			info.Blobs++
+			info.Bytes += h.Size
+			if info.Blobs%1000 == 0 {
+				cfg.Logger.Info("restoring blobs", "blobs", info.Blobs, "bytes", info.Bytes)
+			}
+		case name == ChecksumsEntry:
+			if _, err := checksums.Seek(0, io.SeekStart); err != nil {
+				return info, err
+			}
+			mismatched, err := compareChecksums(tr, checksums)
+			if err != nil {
+				return info, fmt.Errorf("invalid %s: %w", ChecksumsEntry, err)
+			}
+			corrupt = append(corrupt, mismatched...)
+			verified = true
+		default:
+			cfg.Logger.Warn("skipping unknown entry in the backup", "name", name)
+		}
+	}
+
+	if info.Manifest.Version == 0 {
+		return info, fmt.Errorf("not a backup, %s is missing", ManifestEntry)
+	}
+	if !verified {
+		return info, fmt.Errorf("the backup is incomplete, %s is missing", ChecksumsEntry)
+	}
+	if len(corrupt) > 0 {
+		return info, fmt.Errorf("%d blobs don't match their checksums: %s", len(corrupt), strings.Join(corrupt, ", "))
+	}
+	return info, nil
+}
+
+// checkEmpty returns an error if the database or storage has anything in it
+func checkEmpty(ctx context.Context, cfg RestoreConfig) error {
+	if cfg.DB != nil {
+		iter := cfg.DB.NewIterator(nil, nil)
+		hasKeys := iter.Next()
+		iter.Release()
+		if hasKeys {
+			return errors.New("the index isn't empty, restore into a fresh volume or force it to replace its keys")
+		}
+	}
+	err := cfg.Storage.List(ctx, "", func(keyval.ObjectInfo) error {
+		return errNotEmpty
+	})
+	if errors.Is(err, errNotEmpty) {
+		return errors.New("the storage isn't empty, restore into a fresh volume or force it to replace its blobs")
+	}
+	return err
+}
+
+// restoreIndex writes the keys and values dumped by writeIndex to db
+func restoreIndex(db *leveldb.DB, r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	batch := new(leveldb.Batch)
+	n := 0
+	for {
+		key, err := readRecord(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return n, err
+		}
+		value, err := readRecord(br)
+		if err != nil {
+			return n, io.ErrUnexpectedEOF
+		}
+		batch.Put(key, value)
+		n++
+		if batch.Len() == restoreBatchSize {
+			if err := db.Write(batch, nil); err != nil {
+				return n, err
+			}
+			batch.Reset()
+		}
+	}
+	return n, db.Write(batch, nil)
+}
+
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// recordChecksum returns the SHA-256 digest of key's blob in its record, if
+// the index was restored and has it
+func recordChecksum(db *leveldb.DB, key string) string {
+	if db == nil {
+		return ""
+	}
+	data, err := db.Get([]byte(key), nil)
+	if err != nil || len(data) == 0 || data[0] != '{' {
+		return ""
+	}
+	var rec keyval.Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return ""
+	}
+	return rec.SHA256
+}
+
+// compareChecksums returns the blobs whose checksums in expected and actual
+// differ. Both list the blobs in the order they're in the archive.
+func compareChecksums(expected, actual io.Reader) ([]string, error) {
+	var mismatched []string
+	exp := bufio.NewScanner(expected)
+	act := bufio.NewScanner(actual)
+	for exp.Scan() {
+		sum, name, ok := strings.Cut(exp.Text(), "  ")
+		if !ok {
+			return nil, fmt.Errorf("invalid line %q", exp.Text())
+		}
+		if !act.Scan() {
+			// The blob is listed but isn't in the archive
+			mismatched = append(mismatched, strings.TrimPrefix(name, BlobsDir))
+			continue
+		}
+		if act.Text() != sum+"  "+name {
+			mismatched = append(mismatched, strings.TrimPrefix(name, BlobsDir))
+		}
+	}
+	if err := exp.Err(); err != nil {
+		return nil, err
+	}
+	return mismatched, act.Err()
+}
@@ -0,0 +1,16 @@
+package grpcapi
+
+import (
+	"log/slog"
+
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+type Config struct {
+	KeyVal *keyval.KeyVal
+	// APIKeys authorize calls with the x-api-key metadata
+	APIKeys    mw.Keys
+	SignSecret string
+	Logger     *slog.Logger
+}
@@ -0,0 +1,348 @@
+//go:build grpc
+
+package grpcapi
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+	imagesv1 "github.com/jaredLunde/railway-image-service/proto/images/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Supported is true when the service is built with the grpc tag
+const Supported = true
+
+// chunkSize is how much of a file each message of Get has
+const chunkSize = 64 << 10
+
+// methodScopes are the scopes an API key needs to call each method
+var methodScopes = map[string]mw.Scope{
+	imagesv1.ImageService_Upload_FullMethodName:  mw.ScopeWrite,
+	imagesv1.ImageService_Get_FullMethodName:     mw.ScopeRead,
+	imagesv1.ImageService_Delete_FullMethodName:  mw.ScopeDelete,
+	imagesv1.ImageService_List_FullMethodName:    mw.ScopeRead,
+	imagesv1.ImageService_SignURL_FullMethodName: mw.ScopeSign,
+}
+
+type tenantKey struct{}
+
+// Server serves the blob storage and signing APIs over gRPC
+type Server struct {
+	imagesv1.UnimplementedImageServiceServer
+	kv         *keyval.KeyVal
+	keys       mw.Keys
+	signSecret string
+	log        *slog.Logger
+	grpc       *grpc.Server
+}
+
+func New(cfg Config) (*Server, error) {
+	s := &Server{
+		kv:         cfg.KeyVal,
+		keys:       cfg.APIKeys,
+		signSecret: cfg.SignSecret,
+		log:        cfg.Logger,
+	}
+	s.grpc = grpc.NewServer(
+		grpc.UnaryInterceptor(s.authorizeUnary),
+		grpc.StreamInterceptor(s.authorizeStream),
+	)
+	imagesv1.RegisterImageServiceServer(s.grpc, s)
+	return s, nil
+}
+
+// Serve accepts connections on lis until Stop is called
+func (s *Server) Serve(lis net.Listener) error {
+	return s.grpc.Serve(lis)
+}
+
+// Stop stops accepting connections and waits for calls in progress to finish
+func (s *Server) Stop() {
+	s.grpc.GracefulStop()
+}
+
+// Upload implements imagesv1.ImageServiceServer interface
+func (s *Server) Upload(stream imagesv1.ImageService_UploadServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	header := req.GetHeader()
+	if header == nil || header.Key == "" || header.Size <= 0 {
+		return status.Error(codes.InvalidArgument, "the first message must be a header with a key and size")
+	}
+	opts := keyval.WriteOptions{SHA256: header.Sha256, ACL: header.Acl}
+	for name, value := range header.Metadata {
+		if opts.Metadata == nil {
+			opts.Metadata = map[string]string{}
+		}
+		// Names are case-insensitive like the x-meta-* headers they're read
+		// from over HTTP
+		opts.Metadata[strings.ToLower(name)] = value
+	}
+	if header.ExpireAfter != nil {
+		opts.ExpiresAt = time.Now().Add(header.ExpireAfter.AsDuration())
+	}
+
+	ctx := stream.Context()
+	key := []byte(namespace(ctx) + header.Key)
+	if !s.kv.LockKey(key) {
+		return status.Error(codes.Aborted, "the key is being written to")
+	}
+	defer s.kv.UnlockKey(key)
+	if code := s.kv.Write(ctx, key, &uploadReader{stream: stream}, int(header.Size), opts); code != http.StatusCreated {
+		return statusError(code)
+	}
+	return stream.SendAndClose(newObject(header.Key, s.kv.GetRecord(key)))
+}
+
+// Get implements imagesv1.ImageServiceServer interface
+func (s *Server) Get(req *imagesv1.GetRequest, stream imagesv1.ImageService_GetServer) error {
+	ctx := stream.Context()
+	key := namespace(ctx) + req.Key
+	rec := s.kv.GetRecord([]byte(key))
+	if req.Key == "" || rec.Deleted != keyval.NO || rec.Expired() {
+		return status.Error(codes.NotFound, "not found")
+	}
+	r, _, err := s.kv.Storage().Get(ctx, rec.StorageKey(key))
+	if errors.Is(err, keyval.ErrNotFound) {
+		return status.Error(codes.NotFound, "not found")
+	} else if err != nil {
+		s.log.Error("failed to get blob", "error", err)
+		return status.Error(codes.Internal, "failed to get blob")
+	}
+	defer r.Close()
+
+	if err := stream.Send(&imagesv1.GetResponse{Data: &imagesv1.GetResponse_Object{Object: newObject(req.Key, rec)}}); err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&imagesv1.GetResponse{Data: &imagesv1.GetResponse_Chunk{Chunk: buf[:n]}}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			s.log.Error("failed to read blob", "error", err)
+			return status.Error(codes.Internal, "failed to read blob")
+		}
+	}
+}
+
+// Delete implements imagesv1.ImageServiceServer interface
+func (s *Server) Delete(ctx context.Context, req *imagesv1.DeleteRequest) (*imagesv1.DeleteResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.NotFound, "not found")
+	}
+	key := []byte(namespace(ctx) + req.Key)
+	if !s.kv.LockKey(key) {
+		return nil, status.Error(codes.Aborted, "the key is being written to")
+	}
+	defer s.kv.UnlockKey(key)
+	if code := s.kv.Delete(ctx, key, req.Unlink); code != http.StatusNoContent {
+		return nil, statusError(code)
+	}
+	return &imagesv1.DeleteResponse{}, nil
+}
+
+// List implements imagesv1.ImageServiceServer interface
+func (s *Server) List(ctx context.Context, req *imagesv1.ListRequest) (*imagesv1.ListResponse, error) {
+	start := ""
+	if req.Cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(req.Cursor)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid cursor")
+		}
+		start = string(decoded)
+	}
+	objects, next, err := s.kv.List(keyval.ListOptions{
+		Namespace:  namespace(ctx),
+		Prefix:     req.Prefix,
+		Glob:       req.Glob,
+		StartingAt: start,
+		Limit:      int(req.Limit),
+		Unlinked:   req.Unlinked,
+	})
+	if errors.Is(err, keyval.ErrInvalidGlob) {
+		return nil, status.Error(codes.InvalidArgument, "invalid glob")
+	} else if err != nil {
+		s.log.Error("failed to iterate records", "error", err)
+		return nil, status.Error(codes.Internal, "failed to list")
+	}
+
+	res := &imagesv1.ListResponse{HasMore: next != ""}
+	if next != "" {
+		res.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(next))
+	}
+	for _, obj := range objects {
+		res.Objects = append(res.Objects, &imagesv1.Object{
+			Key:          obj.Key,
+			Size:         obj.Size,
+			ContentType:  obj.ContentType,
+			ModifiedTime: timestamppb.New(obj.ModifiedTime),
+			Metadata:     obj.Metadata,
+			Acl:          obj.ACL,
+			Placeholder:  obj.Placeholder,
+		})
+	}
+	return res, nil
+}
+
+// SignURL implements imagesv1.ImageServiceServer interface
+func (s *Server) SignURL(ctx context.Context, req *imagesv1.SignURLRequest) (*imagesv1.SignURLResponse, error) {
+	opts := sign.Options{ExpireAt: time.Now().Add(time.Hour), SingleUse: req.SingleUse, IP: req.Ip}
+	if req.ExpiresIn != nil {
+		d := req.ExpiresIn.AsDuration()
+		if d <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "invalid expires_in")
+		}
+		opts.ExpireAt = time.Now().Add(d)
+		opts.ExpireServe = true
+	}
+	u, err := url.Parse(req.Path)
+	if err != nil || !strings.HasPrefix(u.Path, "/") || u.Host != "" {
+		return nil, status.Error(codes.InvalidArgument, "invalid path")
+	}
+	secret := s.signSecret
+	if tenant := tenant(ctx); tenant != "" {
+		q := u.Query()
+		q.Set("x-tenant", tenant)
+		u.RawQuery = q.Encode()
+		secret = sign.TenantSecret(s.signSecret, tenant)
+	}
+	uri, err := sign.SignURLWithOptions(u, secret, opts)
+	if errors.Is(err, sign.ErrInvalidIP) {
+		return nil, status.Error(codes.InvalidArgument, "invalid ip")
+	} else if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid path")
+	}
+	return &imagesv1.SignURLResponse{Url: *uri}, nil
+}
+
+// authorize checks the API key in the x-api-key metadata of a call has the
+// scope the method needs, and returns ctx with the key's tenant
+func (s *Server) authorize(ctx context.Context, method string) (context.Context, error) {
+	var key string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("x-api-key"); len(v) > 0 {
+			key = v[0]
+		}
+	}
+	apiKey, ok := s.keys.Find(key)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	if scope, ok := methodScopes[method]; !ok || !apiKey.Scopes.Has(scope) {
+		return nil, status.Error(codes.PermissionDenied, "forbidden")
+	}
+	return context.WithValue(ctx, tenantKey{}, apiKey.Tenant), nil
+}
+
+func (s *Server) authorizeUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) authorizeStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authorize(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authorizedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authorizedStream is a stream with the context of its authorized call
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+func tenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// namespace returns the prefix of the keys the caller can reach
+func namespace(ctx context.Context) string {
+	if tenant := tenant(ctx); tenant != "" {
+		return tenant + "/"
+	}
+	return ""
+}
+
+// uploadReader reads the chunks of an Upload stream
+type uploadReader struct {
+	stream imagesv1.ImageService_UploadServer
+	buf    []byte
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		req, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = req.GetChunk()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func newObject(key string, rec keyval.Record) *imagesv1.Object {
+	return &imagesv1.Object{
+		Key:          key,
+		Size:         rec.Size,
+		ContentType:  rec.ContentType,
+		ModifiedTime: timestamppb.New(rec.ModifiedTime),
+		Metadata:     rec.Metadata,
+		Acl:          rec.ACL,
+		Placeholder:  rec.Placeholder,
+	}
+}
+
+// statusError converts the HTTP status code of a blob operation to a gRPC
+// status
+func statusError(code int) error {
+	msg := strings.ToLower(http.StatusText(code))
+	switch code {
+	case http.StatusBadRequest, http.StatusUnsupportedMediaType, http.StatusLengthRequired:
+		return status.Error(codes.InvalidArgument, msg)
+	case http.StatusForbidden:
+		return status.Error(codes.PermissionDenied, msg)
+	case http.StatusNotFound:
+		return status.Error(codes.NotFound, msg)
+	case http.StatusConflict:
+		return status.Error(codes.Aborted, msg)
+	case http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage:
+		return status.Error(codes.ResourceExhausted, msg)
+	}
+	return status.Error(codes.Internal, msg)
+}
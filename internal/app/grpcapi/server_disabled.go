@@ -0,0 +1,26 @@
+//go:build !grpc
+
+package grpcapi
+
+import (
+	"errors"
+	"net"
+)
+
+// Supported is true when the service is built with the grpc tag
+const Supported = false
+
+// Server serves the blob storage and signing APIs over gRPC
+type Server struct{}
+
+func New(Config) (*Server, error) {
+	return nil, errors.New("gRPC isn't supported by this build, build it with -tags grpc")
+}
+
+// Serve accepts connections on lis until Stop is called
+func (s *Server) Serve(net.Listener) error {
+	return nil
+}
+
+// Stop stops accepting connections and waits for calls in progress to finish
+func (s *Server) Stop() {}
@@ -1,141 +1,105 @@
 package imagor
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
-	"regexp"
 	"strings"
 
 	"github.com/cshum/imagor"
-	"github.com/cshum/imagor/imagorpath"
 	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
 )
 
-var dotFileRegex = regexp.MustCompile(`/.`)
-
-// BlobStorage File Storage implements imagor.Storage interface
+// BlobStorage Blob Storage implements imagor.Storage interface
 type BlobStorage struct {
-	KV              *keyval.KeyVal
-	PathPrefix      string
-	Blacklists      []*regexp.Regexp
-	MkdirPermission os.FileMode
-	WritePermission os.FileMode
-	SaveErrIfExists bool
-	SafeChars       string
-
-	safeChars imagorpath.SafeChars
+	KV *keyval.KeyVal
 }
 
-// New creates FileStorage
-func NewBlobStorage(kv *keyval.KeyVal, uploadPath string) *BlobStorage {
-	s := &BlobStorage{
-		KV:              kv,
-		Blacklists:      []*regexp.Regexp{dotFileRegex},
-		MkdirPermission: 0755,
-		WritePermission: 0666,
-		PathPrefix:      uploadPath,
-	}
-	s.safeChars = imagorpath.NewSafeChars(s.SafeChars)
-	return s
+// New creates BlobStorage
+func NewBlobStorage(kv *keyval.KeyVal) *BlobStorage {
+	return &BlobStorage{KV: kv}
 }
 
-// Path transforms and validates image key for storage path
-func (s *BlobStorage) Path(image string) (string, bool) {
-	key := []byte(image)
-	if strings.HasPrefix(image, "/") {
-		key = []byte(image[1:])
-	}
-	if !bytes.HasPrefix(key, []byte("blob/")) {
+// Key transforms and validates image key for blob storage
+func (s *BlobStorage) Key(image string) (string, bool) {
+	key := strings.TrimPrefix(image, "/")
+	if !strings.HasPrefix(key, "blob/") {
 		return "", false
 	}
-	key = bytes.TrimPrefix(key, []byte("blob/"))
-	if s.KV.GetRecord(key).Deleted != keyval.NO {
+	key = strings.TrimPrefix(key, "blob/")
+	if s.KV.GetRecord([]byte(key)).Deleted != keyval.NO {
 		return "", false
 	}
-	return filepath.Join(s.PathPrefix, keyval.KeyToPath(key)), true
+	return key, true
 }
 
 // Get implements imagor.Storage interface
-func (s *BlobStorage) Get(_ *http.Request, image string) (*imagor.Blob, error) {
-	image, ok := s.Path(image)
+func (s *BlobStorage) Get(r *http.Request, image string) (*imagor.Blob, error) {
+	// Another tenant's blobs are as good as missing
+	if !tenantAllows(r.Context(), image) {
+		return nil, imagor.ErrNotFound
+	}
+	key, ok := s.Key(image)
 	if !ok {
 		return nil, imagor.ErrInvalid
 	}
-	f := imagor.NewBlobFromFile(image, func(stat os.FileInfo) error {
-		return nil
-	})
-	return f, nil
+	ctx := r.Context()
+	return imagor.NewBlob(func() (io.ReadCloser, int64, error) {
+		reader, info, err := s.KV.Storage().Get(ctx, s.KV.GetRecord([]byte(key)).StorageKey(key))
+		if err != nil {
+			if errors.Is(err, keyval.ErrNotFound) {
+				return nil, 0, imagor.ErrNotFound
+			}
+			return nil, 0, err
+		}
+		return reader, info.Size, nil
+	}), nil
 }
 
 // Put implements imagor.Storage interface
-func (s *BlobStorage) Put(_ context.Context, image string, blob *imagor.Blob) (err error) {
-	image, ok := s.Path(image)
+func (s *BlobStorage) Put(ctx context.Context, image string, blob *imagor.Blob) error {
+	key, ok := s.Key(image)
 	if !ok {
 		return imagor.ErrInvalid
 	}
-	if err = os.MkdirAll(filepath.Dir(image), s.MkdirPermission); err != nil {
-		return
-	}
-	reader, _, err := blob.NewReader()
+	reader, size, err := blob.NewReader()
 	if err != nil {
 		return err
 	}
 	defer func() {
 		_ = reader.Close()
 	}()
-	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
-	if s.SaveErrIfExists {
-		flag = os.O_RDWR | os.O_CREATE | os.O_EXCL
-	}
-	w, err := os.OpenFile(image, flag, s.WritePermission)
-	if err != nil {
-		return
-	}
-	defer func() {
-		_ = w.Close()
-		if err != nil {
-			_ = os.Remove(w.Name())
-		}
-	}()
-	if _, err = io.Copy(w, reader); err != nil {
-		return
-	}
-	if err = w.Sync(); err != nil {
-		return
-	}
-	return
+	return s.KV.Storage().Put(ctx, key, reader, size)
 }
 
 // Delete implements imagor.Storage interface
-func (s *BlobStorage) Delete(_ context.Context, image string) error {
-	image, ok := s.Path(image)
+func (s *BlobStorage) Delete(ctx context.Context, image string) error {
+	key, ok := s.Key(image)
 	if !ok {
 		return imagor.ErrInvalid
 	}
-	return os.Remove(image)
+	return s.KV.Storage().Delete(ctx, key)
 }
 
 // Stat implements imagor.Storage interface
-func (s *BlobStorage) Stat(_ context.Context, image string) (stat *imagor.Stat, err error) {
-	image, ok := s.Path(image)
+func (s *BlobStorage) Stat(ctx context.Context, image string) (*imagor.Stat, error) {
+	if !tenantAllows(ctx, image) {
+		return nil, imagor.ErrNotFound
+	}
+	key, ok := s.Key(image)
 	if !ok {
 		return nil, imagor.ErrInvalid
 	}
-	osStat, err := os.Stat(image)
+	info, err := s.KV.Storage().Stat(ctx, s.KV.GetRecord([]byte(key)).StorageKey(key))
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, keyval.ErrNotFound) {
 			return nil, imagor.ErrNotFound
 		}
 		return nil, err
 	}
-	size := osStat.Size()
-	modTime := osStat.ModTime()
 	return &imagor.Stat{
-		Size:         size,
-		ModifiedTime: modTime,
+		Size:         info.Size,
+		ModifiedTime: info.ModifiedTime,
 	}, nil
 }
@@ -0,0 +1,75 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"net/http"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/blurhash"
+)
+
+// BlurHashPrefix is what the /serve paths of BlurHashes start with, e.g.
+// /blurhash/{key}
+const BlurHashPrefix = "/blurhash/"
+
+const (
+	// blurHashSampleSize is the size of the thumbnail BlurHashes are
+	// computed from. They're too blurry for more pixels to matter.
+	blurHashSampleSize = 32
+	// blurHashComponentsX and blurHashComponentsY are how much detail
+	// BlurHashes keep across and down
+	blurHashComponentsX = 4
+	blurHashComponentsY = 3
+)
+
+// BlurHash returns the BlurHash of the blob at key. Keys of tenants are
+// prefixed with the tenant's name. BlurHashes are cached in the result
+// storage with the processed images of the blob, so they're purged with them.
+func (s *Imagor) BlurHash(ctx context.Context, key string) (string, error) {
+	image := "blob/" + key
+	cacheKey := sourcePrefix(image) + "blurhash"
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "", nil)
+	if err != nil {
+		return "", err
+	}
+	if blob, err := s.resultStorage.Get(r, cacheKey); err == nil {
+		if buf, err := blob.ReadAll(); err == nil && len(buf) > 0 {
+			return string(buf), nil
+		}
+	}
+
+	sample, err := s.Serve(ctx, imagorpath.Params{
+		Image:   image,
+		FitIn:   true,
+		Width:   blurHashSampleSize,
+		Height:  blurHashSampleSize,
+		Filters: imagorpath.Filters{{Name: "format", Args: "png"}},
+	})
+	if err != nil {
+		return "", err
+	}
+	buf, err := sample.ReadAll()
+	if err != nil {
+		return "", err
+	}
+	img, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return "", err
+	}
+	hash, err := blurhash.Encode(img, blurHashComponentsX, blurHashComponentsY)
+	if err != nil {
+		return "", err
+	}
+	if err := s.resultStorage.Put(ctx, cacheKey, i.NewBlobFromBytes([]byte(hash))); err != nil {
+		s.log.Error("failed to cache blurhash", "key", key, "error", err)
+	}
+	return hash, nil
+}
+
+// ErrorStatus returns the status code imagor responds to err with
+func ErrorStatus(err error) int {
+	return i.WrapError(err).Code
+}
@@ -0,0 +1,191 @@
+package imagor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SourcePolicy is how images are fetched from HTTP sources that fail
+type SourcePolicy struct {
+	// Retries is how many times a fetch that fails with a network error or a
+	// 429, 502, 503 or 504 is retried
+	Retries int
+	// RetryBackoff is how long to wait before the first retry. It doubles
+	// after every retry.
+	RetryBackoff time.Duration
+	// BreakerFailures is how many fetches from a host can fail in a row
+	// before it isn't fetched from for BreakerCooldown. Zero never stops
+	// fetching.
+	BreakerFailures int
+	// BreakerCooldown is how long the images of a failing host fail right
+	// away with 503 Service Unavailable
+	BreakerCooldown time.Duration
+}
+
+// sourceTransport retries the requests to HTTP sources and stops sending
+// them to hosts that keep failing, so a flaky source doesn't hold on to the
+// images being processed until they time out
+type sourceTransport struct {
+	http.RoundTripper
+	policy SourcePolicy
+	hosts  *breakers
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t *sourceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.hosts.allow(req.URL.Host) {
+		return unavailable(req), nil
+	}
+	backoff := t.policy.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		res, err := t.RoundTripper.RoundTrip(req)
+		if !failed(res, err) {
+			t.hosts.succeeded(req.URL.Host)
+			return res, err
+		}
+		if req.Context().Err() != nil {
+			// The request was canceled, it's not the host that failed
+			t.hosts.canceled(req.URL.Host)
+			return res, err
+		}
+		// Requests with a body can't be sent again
+		if attempt >= t.policy.Retries || req.Body != nil && req.Body != http.NoBody {
+			t.hosts.failed(req.URL.Host)
+			return res, err
+		}
+		if res != nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+			res.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			t.hosts.canceled(req.URL.Host)
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// failed returns true if a response is worth retrying
+func failed(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// unavailable is the response to requests to a host whose breaker is open
+func unavailable(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "503 Service Unavailable",
+		StatusCode: http.StatusServiceUnavailable,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+// breakers are the circuit breakers of the hosts of HTTP sources
+type breakers struct {
+	failures int
+	cooldown time.Duration
+	log      *slog.Logger
+	mu       sync.Mutex
+	hosts    map[string]*breaker
+}
+
+type breaker struct {
+	failures  int
+	openUntil time.Time
+	// probing is set while a single request checks whether the host
+	// recovered after the cooldown
+	probing bool
+}
+
+func newBreakers(failures int, cooldown time.Duration, log *slog.Logger) *breakers {
+	return &breakers{
+		failures: failures,
+		cooldown: cooldown,
+		log:      log,
+		hosts:    map[string]*breaker{},
+	}
+}
+
+// allow returns false while the breaker of host is open
+func (b *breakers) allow(host string) bool {
+	if b.failures <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h, ok := b.hosts[host]
+	if !ok || h.failures < b.failures {
+		return true
+	}
+	if h.probing || time.Now().Before(h.openUntil) {
+		return false
+	}
+	h.probing = true
+	return true
+}
+
+func (b *breakers) succeeded(host string) {
+	if b.failures <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if h, ok := b.hosts[host]; ok {
+		if h.failures >= b.failures {
+			b.log.Info("closed the circuit breaker of an HTTP source", "host", host)
+		}
+		delete(b.hosts, host)
+	}
+}
+
+func (b *breakers) failed(host string) {
+	if b.failures <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h, ok := b.hosts[host]
+	if !ok {
+		h = &breaker{}
+		b.hosts[host] = h
+	}
+	h.failures++
+	h.probing = false
+	if h.failures >= b.failures {
+		if h.failures == b.failures {
+			b.log.Warn("opened the circuit breaker of an HTTP source", "host", host, "cooldown", b.cooldown)
+		}
+		h.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// canceled lets another request check whether host recovered if the one that
+// was checking it was canceled
+func (b *breakers) canceled(host string) {
+	if b.failures <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if h, ok := b.hosts[host]; ok {
+		h.probing = false
+	}
+}
@@ -0,0 +1,29 @@
+package imagor
+
+import (
+	"github.com/cshum/imagor/vips"
+)
+
+// VipsStats is how much memory and how many files libvips is using
+type VipsStats struct {
+	// Mem is the memory libvips has allocated, in bytes
+	Mem int64 `json:"mem"`
+	// MemHigh is the most memory libvips has had allocated at once
+	MemHigh int64 `json:"mem_high"`
+	// Allocs is the number of allocations libvips is holding
+	Allocs int64 `json:"allocs"`
+	// Files is the number of files libvips has open
+	Files int64 `json:"files"`
+}
+
+// ReadVipsStats reads the memory stats libvips tracks
+func ReadVipsStats() VipsStats {
+	var stats vips.MemoryStats
+	vips.ReadVipsMemStats(&stats)
+	return VipsStats{
+		Mem:     stats.Mem,
+		MemHigh: stats.MemHigh,
+		Allocs:  stats.Allocs,
+		Files:   stats.Files,
+	}
+}
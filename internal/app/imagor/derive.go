@@ -0,0 +1,51 @@
+package imagor
+
+import (
+	"time"
+)
+
+// Deriver renders presets of blobs into the result cache right after they're
+// uploaded, so the first page views don't wait for them to be processed. It
+// implements the keyval.Deriver interface.
+type Deriver struct {
+	imagor  *Imagor
+	presets func() Presets
+}
+
+// NewDeriver returns a Deriver that renders the presets returned by presets,
+// which can change when the config is reloaded
+func NewDeriver(s *Imagor, presets func() Presets) *Deriver {
+	return &Deriver{imagor: s, presets: presets}
+}
+
+// HasPreset implements keyval.Deriver interface
+func (d *Deriver) HasPreset(name string) bool {
+	_, ok := d.presets()[name]
+	return ok
+}
+
+// Derive implements keyval.Deriver interface. The presets are rendered by a
+// warm job, so their progress can be looked up at /serve/warm/{id}.
+func (d *Deriver) Derive(tenant, key string, names []string) string {
+	presets := d.presets()
+	job := &WarmJob{
+		ID:        newWarmJobID(),
+		Status:    WarmJobRunning,
+		CreatedAt: time.Now().UTC(),
+		tenant:    tenant,
+	}
+	for _, name := range names {
+		ops, ok := presets[name]
+		if !ok {
+			// The preset was removed since the upload started
+			continue
+		}
+		p, ok := blobParams(key, ops, tenant)
+		if !ok {
+			continue
+		}
+		job.images = append(job.images, warmImage{key: key, operation: ops, params: p})
+	}
+	job.Total = len(job.images)
+	return d.imagor.startWarm(job).ID
+}
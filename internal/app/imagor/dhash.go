@@ -0,0 +1,48 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/dhash"
+)
+
+// dHashSampleSize is the size of the thumbnail difference hashes are
+// computed from. It's stretched, so the hash doesn't depend on how the image
+// is cropped.
+const dHashSampleSize = 32
+
+// DHash returns the difference hash of the blob at key, a perceptual hash
+// near-duplicates of the image share most bits of. Keys of tenants are
+// prefixed with the tenant's name.
+func (s *Imagor) DHash(ctx context.Context, key string) (string, error) {
+	sample, err := s.Serve(ctx, imagorpath.Params{
+		Image:   "blob/" + key,
+		Stretch: true,
+		Width:   dHashSampleSize,
+		Height:  dHashSampleSize,
+		Filters: imagorpath.Filters{
+			{Name: "grayscale"},
+			{Name: "format", Args: "png"},
+			{Name: "strip_metadata"},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	buf, err := sample.ReadAll()
+	if err != nil {
+		return "", err
+	}
+	img, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return "", err
+	}
+	hash, err := dhash.Hash(img)
+	if err != nil {
+		return "", err
+	}
+	return dhash.Format(hash), nil
+}
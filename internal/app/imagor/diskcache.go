@@ -0,0 +1,221 @@
+package imagor
+
+import (
+	"container/list"
+	"context"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/storage/filestorage"
+)
+
+// diskCacheSweepInterval is how often expired images are removed from the
+// disk cache
+const diskCacheSweepInterval = time.Minute
+
+// diskCache is a result storage that keeps processed images on disk, up to
+// maxBytes of them. The least recently used images are removed to make room
+// for new ones, and expired images are removed by run.
+type diskCache struct {
+	*filestorage.FileStorage
+	dir        string
+	maxBytes   int64
+	expiration time.Duration
+	log        *slog.Logger
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	files map[string]*list.Element
+}
+
+type diskCacheFile struct {
+	path     string
+	size     int64
+	storedAt time.Time
+}
+
+// newDiskCache creates a disk cache in dir. Images already in dir are counted
+// towards maxBytes, oldest first. Zero maxBytes doesn't limit the size.
+func newDiskCache(dir string, maxBytes int64, expiration time.Duration, log *slog.Logger) *diskCache {
+	c := &diskCache{
+		FileStorage: filestorage.New(dir, filestorage.WithExpiration(expiration)),
+		dir:         dir,
+		maxBytes:    maxBytes,
+		expiration:  expiration,
+		log:         log,
+		lru:         list.New(),
+		files:       map[string]*list.Element{},
+	}
+	var existing []diskCacheFile
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			existing = append(existing, diskCacheFile{path: path, size: info.Size(), storedAt: info.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(existing, func(a, b int) bool {
+		return existing[a].storedAt.Before(existing[b].storedAt)
+	})
+	for _, f := range existing {
+		c.add(f)
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c
+}
+
+// Get implements imagor.Storage interface
+func (c *diskCache) Get(r *http.Request, key string) (*i.Blob, error) {
+	blob, err := c.FileStorage.Get(r, key)
+	if err != nil {
+		return blob, err
+	}
+	if path, ok := c.Path(key); ok {
+		c.mu.Lock()
+		if e, ok := c.files[path]; ok {
+			c.lru.MoveToFront(e)
+		}
+		c.mu.Unlock()
+	}
+	return blob, nil
+}
+
+// Put implements imagor.Storage interface
+func (c *diskCache) Put(ctx context.Context, key string, blob *i.Blob) error {
+	if err := c.FileStorage.Put(ctx, key, blob); err != nil {
+		return err
+	}
+	path, ok := c.Path(key)
+	if !ok {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	c.add(diskCacheFile{path: path, size: info.Size(), storedAt: info.ModTime()})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+	return nil
+}
+
+// Delete implements imagor.Storage interface
+func (c *diskCache) Delete(ctx context.Context, key string) error {
+	err := c.FileStorage.Delete(ctx, key)
+	if path, ok := c.Path(key); ok {
+		c.mu.Lock()
+		if e, ok := c.files[path]; ok {
+			c.forget(e)
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// DeletePrefix removes the images stored under prefix
+func (c *diskCache) DeletePrefix(ctx context.Context, prefix string) error {
+	dir, ok := c.Path(prefix)
+	if !ok {
+		return i.ErrInvalid
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	for path, e := range c.files {
+		if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			c.forget(e)
+		}
+	}
+	return nil
+}
+
+// run removes expired images every diskCacheSweepInterval until ctx is done
+func (c *diskCache) run(ctx context.Context) {
+	if c.expiration <= 0 {
+		return
+	}
+	ticker := time.NewTicker(diskCacheSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.sweep()
+		}
+	}
+}
+
+// sweep removes the images that have expired
+func (c *diskCache) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for e := c.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if f := e.Value.(*diskCacheFile); time.Since(f.storedAt) > c.expiration {
+			c.remove(e)
+			removed++
+		}
+		e = prev
+	}
+	if removed > 0 {
+		c.log.Debug("removed expired images from the result cache", "count", removed)
+	}
+}
+
+// add counts a file that was stored as the most recently used one
+func (c *diskCache) add(f diskCacheFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.files[f.path]; ok {
+		c.forget(e)
+	}
+	c.files[f.path] = c.lru.PushFront(&f)
+	c.size += f.size
+}
+
+// evict removes the least recently used files until the cache fits in
+// maxBytes. The lock must be held by the caller.
+func (c *diskCache) evict() {
+	for c.maxBytes > 0 && c.size > c.maxBytes {
+		e := c.lru.Back()
+		if e == nil {
+			return
+		}
+		c.remove(e)
+	}
+}
+
+// remove deletes a file and stops counting it. The lock must be held by the
+// caller.
+func (c *diskCache) remove(e *list.Element) {
+	f := e.Value.(*diskCacheFile)
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		c.log.Error("failed to remove image from the result cache", "error", err)
+	}
+	c.forget(e)
+}
+
+// forget stops counting a file. The lock must be held by the caller.
+func (c *diskCache) forget(e *list.Element) {
+	f := c.lru.Remove(e).(*diskCacheFile)
+	delete(c.files, f.path)
+	c.size -= f.size
+}
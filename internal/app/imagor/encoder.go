@@ -0,0 +1,28 @@
+package imagor
+
+import (
+	"context"
+	"strconv"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// encoderProcessor encodes PNGs with a default compression level, unless
+// they're processed with the compression filter. SVGs are rasterized as PNGs
+// unless they're given another format, so they stay transparent.
+type encoderProcessor struct {
+	i.Processor
+	pngCompression int
+}
+
+// Process implements imagor.Processor interface
+func (e *encoderProcessor) Process(ctx context.Context, blob *i.Blob, p imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	if blob != nil && blob.BlobType() == i.BlobTypeSVG && !hasFilter(p, "format") {
+		p.Filters = append(p.Filters, imagorpath.Filter{Name: "format", Args: "png"})
+	}
+	if e.pngCompression > 0 && !hasFilter(p, "compression") {
+		p.Filters = append(p.Filters, imagorpath.Filter{Name: "compression", Args: strconv.Itoa(e.pngCompression)})
+	}
+	return e.Processor.Process(ctx, blob, p, load)
+}
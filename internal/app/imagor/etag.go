@@ -0,0 +1,113 @@
+package imagor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+// filterBlobPattern matches the blobs the arguments of a filter load, like
+// the image of a watermark
+var filterBlobPattern = regexp.MustCompile(`(?:^|[/(,])blob/([^,()]+)`)
+
+// ETag returns a strong entity tag for the image processed at a /serve path
+// without processing it. It's the digest of the path and the hashes of every
+// blob the image is processed from, so it changes when any of them are
+// replaced. Images from URLs don't have one.
+func (s *Imagor) ETag(path string) (string, bool) {
+	key, ok := SourceKey(path)
+	if !ok {
+		return "", false
+	}
+	keys := []string{key}
+	for _, f := range imagorpath.Parse("/unsafe" + path).Filters {
+		for _, arg := range strings.Split(f.Args, ",") {
+			// Filters load their arguments URL decoded, e.g. blob%2Ffont.ttf
+			if unescaped, err := url.QueryUnescape(arg); err == nil {
+				arg = unescaped
+			}
+			for _, m := range filterBlobPattern.FindAllStringSubmatch(arg, -1) {
+				keys = append(keys, m[1])
+			}
+		}
+	}
+	h := sha256.New()
+	for _, key := range keys {
+		rec := s.kv.GetRecord([]byte(key))
+		if rec.Deleted != keyval.NO || rec.Expired() || rec.Hash == "" {
+			return "", false
+		}
+		h.Write([]byte(rec.Hash + "\n"))
+	}
+	h.Write([]byte(path))
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, true
+}
+
+// NotModified responds with 304 Not Modified if the If-None-Match header of r
+// matches etag, so clients revalidate a processed image without it being
+// loaded or processed again
+func (s *Imagor) NotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	noneMatch := r.Header.Get("If-None-Match")
+	if noneMatch == "" {
+		return false
+	}
+	match := false
+	for _, tag := range strings.Split(noneMatch, ",") {
+		// Weak comparison, so W/ prefixes added by proxies still match
+		if tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/"); tag == etag || tag == "*" {
+			match = true
+			break
+		}
+	}
+	if !match {
+		return false
+	}
+	// The same caching headers as the image itself
+	ttl, swr := int64(s.CacheHeaderTTL.Seconds()), int64(s.CacheHeaderSWR.Seconds())
+	cacheControl := fmt.Sprintf("public, s-maxage=%d, max-age=%d, no-transform", ttl, ttl)
+	if swr > 0 && swr < ttl {
+		cacheControl += fmt.Sprintf(", stale-while-revalidate=%d", swr)
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// WithETag returns a ResponseWriter that sends etag with every response that
+// isn't an error, in place of the one imagor derives from the result cache
+func WithETag(w http.ResponseWriter, etag string) http.ResponseWriter {
+	return &etagWriter{ResponseWriter: w, etag: etag}
+}
+
+type etagWriter struct {
+	http.ResponseWriter
+	etag        string
+	wroteHeader bool
+}
+
+func (w *etagWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code < http.StatusBadRequest {
+			w.Header().Set("ETag", w.etag)
+		} else {
+			w.Header().Del("ETag")
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *etagWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,43 @@
+package imagor
+
+import (
+	"context"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/events"
+)
+
+// EventImageProcessed is emitted when an image is processed. Images served
+// from the result cache aren't processed again.
+const EventImageProcessed = "image.processed"
+
+// ProcessedImage is the object of an image.processed event
+type ProcessedImage struct {
+	// Path is the processing path, e.g. 300x300/blob/gopher.png
+	Path string `json:"path"`
+	// Image is the blob key or URL the image was processed from, e.g.
+	// blob/gopher.png. Keys of tenants are prefixed with the tenant's name.
+	Image       string `json:"image"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// eventProcessor emits an event every time its processor processes an image
+type eventProcessor struct {
+	i.Processor
+	events *events.Queue
+}
+
+func (p *eventProcessor) Process(ctx context.Context, blob *i.Blob, params imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	out, err := p.Processor.Process(ctx, blob, params, load)
+	if err == nil && out != nil {
+		p.events.Push(events.New(EventImageProcessed, ProcessedImage{
+			Path:        params.Path,
+			Image:       params.Image,
+			ContentType: out.ContentType(),
+			Size:        out.Size(),
+		}), params.Image)
+	}
+	return out, err
+}
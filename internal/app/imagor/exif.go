@@ -0,0 +1,54 @@
+package imagor
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+// ExifEndpoint is the path the EXIF and XMP metadata of blobs is read at
+const ExifEndpoint = "/serve/exif/"
+
+type ExifResponse struct {
+	Exif map[string]any `json:"exif"`
+	// XMP is the XMP packet of the image, if it has one
+	XMP string `json:"xmp,omitempty"`
+}
+
+// ExifHandler responds with the EXIF and XMP metadata of a blob, which is
+// stripped from the images that are served by default, e.g.
+// GET /serve/exif/{key}
+func (s *Imagor) ExifHandler(c fiber.Ctx) error {
+	key := strings.TrimPrefix(c.Path(), ExifEndpoint)
+	if key == "" || key == c.Path() {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if tenant := mw.GetTenant(c); tenant != "" {
+		key = tenant + "/" + key
+	}
+	blob, err := s.Serve(c.Context(), imagorpath.Params{
+		Image:   "blob/" + key,
+		Meta:    true,
+		Filters: imagorpath.Filters{{Name: keepExifFilter}},
+	})
+	if err != nil {
+		status := ErrorStatus(err)
+		if status >= fiber.StatusInternalServerError {
+			s.log.Error("failed to read exif", "key", key, "error", err)
+		}
+		return c.SendStatus(status)
+	}
+	buf, err := blob.ReadAll()
+	var meta ExifResponse
+	if err == nil {
+		err = json.Unmarshal(buf, &meta)
+	}
+	if err != nil {
+		s.log.Error("failed to read exif", "key", key, "error", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(meta)
+}
@@ -0,0 +1,84 @@
+package facedetect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"time"
+)
+
+// HTTPDetector finds faces by sending images to a detection service. Images
+// are POSTed as PNGs and the service responds with the boxes of the faces in
+// pixels, e.g. {"faces":[{"x":10,"y":20,"width":50,"height":60}]}
+type HTTPDetector struct {
+	url    string
+	client *http.Client
+}
+
+// Option HTTPDetector option
+type Option func(d *HTTPDetector)
+
+// WithTimeout with how long a detection can take option
+func WithTimeout(timeout time.Duration) Option {
+	return func(d *HTTPDetector) {
+		if timeout > 0 {
+			d.client.Timeout = timeout
+		}
+	}
+}
+
+// New creates a detector that sends images to url
+func New(url string, options ...Option) *HTTPDetector {
+	d := &HTTPDetector{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+	for _, option := range options {
+		option(d)
+	}
+	return d
+}
+
+type response struct {
+	Faces []struct {
+		X      int `json:"x"`
+		Y      int `json:"y"`
+		Width  int `json:"width"`
+		Height int `json:"height"`
+	} `json:"faces"`
+}
+
+// DetectFaces returns the boxes of the faces in img
+func (d *HTTPDetector) DetectFaces(ctx context.Context, img image.Image) ([]image.Rectangle, error) {
+	var body bytes.Buffer
+	if err := png.Encode(&body, img); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "image/png")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("face detector responded with %d", resp.StatusCode)
+	}
+	var res response
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	faces := make([]image.Rectangle, 0, len(res.Faces))
+	for _, f := range res.Faces {
+		face := image.Rect(f.X, f.Y, f.X+f.Width, f.Y+f.Height).Add(bounds.Min).Intersect(bounds)
+		if !face.Empty() {
+			faces = append(faces, face)
+		}
+	}
+	return faces, nil
+}
@@ -0,0 +1,113 @@
+package imagor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// FramePrefix is what the /serve paths of video poster frames start with,
+// e.g. /frame/2s/300x200/{key}
+const FramePrefix = "/frame/"
+
+var (
+	// framePathPattern matches a /serve path of a poster frame
+	framePathPattern = regexp.MustCompile(`^/frame/(\d+(?:\.\d+)?(?:ms|s|m))/(.+)$`)
+	// frameImagePattern matches the images frames are loaded from, e.g.
+	// frame/2s/blob/{key}
+	frameImagePattern = regexp.MustCompile(`^frame/(\d+(?:\.\d+)?(?:ms|s|m))/(blob/.+)$`)
+)
+
+// frameLoader extracts poster frames from videos in blob storage with ffmpeg
+type frameLoader struct {
+	blobs  *BlobStorage
+	ffmpeg string
+}
+
+// Get implements imagor.Loader interface
+func (l *frameLoader) Get(r *http.Request, image string) (*i.Blob, error) {
+	m := frameImagePattern.FindStringSubmatch(image)
+	if m == nil {
+		return nil, i.ErrInvalid
+	}
+	at, err := time.ParseDuration(m[1])
+	if err != nil {
+		return nil, i.ErrInvalid
+	}
+	video, err := l.blobs.Get(r, m[2])
+	if err != nil {
+		return nil, err
+	}
+	reader, _, err := video.NewReader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// ffmpeg has to seek around most videos, which it can't do in a pipe
+	f, err := os.CreateTemp("", "frame-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, reader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(r.Context(), l.ffmpeg,
+		"-nostdin", "-v", "error",
+		"-ss", fmt.Sprintf("%.3f", at.Seconds()),
+		"-i", f.Name(),
+		"-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "pipe:1",
+	)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		// The video is shorter than the timestamp
+		return nil, i.ErrNotFound
+	}
+	return i.NewBlobFromBytes(stdout.Bytes()), nil
+}
+
+// ExpandFrame rewrites the /serve path of a poster frame, e.g.
+// /frame/2s/300x200/{key}, to the one imagor processes it at
+func ExpandFrame(path string) string {
+	m := framePathPattern.FindStringSubmatch(path)
+	if m == nil {
+		return path
+	}
+	p := imagorpath.Parse("/unsafe/" + m[2])
+	if p.Image == "" {
+		return path
+	}
+	if !strings.HasPrefix(p.Image, "blob/") {
+		p.Image = "blob/" + p.Image
+	}
+	p.Image = "frame/" + m[1] + "/" + p.Image
+	return "/" + imagorpath.GeneratePath(p)
+}
+
+// frameSource returns the image a poster frame is extracted from, or image
+// if it isn't a frame
+func frameSource(image string) string {
+	if m := frameImagePattern.FindStringSubmatch(image); m != nil {
+		return m[2]
+	}
+	return image
+}
@@ -0,0 +1,29 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+
+	"github.com/cshum/imagor/vips"
+)
+
+// CheckProcessing resizes a tiny image with libvips to check that it works.
+// It skips imagor, so the check isn't counted as a processed image.
+func CheckProcessing(ctx context.Context) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		return err
+	}
+	img, err := vips.LoadImageFromBuffer(buf.Bytes(), nil)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if err := img.Thumbnail(1, 1, vips.InterestingNone); err != nil {
+		return err
+	}
+	_, err = img.ExportPng(nil)
+	return err
+}
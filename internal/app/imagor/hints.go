@@ -0,0 +1,76 @@
+package imagor
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// AcceptCH is the Accept-CH header that asks browsers to send the client
+// hints images are scaled by
+const AcceptCH = "Sec-CH-DPR, Sec-CH-Width, Save-Data"
+
+const (
+	// maxDPR is the highest device pixel ratio dimensions are scaled by
+	maxDPR = 4
+	// saveDataQuality is the quality images are encoded with when the
+	// client asks to save data
+	saveDataQuality = "50"
+)
+
+// ClientHints scales the dimensions of a /serve path by the Sec-CH-DPR and
+// Sec-CH-Width hints of a request, and lowers its quality when it has
+// Save-Data: on. Paths that choose their own quality aren't changed by
+// Save-Data, and a width hint only sizes images without dimensions. Hints
+// that would take the path over the limits are ignored. It returns the
+// headers the image served depends on.
+func (s *Imagor) ClientHints(path string, h http.Header) (string, []string) {
+	if !s.clientHints {
+		return path, nil
+	}
+	p := imagorpath.Parse("/unsafe" + path)
+	if p.Image == "" || p.Meta {
+		return path, nil
+	}
+	var vary []string
+	scaled, scaling := p, false
+	if p.Width == 0 && p.Height == 0 {
+		vary = append(vary, "Sec-CH-Width")
+		// The width hint is in physical pixels, so it's already scaled by
+		// the device pixel ratio
+		if width, err := strconv.Atoi(strings.TrimSpace(h.Get("Sec-CH-Width"))); err == nil && width > 0 {
+			scaled.Width, scaling = width, true
+		}
+	} else {
+		vary = append(vary, "Sec-CH-DPR")
+		if dpr, err := strconv.ParseFloat(strings.TrimSpace(h.Get("Sec-CH-DPR")), 64); err == nil && dpr > 1 {
+			dpr = math.Min(dpr, maxDPR)
+			for _, n := range []*int{&scaled.Width, &scaled.Height, &scaled.PaddingLeft, &scaled.PaddingTop, &scaled.PaddingRight, &scaled.PaddingBottom} {
+				*n = int(math.Round(float64(*n) * dpr))
+			}
+			scaling = true
+		}
+	}
+	changed := false
+	if scaling && s.limits.Check(scaled) == nil {
+		p, changed = scaled, true
+	}
+	if !hasFilter(p, "quality") {
+		vary = append(vary, "Save-Data")
+		if strings.EqualFold(strings.TrimSpace(h.Get("Save-Data")), "on") {
+			saving := p
+			saving.Filters = append(slices.Clone(p.Filters), imagorpath.Filter{Name: "quality", Args: saveDataQuality})
+			if s.limits.Check(saving) == nil {
+				p, changed = saving, true
+			}
+		}
+	}
+	if !changed {
+		return path, vary
+	}
+	return "/" + imagorpath.GeneratePath(p), vary
+}
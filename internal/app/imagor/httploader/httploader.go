@@ -18,6 +18,7 @@ import (
 	"syscall"
 
 	"github.com/cshum/imagor"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/ssrf"
 )
 
 func randomProxyFunc(proxyURLs, hosts string) func(*http.Request) (*url.URL, error) {
@@ -54,10 +55,8 @@ func isURLAllowed(u *url.URL, allowedSources []AllowedSource) bool {
 	if len(allowedSources) == 0 {
 		return true
 	}
-	_, err := net.LookupHost(u.Host)
-	if err != nil {
-		return false
-	}
+	// Host names aren't resolved here, sources can be fetched through a
+	// proxy that resolves names that aren't visible to the service
 	for _, source := range allowedSources {
 		if source.Match(u) {
 			return true
@@ -88,10 +87,12 @@ func validateContentType(contentType string, accepts []string) bool {
 }
 
 // AllowedSource represents a source the HTTPLoader is allowed to load from.
-// It supports host glob patterns such as *.google.com and a full URL regex.
+// It supports host glob patterns such as *.google.com, optionally with a
+// scheme and port like https://*.google.com:8443, and a full URL regex.
 type AllowedSource struct {
 	HostPattern string
 	URLRegex    *regexp.Regexp
+	source      ssrf.Source
 }
 
 // NewRegexpAllowedSource creates a new AllowedSource from the regex pattern
@@ -109,6 +110,7 @@ func NewRegexpAllowedSource(pattern string) (AllowedSource, error) {
 func NewHostPatternAllowedSource(pattern string) AllowedSource {
 	return AllowedSource{
 		HostPattern: pattern,
+		source:      ssrf.ParseSource(pattern),
 	}
 }
 
@@ -117,8 +119,7 @@ func (s AllowedSource) Match(u *url.URL) bool {
 	if s.URLRegex != nil {
 		return s.URLRegex.MatchString(u.String())
 	}
-	matched, e := path.Match(s.HostPattern, u.Host)
-	return matched && e == nil
+	return s.source.Match(u)
 }
 
 // HTTPLoader HTTP Loader implements imagor.Loader interface
@@ -267,7 +268,7 @@ func (h *HTTPLoader) Get(r *http.Request, image string) (*imagor.Blob, error) {
 	blob = imagor.NewBlob(func() (io.ReadCloser, int64, error) {
 		resp, err := client.Do(req)
 		if err != nil {
-			if errors.Is(err, ErrUnauthorizedRequest) {
+			if errors.Is(err, ErrUnauthorizedRequest) || errors.Is(err, ssrf.ErrBlocked) {
 				err = imagor.NewError(
 					fmt.Sprintf("%s: %s", err.Error(), image),
 					http.StatusForbidden)
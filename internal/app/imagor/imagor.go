@@ -5,68 +5,232 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"fmt"
 	"hash"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"sync/atomic"
 	"time"
 
 	i "github.com/cshum/imagor"
 	"github.com/cshum/imagor/imagorpath"
-	"github.com/cshum/imagor/storage/filestorage"
 	"github.com/cshum/imagor/vips"
-	"github.com/jaredLunde/railway-image-service/internal/app/imagor/httploader"
+	"github.com/jaredLunde/railway-image-service/internal/app/jobs"
 	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/events"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/metrics"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/sourceauth"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/ssrf"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/tracing"
+)
+
+// How animated images are processed
+const (
+	// AnimationAnimate resizes every frame of animated images
+	AnimationAnimate = "animate"
+	// AnimationFlatten processes only the first frame of animated images
+	AnimationFlatten = "flatten"
 )
 
 type Config struct {
 	KeyVal             *keyval.KeyVal
-	UploadPath         string
 	MaxUploadSize      int
 	SignSecret         string
 	AllowedHTTPSources string
-	AutoWebP           bool
-	AutoAVIF           bool
-	ResultCacheTTL     time.Duration
-	Concurrency        int
-	RequestTimeout     time.Duration
-	CacheControlTTL    time.Duration
-	CacheControlSWR    time.Duration
-	Debug              bool
+	// BlockNetworks are the networks images can't be loaded from, whatever
+	// the host names of AllowedHTTPSources resolve to
+	BlockNetworks []*net.IPNet
+	// SourceAuth are the credentials sent to AllowedHTTPSources. They can be
+	// replaced while the service is running.
+	SourceAuth *atomic.Pointer[sourceauth.Rules]
+	// SourceProxy returns the proxy images are loaded from AllowedHTTPSources
+	// through, if any
+	SourceProxy func(*http.Request) (*url.URL, error)
+	// SourcePolicy retries the images loaded from AllowedHTTPSources and
+	// stops loading them from hosts that keep failing
+	SourcePolicy SourcePolicy
+	AutoWebP     bool
+	AutoAVIF     bool
+	// AutoJXL converts images to JPEG XL for browsers that accept them. It
+	// needs the service to be built with the jxl tag.
+	AutoJXL bool
+	// ClientHints scales images by the Sec-CH-DPR and Sec-CH-Width headers
+	// of requests and lowers their quality for Save-Data
+	ClientHints    bool
+	ResultCacheTTL time.Duration
+	// StaleIfError is how long after ResultCacheTTL a processed image is
+	// kept in the result cache and served when it fails to load or process
+	// again. Zero serves the error instead.
+	StaleIfError time.Duration
+	// ResultCacheMaxBytes is how much space processed images can take up in
+	// the disk cache before the least recently used ones are removed. Zero
+	// doesn't limit it.
+	ResultCacheMaxBytes int64
+	Concurrency         int
+	RequestTimeout      time.Duration
+	CacheControlTTL     time.Duration
+	CacheControlSWR     time.Duration
+	Debug               bool
+	// Events publishes an event for every processed image
+	Events *events.Queue
+	// Metrics records how long processing takes and how often the result
+	// cache is hit
+	Metrics *metrics.Registry
+	// Tracer records a span for every processed image
+	Tracer *tracing.Tracer
+	// ResultStorage caches processed images. They're cached in a temporary
+	// directory if it's nil.
+	ResultStorage i.Storage
+	// Limits restrict the operations images can be processed with
+	Limits Limits
+	// SmartCrop is the strategy the smart operation crops with,
+	// SmartCropAttention by default
+	SmartCrop string
+	// FaceDetector finds the faces images with the faces gravity are cropped
+	// around. They're smart cropped if it's nil.
+	FaceDetector FaceDetector
+	// Animation is how animated images are processed, AnimationAnimate by
+	// default
+	Animation string
+	// MaxFrames is the most frames of an animated image that are processed.
+	// Zero doesn't limit them.
+	MaxFrames int
+	// SourceLimits reject images that would take too much memory to decode
+	SourceLimits SourceLimits
+	// AvifSpeed is how fast AVIFs are encoded, from 0, the slowest and
+	// smallest, to 9
+	AvifSpeed int
+	// JPEGProgressive encodes progressive JPEGs with mozjpeg's settings
+	JPEGProgressive bool
+	// PNGCompression is the zlib compression level of PNGs from 1 to 9,
+	// libvips' default if it's zero
+	PNGCompression int
+	// FFmpegPath is the ffmpeg binary poster frames are extracted from
+	// videos with. Frames can't be served without it.
+	FFmpegPath string
+	// StripMetadata strips the EXIF, XMP and other metadata from images
+	// unless they're processed with the keep_exif filter
+	StripMetadata bool
+	// Jobs runs the transform jobs that store processed images. They can't
+	// be queued if it's nil.
+	Jobs   *jobs.Jobs
+	Logger *slog.Logger
 }
 
-func New(ctx context.Context, cfg Config) (*i.Imagor, error) {
+func New(ctx context.Context, cfg Config) (*Imagor, error) {
 	tmpDir, err := os.MkdirTemp("", "imagor-*")
 	if err != nil {
 		return nil, err
 	}
 
-	loaders := []i.Loader{
-		NewBlobStorage(cfg.KeyVal, cfg.UploadPath),
+	blobStorage := NewBlobStorage(cfg.KeyVal)
+	loaders := []i.Loader{blobStorage}
+	if cfg.FFmpegPath != "" {
+		loaders = append(loaders, &frameLoader{blobs: blobStorage, ffmpeg: cfg.FFmpegPath})
 	}
 
-	if cfg.AllowedHTTPSources != "" {
-		loaders = append(loaders, httploader.New(
-			httploader.WithForwardClientHeaders(false),
-			httploader.WithAccept("image/*"),
-			httploader.WithForwardHeaders(""),
-			httploader.WithOverrideResponseHeaders(""),
-			httploader.WithAllowedSources(cfg.AllowedHTTPSources),
-			httploader.WithAllowedSourceRegexps(""),
-			httploader.WithMaxAllowedSize(cfg.MaxUploadSize),
-			httploader.WithInsecureSkipVerifyTransport(false),
-			httploader.WithDefaultScheme("https"),
-			httploader.WithBaseURL(""),
-			httploader.WithProxyTransport("", ""),
-			httploader.WithBlockLoopbackNetworks(false),
-			httploader.WithBlockPrivateNetworks(false),
-			httploader.WithBlockLinkLocalNetworks(false),
-			httploader.WithBlockNetworks(),
-			httploader.WithUserAgent("RailwayImagesClient/1.0 (Platform: Linux; Architecture: x64)"),
-		))
+	log := cfg.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+
+	sources := &httpSources{
+		maxSize: cfg.MaxUploadSize,
+		policy:  cfg.SourcePolicy,
+		guard:   ssrf.NewGuard(cfg.BlockNetworks...),
+		proxy:   cfg.SourceProxy,
+		auth:    cfg.SourceAuth,
+		hosts:   newBreakers(cfg.SourcePolicy.BreakerFailures, cfg.SourcePolicy.BreakerCooldown, log),
+	}
+	sources.set(cfg.AllowedHTTPSources)
+	loaders = append(loaders, sources)
+	staleIfError := cfg.StaleIfError
+	if cfg.ResultCacheTTL <= 0 {
+		// Images never expire
+		staleIfError = 0
+	}
+	if staleIfError > 0 {
+		for n, loader := range loaders {
+			loaders[n] = &staleLoader{Loader: loader}
+		}
+	}
+
+	if cfg.SmartCrop != "" && cfg.SmartCrop != SmartCropAttention && cfg.SmartCrop != SmartCropEntropy {
+		return nil, fmt.Errorf("unknown smart crop strategy %q", cfg.SmartCrop)
+	}
+	if cfg.Animation != "" && cfg.Animation != AnimationAnimate && cfg.Animation != AnimationFlatten {
+		return nil, fmt.Errorf("unknown animation mode %q", cfg.Animation)
+	}
+	maxFrames := cfg.MaxFrames
+	if cfg.Animation == AnimationFlatten {
+		maxFrames = 1
+	}
+	if cfg.AvifSpeed < 0 || cfg.AvifSpeed > 9 {
+		return nil, fmt.Errorf("avif speed must be between 0 and 9, got %d", cfg.AvifSpeed)
+	}
+	if cfg.PNGCompression < 0 || cfg.PNGCompression > 9 {
+		return nil, fmt.Errorf("png compression must be between 0 and 9, got %d", cfg.PNGCompression)
+	}
+	if cfg.AutoJXL && !jxlSupported {
+		return nil, fmt.Errorf("JPEG XL isn't supported by this build, build it with -tags jxl")
+	}
+	vipsProcessor := vips.NewProcessor(
+		vips.WithMaxAnimationFrames(maxFrames),
+		vips.WithAvifSpeed(cfg.AvifSpeed),
+		vips.WithMozJPEG(cfg.JPEGProgressive),
+		vips.WithFilter(textFilter, newTextRenderer().Filter),
+	)
+	var processor i.Processor = &cropProcessor{
+		Processor: &metaProcessor{
+			Processor: &jxlProcessor{
+				Processor: &encoderProcessor{Processor: vipsProcessor, pngCompression: cfg.PNGCompression},
+			},
+			vips:  vipsProcessor,
+			strip: cfg.StripMetadata,
+		},
+		vips:    vipsProcessor,
+		entropy: cfg.SmartCrop == SmartCropEntropy,
+		faces:   cfg.FaceDetector,
+		log:     log,
+	}
+	if cfg.SourceLimits.enabled() {
+		processor = &sourceLimitProcessor{
+			Processor: processor,
+			vips:      vipsProcessor,
+			limits:    cfg.SourceLimits,
+			maxFrames: maxFrames,
+		}
+	}
+	if cfg.Metrics != nil {
+		processor = newMetricsProcessor(processor, cfg.Metrics)
+	}
+	if cfg.Tracer != nil {
+		processor = &tracingProcessor{Processor: processor, tracer: cfg.Tracer}
+	}
+	if cfg.Events != nil {
+		processor = &eventProcessor{Processor: processor, events: cfg.Events}
+	}
+
+	cache := cfg.ResultStorage
+	if cache == nil {
+		diskCache := newDiskCache(tmpDir, cfg.ResultCacheMaxBytes, cfg.ResultCacheTTL+staleIfError, log)
+		go diskCache.run(ctx)
+		cache = diskCache
+	}
+	var resultStorage i.Storage = &jxlResultStorage{Storage: cache}
+	if staleIfError > 0 {
+		resultStorage = &staleResultStorage{Storage: resultStorage, ttl: cfg.ResultCacheTTL}
+	}
+	if cfg.Metrics != nil {
+		resultStorage = newMetricsResultStorage(resultStorage, cfg.Metrics)
 	}
 
 	imagorService := i.New(
 		i.WithLoaders(loaders...),
-		i.WithProcessors(vips.NewProcessor()),
+		i.WithProcessors(processor),
 		i.WithSigner(NewHMACSigner(sha256.New, 0, cfg.SignSecret)),
 		i.WithBasePathRedirect(""),
 		i.WithBaseParams(""),
@@ -84,9 +248,9 @@ func New(ctx context.Context, cfg Config) (*i.Imagor, error) {
 		i.WithModifiedTimeCheck(false),
 		i.WithDisableErrorBody(false),
 		i.WithDisableParamsEndpoint(true),
-		i.WithResultStorages(filestorage.New(tmpDir, filestorage.WithExpiration(cfg.ResultCacheTTL))),
+		i.WithResultStorages(resultStorage),
 		i.WithStoragePathStyle(imagorpath.DigestStorageHasher),
-		i.WithResultStoragePathStyle(imagorpath.DigestResultStorageHasher),
+		i.WithResultStoragePathStyle(sourceResultStorageHasher),
 		i.WithUnsafe(cfg.Debug),
 		i.WithDebug(cfg.Debug),
 	)
@@ -98,7 +262,28 @@ func New(ctx context.Context, cfg Config) (*i.Imagor, error) {
 		return nil, err
 	}
 
-	return imagorService, nil
+	s := &Imagor{
+		Imagor:        imagorService,
+		ctx:           ctx,
+		kv:            cfg.KeyVal,
+		staleIfError:  staleIfError,
+		resultStorage: cache,
+		limits:        cfg.Limits,
+		autoJXL:       cfg.AutoJXL,
+		clientHints:   cfg.ClientHints,
+		signSecret:    cfg.SignSecret,
+		httpSources:   sources,
+		log:           log,
+		warmJobs:      map[string]*WarmJob{},
+		jobs:          cfg.Jobs,
+		vips:          vipsProcessor,
+		maxUploadSize: cfg.MaxUploadSize,
+	}
+	if cfg.Jobs != nil {
+		cfg.Jobs.Handle(TransformJobType, s.transform)
+		cfg.Jobs.Handle(ReencodeJobType, s.reencode)
+	}
+	return s, nil
 }
 
 func NewHMACSigner(alg func() hash.Hash, truncate int, secret string) imagorpath.Signer {
@@ -0,0 +1,112 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// jxlFormat is the format filter argument of JPEG XL images
+const jxlFormat = "jxl"
+
+// The signatures JPEG XL files start with, either a bare codestream or an ISO
+// BMFF container
+var (
+	jxlCodestream = []byte{0xff, 0x0a}
+	jxlContainer  = []byte("\x00\x00\x00\x0cJXL \r\n\x87\n")
+)
+
+// jxlProcessor encodes images with the format(jxl) filter as JPEG XL, which
+// imagor doesn't support. They're processed as lossless PNGs first.
+type jxlProcessor struct {
+	i.Processor
+}
+
+// Process implements imagor.Processor interface
+func (j *jxlProcessor) Process(ctx context.Context, blob *i.Blob, p imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	if p.Meta || !isJXL(p) {
+		return j.Processor.Process(ctx, blob, p, load)
+	}
+	if !jxlSupported {
+		return nil, i.ErrUnsupportedFormat
+	}
+	quality := 0
+	filters := make(imagorpath.Filters, 0, len(p.Filters)+1)
+	for _, f := range p.Filters {
+		switch f.Name {
+		case "format":
+			filters = append(filters, imagorpath.Filter{Name: "format", Args: "png"})
+		case "quality":
+			quality, _ = strconv.Atoi(f.Args)
+		case "compression":
+		default:
+			filters = append(filters, f)
+		}
+	}
+	// The PNG is thrown away, so it's compressed as little as possible
+	p.Filters = append(filters, imagorpath.Filter{Name: "compression", Args: "1"})
+
+	out, err := j.Processor.Process(ctx, blob, p, load)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := out.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if buf, err = encodeJXL(buf, quality); err != nil {
+		return nil, err
+	}
+	out = i.NewBlobFromBytes(buf)
+	out.SetContentType("image/jxl")
+	return out, nil
+}
+
+// AutoFormat adds a format(jxl) filter to a /serve path when JPEG XL images
+// are turned on and accepted, and the path doesn't choose a format itself. It
+// returns true if the image served depends on the Accept header.
+func (s *Imagor) AutoFormat(path, accept string) (string, bool) {
+	if !s.autoJXL {
+		return path, false
+	}
+	p := imagorpath.Parse("/unsafe" + path)
+	if p.Image == "" || p.Meta || hasFilter(p, "format") {
+		return path, false
+	}
+	if !strings.Contains(accept, "image/jxl") {
+		return path, true
+	}
+	p.Filters = append(p.Filters, imagorpath.Filter{Name: "format", Args: jxlFormat})
+	return "/" + imagorpath.GeneratePath(p), true
+}
+
+// jxlResultStorage serves cached JPEG XL images with their content type,
+// which imagor doesn't detect
+type jxlResultStorage struct {
+	i.Storage
+}
+
+// Get implements imagor.Storage interface
+func (s *jxlResultStorage) Get(r *http.Request, key string) (*i.Blob, error) {
+	blob, err := s.Storage.Get(r, key)
+	if err == nil && blob != nil {
+		if sniff := blob.Sniff(); bytes.HasPrefix(sniff, jxlCodestream) || bytes.HasPrefix(sniff, jxlContainer) {
+			blob.SetContentType("image/jxl")
+		}
+	}
+	return blob, err
+}
+
+func isJXL(p imagorpath.Params) bool {
+	for _, f := range p.Filters {
+		if f.Name == "format" && f.Args == jxlFormat {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+//go:build jxl
+
+package imagor
+
+// #cgo pkg-config: vips
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// static int jxl_save(void *buf, size_t len, int quality, void **out, size_t *out_len) {
+//   VipsImage *img = vips_image_new_from_buffer(buf, len, "", NULL);
+//   if (img == NULL) {
+//     return -1;
+//   }
+//   int err = quality > 0
+//     ? vips_jxlsave_buffer(img, out, out_len, "Q", quality, NULL)
+//     : vips_jxlsave_buffer(img, out, out_len, NULL);
+//   g_object_unref(img);
+//   return err;
+// }
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// jxlSupported is true when the service is built with the jxl tag
+const jxlSupported = true
+
+// encodeJXL re-encodes an image as a JPEG XL with libvips. A quality of zero
+// uses libvips' default.
+func encodeJXL(buf []byte, quality int) ([]byte, error) {
+	if len(buf) == 0 {
+		return nil, errors.New("image is empty")
+	}
+	in := C.CBytes(buf)
+	defer C.free(in)
+	var out unsafe.Pointer
+	var outLen C.size_t
+	if C.jxl_save(in, C.size_t(len(buf)), C.int(quality), &out, &outLen) != 0 {
+		msg := C.GoString(C.vips_error_buffer())
+		C.vips_error_clear()
+		return nil, errors.New(msg)
+	}
+	defer C.g_free(C.gpointer(out))
+	return C.GoBytes(out, C.int(outLen)), nil
+}
@@ -0,0 +1,12 @@
+//go:build !jxl
+
+package imagor
+
+import i "github.com/cshum/imagor"
+
+// jxlSupported is true when the service is built with the jxl tag
+const jxlSupported = false
+
+func encodeJXL([]byte, int) ([]byte, error) {
+	return nil, i.ErrUnsupportedFormat
+}
@@ -0,0 +1,68 @@
+package imagor
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// Limits restrict the operations images can be processed with, so a valid
+// signature can't be used to request absurd transforms
+type Limits struct {
+	// MaxWidth is the widest an image can be made, including padding. Zero
+	// doesn't limit it.
+	MaxWidth int
+	// MaxHeight is the tallest an image can be made, including padding. Zero
+	// doesn't limit it.
+	MaxHeight int
+	// AllowedFilters are the names of the filters that can be used. Every
+	// filter can be used if it's empty.
+	AllowedFilters []string
+}
+
+// ParseFilters parses a comma-separated list of filter names
+func ParseFilters(s string) []string {
+	var filters []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			filters = append(filters, name)
+		}
+	}
+	return filters
+}
+
+// Check returns an error if p isn't within the limits
+func (l Limits) Check(p imagorpath.Params) error {
+	width := abs(p.Width) + p.PaddingLeft + p.PaddingRight
+	if l.MaxWidth > 0 && width > l.MaxWidth {
+		return fmt.Errorf("width can't be more than %d", l.MaxWidth)
+	}
+	height := abs(p.Height) + p.PaddingTop + p.PaddingBottom
+	if l.MaxHeight > 0 && height > l.MaxHeight {
+		return fmt.Errorf("height can't be more than %d", l.MaxHeight)
+	}
+	if len(l.AllowedFilters) > 0 {
+		for _, f := range p.Filters {
+			// The faces gravity is a filter under the hood
+			if f.Name != facesFilter && !slices.Contains(l.AllowedFilters, f.Name) {
+				return fmt.Errorf("filter %q isn't allowed", f.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckPath returns an error if the operations of a /serve path, e.g.
+// /200x200/blob/{key}, aren't within the limits
+func (s *Imagor) CheckPath(path string) error {
+	return s.limits.Check(imagorpath.Parse("/unsafe" + path))
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,131 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/cshum/imagor/vips"
+)
+
+// MetaPrefix is what the /serve paths of image metadata start with, e.g.
+// /meta/{key} or /meta/{operations}/blob/{key}
+const MetaPrefix = "/meta/"
+
+// keepExifFilter keeps the metadata of an image that's stripped by default.
+// It's removed before images are processed.
+const keepExifFilter = "keep_exif"
+
+// colorSpaces are the libvips names of the color spaces images are reported in
+var colorSpaces = map[vips.Interpretation]string{
+	vips.InterpretationMultiband: "multiband",
+	vips.InterpretationBW:        "b-w",
+	vips.InterpretationHistogram: "histogram",
+	vips.InterpretationXYZ:       "xyz",
+	vips.InterpretationLAB:       "lab",
+	vips.InterpretationCMYK:      "cmyk",
+	vips.InterpretationLABQ:      "labq",
+	vips.InterpretationRGB:       "rgb",
+	vips.InterpretationRGB16:     "rgb16",
+	vips.InterpretationCMC:       "cmc",
+	vips.InterpretationLCH:       "lch",
+	vips.InterpretationLABS:      "labs",
+	vips.InterpretationSRGB:      "srgb",
+	vips.InterpretationYXY:       "yxy",
+	vips.InterpretationFourier:   "fourier",
+	vips.InterpretationGrey16:    "grey16",
+	vips.InterpretationMatrix:    "matrix",
+	vips.InterpretationScRGB:     "scrgb",
+	vips.InterpretationHSV:       "hsv",
+}
+
+// Metadata is what the metadata of an image is served as. Pages is the
+// number of frames of animated images.
+type Metadata struct {
+	*vips.Metadata
+	// ColorSpace is the color space of the original image, e.g. srgb or cmyk
+	ColorSpace string `json:"color_space,omitempty"`
+	// XMP is the XMP packet of the original image
+	XMP string `json:"xmp,omitempty"`
+}
+
+// metaProcessor strips the EXIF, XMP and other metadata from images unless
+// they're processed with the keep_exif filter, and adds the color space and
+// XMP packet of images to their metadata
+type metaProcessor struct {
+	i.Processor
+	vips  *vips.Processor
+	strip bool
+}
+
+// Process implements imagor.Processor interface
+func (m *metaProcessor) Process(ctx context.Context, blob *i.Blob, p imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	keep := !m.strip
+	filters := make(imagorpath.Filters, 0, len(p.Filters)+2)
+	for _, f := range p.Filters {
+		if f.Name == keepExifFilter {
+			keep = true
+		} else {
+			filters = append(filters, f)
+		}
+	}
+	if !keep {
+		filters = append(filters, imagorpath.Filter{Name: "strip_exif"}, imagorpath.Filter{Name: "strip_metadata"})
+	}
+	p.Filters = filters
+
+	out, err := m.Processor.Process(ctx, blob, p, load)
+	if err != nil || !p.Meta {
+		return out, err
+	}
+	buf, err := out.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	meta := Metadata{Metadata: &vips.Metadata{}}
+	if err := json.Unmarshal(buf, meta.Metadata); err != nil {
+		return nil, err
+	}
+	img, err := m.vips.NewImage(ctx, blob, 1, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	meta.ColorSpace = colorSpaces[img.Interpretation()]
+	if keep && !hasFilter(p, "strip_exif") {
+		if buf, err := blob.ReadAll(); err == nil {
+			meta.XMP = xmpPacket(buf)
+		}
+	}
+	return i.NewBlobFromJsonMarshal(meta), nil
+}
+
+// xmpPacket returns the XMP packet embedded in an image file, if there's one
+func xmpPacket(buf []byte) string {
+	start := bytes.Index(buf, []byte("<x:xmpmeta"))
+	if start < 0 {
+		return ""
+	}
+	end := bytes.Index(buf[start:], []byte("</x:xmpmeta>"))
+	if end < 0 {
+		return ""
+	}
+	return string(buf[start : start+end+len("</x:xmpmeta>")])
+}
+
+// ExpandMeta rewrites the metadata path of a blob, e.g. /meta/{key}, to the
+// one imagor serves it at. Paths with a blob/ or url/ image are left alone.
+func ExpandMeta(path string) string {
+	key, ok := strings.CutPrefix(path, MetaPrefix)
+	if !ok || key == "" {
+		return path
+	}
+	image := imagorpath.Parse("/unsafe" + path).Image
+	if strings.HasPrefix(image, "blob/") || strings.HasPrefix(image, "url/") {
+		return path
+	}
+	return MetaPrefix + "blob/" + key
+}
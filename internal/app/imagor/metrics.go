@@ -0,0 +1,67 @@
+package imagor
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/metrics"
+)
+
+// metricsProcessor measures how long its processor takes to process images
+type metricsProcessor struct {
+	i.Processor
+	durations *metrics.Histogram
+	errors    *metrics.Counter
+}
+
+func newMetricsProcessor(processor i.Processor, registry *metrics.Registry) *metricsProcessor {
+	return &metricsProcessor{
+		Processor: processor,
+		durations: registry.NewHistogram("image_processing_duration_seconds", "How long processing an image takes", metrics.DurationBuckets),
+		errors:    registry.NewCounter("image_processing_errors_total", "The number of images that failed to process"),
+	}
+}
+
+func (p *metricsProcessor) Process(ctx context.Context, blob *i.Blob, params imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	start := time.Now()
+	out, err := p.Processor.Process(ctx, blob, params, load)
+	p.durations.Observe(time.Since(start).Seconds())
+	if err != nil {
+		p.errors.Inc()
+	}
+	return out, err
+}
+
+// metricsResultStorage counts how often processed images are served from its
+// storage instead of being processed again
+type metricsResultStorage struct {
+	i.Storage
+	hits   *metrics.Counter
+	misses *metrics.Counter
+}
+
+func newMetricsResultStorage(storage i.Storage, registry *metrics.Registry) *metricsResultStorage {
+	return &metricsResultStorage{
+		Storage: storage,
+		hits:    registry.NewCounter("image_result_cache_hits_total", "The number of processed images served from the result cache"),
+		misses:  registry.NewCounter("image_result_cache_misses_total", "The number of processed images that weren't in the result cache"),
+	}
+}
+
+// Get implements imagor.Storage interface
+func (s *metricsResultStorage) Get(r *http.Request, key string) (*i.Blob, error) {
+	blob, err := s.Storage.Get(r, key)
+	// Blobs are opened lazily, so missing ones only fail once they're used
+	if err == nil && blob != nil {
+		err = blob.Err()
+	}
+	if err == nil {
+		s.hits.Inc()
+	} else {
+		s.misses.Inc()
+	}
+	return blob, err
+}
@@ -0,0 +1,35 @@
+package imagor
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/cshum/imagor/imagorpath"
+)
+
+var errInvalidPage = errors.New("page must be a positive number")
+
+// PagePath adds a page(N) filter to a /serve path, so a page of a PDF or a
+// frame of an animated image other than the first is processed. An empty
+// page leaves the path alone.
+func PagePath(path, page string) (string, error) {
+	if page == "" {
+		return path, nil
+	}
+	n, err := strconv.Atoi(page)
+	if err != nil || n < 1 {
+		return path, errInvalidPage
+	}
+	p := imagorpath.Parse("/unsafe" + path)
+	if p.Image == "" {
+		return path, nil
+	}
+	filters := make(imagorpath.Filters, 0, len(p.Filters)+1)
+	for _, f := range p.Filters {
+		if f.Name != "page" {
+			filters = append(filters, f)
+		}
+	}
+	p.Filters = append(filters, imagorpath.Filter{Name: "page", Args: strconv.Itoa(n)})
+	return "/" + imagorpath.GeneratePath(p), nil
+}
@@ -0,0 +1,41 @@
+package imagor
+
+import (
+	"context"
+	"encoding/base64"
+
+	"github.com/cshum/imagor/imagorpath"
+)
+
+const (
+	// placeholderSize is the size of the thumbnail placeholders are made
+	// of. Browsers blur it when it's scaled up.
+	placeholderSize = 16
+	// placeholderQuality is the WebP quality placeholders are encoded with
+	placeholderQuality = "40"
+)
+
+// Placeholder returns a tiny version of the blob at key as a WebP data URI,
+// for apps to show while the image loads. Keys of tenants are prefixed with
+// the tenant's name.
+func (s *Imagor) Placeholder(ctx context.Context, key string) (string, error) {
+	blob, err := s.Serve(ctx, imagorpath.Params{
+		Image:  "blob/" + key,
+		FitIn:  true,
+		Width:  placeholderSize,
+		Height: placeholderSize,
+		Filters: imagorpath.Filters{
+			{Name: "format", Args: "webp"},
+			{Name: "quality", Args: placeholderQuality},
+			{Name: "strip_metadata"},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	buf, err := blob.ReadAll()
+	if err != nil {
+		return "", err
+	}
+	return "data:image/webp;base64," + base64.StdEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,60 @@
+package imagor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PresetPrefix is what the /serve paths of presets start with, e.g.
+// /preset/thumb/{key}
+const PresetPrefix = "/preset/"
+
+var presetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Presets are named operations, so URLs stay short and what they render can
+// be changed in one place
+type Presets map[string]string
+
+// ParsePresets parses a semicolon-separated list of name=operations presets,
+// e.g. thumb=200x200/smart/filters:quality(80);banner=fit-in/1200x400
+func ParsePresets(s string) (Presets, error) {
+	presets := Presets{}
+	for _, preset := range strings.Split(s, ";") {
+		preset = strings.TrimSpace(preset)
+		if preset == "" {
+			continue
+		}
+		name, ops, ok := strings.Cut(preset, "=")
+		name, ops = strings.TrimSpace(name), strings.Trim(strings.TrimSpace(ops), "/")
+		if !ok || !presetNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid preset %q, expected name=operations", preset)
+		}
+		if _, ok := blobParams("preset", ops, ""); !ok {
+			return nil, fmt.Errorf("invalid preset %q, operations can't include the image", preset)
+		}
+		if _, ok := presets[name]; ok {
+			return nil, fmt.Errorf("duplicate preset %q", name)
+		}
+		presets[name] = ops
+	}
+	return presets, nil
+}
+
+// Expand rewrites the /serve path of a preset, e.g. /preset/thumb/{key}, to
+// the path of its operations on the blob at key. It returns false if the
+// preset doesn't exist.
+func (p Presets) Expand(path string) (string, bool) {
+	name, key, ok := strings.Cut(strings.TrimPrefix(path, PresetPrefix), "/")
+	if !ok || key == "" {
+		return "", false
+	}
+	ops, ok := p[name]
+	if !ok {
+		return "", false
+	}
+	if ops == "" {
+		return "/blob/" + key, true
+	}
+	return "/" + ops + "/blob/" + key, true
+}
@@ -0,0 +1,100 @@
+package imagor
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/cshum/imagor/vips"
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/app/jobs"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+// PurgeEndpoint is the path the processed images of a blob are purged at
+const PurgeEndpoint = "/serve/cache/"
+
+// ErrPurgeNotSupported is returned when the result storage can't purge images
+var ErrPurgeNotSupported = errors.New("result storage doesn't support purging")
+
+// Imagor serves processed images, warms the result cache with them and
+// purges them from it
+type Imagor struct {
+	*i.Imagor
+	ctx           context.Context
+	kv            *keyval.KeyVal
+	staleIfError  time.Duration
+	resultStorage i.Storage
+	limits        Limits
+	autoJXL       bool
+	clientHints   bool
+	signSecret    string
+	httpSources   *httpSources
+	log           *slog.Logger
+	jobsMu        sync.Mutex
+	warmJobs      map[string]*WarmJob
+	jobs          *jobs.Jobs
+	vips          *vips.Processor
+	maxUploadSize int
+}
+
+// Purge removes every processed image of the blob at key from the result
+// cache. Keys of tenants are prefixed with the tenant's name.
+func (s *Imagor) Purge(ctx context.Context, key string) error {
+	storage, ok := s.resultStorage.(prefixDeleter)
+	if !ok {
+		return ErrPurgeNotSupported
+	}
+	return storage.DeletePrefix(ctx, sourcePrefix("blob/"+key))
+}
+
+// PurgeHandler purges the processed images of a blob from the result cache,
+// e.g. DELETE /serve/cache/{key}
+func (s *Imagor) PurgeHandler(c fiber.Ctx) error {
+	key := strings.TrimPrefix(c.Path(), PurgeEndpoint)
+	if key == "" || key == c.Path() {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if tenant := mw.GetTenant(c); tenant != "" {
+		key = tenant + "/" + key
+	}
+	if err := s.Purge(c.Context(), key); err != nil {
+		s.log.Error("failed to purge result cache", "key", key, "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("failed to purge result cache")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// SourceKey returns the key of the blob the image of a /serve path is
+// processed from. Keys of tenants are prefixed with the tenant's name.
+func SourceKey(path string) (string, bool) {
+	return strings.CutPrefix(frameSource(imagorpath.Parse("/unsafe"+path).Image), "blob/")
+}
+
+// prefixDeleter is a result storage that can delete all of the images stored
+// under a prefix
+type prefixDeleter interface {
+	DeletePrefix(ctx context.Context, prefix string) error
+}
+
+// sourceResultStorageHasher stores processed images under a directory named
+// after the digest of their source image, so that all of the variants of an
+// image, including the poster frames of a video, can be purged at once
+var sourceResultStorageHasher = imagorpath.ResultStorageHasherFunc(func(p imagorpath.Params) string {
+	return sourcePrefix(frameSource(p.Image)) + imagorpath.DigestResultStorageHasher.HashResult(p)
+})
+
+// sourcePrefix returns the prefix the processed images of image are stored
+// under
+func sourcePrefix(image string) string {
+	digest := sha1.Sum([]byte(image))
+	return hex.EncodeToString(digest[:]) + "/"
+}
@@ -0,0 +1,273 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/vips"
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/app/jobs"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+const (
+	// ReencodeJobType is the type of the jobs that re-encode stored images
+	// to another format or quality
+	ReencodeJobType = "reencode"
+	// defaultReencodeRate is how many images a re-encode job processes per
+	// second when its request doesn't say
+	defaultReencodeRate = 5
+	// reencodePageSize is how many keys are listed at a time
+	reencodePageSize = 100
+)
+
+// Stats of re-encode jobs
+const (
+	// StatReplaced is the number of images that were replaced
+	StatReplaced = "replaced"
+	// StatBytesBefore is the size of the images before they were re-encoded
+	StatBytesBefore = "bytes_before"
+	// StatBytesAfter is their size after, counting the ones that were kept
+	// because re-encoding didn't make them smaller
+	StatBytesAfter = "bytes_after"
+	// StatBytesSaved is the difference between the two
+	StatBytesSaved = "bytes_saved"
+)
+
+// reencodeContentTypes are the formats images can be re-encoded to
+var reencodeContentTypes = map[string]string{
+	"webp": "image/webp",
+	"avif": "image/avif",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+}
+
+type ReencodeRequest struct {
+	// Prefix only re-encodes the images with keys starting with it
+	Prefix string `json:"prefix,omitempty"`
+	// ContentTypes are the types of the images to re-encode, e.g. image/png
+	ContentTypes []string `json:"content_types"`
+	// Format is what they're re-encoded to: webp, avif, jpeg or png
+	Format string `json:"format"`
+	// Quality of lossy formats from 1 to 100. Zero is the encoder's default.
+	Quality int `json:"quality,omitempty"`
+	// Lossless encodes WebP and AVIF images without losing any detail
+	Lossless bool `json:"lossless,omitempty"`
+	// Rate is the most images re-encoded per second, so the job doesn't
+	// crowd out the images being served
+	Rate float64 `json:"rate,omitempty"`
+	// StartingAt is the first key that's re-encoded, e.g. the cursor of a
+	// job that didn't finish
+	StartingAt string `json:"starting_at,omitempty"`
+	// DryRun reports the savings without replacing any images
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// ReencodeHandler queues a job that re-encodes the stored images matching a
+// ReencodeRequest, replacing each one that gets smaller, and responds with
+// the job. Its progress and savings can be looked up at /jobs/{id}.
+func (s *Imagor) ReencodeHandler(c fiber.Ctx) error {
+	if s.jobs == nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	var req ReencodeRequest
+	if err := json.Unmarshal(c.Body(), &req); err != nil || len(req.ContentTypes) == 0 {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if _, ok := reencodeContentTypes[req.Format]; !ok {
+		return c.Status(fiber.StatusBadRequest).SendString("unsupported format: " + req.Format)
+	}
+	if req.Quality < 0 || req.Quality > 100 || req.Rate < 0 {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if req.Rate == 0 {
+		req.Rate = defaultReencodeRate
+	}
+	if req.Prefix != "" {
+		mw.SetAuditKeys(c, req.Prefix)
+	}
+
+	job, err := s.jobs.Enqueue(c.Context(), ReencodeJobType, mw.GetTenant(c), 0, req)
+	if errors.Is(err, jobs.ErrQueueFull) {
+		return c.SendStatus(fiber.StatusServiceUnavailable)
+	}
+	if err != nil {
+		s.log.Error("failed to queue re-encode job", "error", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+// reencode runs a re-encode job. The key of the image being re-encoded is its
+// cursor, so a job that's interrupted can be resumed from it.
+func (s *Imagor) reencode(ctx context.Context, job jobs.Job, progress *jobs.Progress) error {
+	var req ReencodeRequest
+	if err := json.Unmarshal(job.Input, &req); err != nil {
+		return err
+	}
+	ns := ""
+	if job.Tenant != "" {
+		ns = job.Tenant + "/"
+	}
+	total, err := s.walkReencodable(ns, req, func(keyval.ListObject) error { return nil })
+	if err != nil {
+		return err
+	}
+	progress.SetTotal(ctx, total)
+
+	throttle := time.NewTicker(time.Duration(float64(time.Second) / req.Rate))
+	defer throttle.Stop()
+	_, err = s.walkReencodable(ns, req, func(obj keyval.ListObject) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-throttle.C:
+		}
+		progress.SetCursor(obj.Key)
+		before, after, replaced, err := s.reencodeImage(ctx, []byte(ns+obj.Key), req)
+		if err != nil {
+			s.log.Error("failed to re-encode image", "key", obj.Key, "error", err)
+			progress.Fail(ctx, obj.Key, err)
+			return nil
+		}
+		progress.Add(StatBytesBefore, before)
+		progress.Add(StatBytesAfter, after)
+		progress.Add(StatBytesSaved, before-after)
+		if replaced {
+			progress.Add(StatReplaced, 1)
+		}
+		progress.Done(ctx, nil)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	progress.SetCursor("")
+	return nil
+}
+
+// walkReencodable calls fn with every image a re-encode job works on, in
+// order of their keys, and returns how many there were
+func (s *Imagor) walkReencodable(ns string, req ReencodeRequest, fn func(keyval.ListObject) error) (int, error) {
+	count := 0
+	start := req.StartingAt
+	for {
+		objects, next, err := s.kv.List(keyval.ListOptions{
+			Namespace:  ns,
+			Prefix:     req.Prefix,
+			StartingAt: start,
+			Limit:      reencodePageSize,
+		})
+		if err != nil {
+			return count, err
+		}
+		for _, obj := range objects {
+			if !slices.Contains(req.ContentTypes, obj.ContentType) {
+				continue
+			}
+			if err := fn(obj); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if next == "" {
+			return count, nil
+		}
+		start = next
+	}
+}
+
+// reencodeImage re-encodes the image at key and replaces it if it got
+// smaller. It returns its size before and after.
+func (s *Imagor) reencodeImage(ctx context.Context, key []byte, req ReencodeRequest) (before, after int64, replaced bool, err error) {
+	// The image can't change while it's re-encoded
+	if !s.kv.LockKey(key) {
+		return 0, 0, false, fmt.Errorf("%s is being written", key)
+	}
+	defer s.kv.UnlockKey(key)
+	rec := s.kv.GetRecord(key)
+	if rec.Deleted != keyval.NO {
+		return 0, 0, false, keyval.ErrNotFound
+	}
+	r, _, err := s.kv.Storage().Get(ctx, rec.StorageKey(string(key)))
+	if err != nil {
+		return 0, 0, false, err
+	}
+	buf, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	out, err := s.encode(ctx, buf, req)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	before, after = int64(len(buf)), int64(len(out))
+	if after >= before {
+		// The original is kept, so nothing is saved
+		return before, before, false, nil
+	}
+	if req.DryRun {
+		return before, after, false, nil
+	}
+	if status := s.kv.Write(ctx, key, bytes.NewReader(out), len(out), keyval.WriteOptions{
+		Metadata:  rec.Metadata,
+		ExpiresAt: rec.ExpiresAt,
+		ACL:       rec.ACL,
+	}); status != fiber.StatusCreated {
+		return 0, 0, false, fmt.Errorf("failed to store %s: %s", key, http.StatusText(status))
+	}
+	return before, after, true, nil
+}
+
+// encode encodes an image in the format of req. It's the original, so its
+// metadata is kept. Animated images aren't supported, since only their first
+// frame would be kept.
+func (s *Imagor) encode(ctx context.Context, buf []byte, req ReencodeRequest) ([]byte, error) {
+	img, err := s.vips.NewImage(ctx, i.NewBlobFromBytes(buf), 1, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	if img.Pages() > 1 {
+		return nil, errors.New("animated images can't be re-encoded")
+	}
+	switch req.Format {
+	case "webp":
+		params := vips.NewWebpExportParams()
+		params.Lossless = req.Lossless
+		if req.Quality > 0 {
+			params.Quality = req.Quality
+		}
+		return img.ExportWebp(params)
+	case "avif":
+		params := vips.NewAvifExportParams()
+		params.Lossless = req.Lossless
+		if req.Quality > 0 {
+			params.Quality = req.Quality
+		}
+		return img.ExportAvif(params)
+	case "jpeg":
+		params := vips.NewJpegExportParams()
+		if req.Quality > 0 {
+			params.Quality = req.Quality
+		}
+		return img.ExportJpeg(params)
+	case "png":
+		params := vips.NewPngExportParams()
+		// PNGs are lossless, so they're compressed as much as possible
+		params.Compression = 9
+		return img.ExportPng(params)
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", req.Format)
+	}
+}
@@ -0,0 +1,227 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"math"
+	"strings"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/cshum/imagor/vips"
+)
+
+// Smart crop strategies
+const (
+	// SmartCropAttention crops around skin tones, saturated colours and
+	// edges, using libvips
+	SmartCropAttention = "attention"
+	// SmartCropEntropy crops around the busiest region of an image
+	SmartCropEntropy = "entropy"
+)
+
+const (
+	// entropySampleSize is the size of the thumbnail the busiest region of
+	// an image is looked for in
+	entropySampleSize = 128
+	// faceSampleSize is the size of the thumbnail faces are looked for in
+	faceSampleSize = 512
+)
+
+// facesFilter marks images that are cropped around their faces. It's added
+// by ExpandFaces and removed before images are processed.
+const facesFilter = "faces"
+
+var errRotated = errors.New("image is rotated")
+
+// FaceDetector finds the faces in an image
+type FaceDetector interface {
+	DetectFaces(ctx context.Context, img image.Image) ([]image.Rectangle, error)
+}
+
+// cropProcessor gives libvips a focal point to crop around for images with
+// the faces gravity, or for smart crops with the entropy strategy. Images it
+// can't find one for are smart cropped by libvips.
+type cropProcessor struct {
+	i.Processor
+	vips    *vips.Processor
+	entropy bool
+	faces   FaceDetector
+	log     *slog.Logger
+}
+
+// Process implements imagor.Processor interface
+func (c *cropProcessor) Process(ctx context.Context, blob *i.Blob, p imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	faces := false
+	filters := make(imagorpath.Filters, 0, len(p.Filters))
+	for _, f := range p.Filters {
+		if f.Name == facesFilter {
+			// Without faces, the image is smart cropped
+			faces, p.Smart = true, true
+		} else {
+			filters = append(filters, f)
+		}
+	}
+	p.Filters = filters
+	if !smartCrops(p) {
+		return c.Processor.Process(ctx, blob, p, load)
+	}
+
+	var focal []imagorpath.Filter
+	if faces && c.faces != nil {
+		rects, err := c.detectFaces(ctx, blob)
+		if err != nil {
+			c.log.Error("failed to detect faces", "error", err)
+		}
+		focal = rects
+	}
+	if len(focal) == 0 && c.entropy {
+		if sample, err := c.sample(ctx, blob, entropySampleSize); err == nil {
+			fx, fy := entropyFocalPoint(sample, float64(p.Width)/float64(p.Height))
+			focal = []imagorpath.Filter{{Name: "focal", Args: fmt.Sprintf("%.4fx%.4f", fx, fy)}}
+		}
+	}
+	if len(focal) > 0 {
+		p.Smart = false
+		p.Filters = append(focal, p.Filters...)
+	}
+	return c.Processor.Process(ctx, blob, p, load)
+}
+
+// detectFaces returns a focal filter for each face in the image
+func (c *cropProcessor) detectFaces(ctx context.Context, blob *i.Blob) ([]imagorpath.Filter, error) {
+	sample, err := c.sample(ctx, blob, faceSampleSize)
+	if err != nil {
+		return nil, err
+	}
+	faces, err := c.faces.DetectFaces(ctx, sample)
+	if err != nil {
+		return nil, err
+	}
+	bounds := sample.Bounds()
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	focal := make([]imagorpath.Filter, 0, len(faces))
+	for _, face := range faces {
+		face = face.Sub(bounds.Min)
+		// Fractions of the image are told apart from pixels by being under 1
+		left, top := math.Min(float64(face.Min.X)/w, 0.9999), math.Min(float64(face.Min.Y)/h, 0.9999)
+		focal = append(focal, imagorpath.Filter{Name: "focal", Args: fmt.Sprintf(
+			"%.4fx%.4f:%.4fx%.4f", left, top, float64(face.Max.X)/w, float64(face.Max.Y)/h,
+		)})
+	}
+	return focal, nil
+}
+
+// sample decodes a thumbnail of the image that fits in size x size
+func (c *cropProcessor) sample(ctx context.Context, blob *i.Blob, size int) (image.Image, error) {
+	img, err := c.vips.NewThumbnail(ctx, blob, size, size, vips.InterestingNone, vips.SizeDown, 1, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	// Focal points are relative to the image before it's rotated
+	if img.Orientation() > 1 {
+		return nil, errRotated
+	}
+	buf, err := img.ExportPng(vips.NewPngExportParams())
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(buf))
+}
+
+// smartCrops returns true if p crops the image with the smart operation
+func smartCrops(p imagorpath.Params) bool {
+	if !p.Smart || p.FitIn || p.Stretch || p.Trim || p.Width == 0 || p.Height == 0 {
+		return false
+	}
+	if p.CropLeft != 0 || p.CropTop != 0 || p.CropRight != 0 || p.CropBottom != 0 {
+		return false
+	}
+	for _, f := range p.Filters {
+		if f.Name == "focal" {
+			return false
+		}
+	}
+	return true
+}
+
+// entropyFocalPoint slides a window with the aspect ratio of the crop across
+// img and returns the center of the one whose luminance has the most
+// entropy. Ties go to the window closest to the center of img.
+func entropyFocalPoint(img image.Image, aspect float64) (float64, float64) {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	luma := make([]uint8, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			luma[y*w+x] = color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y
+		}
+	}
+
+	cw, ch := w, h
+	if float64(w)/float64(h) > aspect {
+		cw = max(1, int(math.Round(float64(h)*aspect)))
+	} else {
+		ch = max(1, int(math.Round(float64(w)/aspect)))
+	}
+	bestX, bestY := (w-cw)/2, (h-ch)/2
+	best, bestDist := -1.0, math.MaxInt
+	for y := 0; y <= h-ch; y++ {
+		for x := 0; x <= w-cw; x++ {
+			e := entropy(luma, w, x, y, cw, ch)
+			dist := abs(x-(w-cw)/2) + abs(y-(h-ch)/2)
+			if e > best+1e-9 || (e > best-1e-9 && dist < bestDist) {
+				best, bestDist, bestX, bestY = e, dist, x, y
+			}
+		}
+	}
+	return (float64(bestX) + float64(cw)/2) / float64(w), (float64(bestY) + float64(ch)/2) / float64(h)
+}
+
+// entropy returns the Shannon entropy of the luminance in a region of luma
+func entropy(luma []uint8, stride, left, top, width, height int) float64 {
+	var hist [256]int
+	for y := top; y < top+height; y++ {
+		for _, v := range luma[y*stride+left : y*stride+left+width] {
+			hist[v]++
+		}
+	}
+	n := float64(width * height)
+	e := 0.0
+	for _, count := range hist {
+		if count > 0 {
+			p := float64(count) / n
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// ExpandFaces rewrites the faces gravity of a /serve path, e.g.
+// /300x300/faces/blob/{key}, to the filter the image is processed with
+func ExpandFaces(path string) string {
+	segments := strings.Split(path, "/")
+	for n, segment := range segments {
+		if segment == "blob" || segment == "url" || strings.HasPrefix(segment, "filters:") {
+			return path
+		}
+		if segment != facesFilter {
+			continue
+		}
+		rest := segments[n+1:]
+		if len(rest) > 0 && strings.HasPrefix(rest[0], "filters:") {
+			rest[0] = "filters:" + facesFilter + "():" + strings.TrimPrefix(rest[0], "filters:")
+		} else {
+			rest = append([]string{"filters:" + facesFilter + "()"}, rest...)
+		}
+		return strings.Join(append(segments[:n], rest...), "/")
+	}
+	return path
+}
@@ -0,0 +1,100 @@
+package imagor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/cshum/imagor/vips"
+)
+
+// SourceLimits reject source images that would take too much memory to
+// decode, like a small PNG that's 50,000×50,000 pixels, before libvips
+// decodes them
+type SourceLimits struct {
+	// MaxPixels is the most pixels a frame of an image can have. Zero
+	// doesn't limit it.
+	MaxPixels int64
+	// MaxFrames is the most frames an animated image can have. Zero doesn't
+	// limit it.
+	MaxFrames int
+	// MaxDecodeMemory is the most bytes the frames of an image that are
+	// processed can take up once they're decoded. Zero doesn't limit it.
+	MaxDecodeMemory int64
+}
+
+func (l SourceLimits) enabled() bool {
+	return l.MaxPixels > 0 || l.MaxFrames > 0 || l.MaxDecodeMemory > 0
+}
+
+// bandBytes are the bytes each band of a pixel takes up in the color spaces
+// that aren't 8-bit
+var bandBytes = map[vips.Interpretation]int64{
+	vips.InterpretationRGB16:  2,
+	vips.InterpretationGrey16: 2,
+	vips.InterpretationScRGB:  4,
+	vips.InterpretationXYZ:    4,
+	vips.InterpretationLAB:    4,
+	vips.InterpretationLCH:    4,
+	vips.InterpretationCMC:    4,
+	vips.InterpretationYXY:    4,
+}
+
+// sourceLimitProcessor checks the header of images against the source limits
+// before they're processed, so they're rejected with 422 instead of running
+// the container out of memory
+type sourceLimitProcessor struct {
+	i.Processor
+	vips   *vips.Processor
+	limits SourceLimits
+	// maxFrames is the most frames of an animated image that are processed
+	maxFrames int
+}
+
+// Process implements imagor.Processor interface
+func (s *sourceLimitProcessor) Process(ctx context.Context, blob *i.Blob, p imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	if blob != nil && s.limits.enabled() {
+		if err := s.check(ctx, blob); err != nil {
+			return nil, err
+		}
+	}
+	return s.Processor.Process(ctx, blob, p, load)
+}
+
+// check returns an error if the image isn't within the limits. Only its
+// header is read.
+func (s *sourceLimitProcessor) check(ctx context.Context, blob *i.Blob) error {
+	img, err := s.vips.NewImage(ctx, blob, 1, 0, 0)
+	if err != nil {
+		// Images libvips can't read fail when they're processed
+		return nil
+	}
+	defer img.Close()
+
+	pixels := int64(img.Width()) * int64(img.PageHeight())
+	if s.limits.MaxPixels > 0 && pixels > s.limits.MaxPixels {
+		return sourceTooLarge("image can't have more than %d pixels, it has %d", s.limits.MaxPixels, pixels)
+	}
+	frames := max(img.Pages(), 1)
+	if s.limits.MaxFrames > 0 && frames > s.limits.MaxFrames {
+		return sourceTooLarge("image can't have more than %d frames, it has %d", s.limits.MaxFrames, frames)
+	}
+	if s.maxFrames > 0 {
+		frames = min(frames, s.maxFrames)
+	}
+	perBand, ok := bandBytes[img.Interpretation()]
+	if !ok {
+		perBand = 1
+	}
+	memory := pixels * int64(img.Bands()) * perBand * int64(frames)
+	if s.limits.MaxDecodeMemory > 0 && memory > s.limits.MaxDecodeMemory {
+		return sourceTooLarge("image can't take up more than %d bytes decoded, it takes up %d", s.limits.MaxDecodeMemory, memory)
+	}
+	return nil
+}
+
+func sourceTooLarge(format string, args ...any) error {
+	return i.NewError(fmt.Sprintf(format, args...), http.StatusUnprocessableEntity)
+}
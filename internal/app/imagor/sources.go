@@ -0,0 +1,78 @@
+package imagor
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	i "github.com/cshum/imagor"
+	"github.com/jaredLunde/railway-image-service/internal/app/imagor/httploader"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/sourceauth"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/ssrf"
+)
+
+// httpSources loads images from the allowed HTTP sources. The sources can be
+// replaced while the service is running without replacing imagor.
+type httpSources struct {
+	loader  atomic.Pointer[httploader.HTTPLoader]
+	maxSize int
+	policy  SourcePolicy
+	// guard checks the address every image is fetched from after its host
+	// name is resolved
+	guard *ssrf.Guard
+	// proxy returns the proxy images are fetched through, if any
+	proxy func(*http.Request) (*url.URL, error)
+	// auth are the credentials sent to the sources
+	auth *atomic.Pointer[sourceauth.Rules]
+	// hosts outlive the loaders, so a host stays broken when the sources are
+	// replaced
+	hosts *breakers
+}
+
+// set replaces the comma-separated list of host patterns images can be
+// loaded from. None can be if it's empty.
+func (s *httpSources) set(sources string) {
+	if sources == "" {
+		s.loader.Store(nil)
+		return
+	}
+	loader := httploader.New(
+		httploader.WithTransport(s.guard.Transport(s.proxy)),
+		httploader.WithForwardClientHeaders(false),
+		httploader.WithAccept("image/*"),
+		httploader.WithForwardHeaders(""),
+		httploader.WithOverrideResponseHeaders(""),
+		httploader.WithAllowedSources(sources),
+		httploader.WithAllowedSourceRegexps(""),
+		httploader.WithMaxAllowedSize(s.maxSize),
+		httploader.WithInsecureSkipVerifyTransport(false),
+		httploader.WithDefaultScheme("https"),
+		httploader.WithBaseURL(""),
+		httploader.WithProxyTransport("", ""),
+		httploader.WithBlockLoopbackNetworks(false),
+		httploader.WithBlockPrivateNetworks(false),
+		httploader.WithBlockLinkLocalNetworks(false),
+		httploader.WithBlockNetworks(),
+		httploader.WithUserAgent("RailwayImagesClient/1.0 (Platform: Linux; Architecture: x64)"),
+	)
+	if s.auth != nil {
+		loader.Transport = sourceauth.NewTransport(s.auth, loader.Transport)
+	}
+	loader.Transport = &sourceTransport{RoundTripper: loader.Transport, policy: s.policy, hosts: s.hosts}
+	s.loader.Store(loader)
+}
+
+// Get implements imagor.Loader interface
+func (s *httpSources) Get(r *http.Request, image string) (*i.Blob, error) {
+	loader := s.loader.Load()
+	if loader == nil {
+		return nil, i.ErrNotFound
+	}
+	return loader.Get(r, image)
+}
+
+// SetAllowedHTTPSources replaces the comma-separated list of host patterns
+// images can be loaded from. Images being loaded aren't affected.
+func (s *Imagor) SetAllowedHTTPSources(sources string) {
+	s.httpSources.set(sources)
+}
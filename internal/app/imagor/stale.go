@@ -0,0 +1,144 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	i "github.com/cshum/imagor"
+)
+
+// StaleWarning is the Warning header of processed images served from the
+// result cache after they expired
+const StaleWarning = `110 - "Response is Stale"`
+
+// errStaleOnly is returned by loaders while an expired image is looked up in
+// the result cache, so its source isn't loaded again
+var errStaleOnly = errors.New("only stale results are served")
+
+type staleKey struct{}
+
+// withStale lets the result cache serve expired images in ctx
+func withStale(ctx context.Context) context.Context {
+	return context.WithValue(ctx, staleKey{}, true)
+}
+
+func isStale(ctx context.Context) bool {
+	stale, _ := ctx.Value(staleKey{}).(bool)
+	return stale
+}
+
+// ServeHTTP serves processed images. With Config.StaleIfError, an image
+// that fails to load or process is served from the result cache after it
+// expired instead of the error, with a Warning header.
+func (s *Imagor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.staleIfError <= 0 {
+		s.Imagor.ServeHTTP(w, r)
+		return
+	}
+	failed := &staleWriter{w: w, header: http.Header{}}
+	s.Imagor.ServeHTTP(failed, r)
+	if !failed.held {
+		return
+	}
+	stale := &staleWriter{w: w, header: http.Header{}, stale: true}
+	s.Imagor.ServeHTTP(stale, r.WithContext(withStale(r.Context())))
+	if stale.held {
+		// There's no copy to serve, so it's the first error that's sent
+		failed.flush()
+		return
+	}
+	s.log.Warn("served a stale image", "path", r.URL.Path, "status", failed.code)
+}
+
+// staleWriter holds back responses with a status that a stale image can be
+// served in place of. Other responses are written as they are.
+type staleWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	stale       bool
+	wroteHeader bool
+	held        bool
+	code        int
+	body        bytes.Buffer
+}
+
+func (sw *staleWriter) Header() http.Header {
+	return sw.header
+}
+
+func (sw *staleWriter) WriteHeader(code int) {
+	if sw.wroteHeader {
+		return
+	}
+	sw.wroteHeader = true
+	sw.code = code
+	if code >= http.StatusInternalServerError || code == http.StatusRequestTimeout {
+		sw.held = true
+		return
+	}
+	for k, v := range sw.header {
+		sw.w.Header()[k] = v
+	}
+	if sw.stale {
+		// Caches shouldn't keep it for as long as a fresh image
+		sw.w.Header().Set("Cache-Control", "no-cache")
+		sw.w.Header().Set("Warning", StaleWarning)
+	}
+	sw.w.WriteHeader(code)
+}
+
+func (sw *staleWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if sw.held {
+		return sw.body.Write(b)
+	}
+	return sw.w.Write(b)
+}
+
+// flush writes the response that was held back
+func (sw *staleWriter) flush() {
+	for k, v := range sw.header {
+		sw.w.Header()[k] = v
+	}
+	sw.w.WriteHeader(sw.code)
+	sw.w.Write(sw.body.Bytes())
+}
+
+// staleResultStorage treats the images in a result cache that are older than
+// ttl as expired, unless the request allows stale images. The cache itself
+// keeps them for longer.
+type staleResultStorage struct {
+	i.Storage
+	ttl time.Duration
+}
+
+// Get implements imagor.Storage interface
+func (s *staleResultStorage) Get(r *http.Request, key string) (*i.Blob, error) {
+	blob, err := s.Storage.Get(r, key)
+	if err != nil || blob == nil || blob.Stat == nil || isStale(r.Context()) {
+		return blob, err
+	}
+	if time.Since(blob.Stat.ModifiedTime) > s.ttl {
+		return nil, i.ErrExpired
+	}
+	return blob, nil
+}
+
+// staleLoader doesn't load images while an expired image is looked up in the
+// result cache
+type staleLoader struct {
+	i.Loader
+}
+
+// Get implements imagor.Loader interface
+func (l *staleLoader) Get(r *http.Request, image string) (*i.Blob, error) {
+	if isStale(r.Context()) {
+		return nil, errStaleOnly
+	}
+	return l.Loader.Get(r, image)
+}
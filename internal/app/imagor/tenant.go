@@ -0,0 +1,128 @@
+package imagor
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/cshum/imagor/imagorpath"
+)
+
+type tenantKey struct{}
+
+// WithTenant limits the blobs loaded for requests with ctx to the keys of
+// tenant. Paths are decoded again by imagor and by filters, so it's where
+// blobs are loaded that tenants are enforced, not only in their paths.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	if tenant == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+func tenantOf(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// tenantAllows reports whether the blob of image can be loaded with ctx.
+// Images that aren't blobs are left to the other loaders.
+func tenantAllows(ctx context.Context, image string) bool {
+	tenant := tenantOf(ctx)
+	if tenant == "" {
+		return true
+	}
+	key, ok := strings.CutPrefix(strings.TrimPrefix(image, "/"), "blob/")
+	return !ok || tenantOwns(key, tenant)
+}
+
+// tenantOwns reports whether key is one of tenant's. Keys aren't paths, but
+// ones with .. segments are rejected in case anything between here and
+// storage resolves them out of the tenant's keys.
+func tenantOwns(key, tenant string) bool {
+	return strings.HasPrefix(key, tenant+"/") && !slices.Contains(strings.Split(key, "/"), "..")
+}
+
+// tenantArgPattern matches the blob keys in the arguments of the filters of
+// a /serve path, e.g. watermark(blob/logo.png,10,10,0)
+var tenantArgPattern = regexp.MustCompile(`([(,])blob/`)
+
+// TenantPath scopes the image of a /serve path, and any blobs its filters
+// load like watermarks, to the keys of tenant. Only blob keys are rewritten,
+// so the URLs of images from HTTP sources are left as they are.
+func TenantPath(path, tenant string) string {
+	path = tenantArgPattern.ReplaceAllString(path, "${1}blob/"+tenant+"/")
+	source := frameSource(imagorpath.Parse(path).Image)
+	if !strings.HasPrefix(source, "blob/") {
+		return path
+	}
+	// The image is the end of the path, where it may still be URL encoded
+	for n := strings.Index(path, "blob/"); n >= 0; {
+		if n == 0 || path[n-1] == '/' {
+			raw := path[n:]
+			if unescaped, err := url.QueryUnescape(raw); raw == source || err == nil && unescaped == source {
+				return path[:n] + "blob/" + tenant + "/" + strings.TrimPrefix(raw, "blob/")
+			}
+		}
+		next := strings.Index(path[n+1:], "blob/")
+		if next < 0 {
+			break
+		}
+		n += next + 1
+	}
+	return path
+}
+
+// TenantPathAllowed reports whether all of the blobs a /serve path refers to,
+// as its image or in the arguments of filters like watermarks, are tenant's,
+// however many times they're URL decoded. Processed images are cached by
+// their path, so a path that decodes to another tenant's blobs could be
+// served from the result cache without them being loaded.
+func TenantPathAllowed(path, tenant string) bool {
+	for {
+		p := imagorpath.Parse(path)
+		if !tenantRef(frameSource(p.Image), tenant) {
+			return false
+		}
+		for _, f := range p.Filters {
+			for _, arg := range strings.Split(f.Args, ",") {
+				if !tenantRef(arg, tenant) {
+					return false
+				}
+			}
+		}
+		unescaped, err := url.QueryUnescape(path)
+		if err != nil || unescaped == path {
+			return true
+		}
+		path = unescaped
+	}
+}
+
+// tenantRef reports whether ref is tenant's blob, or not a blob at all, once
+// it's fully URL decoded
+func tenantRef(ref, tenant string) bool {
+	for {
+		key, ok := strings.CutPrefix(strings.TrimPrefix(ref, "/"), "blob/")
+		if ok && !tenantOwns(key, tenant) {
+			return false
+		}
+		unescaped, err := url.QueryUnescape(ref)
+		if err != nil || unescaped == ref {
+			return true
+		}
+		ref = unescaped
+	}
+}
+
+// blobRefPattern matches the blob:{key} arguments of filters in a /serve
+// path, e.g. watermark(blob:logo.png,10,10,0)
+var blobRefPattern = regexp.MustCompile(`([(,])blob:`)
+
+// ExpandBlobRefs rewrites the blob:{key} arguments of filters in a /serve
+// path to the blob/{key} images are loaded from
+func ExpandBlobRefs(path string) string {
+	return blobRefPattern.ReplaceAllString(path, "${1}blob/")
+}
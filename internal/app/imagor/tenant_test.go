@@ -0,0 +1,300 @@
+package imagor
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	i "github.com/cshum/imagor"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+func TestTenantPath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{
+			name: "blob image",
+			path: "fit-in/200x200/blob/logo.png",
+			want: "fit-in/200x200/blob/acme/logo.png",
+		},
+		{
+			name: "image from a URL",
+			path: "fit-in/200x200/https://example.com/blob/logo.png",
+			want: "fit-in/200x200/https://example.com/blob/logo.png",
+		},
+		{
+			name: "frame of a blob",
+			path: "fit-in/200x200/frame/2s/blob/clip.mp4",
+			want: "fit-in/200x200/frame/2s/blob/acme/clip.mp4",
+		},
+		{
+			name: "another tenant's blob",
+			path: "fit-in/200x200/blob/other/logo.png",
+			want: "fit-in/200x200/blob/acme/other/logo.png",
+		},
+		{
+			name: "key starting with blob",
+			path: "fit-in/200x200/blob/blob/logo.png",
+			want: "fit-in/200x200/blob/acme/blob/logo.png",
+		},
+		{
+			name: "dot segments",
+			path: "fit-in/blob/../other/photo.jpg",
+			want: "fit-in/blob/acme/../other/photo.jpg",
+		},
+		{
+			name: "watermark",
+			path: "fit-in/200x200/filters:watermark(blob/logo.png,10,10,0)/blob/photo.jpg",
+			want: "fit-in/200x200/filters:watermark(blob/acme/logo.png,10,10,0)/blob/acme/photo.jpg",
+		},
+		{
+			name: "watermark blob ref",
+			path: ExpandBlobRefs("filters:watermark(blob:other/logo.png,10,10,0)/blob/photo.jpg"),
+			want: "filters:watermark(blob/acme/other/logo.png,10,10,0)/blob/acme/photo.jpg",
+		},
+		{
+			name: "font",
+			path: "filters:text(Hello,blob/fonts/inter.ttf,32)/blob/card.png",
+			want: "filters:text(Hello,blob/acme/fonts/inter.ttf,32)/blob/acme/card.png",
+		},
+		{
+			name: "font blob ref",
+			path: ExpandBlobRefs("filters:text(Hello,blob:fonts/inter.ttf,32)/blob/card.png"),
+			want: "filters:text(Hello,blob/acme/fonts/inter.ttf,32)/blob/acme/card.png",
+		},
+		{
+			name: "encoded font",
+			path: "filters:text(Hello,blob%2Fother%2Finter.ttf,32)/blob/card.png",
+			want: "filters:text(Hello,blob%2Fother%2Finter.ttf,32)/blob/acme/card.png",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TenantPath(tt.path, "acme"); got != tt.want {
+				t.Errorf("TenantPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTenantPathAllowed(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{
+			name: "tenant's blob",
+			path: "fit-in/200x200/blob/acme/logo.png",
+			want: true,
+		},
+		{
+			name: "image from a URL",
+			path: "fit-in/200x200/https://example.com/blob/logo.png",
+			want: true,
+		},
+		{
+			name: "another tenant's blob",
+			path: "fit-in/200x200/blob/other/logo.png",
+			want: false,
+		},
+		{
+			name: "tenant name as a prefix of another",
+			path: "fit-in/200x200/blob/acmecorp/logo.png",
+			want: false,
+		},
+		{
+			name: "encoded blob",
+			path: "fit-in/200x200/blob%2Fother%2Flogo.png",
+			want: false,
+		},
+		{
+			name: "dot segments",
+			path: "fit-in/blob/acme/../other/photo.jpg",
+			want: false,
+		},
+		{
+			name: "encoded dot segments",
+			path: "fit-in/blob%2Facme%2F..%2Fother%2Fphoto.jpg",
+			want: false,
+		},
+		{
+			name: "frame of another tenant's blob",
+			path: "fit-in/200x200/frame/2s/blob/other/clip.mp4",
+			want: false,
+		},
+		{
+			name: "tenant's watermark",
+			path: "filters:watermark(blob/acme/logo.png,10,10,0)/blob/acme/photo.jpg",
+			want: true,
+		},
+		{
+			name: "another tenant's watermark",
+			path: "filters:watermark(blob/other/logo.png,10,10,0)/blob/acme/photo.jpg",
+			want: false,
+		},
+		{
+			name: "another tenant's watermark blob ref",
+			path: ExpandBlobRefs("filters:watermark(blob:other/logo.png,10,10,0)/blob/acme/photo.jpg"),
+			want: false,
+		},
+		{
+			name: "double encoded watermark",
+			path: "filters:watermark(blob%252Fother%252Flogo.png,0,0,0)/blob/acme/photo.jpg",
+			want: false,
+		},
+		{
+			name: "watermark with dot segments",
+			path: "filters:watermark(blob/acme/../other/logo.png,0,0,0)/blob/acme/photo.jpg",
+			want: false,
+		},
+		{
+			name: "tenant's font",
+			path: "filters:text(Hello,blob/acme/fonts/inter.ttf,32)/blob/acme/card.png",
+			want: true,
+		},
+		{
+			name: "another tenant's font",
+			path: "filters:text(Hello,blob/other/inter.ttf,32)/blob/acme/card.png",
+			want: false,
+		},
+		{
+			name: "encoded font",
+			path: "filters:text(Hello,blob%2Fother%2Finter.ttf,32)/blob/acme/card.png",
+			want: false,
+		},
+		{
+			name: "font with encoded dot segments",
+			path: "filters:text(Hello,blob%2Facme%2F%2E%2E%2Fother%2Finter.ttf,32)/blob/acme/card.png",
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TenantPathAllowed(tt.path, "acme"); got != tt.want {
+				t.Errorf("TenantPathAllowed(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTenantAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		tenant string
+		image  string
+		want   bool
+	}{
+		{
+			name:   "without a tenant",
+			tenant: "",
+			image:  "blob/other/logo.png",
+			want:   true,
+		},
+		{
+			name:   "tenant's blob",
+			tenant: "acme",
+			image:  "blob/acme/logo.png",
+			want:   true,
+		},
+		{
+			name:   "leading slash",
+			tenant: "acme",
+			image:  "/blob/acme/logo.png",
+			want:   true,
+		},
+		{
+			name:   "another tenant's blob",
+			tenant: "acme",
+			image:  "blob/other/logo.png",
+			want:   false,
+		},
+		{
+			name:   "tenant name as a prefix of another",
+			tenant: "acme",
+			image:  "blob/acmecorp/logo.png",
+			want:   false,
+		},
+		{
+			name:   "dot segments",
+			tenant: "acme",
+			image:  "blob/acme/../other/logo.png",
+			want:   false,
+		},
+		{
+			name:   "image from a URL",
+			tenant: "acme",
+			image:  "https://example.com/blob/other/logo.png",
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := WithTenant(context.Background(), tt.tenant)
+			if got := tenantAllows(ctx, tt.image); got != tt.want {
+				t.Errorf("tenantAllows(%q) = %v, want %v", tt.image, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTextFontTenant(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr error
+	}{
+		{
+			name: "tenant's font",
+			file: "blob/acme/inter.ttf",
+		},
+		{
+			name: "encoded tenant's font",
+			file: "blob%2Facme%2Finter.ttf",
+		},
+		{
+			name:    "another tenant's font",
+			file:    "blob/other/inter.ttf",
+			wantErr: i.ErrNotFound,
+		},
+		{
+			name:    "encoded font of another tenant",
+			file:    "blob%2Fother%2Finter.ttf",
+			wantErr: i.ErrNotFound,
+		},
+		{
+			name:    "font with dot segments",
+			file:    "blob/acme/../other/inter.ttf",
+			wantErr: i.ErrNotFound,
+		},
+		{
+			name:    "encoded font with dot segments",
+			file:    "blob%2Facme%2F..%2Fother%2Finter.ttf",
+			wantErr: i.ErrNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var loaded string
+			load := func(image string) (*i.Blob, error) {
+				loaded = image
+				return i.NewBlobFromBytes(goregular.TTF), nil
+			}
+			ctx := WithTenant(context.Background(), "acme")
+			_, err := newTextRenderer().font(ctx, tt.file, load)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("font() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && loaded != "" {
+				t.Errorf("font() loaded %q", loaded)
+			}
+		})
+	}
+}
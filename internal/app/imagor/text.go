@@ -0,0 +1,297 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/vips"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// textFilter draws text over an image, e.g. for Open Graph cards:
+// text(string,font,size,color,gravity[,background]). The string is URL
+// encoded, and the font is a blob:{key} of a TrueType or OpenType font, or
+// empty for the default one.
+const textFilter = "text"
+
+const (
+	// maxTextLength is the most characters text can draw
+	maxTextLength = 500
+	// maxTextSize is the largest font size in pixels
+	maxTextSize = 1000
+	// defaultTextSize is the font size when it's not given
+	defaultTextSize = 32
+	// maxCachedFonts is how many parsed fonts are kept
+	maxCachedFonts = 32
+)
+
+// textRenderer draws the text of text filters, caching the fonts loaded from
+// blob storage by their content
+type textRenderer struct {
+	mu          sync.Mutex
+	fonts       map[string]*opentype.Font
+	defaultFont *opentype.Font
+}
+
+func newTextRenderer() *textRenderer {
+	// The Go font is embedded, so it can't fail to parse
+	defaultFont, _ := opentype.Parse(goregular.TTF)
+	return &textRenderer{fonts: map[string]*opentype.Font{}, defaultFont: defaultFont}
+}
+
+// Filter implements vips.FilterFunc
+func (t *textRenderer) Filter(ctx context.Context, img *vips.Image, load i.LoadFunc, args ...string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	text := args[0]
+	if unescaped, err := url.QueryUnescape(text); err == nil {
+		text = unescaped
+	}
+	if text == "" {
+		return nil
+	}
+	if utf8.RuneCountInString(text) > maxTextLength {
+		return i.NewError("text is too long", 400)
+	}
+	fontFile := ""
+	if len(args) > 1 {
+		fontFile = args[1]
+	}
+	size := defaultTextSize
+	if len(args) > 2 && args[2] != "" {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n <= 0 || n > maxTextSize {
+			return i.NewError("invalid text size", 400)
+		}
+		size = n
+	}
+	fg := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	if len(args) > 3 && args[3] != "" {
+		c, ok := parseHexColor(args[3])
+		if !ok {
+			return i.NewError("invalid text color", 400)
+		}
+		fg = c
+	}
+	gravity := "south"
+	if len(args) > 4 && args[4] != "" {
+		gravity = args[4]
+	}
+	var bg *color.NRGBA
+	if len(args) > 5 && args[5] != "" {
+		c, ok := parseHexColor(args[5])
+		if !ok {
+			return i.NewError("invalid background color", 400)
+		}
+		bg = &c
+	}
+
+	f, err := t.font(ctx, fontFile, load)
+	if err != nil {
+		return err
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: float64(size), DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+
+	margin := size / 2
+	width, height := img.Width(), img.PageHeight()
+	lines := wrapText(face, text, width-2*margin)
+	overlay := drawText(face, lines, fg, bg, margin)
+	x, y, ok := gravityOffset(gravity, width, height, overlay.Bounds().Dx(), overlay.Bounds().Dy())
+	if !ok {
+		return i.NewError("invalid text gravity", 400)
+	}
+	return compositeText(img, overlay, x, y)
+}
+
+// font returns the font in the blob of a blob:{key} argument, after it's been
+// expanded to blob/{key}, or the default font if it's empty. Fonts are only
+// loaded from the keys of the tenant of ctx, if it has one.
+func (t *textRenderer) font(ctx context.Context, file string, load i.LoadFunc) (*opentype.Font, error) {
+	if file == "" {
+		return t.defaultFont, nil
+	}
+	if unescaped, err := url.QueryUnescape(file); err == nil {
+		file = unescaped
+	}
+	// Fonts can't be loaded from URLs
+	if !strings.HasPrefix(file, "blob/") {
+		return nil, i.NewError("font must be a blob", 400)
+	}
+	if !tenantAllows(ctx, file) {
+		return nil, i.ErrNotFound
+	}
+	blob, err := load(file)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := blob.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(buf)
+	key := hex.EncodeToString(sum[:])
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f, ok := t.fonts[key]; ok {
+		return f, nil
+	}
+	f, err := opentype.Parse(buf)
+	if err != nil {
+		return nil, i.NewError("invalid font", 400)
+	}
+	if len(t.fonts) >= maxCachedFonts {
+		clear(t.fonts)
+	}
+	t.fonts[key] = f
+	return f, nil
+}
+
+// wrapText breaks text into lines that fit in width pixels where it can.
+// Line breaks in the text are kept.
+func wrapText(face font.Face, text string, width int) []string {
+	limit := fixed.I(max(width, 1))
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			if line == "" {
+				line = word
+				continue
+			}
+			if font.MeasureString(face, line+" "+word) > limit {
+				lines = append(lines, line)
+				line = word
+				continue
+			}
+			line += " " + word
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// drawText draws lines of text, centered on each other, with margin pixels
+// around them filled with bg if it isn't nil
+func drawText(face font.Face, lines []string, fg color.NRGBA, bg *color.NRGBA, margin int) *image.NRGBA {
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	textWidth := 0
+	for _, line := range lines {
+		textWidth = max(textWidth, font.MeasureString(face, line).Ceil())
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, textWidth+2*margin, lineHeight*len(lines)+2*margin))
+	if bg != nil {
+		draw.Draw(out, out.Bounds(), image.NewUniform(*bg), image.Point{}, draw.Src)
+	}
+	d := font.Drawer{Dst: out, Src: image.NewUniform(fg), Face: face}
+	for n, line := range lines {
+		lineWidth := font.MeasureString(face, line)
+		d.Dot = fixed.Point26_6{
+			X: fixed.I(margin) + (fixed.I(textWidth)-lineWidth)/2,
+			Y: fixed.I(margin+n*lineHeight) + metrics.Ascent,
+		}
+		d.DrawString(line)
+	}
+	return out
+}
+
+// gravityOffset returns where an overlay is placed on an image by gravity,
+// e.g. north, southeast or center. It returns false for unknown gravities.
+func gravityOffset(gravity string, width, height, overlayWidth, overlayHeight int) (int, int, bool) {
+	x, y := (width-overlayWidth)/2, (height-overlayHeight)/2
+	switch gravity {
+	case "center":
+	case "north":
+		y = 0
+	case "south":
+		y = height - overlayHeight
+	case "east":
+		x = width - overlayWidth
+	case "west":
+		x = 0
+	case "northeast":
+		x, y = width-overlayWidth, 0
+	case "northwest":
+		x, y = 0, 0
+	case "southeast":
+		x, y = width-overlayWidth, height-overlayHeight
+	case "southwest":
+		x, y = 0, height-overlayHeight
+	default:
+		return 0, 0, false
+	}
+	return x, y, true
+}
+
+// compositeText draws overlay over every frame of img at x, y
+func compositeText(img *vips.Image, overlay *image.NRGBA, x, y int) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, overlay); err != nil {
+		return err
+	}
+	layer, err := vips.LoadImageFromBuffer(buf.Bytes(), nil)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+	if img.Bands() < 3 {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+	if err := layer.EmbedBackgroundRGBA(x, y, img.Width(), img.PageHeight(), &vips.ColorRGBA{}); err != nil {
+		return err
+	}
+	if frames := img.Height() / img.PageHeight(); frames > 1 {
+		if err := layer.Replicate(1, frames); err != nil {
+			return err
+		}
+	}
+	return img.Composite(layer, vips.BlendModeOver, 0, 0)
+}
+
+// parseHexColor parses an RGB or RRGGBB color, optionally followed by an
+// alpha of A or AA
+func parseHexColor(s string) (color.NRGBA, bool) {
+	s = strings.TrimPrefix(s, "#")
+	switch len(s) {
+	case 3, 4:
+		expanded := make([]byte, 0, len(s)*2)
+		for n := 0; n < len(s); n++ {
+			expanded = append(expanded, s[n], s[n])
+		}
+		s = string(expanded)
+	case 6, 8:
+	default:
+		return color.NRGBA{}, false
+	}
+	if len(s) == 6 {
+		s += "ff"
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, false
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, true
+}
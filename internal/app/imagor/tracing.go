@@ -0,0 +1,29 @@
+package imagor
+
+import (
+	"context"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/tracing"
+)
+
+// tracingProcessor records a span for every image its processor processes
+type tracingProcessor struct {
+	i.Processor
+	tracer *tracing.Tracer
+}
+
+func (p *tracingProcessor) Process(ctx context.Context, blob *i.Blob, params imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	ctx, span := p.tracer.Start(ctx, "imagor.process")
+	defer span.End()
+	span.SetAttribute("image.path", params.Path)
+	span.SetAttribute("image.source", params.Image)
+	out, err := p.Processor.Process(ctx, blob, params, load)
+	span.RecordError(err)
+	if err == nil && out != nil {
+		span.SetAttribute("image.content_type", out.ContentType())
+		span.SetAttribute("image.size", out.Size())
+	}
+	return out, err
+}
@@ -0,0 +1,140 @@
+package imagor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/app/jobs"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+const (
+	// TransformJobType is the type of the jobs that process images and
+	// store them as blobs
+	TransformJobType = "transform"
+	// MaxTransforms is the most images a single transform job processes
+	MaxTransforms = 1000
+)
+
+type TransformRequest struct {
+	Transforms []Transform `json:"transforms"`
+}
+
+type Transform struct {
+	// Key of the blob to process
+	Key string `json:"key"`
+	// Operation to process it with, e.g. "fit-in/800x0/filters:format(avif)"
+	Operation string `json:"operation"`
+	// Destination is the key the processed image is stored at
+	Destination string `json:"destination"`
+}
+
+// TransformHandler queues a job that processes every transform of a
+// TransformRequest and stores the images at their destinations, and
+// responds with the job. Its progress can be looked up at /jobs/{id}.
+func (s *Imagor) TransformHandler(c fiber.Ctx) error {
+	if s.jobs == nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	var req TransformRequest
+	if err := json.Unmarshal(c.Body(), &req); err != nil || len(req.Transforms) == 0 {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if len(req.Transforms) > MaxTransforms {
+		return c.Status(fiber.StatusBadRequest).SendString("too many transforms")
+	}
+
+	tenant := mw.GetTenant(c)
+	destinations := make([]string, 0, len(req.Transforms))
+	for _, t := range req.Transforms {
+		t.Destination = strings.TrimPrefix(t.Destination, "/")
+		if t.Destination == "" {
+			return c.Status(fiber.StatusBadRequest).SendString("missing destination")
+		}
+		p, ok := blobParams(t.Key, t.Operation, tenant)
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).SendString("invalid operation: " + t.Operation)
+		}
+		if err := s.limits.Check(p); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		destinations = append(destinations, t.Destination)
+	}
+	mw.SetAuditKeys(c, destinations...)
+
+	job, err := s.jobs.Enqueue(c.Context(), TransformJobType, tenant, len(req.Transforms), req)
+	if errors.Is(err, jobs.ErrQueueFull) {
+		return c.SendStatus(fiber.StatusServiceUnavailable)
+	}
+	if err != nil {
+		s.log.Error("failed to queue transform job", "error", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+// transform runs a transform job, processing its images one at a time so
+// jobs don't crowd out the images being served
+func (s *Imagor) transform(ctx context.Context, job jobs.Job, progress *jobs.Progress) error {
+	var req TransformRequest
+	if err := json.Unmarshal(job.Input, &req); err != nil {
+		return err
+	}
+	for _, t := range req.Transforms {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		artifact, err := s.transformImage(ctx, job.Tenant, t)
+		if err != nil {
+			s.log.Error("failed to transform image", "key", t.Key, "operation", t.Operation, "error", err)
+			progress.Fail(ctx, t.Key, err)
+			continue
+		}
+		progress.Done(ctx, &artifact)
+	}
+	return nil
+}
+
+// transformImage processes the image of a transform and stores it at its
+// destination
+func (s *Imagor) transformImage(ctx context.Context, tenant string, t Transform) (jobs.Artifact, error) {
+	p, ok := blobParams(t.Key, t.Operation, tenant)
+	if !ok {
+		return jobs.Artifact{}, fmt.Errorf("invalid operation: %s", t.Operation)
+	}
+	// Without a path, imagor doesn't check the signature
+	p.Path = ""
+	blob, err := s.Serve(WithTenant(ctx, tenant), p)
+	if err != nil {
+		return jobs.Artifact{}, err
+	}
+	r, size, err := blob.NewReader()
+	if err != nil {
+		return jobs.Artifact{}, err
+	}
+	defer r.Close()
+	if size <= 0 {
+		size = -1
+	}
+
+	destination := strings.TrimPrefix(t.Destination, "/")
+	key := []byte(destination)
+	if tenant != "" {
+		key = []byte(tenant + "/" + destination)
+	}
+	if !s.kv.LockKey(key) {
+		return jobs.Artifact{}, fmt.Errorf("%s is being written", destination)
+	}
+	defer s.kv.UnlockKey(key)
+	if status := s.kv.Write(ctx, key, r, int(size), keyval.WriteOptions{}); status != fiber.StatusCreated {
+		return jobs.Artifact{}, fmt.Errorf("failed to store %s: %s", destination, http.StatusText(status))
+	}
+	rec := s.kv.GetRecord(key)
+	return jobs.Artifact{Key: destination, Size: rec.Size, ContentType: rec.ContentType}, nil
+}
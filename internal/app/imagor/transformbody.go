@@ -0,0 +1,95 @@
+package imagor
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+// TransformEndpoint is the path images in the request body are processed at
+const TransformEndpoint = "/serve/transform"
+
+// bodyImage is the image of the operations of a /serve/transform request,
+// which is replaced by the request body
+const bodyImage = "body"
+
+// TransformBodyHandler processes the image in the request body with the
+// operation in the query and responds with the result, without storing
+// either of them, e.g. POST /serve/transform?operation=fit-in/800x0
+func (s *Imagor) TransformBodyHandler(c fiber.Ctx) error {
+	p, ok := bodyParams(c.Query("operation"), mw.GetTenant(c))
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid operation: " + c.Query("operation"))
+	}
+	if err := s.limits.Check(p); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	var body io.Reader
+	if stream := c.Request().BodyStream(); stream != nil {
+		body = stream
+	} else {
+		body = bytes.NewReader(c.Body())
+	}
+	// The body is read one byte past the limit to tell if it's over it
+	buf, err := io.ReadAll(io.LimitReader(body, int64(s.maxUploadSize)+1))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if len(buf) > s.maxUploadSize {
+		return c.SendStatus(fiber.StatusRequestEntityTooLarge)
+	}
+	if len(buf) == 0 {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	blob := i.NewBlobFromBytes(buf)
+	if blob.BlobType() == i.BlobTypeUnknown {
+		return c.SendStatus(fiber.StatusUnsupportedMediaType)
+	}
+
+	out, err := s.ServeBlob(WithTenant(c.Context(), mw.GetTenant(c)), blob, p)
+	if err != nil {
+		status := ErrorStatus(err)
+		if status >= fiber.StatusInternalServerError {
+			s.log.Error("failed to transform image", "operation", c.Query("operation"), "error", err)
+		}
+		return c.SendStatus(status)
+	}
+	res, err := out.ReadAll()
+	if err != nil {
+		s.log.Error("failed to transform image", "operation", c.Query("operation"), "error", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	// Nothing is stored, so the result can't be cached either
+	c.Set("Cache-Control", "no-store")
+	c.Set(fiber.HeaderContentType, out.ContentType())
+	return c.Send(res)
+}
+
+// bodyParams parses an operation on the image in a request body. Like the
+// operations of warm jobs, it can't load another image instead.
+func bodyParams(op, tenant string) (imagorpath.Params, bool) {
+	op = strings.Trim(op, "/")
+	if strings.HasPrefix(op, "unsafe/") {
+		return imagorpath.Params{}, false
+	}
+	path := "/unsafe/"
+	if op != "" {
+		path += op + "/"
+	}
+	path = ExpandFaces(ExpandBlobRefs(path)) + bodyImage
+	if tenant != "" {
+		// The blobs of watermarks are loaded from the tenant's namespace
+		path = TenantPath(path, tenant)
+		if !TenantPathAllowed(path, tenant) {
+			return imagorpath.Params{}, false
+		}
+	}
+	p := imagorpath.Parse(path)
+	return p, p.Image == bodyImage && !p.Meta
+}
@@ -0,0 +1,148 @@
+package imagor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+// MaxVariants is the most variants a single request can make, i.e. the
+// number of widths times the number of formats
+const MaxVariants = 100
+
+// variantFormats are the formats variants can be made in
+var variantFormats = []string{"jpeg", "png", "gif", "webp", "avif"}
+
+type VariantsRequest struct {
+	// Key of the blob to make variants of
+	Key string `json:"key"`
+	// Widths to make the image in. Images aren't made any wider than they
+	// are.
+	Widths []int `json:"widths"`
+	// Formats to make each width in, e.g. "webp" or "avif". Images are
+	// served in their own format, or the one browsers are served
+	// automatically, if it's empty.
+	Formats []string `json:"formats,omitempty"`
+	// ExpiresIn is how long the URLs are valid for, e.g. "24h". They never
+	// expire if it's empty.
+	ExpiresIn string `json:"expires_in,omitempty"`
+}
+
+type VariantsResponse struct {
+	Key  string       `json:"key"`
+	Sets []VariantSet `json:"sets"`
+	// Job renders the variants into the result cache. Its progress can be
+	// looked up at /serve/warm/{id}.
+	Job WarmJob `json:"job"`
+}
+
+type VariantSet struct {
+	// Format of the variants, or empty if they're served in the image's own
+	// format
+	Format string `json:"format,omitempty"`
+	// SrcSet is the srcset attribute of the variants
+	SrcSet   string    `json:"srcset"`
+	Variants []Variant `json:"variants"`
+}
+
+type Variant struct {
+	Width int    `json:"width"`
+	URL   string `json:"url"`
+}
+
+// VariantsHandler responds with signed /serve URLs of a blob in every width
+// and format of a VariantsRequest, grouped into srcsets by format, and
+// renders them into the result cache in the background
+func (s *Imagor) VariantsHandler(c fiber.Ctx) error {
+	var req VariantsRequest
+	if err := json.Unmarshal(c.Body(), &req); err != nil || req.Key == "" || len(req.Widths) == 0 {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	widths := slices.Clone(req.Widths)
+	slices.Sort(widths)
+	widths = slices.Compact(widths)
+	if widths[0] <= 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid width")
+	}
+	formats := slices.Compact(slices.Clone(req.Formats))
+	for _, format := range formats {
+		if !slices.Contains(variantFormats, format) && (format != jxlFormat || !jxlSupported) {
+			return c.Status(fiber.StatusBadRequest).SendString("invalid format: " + format)
+		}
+	}
+	if len(formats) == 0 {
+		formats = []string{""}
+	}
+	if len(widths)*len(formats) > MaxVariants {
+		return c.Status(fiber.StatusBadRequest).SendString("too many variants")
+	}
+	opts := sign.Options{}
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("invalid expires_in")
+		}
+		opts.ExpireServe = true
+		opts.ExpireAt = time.Now().Add(d)
+	}
+	base, err := url.Parse(string(c.Request().URI().FullURI()))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid request")
+	}
+	base.RawPath = ""
+	base.RawQuery = ""
+	mw.SetAuditKeys(c, req.Key)
+
+	tenant := mw.GetTenant(c)
+	secret := s.signSecret
+	if tenant != "" {
+		secret = sign.TenantSecret(s.signSecret, tenant)
+		base.RawQuery = url.Values{"x-tenant": {tenant}}.Encode()
+	}
+	res := VariantsResponse{Key: req.Key}
+	job := &WarmJob{
+		ID:        newWarmJobID(),
+		Status:    WarmJobRunning,
+		Total:     len(widths) * len(formats),
+		CreatedAt: time.Now().UTC(),
+		tenant:    tenant,
+	}
+	for _, format := range formats {
+		set := VariantSet{Format: format}
+		var srcset []string
+		for _, width := range widths {
+			op := fmt.Sprintf("fit-in/%dx0", width)
+			if format != "" {
+				op += "/filters:format(" + format + ")"
+			}
+			p, ok := blobParams(req.Key, op, tenant)
+			if !ok {
+				return c.Status(fiber.StatusBadRequest).SendString("invalid key")
+			}
+			if err := s.limits.Check(p); err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+			}
+			u := *base
+			u.Path = "/serve/" + op + "/blob/" + req.Key
+			uri, err := sign.SignURLWithOptions(&u, secret, opts)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString("invalid request")
+			}
+			set.Variants = append(set.Variants, Variant{Width: width, URL: *uri})
+			// Commas separate the candidates of a srcset
+			srcset = append(srcset, fmt.Sprintf("%s %dw", strings.ReplaceAll(*uri, ",", "%2C"), width))
+			job.images = append(job.images, warmImage{key: req.Key, operation: op, params: p})
+		}
+		set.SrcSet = strings.Join(srcset, ", ")
+		res.Sets = append(res.Sets, set)
+	}
+	res.Job = s.startWarm(job)
+	return c.JSON(res)
+}
@@ -0,0 +1,251 @@
+package imagor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+const (
+	// MaxWarmSize is the most images a single warm job renders, i.e. the
+	// number of keys times the number of operations
+	MaxWarmSize = 1000
+	// warmJobTTL is how long finished warm jobs can be looked up
+	warmJobTTL = time.Hour
+)
+
+// Warm job statuses
+const (
+	WarmJobRunning  = "running"
+	WarmJobDone     = "done"
+	WarmJobCanceled = "canceled"
+)
+
+type WarmRequest struct {
+	// Keys of the blobs to render
+	Keys []string `json:"keys"`
+	// Operations to render each blob with, e.g. "200x200" or
+	// "fit-in/800x0/filters:format(webp)"
+	Operations []string `json:"operations"`
+}
+
+type WarmJob struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// Total is the number of images the job renders
+	Total int `json:"total"`
+	// Completed is the number of images that were rendered
+	Completed int `json:"completed"`
+	// Failed is the number of images that couldn't be rendered
+	Failed     int         `json:"failed"`
+	Errors     []WarmError `json:"errors,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+
+	tenant string
+	images []warmImage
+}
+
+type WarmError struct {
+	Key       string `json:"key"`
+	Operation string `json:"operation"`
+	Error     string `json:"error"`
+}
+
+type warmImage struct {
+	key       string
+	operation string
+	params    imagorpath.Params
+}
+
+// WarmHandler starts a job that renders every operation of a WarmRequest
+// for each of its keys into the result cache, and responds with the job
+func (s *Imagor) WarmHandler(c fiber.Ctx) error {
+	var req WarmRequest
+	if err := json.Unmarshal(c.Body(), &req); err != nil || len(req.Keys) == 0 || len(req.Operations) == 0 {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if len(req.Keys)*len(req.Operations) > MaxWarmSize {
+		return c.Status(fiber.StatusBadRequest).SendString("too many images")
+	}
+	mw.SetAuditKeys(c, req.Keys...)
+
+	tenant := mw.GetTenant(c)
+	job := &WarmJob{
+		ID:        newWarmJobID(),
+		Status:    WarmJobRunning,
+		Total:     len(req.Keys) * len(req.Operations),
+		CreatedAt: time.Now().UTC(),
+		tenant:    tenant,
+	}
+	for _, key := range req.Keys {
+		for _, op := range req.Operations {
+			p, ok := blobParams(key, op, tenant)
+			if !ok {
+				return c.Status(fiber.StatusBadRequest).SendString("invalid operation: " + op)
+			}
+			if err := s.limits.Check(p); err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+			}
+			job.images = append(job.images, warmImage{key: key, operation: op, params: p})
+		}
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(s.startWarm(job))
+}
+
+// WarmJobHandler responds with the progress of a warm job, e.g.
+// GET /serve/warm/{id}
+func (s *Imagor) WarmJobHandler(c fiber.Ctx) error {
+	s.jobsMu.Lock()
+	job, ok := s.warmJobs[c.Params("id")]
+	if !ok || job.tenant != mw.GetTenant(c) {
+		s.jobsMu.Unlock()
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	res := job.snapshot()
+	s.jobsMu.Unlock()
+	return c.JSON(res)
+}
+
+// startWarm registers job so its progress can be looked up and starts
+// rendering it in the background. It returns a snapshot of the job.
+func (s *Imagor) startWarm(job *WarmJob) WarmJob {
+	s.jobsMu.Lock()
+	for id, j := range s.warmJobs {
+		if j.FinishedAt != nil && time.Since(*j.FinishedAt) > warmJobTTL {
+			delete(s.warmJobs, id)
+		}
+	}
+	s.warmJobs[job.ID] = job
+	res := job.snapshot()
+	s.jobsMu.Unlock()
+
+	go s.warm(job)
+	return res
+}
+
+// warm renders the images of job one at a time, so jobs don't crowd out the
+// images being served
+func (s *Imagor) warm(job *WarmJob) {
+	for _, img := range job.images {
+		if s.ctx.Err() != nil {
+			break
+		}
+		err := s.render(WithTenant(s.ctx, job.tenant), img.params)
+		s.jobsMu.Lock()
+		if err != nil {
+			job.Failed++
+			job.Errors = append(job.Errors, WarmError{Key: img.key, Operation: img.operation, Error: err.Error()})
+		} else {
+			job.Completed++
+		}
+		s.jobsMu.Unlock()
+		if err != nil {
+			s.log.Error("failed to warm image", "key", img.key, "operation", img.operation, "error", err)
+		}
+	}
+	s.jobsMu.Lock()
+	finishedAt := time.Now().UTC()
+	job.Status = WarmJobDone
+	if s.ctx.Err() != nil {
+		// The server is shutting down
+		job.Status = WarmJobCanceled
+	}
+	job.FinishedAt = &finishedAt
+	job.images = nil
+	s.jobsMu.Unlock()
+}
+
+// render processes an image into the result cache. With automatic WebP, AVIF
+// or JPEG XL, the formats browsers are served are rendered too.
+func (s *Imagor) render(ctx context.Context, p imagorpath.Params) error {
+	accepts := []string{""}
+	if !hasFilter(p, "format") {
+		if s.AutoWebP {
+			accepts = append(accepts, "image/webp")
+		}
+		if s.AutoAVIF {
+			accepts = append(accepts, "image/avif")
+		}
+		if s.autoJXL {
+			accepts = append(accepts, "image/jxl")
+		}
+	}
+	for _, accept := range accepts {
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "", nil)
+		if err != nil {
+			return err
+		}
+		variant := p
+		if accept == "image/jxl" {
+			// JPEG XL is negotiated before imagor sees the request
+			variant.Filters = append(imagorpath.Filters{}, p.Filters...)
+			variant.Filters = append(variant.Filters, imagorpath.Filter{Name: "format", Args: jxlFormat})
+		} else if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		// Without a path, imagor doesn't check the signature
+		variant.Path = ""
+		if _, err := s.Do(r, variant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobParams parses an operation on the blob at key. The operation can't
+// change the image, e.g. by loading it from a URL.
+func blobParams(key, op, tenant string) (imagorpath.Params, bool) {
+	op = strings.Trim(op, "/")
+	if key == "" || strings.HasPrefix(op, "unsafe/") {
+		return imagorpath.Params{}, false
+	}
+	path := "/unsafe/"
+	if op != "" {
+		path += op + "/"
+	}
+	path = ExpandFaces(ExpandBlobRefs(path)) + "blob/" + key
+	image := "blob/" + key
+	if tenant != "" {
+		path = TenantPath(path, tenant)
+		image = "blob/" + tenant + "/" + key
+	}
+	if tenant != "" && !TenantPathAllowed(path, tenant) {
+		return imagorpath.Params{}, false
+	}
+	p := imagorpath.Parse(path)
+	return p, p.Image == image && !p.Meta
+}
+
+// hasFilter returns true if p has a filter with the given name
+func hasFilter(p imagorpath.Params, name string) bool {
+	for _, f := range p.Filters {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot copies the job so it can be encoded without the lock
+func (j *WarmJob) snapshot() WarmJob {
+	res := *j
+	res.Errors = append([]WarmError(nil), j.Errors...)
+	res.images = nil
+	return res
+}
+
+func newWarmJobID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return "job_" + hex.EncodeToString(id)
+}
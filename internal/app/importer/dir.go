@@ -0,0 +1,74 @@
+package importer
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+// DirSource imports the files in a local directory. The key of a file is its
+// path relative to the directory, with forward slashes.
+type DirSource struct {
+	Root string
+}
+
+func NewDirSource(root string) *DirSource {
+	return &DirSource{Root: root}
+}
+
+// Get implements the Source interface
+func (s *DirSource) Get(_ context.Context, key string) (io.ReadCloser, *keyval.ObjectInfo, error) {
+	f, err := os.Open(filepath.Join(s.Root, filepath.FromSlash(key)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, keyval.ErrNotFound
+		}
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, &keyval.ObjectInfo{Key: key, Size: stat.Size(), ModifiedTime: stat.ModTime()}, nil
+}
+
+// List implements the Source interface. Hidden files and directories, like
+// .git, are skipped.
+func (s *DirSource) List(ctx context.Context, prefix string, fn func(keyval.ObjectInfo) error) error {
+	return filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != s.Root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(keyval.ObjectInfo{Key: key, Size: info.Size(), ModifiedTime: info.ModTime()})
+	})
+}
@@ -0,0 +1,144 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"golang.org/x/sync/errgroup"
+)
+
+// errUnsupported is returned for objects whose content type isn't allowed
+var errUnsupported = errors.New("unsupported content type")
+
+// DefaultConcurrency is how many objects are imported at a time by default
+const DefaultConcurrency = 8
+
+// Source is an object store objects are imported from. Every
+// keyval.Storage is a Source.
+type Source interface {
+	// Get opens the object stored under key for reading
+	Get(ctx context.Context, key string) (io.ReadCloser, *keyval.ObjectInfo, error)
+	// List calls fn for every object whose key starts with prefix
+	List(ctx context.Context, prefix string, fn func(keyval.ObjectInfo) error) error
+}
+
+type Config struct {
+	// Source is where objects are imported from
+	Source Source
+	// KeyVal is where objects are imported to. They're written like any
+	// other upload, so their content types are detected, quotas apply and
+	// webhooks are sent.
+	KeyVal *keyval.KeyVal
+	// Prefix limits the import to the keys that start with it
+	Prefix string
+	// Concurrency is how many objects are imported at a time. Zero means
+	// DefaultConcurrency.
+	Concurrency int
+	Logger      *slog.Logger
+}
+
+// Info is the result of an import
+type Info struct {
+	Imported int64
+	// Skipped are the objects that had already been imported
+	Skipped int64
+	// Unsupported are the objects whose content type isn't allowed
+	Unsupported int64
+	Failed      int64
+	Bytes       int64
+}
+
+// Run imports every object in Source under the same key. Objects whose key
+// already has a blob of the same size and modification time are skipped, so
+// an import that was interrupted or failed resumes where it left off when
+// it's run again. Objects that fail to import are logged and the import
+// carries on, returning an error once every object has been tried. Objects
+// with a content type that isn't allowed are skipped with a warning.
+func Run(ctx context.Context, cfg Config) (Info, error) {
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	var imported, skipped, unsupported, failed, bytes atomic.Int64
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	err := cfg.Source.List(gctx, cfg.Prefix, func(obj keyval.ObjectInfo) error {
+		if rec := cfg.KeyVal.GetRecord([]byte(obj.Key)); rec.Deleted == keyval.NO && rec.Size == obj.Size && rec.ModifiedTime.Equal(obj.ModifiedTime) {
+			skipped.Add(1)
+			return nil
+		}
+		g.Go(func() error {
+			if err := importObject(gctx, cfg, obj); err != nil {
+				if gctx.Err() != nil {
+					return gctx.Err()
+				}
+				if errors.Is(err, errUnsupported) {
+					cfg.Logger.Warn("skipping object with an unsupported content type", "key", obj.Key)
+					unsupported.Add(1)
+					return nil
+				}
+				cfg.Logger.Error("failed to import object", "key", obj.Key, "error", err)
+				failed.Add(1)
+				return nil
+			}
+			bytes.Add(obj.Size)
+			if n := imported.Add(1); n%1000 == 0 {
+				cfg.Logger.Info("importing objects", "imported", n, "bytes", bytes.Load())
+			}
+			return nil
+		})
+		return gctx.Err()
+	})
+	if waitErr := g.Wait(); err == nil {
+		err = waitErr
+	}
+
+	info := Info{
+		Imported:    imported.Load(),
+		Skipped:     skipped.Load(),
+		Unsupported: unsupported.Load(),
+		Failed:      failed.Load(),
+		Bytes:       bytes.Load(),
+	}
+	if err != nil {
+		return info, err
+	}
+	if info.Failed > 0 {
+		return info, fmt.Errorf("%d objects failed to import, run it again to retry them", info.Failed)
+	}
+	return info, nil
+}
+
+func importObject(ctx context.Context, cfg Config, obj keyval.ObjectInfo) error {
+	key := []byte(obj.Key)
+	if !cfg.KeyVal.LockKey(key) {
+		return errors.New("the key is being written to")
+	}
+	defer cfg.KeyVal.UnlockKey(key)
+
+	r, stat, err := cfg.Source.Get(ctx, obj.Key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	// The modification time stays the listed one, which is what's compared
+	// when the import resumes. Headers can be less precise than listings.
+	if stat != nil {
+		obj.Size = stat.Size
+	}
+	status := cfg.KeyVal.Write(ctx, key, r, int(obj.Size), keyval.WriteOptions{ModifiedTime: obj.ModifiedTime})
+	if status == fiber.StatusUnsupportedMediaType {
+		return errUnsupported
+	}
+	if status != fiber.StatusCreated {
+		return fmt.Errorf("write failed with status %d", status)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+// Job statuses
+const (
+	StatusQueued  = "queued"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// JobTTL is how long finished jobs can be looked up
+const JobTTL = 24 * time.Hour
+
+var (
+	// ErrNotFound is returned by a Store when a job doesn't exist
+	ErrNotFound = errors.New("job not found")
+	// ErrQueueFull is returned by a Store when it can't queue any more jobs
+	ErrQueueFull = errors.New("job queue is full")
+)
+
+// Job is work that's done in the background, like processing a batch of
+// images, so it doesn't hold up the request that asked for it
+type Job struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	// Tenant is who queued the job. Only they can look it up.
+	Tenant string `json:"tenant,omitempty"`
+	// Input is what the job was queued with, decoded by the handler of its
+	// type
+	Input json.RawMessage `json:"input"`
+	// Total is the number of items the job works on
+	Total int `json:"total"`
+	// Completed is the number of items that are done
+	Completed int `json:"completed"`
+	// Failed is the number of items that couldn't be done
+	Failed int `json:"failed"`
+	// Artifacts are the blobs the job stored
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+	Errors    []Error    `json:"errors,omitempty"`
+	// Stats are counters the job keeps, e.g. the bytes it saved
+	Stats map[string]int64 `json:"stats,omitempty"`
+	// Cursor is where the job got to, so a job that didn't finish can be
+	// resumed by another one
+	Cursor     string     `json:"cursor,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Artifact is a blob a job stored
+type Artifact struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+// Error is an item a job couldn't do
+type Error struct {
+	// Item describes what couldn't be done, e.g. the key of a blob
+	Item  string `json:"item"`
+	Error string `json:"error"`
+}
+
+// Store keeps jobs and the queue of the ones waiting to run
+type Store interface {
+	// Enqueue stores job and queues it to be run
+	Enqueue(ctx context.Context, job Job) error
+	// Next blocks until a job is queued, or ctx is done, and returns it
+	Next(ctx context.Context) (Job, error)
+	// Get returns the job with the given ID, or ErrNotFound
+	Get(ctx context.Context, id string) (Job, error)
+	// Put stores the progress of job. Finished jobs are kept for JobTTL.
+	Put(ctx context.Context, job Job) error
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// Handler does the work of a job, recording the outcome of every item with
+// progress. Its error fails the whole job.
+type Handler func(ctx context.Context, job Job, progress *Progress) error
+
+type Config struct {
+	// Store keeps the jobs. Defaults to an in-memory store.
+	Store Store
+	// Workers is how many jobs run at once. Defaults to 1.
+	Workers int
+	Logger  *slog.Logger
+}
+
+// Jobs runs the jobs queued in a Store with the handlers of their types
+type Jobs struct {
+	store    Store
+	workers  int
+	handlers map[string]Handler
+	log      *slog.Logger
+}
+
+func New(cfg Config) *Jobs {
+	store := cfg.Store
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	log := cfg.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	return &Jobs{store: store, workers: workers, handlers: map[string]Handler{}, log: log}
+}
+
+// Handle runs the jobs of jobType with h. It must be called before Run.
+func (j *Jobs) Handle(jobType string, h Handler) {
+	j.handlers[jobType] = h
+}
+
+// Enqueue queues a job of jobType for tenant that works on total items
+func (j *Jobs) Enqueue(ctx context.Context, jobType, tenant string, total int, input any) (Job, error) {
+	if _, ok := j.handlers[jobType]; !ok {
+		return Job{}, fmt.Errorf("unknown job type %q", jobType)
+	}
+	data, err := json.Marshal(input)
+	if err != nil {
+		return Job{}, err
+	}
+	job := Job{
+		ID:        newJobID(),
+		Type:      jobType,
+		Status:    StatusQueued,
+		Tenant:    tenant,
+		Input:     data,
+		Total:     total,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := j.store.Enqueue(ctx, job); err != nil {
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// Run runs queued jobs until ctx is done. Jobs that are running when it's
+// done are marked as failed.
+func (j *Jobs) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < j.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, err := j.store.Next(ctx)
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					j.log.Error("failed to get next job", "error", err)
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(time.Second):
+					}
+					continue
+				}
+				j.run(ctx, job)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// run runs a job with the handler of its type
+func (j *Jobs) run(ctx context.Context, job Job) {
+	startedAt := time.Now().UTC()
+	job.Status, job.StartedAt = StatusRunning, &startedAt
+	progress := &Progress{jobs: j, job: job}
+	progress.save(ctx)
+
+	var err error
+	if h, ok := j.handlers[job.Type]; ok {
+		err = h(ctx, job, progress)
+	} else {
+		err = fmt.Errorf("unknown job type %q", job.Type)
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	finishedAt := time.Now().UTC()
+	progress.job.Status, progress.job.FinishedAt = StatusDone, &finishedAt
+	if err != nil {
+		j.log.Error("job failed", "id", job.ID, "type", job.Type, "error", err)
+		progress.job.Status = StatusFailed
+		progress.job.Errors = append(progress.job.Errors, Error{Error: err.Error()})
+	}
+	// The job is saved even if the server is shutting down
+	if err := j.store.Put(context.WithoutCancel(ctx), progress.job); err != nil {
+		j.log.Error("failed to save job", "id", job.ID, "error", err)
+	}
+}
+
+// Progress records the outcome of the items of a running job
+type Progress struct {
+	jobs *Jobs
+	mu   sync.Mutex
+	job  Job
+}
+
+// Done records an item that's done, along with the blob it stored if there's
+// one
+func (p *Progress) Done(ctx context.Context, artifact *Artifact) {
+	p.mu.Lock()
+	p.job.Completed++
+	if artifact != nil {
+		p.job.Artifacts = append(p.job.Artifacts, *artifact)
+	}
+	p.mu.Unlock()
+	p.save(ctx)
+}
+
+// Fail records an item that couldn't be done
+func (p *Progress) Fail(ctx context.Context, item string, err error) {
+	p.mu.Lock()
+	p.job.Failed++
+	p.job.Errors = append(p.job.Errors, Error{Item: item, Error: err.Error()})
+	p.mu.Unlock()
+	p.save(ctx)
+}
+
+// SetTotal sets the number of items the job works on, for jobs that only
+// know it once they start
+func (p *Progress) SetTotal(ctx context.Context, total int) {
+	p.mu.Lock()
+	p.job.Total = total
+	p.mu.Unlock()
+	p.save(ctx)
+}
+
+// SetCursor records where the job got to. It's saved with the next item.
+func (p *Progress) SetCursor(cursor string) {
+	p.mu.Lock()
+	p.job.Cursor = cursor
+	p.mu.Unlock()
+}
+
+// Add adds n to the stat with the given name. It's saved with the next item.
+func (p *Progress) Add(name string, n int64) {
+	p.mu.Lock()
+	if p.job.Stats == nil {
+		p.job.Stats = map[string]int64{}
+	}
+	p.job.Stats[name] += n
+	p.mu.Unlock()
+}
+
+func (p *Progress) save(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.jobs.store.Put(ctx, p.job); err != nil {
+		p.jobs.log.Error("failed to save job", "id", p.job.ID, "error", err)
+	}
+}
+
+// JobHandler responds with a job, e.g. GET /jobs/{id}
+func (j *Jobs) JobHandler(c fiber.Ctx) error {
+	job, err := j.store.Get(c.Context(), c.Params("id"))
+	if errors.Is(err, ErrNotFound) || (err == nil && job.Tenant != mw.GetTenant(c)) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if err != nil {
+		j.log.Error("failed to get job", "error", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(job)
+}
+
+// Close closes the store
+func (j *Jobs) Close() error {
+	return j.store.Close()
+}
+
+func newJobID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return "job_" + hex.EncodeToString(id)
+}
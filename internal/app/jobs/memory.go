@@ -0,0 +1,90 @@
+package jobs
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memoryQueueSize is how many jobs can wait to run in a MemoryStore
+const memoryQueueSize = 1024
+
+// MemoryStore keeps jobs in memory, so they're lost when the service
+// restarts and each replica runs its own. It implements the Store interface.
+type MemoryStore struct {
+	mu    sync.Mutex
+	jobs  map[string]Job
+	queue chan string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{jobs: map[string]Job{}, queue: make(chan string, memoryQueueSize)}
+}
+
+// Enqueue implements Store interface
+func (s *MemoryStore) Enqueue(ctx context.Context, job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case s.queue <- job.ID:
+	default:
+		return ErrQueueFull
+	}
+	s.expire()
+	s.jobs[job.ID] = clone(job)
+	return nil
+}
+
+// Next implements Store interface
+func (s *MemoryStore) Next(ctx context.Context) (Job, error) {
+	select {
+	case <-ctx.Done():
+		return Job{}, ctx.Err()
+	case id := <-s.queue:
+		return s.Get(ctx, id)
+	}
+}
+
+// Get implements Store interface
+func (s *MemoryStore) Get(ctx context.Context, id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return clone(job), nil
+}
+
+// Put implements Store interface
+func (s *MemoryStore) Put(ctx context.Context, job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = clone(job)
+	return nil
+}
+
+// Close implements Store interface
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// expire removes the jobs that finished more than JobTTL ago. The lock must
+// be held by the caller.
+func (s *MemoryStore) expire() {
+	for id, job := range s.jobs {
+		if job.FinishedAt != nil && time.Since(*job.FinishedAt) > JobTTL {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// clone copies job so the caller can't change what's stored
+func clone(job Job) Job {
+	job.Artifacts = slices.Clone(job.Artifacts)
+	job.Errors = slices.Clone(job.Errors)
+	job.Stats = maps.Clone(job.Stats)
+	return job
+}
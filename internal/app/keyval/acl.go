@@ -0,0 +1,55 @@
+package keyval
+
+import (
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+const (
+	// ACLPrivate blobs can only be read with an API key or a signed URL
+	ACLPrivate = "private"
+	// ACLPublic blobs can be read by anyone
+	ACLPublic = "public"
+)
+
+// parseACL parses an x-acl header. An empty value means the default ACL.
+func parseACL(v string) (string, bool) {
+	switch v {
+	case "", ACLPrivate, ACLPublic:
+		return v, true
+	}
+	return "", false
+}
+
+// acl returns the ACL of a record, falling back to the default ACL for
+// records uploaded without one
+func (k *KeyVal) acl(rec Record) string {
+	if rec.ACL != "" {
+		return rec.ACL
+	}
+	return k.defaultACL
+}
+
+// NewVerifyReadAccess lets requests without an API key or a signature read
+// public blobs, scoped to the tenant in their x-tenant parameter. Every other
+// request has to be allowed by verify.
+func (k *KeyVal) NewVerifyReadAccess(keys mw.Keys, verify fiber.Handler) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		if c.Get("x-api-key") != "" || c.Query("x-signature") != "" {
+			return verify(c)
+		}
+		if tenant := c.Query("x-tenant"); tenant != "" {
+			if !keys.HasTenant(tenant) {
+				return c.Status(fiber.StatusUnauthorized).SendString("unauthorized")
+			}
+			c.Locals(mw.TenantKey, tenant)
+		}
+		// Private and missing blobs look the same, so their keys can't be
+		// discovered
+		rec := k.GetRecord(k.blobKey(c))
+		if rec.Deleted != NO || k.acl(rec) != ACLPublic {
+			return c.Status(fiber.StatusUnauthorized).SendString("unauthorized")
+		}
+		return c.Next()
+	}
+}
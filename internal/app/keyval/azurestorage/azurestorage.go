@@ -0,0 +1,331 @@
+package azurestorage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+const apiVersion = "2021-08-06"
+
+// AzureStorage stores blobs in an Azure Blob Storage container. Requests are
+// authorized with either a SAS token or the storage account key. It implements
+// the keyval.Storage interface.
+type AzureStorage struct {
+	// Account is the name of the storage account
+	Account string
+	// Container is the name of the container blobs are stored in
+	Container string
+	// Endpoint is the blob service endpoint. Defaults to
+	// https://<account>.blob.core.windows.net.
+	Endpoint *url.URL
+	// AccountKey is the base64 encoded storage account key used for Shared
+	// Key authorization
+	AccountKey []byte
+	// SASToken is a shared access signature query string. It takes
+	// precedence over AccountKey.
+	SASToken url.Values
+	// PathPrefix is prepended to every key
+	PathPrefix string
+	// Client is the HTTP client used to talk to Azure
+	Client *http.Client
+}
+
+// Option AzureStorage option
+type Option func(s *AzureStorage)
+
+// New creates AzureStorage
+func New(account, container string, options ...Option) (*AzureStorage, error) {
+	s := &AzureStorage{
+		Account:   account,
+		Container: container,
+		Client:    http.DefaultClient,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	if s.Endpoint == nil {
+		s.Endpoint = &url.URL{Scheme: "https", Host: account + ".blob.core.windows.net"}
+	}
+	if s.SASToken == nil && s.AccountKey == nil {
+		return nil, fmt.Errorf("azurestorage: either an account key or a SAS token is required")
+	}
+	return s, nil
+}
+
+// WithEndpoint with custom blob service endpoint option, e.g. for Azurite
+func WithEndpoint(endpoint string) Option {
+	return func(s *AzureStorage) {
+		if endpoint != "" {
+			if u, err := url.Parse(strings.TrimSuffix(endpoint, "/")); err == nil {
+				s.Endpoint = u
+			}
+		}
+	}
+}
+
+// WithAccountKey with Shared Key authorization option
+func WithAccountKey(accountKey string) Option {
+	return func(s *AzureStorage) {
+		if accountKey != "" {
+			if key, err := base64.StdEncoding.DecodeString(accountKey); err == nil {
+				s.AccountKey = key
+			}
+		}
+	}
+}
+
+// WithSASToken with shared access signature authorization option
+func WithSASToken(token string) Option {
+	return func(s *AzureStorage) {
+		if token != "" {
+			if q, err := url.ParseQuery(strings.TrimPrefix(token, "?")); err == nil {
+				s.SASToken = q
+			}
+		}
+	}
+}
+
+// WithPathPrefix with key prefix option
+func WithPathPrefix(prefix string) Option {
+	return func(s *AzureStorage) {
+		s.PathPrefix = strings.Trim(prefix, "/")
+	}
+}
+
+// WithHTTPClient with custom HTTP client option
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *AzureStorage) {
+		if client != nil {
+			s.Client = client
+		}
+	}
+}
+
+// Get implements keyval.Storage interface
+func (s *AzureStorage) Get(ctx context.Context, key string) (io.ReadCloser, *keyval.ObjectInfo, error) {
+	res, err := s.do(ctx, http.MethodGet, s.blobPath(key), nil, nil, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.Body, objectInfo(key, res), nil
+}
+
+// Put implements keyval.Storage interface
+func (s *AzureStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if size < 0 {
+		// Put Blob needs to know the content length up front, so spool the
+		// body to disk when the caller doesn't know it.
+		tmp, err := os.CreateTemp("", "azurestorage-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if size, err = io.Copy(tmp, r); err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r = tmp
+	}
+	res, err := s.do(ctx, http.MethodPut, s.blobPath(key), nil, r, size)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Delete implements keyval.Storage interface
+func (s *AzureStorage) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, s.blobPath(key), nil, nil, -1)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Stat implements keyval.Storage interface
+func (s *AzureStorage) Stat(ctx context.Context, key string) (*keyval.ObjectInfo, error) {
+	res, err := s.do(ctx, http.MethodHead, s.blobPath(key), nil, nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	_ = res.Body.Close()
+	return objectInfo(key, res), nil
+}
+
+// List implements keyval.Storage interface
+func (s *AzureStorage) List(ctx context.Context, prefix string, fn func(keyval.ObjectInfo) error) error {
+	marker := ""
+	for {
+		q := url.Values{}
+		q.Set("restype", "container")
+		q.Set("comp", "list")
+		q.Set("prefix", s.blobKey(prefix))
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		res, err := s.do(ctx, http.MethodGet, "/"+s.Container, q, nil, -1)
+		if err != nil {
+			return err
+		}
+		var result enumerationResults
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		_ = res.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, blob := range result.Blobs {
+			key := blob.Name
+			if s.PathPrefix != "" {
+				key = strings.TrimPrefix(key, s.PathPrefix+"/")
+			}
+			modTime, _ := http.ParseTime(blob.Properties.LastModified)
+			if err := fn(keyval.ObjectInfo{Key: key, Size: blob.Properties.ContentLength, ModifiedTime: modTime}); err != nil {
+				return err
+			}
+		}
+		if result.NextMarker == "" {
+			return nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+func (s *AzureStorage) blobKey(key string) string {
+	if s.PathPrefix == "" {
+		return key
+	}
+	return s.PathPrefix + "/" + key
+}
+
+func (s *AzureStorage) blobPath(key string) string {
+	return "/" + s.Container + "/" + s.blobKey(key)
+}
+
+func (s *AzureStorage) do(ctx context.Context, method, p string, q url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := *s.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + p
+	if q == nil {
+		q = url.Values{}
+	}
+	for k, v := range s.SASToken {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", apiVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+	}
+	if s.SASToken == nil {
+		s.signSharedKey(req)
+	}
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		_ = res.Body.Close()
+		return nil, keyval.ErrNotFound
+	}
+	if res.StatusCode >= 300 {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("azurestorage: %s %s: %s %s", method, p, res.Status, res.Header.Get("x-ms-error-code"))
+	}
+	return res, nil
+}
+
+// signSharedKey authorizes req with the storage account key, see
+// https://learn.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (s *AzureStorage) signSharedKey(req *http.Request) {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var msHeaders []string
+	for name := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name)
+		}
+	}
+	sort.Strings(msHeaders)
+	var canonicalHeaders strings.Builder
+	for _, name := range msHeaders {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	canonicalResource := "/" + s.Account + req.URL.EscapedPath()
+	q := req.URL.Query()
+	params := make([]string, 0, len(q))
+	for name := range q {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := q[name]
+		sort.Strings(values)
+		canonicalResource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonicalHeaders.String() + canonicalResource,
+	}, "\n")
+
+	h := hmac.New(sha256.New, s.AccountKey)
+	h.Write([]byte(stringToSign))
+	signature := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", s.Account, signature))
+}
+
+func objectInfo(key string, res *http.Response) *keyval.ObjectInfo {
+	size, _ := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &keyval.ObjectInfo{Key: key, Size: size, ModifiedTime: modTime}
+}
+
+type enumerationResults struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			ContentLength int64  `xml:"Content-Length"`
+			LastModified  string `xml:"Last-Modified"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
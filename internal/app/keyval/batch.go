@@ -0,0 +1,127 @@
+package keyval
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+const (
+	// MAX_BATCH_SIZE is the most keys a single batch request operates on
+	MAX_BATCH_SIZE = 1000
+	// batchConcurrency is the number of keys of a batch processed at once
+	batchConcurrency = 16
+)
+
+type BatchDeleteRequest struct {
+	// Keys to delete
+	Keys []string `json:"keys,omitempty"`
+	// Prefix deletes every key starting with it, up to MAX_BATCH_SIZE keys
+	// per request, instead of Keys
+	Prefix string `json:"prefix,omitempty"`
+	// Unlink soft deletes the keys instead of removing them
+	Unlink bool `json:"unlink,omitempty"`
+}
+
+type BatchDeleteResponse struct {
+	Results []BatchResult `json:"results"`
+	// Deleted is the number of keys that were deleted
+	Deleted int `json:"deleted"`
+	// HasMore is true when more keys match Prefix than were deleted
+	HasMore bool `json:"has_more"`
+}
+
+type BatchResult struct {
+	Key string `json:"key"`
+	// Status is the status code the key would have gotten from its single
+	// key endpoint
+	Status int `json:"status"`
+}
+
+// BatchDeleteHandler deletes many keys in one request. The body is either a
+// BatchDeleteRequest or a plain JSON array of keys.
+func (k *KeyVal) BatchDeleteHandler(c fiber.Ctx) error {
+	var req BatchDeleteRequest
+	body := bytes.TrimSpace(c.Body())
+	var err error
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &req.Keys)
+	} else {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	ns := namespace(c)
+	keys := req.Keys
+	hasMore := false
+	if len(keys) == 0 {
+		// An empty prefix would delete everything, so it has to be explicit
+		if req.Prefix == "" {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		err := k.db.Iterate([]byte(ns+req.Prefix), nil, func(key []byte, rec Record) bool {
+			if rec.Expired() || (req.Unlink && rec.Deleted == SOFT) {
+				return true
+			}
+			if len(keys) == MAX_BATCH_SIZE {
+				hasMore = true
+				return false
+			}
+			keys = append(keys, string(key[len(ns):]))
+			return true
+		})
+		if err != nil {
+			k.log.Error("failed to iterate records", "error", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+	if len(keys) > MAX_BATCH_SIZE {
+		return c.SendStatus(fiber.StatusRequestEntityTooLarge)
+	}
+	mw.SetAuditKeys(c, keys...)
+
+	ctx := c.Context()
+	results := make([]BatchResult, len(keys))
+	sem := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		results[i].Key = key
+		if key == "" {
+			results[i].Status = fiber.StatusBadRequest
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, key []byte) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if !k.LockKey(key) {
+				results[i].Status = fiber.StatusConflict
+				return
+			}
+			defer k.UnlockKey(key)
+			results[i].Status = k.Delete(ctx, key, req.Unlink)
+		}(i, []byte(ns+key))
+	}
+	wg.Wait()
+
+	deleted := 0
+	for _, result := range results {
+		if result.Status == fiber.StatusNoContent {
+			deleted++
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(BatchDeleteResponse{
+		Results: results,
+		Deleted: deleted,
+		HasMore: hasMore,
+	})
+}
@@ -0,0 +1,74 @@
+package keyval
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumReader hashes everything read from r. Once r is exhausted it fails
+// with errChecksumMismatch if the digests differ from the expected ones, so
+// backends abort the write instead of storing a corrupted blob.
+type checksumReader struct {
+	r          io.Reader
+	md5        hash.Hash
+	sha256     hash.Hash
+	wantMD5    []byte
+	wantSHA256 []byte
+}
+
+func newChecksumReader(r io.Reader, wantMD5, wantSHA256 []byte) *checksumReader {
+	return &checksumReader{
+		r:          r,
+		md5:        md5.New(),
+		sha256:     sha256.New(),
+		wantMD5:    wantMD5,
+		wantSHA256: wantSHA256,
+	}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.md5.Write(p[:n])
+	c.sha256.Write(p[:n])
+	if err == io.EOF && !c.verify() {
+		return n, errChecksumMismatch
+	}
+	return n, err
+}
+
+func (c *checksumReader) verify() bool {
+	if c.wantMD5 != nil && !bytes.Equal(c.md5.Sum(nil), c.wantMD5) {
+		return false
+	}
+	if c.wantSHA256 != nil && !bytes.Equal(c.sha256.Sum(nil), c.wantSHA256) {
+		return false
+	}
+	return true
+}
+
+// parseChecksum decodes a digest of size bytes sent as either hex or
+// standard base64, e.g. a Content-MD5 header. An empty value is no digest.
+func parseChecksum(v string, size int) ([]byte, bool) {
+	if v == "" {
+		return nil, true
+	}
+	var sum []byte
+	var err error
+	if len(v) == hex.EncodedLen(size) {
+		sum, err = hex.DecodeString(v)
+	} else {
+		sum, err = base64.StdEncoding.DecodeString(v)
+	}
+	if err != nil || len(sum) != size {
+		return nil, false
+	}
+	return sum, true
+}
@@ -0,0 +1,57 @@
+package keyval
+
+import (
+	"mime"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+const (
+	// ContentTypeMismatchReject rejects uploads whose content doesn't match
+	// the content type they were declared with
+	ContentTypeMismatchReject = "reject"
+	// ContentTypeMismatchRewrite stores uploads whose content doesn't match
+	// the content type they were declared with as the detected type
+	ContentTypeMismatchRewrite = "rewrite"
+)
+
+// genericContentTypes are sent by clients that don't know what they're
+// uploading, so they don't declare anything
+var genericContentTypes = map[string]bool{
+	"application/octet-stream":          true,
+	"binary/octet-stream":               true,
+	"application/x-www-form-urlencoded": true,
+}
+
+// parseContentTypeMismatch parses a mismatch mode. An empty value means
+// ContentTypeMismatchReject.
+func parseContentTypeMismatch(v string) (string, bool) {
+	switch v {
+	case "":
+		return ContentTypeMismatchReject, true
+	case ContentTypeMismatchReject, ContentTypeMismatchRewrite:
+		return v, true
+	}
+	return "", false
+}
+
+// declaredMatches returns true if the content type an upload was declared
+// with is the one detected from its first bytes, or one it's a kind of, e.g.
+// text/xml for an SVG. Uploads that weren't declared a specific type match.
+func declaredMatches(detected *mimetype.MIME, declared string) bool {
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil {
+		return declared == ""
+	}
+	mediaType = strings.ToLower(mediaType)
+	if genericContentTypes[mediaType] {
+		return true
+	}
+	for m := detected; m != nil; m = m.Parent() {
+		if m.Is(mediaType) {
+			return true
+		}
+	}
+	return false
+}
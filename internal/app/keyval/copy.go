@@ -0,0 +1,149 @@
+package keyval
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+type CopyRequest struct {
+	// Source is the key to copy from
+	Source string `json:"source"`
+	// Destination is the key to copy to
+	Destination string `json:"destination"`
+	// Overwrite replaces an existing blob at Destination instead of failing
+	Overwrite bool `json:"overwrite,omitempty"`
+}
+
+// CopyHandler duplicates a blob and its record under a new key
+func (k *KeyVal) CopyHandler(c fiber.Ctx) error {
+	return k.copyHandler(c, false)
+}
+
+// MoveHandler renames a blob and its record to a new key
+func (k *KeyVal) MoveHandler(c fiber.Ctx) error {
+	return k.copyHandler(c, true)
+}
+
+func (k *KeyVal) copyHandler(c fiber.Ctx, move bool) error {
+	var req CopyRequest
+	if err := json.Unmarshal(c.Body(), &req); err != nil || req.Source == "" || req.Destination == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	mw.SetAuditKeys(c, req.Source, req.Destination)
+	if req.Source == req.Destination {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	ns := namespace(c)
+	src, dst := []byte(ns+req.Source), []byte(ns+req.Destination)
+	if !k.LockKey(src) {
+		return c.SendStatus(fiber.StatusConflict)
+	}
+	defer k.UnlockKey(src)
+	if !k.LockKey(dst) {
+		return c.SendStatus(fiber.StatusConflict)
+	}
+	defer k.UnlockKey(dst)
+
+	rec, status := k.Copy(c.Context(), src, dst, req.Overwrite)
+	if status != fiber.StatusCreated {
+		return c.SendStatus(status)
+	}
+	if move {
+		// The source is gone from the caller's point of view, so it's removed
+		// outright even if soft deletes are required
+		if err := k.releaseBlob(c.Context(), src, rec); err != nil {
+			k.log.Error("failed to delete blob", "error", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := k.db.Delete(src); err != nil {
+			k.log.Error("failed to delete record", "error", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		k.updateQuotaUsage(src, rec, Record{Deleted: HARD})
+		k.emit(EventBlobDeleted, src, rec)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(newListObject(req.Destination, rec))
+}
+
+// Copy copies the blob and record of src to dst. Both keys must be locked by
+// the caller.
+func (k *KeyVal) Copy(ctx context.Context, src, dst []byte, overwrite bool) (Record, int) {
+	if reservedKey(dst) {
+		return Record{}, fiber.StatusBadRequest
+	}
+	rec := k.GetRecord(src)
+	if rec.Deleted != NO {
+		return rec, fiber.StatusNotFound
+	}
+
+	dstStored := k.storedRecord(dst)
+	dstRec := dstStored
+	if dstRec.Expired() {
+		dstRec = Record{Deleted: HARD}
+	}
+	dstNotFound := dstRec.Deleted == HARD
+	// Expired records are left in place, like Write does
+	reserved := dstStored.Deleted == HARD
+	if !dstNotFound && !overwrite {
+		return rec, fiber.StatusPreconditionFailed
+	}
+	quotaRemaining, status := k.quotaRemaining(dst)
+	if status != 0 {
+		return rec, status
+	}
+	if quotaRemaining >= 0 && rec.Size > quotaRemaining {
+		return rec, fiber.StatusInsufficientStorage
+	}
+	if reserved {
+		// Reserve the key, like Write does, so it isn't listed until the blob
+		// exists
+		if err := k.PutRecord(dst, Record{Deleted: SOFT}); err != nil {
+			k.log.Error("failed to put record", "error", err)
+			return rec, fiber.StatusInternalServerError
+		}
+	}
+
+	// Deduplicated blobs are shared by the copy instead
+	var err error
+	if rec.Blob != "" {
+		err = k.addRef(rec)
+	} else {
+		err = CopyBlob(ctx, k.storage, string(src), string(dst))
+	}
+	if err != nil {
+		if reserved {
+			k.db.Delete(dst)
+		}
+		if errors.Is(err, ErrNotFound) {
+			return rec, fiber.StatusNotFound
+		}
+		k.log.Error("failed to copy blob", "error", err)
+		return rec, fiber.StatusInternalServerError
+	}
+
+	rec.ModifiedTime = time.Now().UTC()
+	if err := k.PutRecord(dst, rec); err != nil {
+		k.log.Error("failed to put record", "error", err)
+		return rec, fiber.StatusInternalServerError
+	}
+	k.updateQuotaUsage(dst, dstStored, rec)
+	// The blob of dst was replaced in place, unless either is deduplicated
+	if dstStored.Hash != "" && (dstStored.Blob != "" || rec.Blob != "") {
+		if err := k.releaseBlob(ctx, dst, dstStored); err != nil {
+			k.log.Error("failed to delete previous blob", "error", err)
+		}
+	}
+	if dstRec.Deleted == NO {
+		k.emit(EventBlobOverwritten, dst, rec)
+	} else {
+		k.emit(EventBlobCreated, dst, rec)
+	}
+	return rec, fiber.StatusCreated
+}
@@ -1,9 +1,17 @@
 package keyval
 
 import (
+	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 const (
@@ -13,12 +21,74 @@ const (
 )
 
 type Record struct {
-	Deleted int
-	Hash    string
+	Deleted      int       `json:"deleted,omitempty"`
+	Hash         string    `json:"hash,omitempty"`
+	Size         int64     `json:"size,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+	ModifiedTime time.Time `json:"modified_time"`
+	// ExpiresAt is the time the key stops being served. Zero means never.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	// Metadata is arbitrary application data set with x-meta-* headers
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// SHA256 is the hex encoded SHA-256 digest of the blob. Hash is its MD5.
+	SHA256 string `json:"sha256,omitempty"`
+	// ACL is who can read the blob, ACLPublic or ACLPrivate. Empty means the
+	// default ACL.
+	ACL string `json:"acl,omitempty"`
+	// Placeholder is a tiny, blurry version of an image as a data URI, shown
+	// while the image loads. It's generated after the blob is written.
+	Placeholder string `json:"placeholder,omitempty"`
+	// DHash is the difference hash of an image, a perceptual hash it shares
+	// most bits of with near-duplicates. It's generated after the blob is
+	// written.
+	DHash string `json:"dhash,omitempty"`
+	// Blob is the storage key of a deduplicated blob, which is stored once
+	// under its content hash. Empty means the blob is stored under the key of
+	// the record.
+	Blob string `json:"blob,omitempty"`
+}
+
+// StorageKey returns the key the blob of the record stored under key is kept
+// under in Storage
+func (r Record) StorageKey(key string) string {
+	if r.Blob != "" {
+		return r.Blob
+	}
+	return key
+}
+
+// Expired reports whether the record has outlived its ExpiresAt time
+func (r Record) Expired() bool {
+	return !r.ExpiresAt.IsZero() && !time.Now().Before(r.ExpiresAt)
+}
+
+// Index stores the Record of every key known to keyval. Blobs themselves live
+// in a Storage backend.
+type Index interface {
+	// Get returns the record stored under key, or ErrNotFound
+	Get(key []byte) (Record, error)
+	// Put stores rec under key
+	Put(key []byte, rec Record) error
+	// Delete removes the record stored under key
+	Delete(key []byte) error
+	// Iterate calls fn in lexicographical key order for every record whose
+	// key starts with prefix, beginning at start if it is not empty.
+	// Iteration stops as soon as fn returns false. key is only valid until
+	// fn returns.
+	Iterate(prefix, start []byte, fn func(key []byte, rec Record) bool) error
+	// Close releases any resources held by the index
+	Close() error
 }
 
 func toRecord(data []byte) Record {
 	var rec Record
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, &rec); err == nil {
+			return rec
+		}
+	}
+
+	// Records written before we moved to JSON
 	ss := string(data)
 	rec.Deleted = NO
 	if strings.HasPrefix(ss, "DELETED") {
@@ -32,17 +102,34 @@ func toRecord(data []byte) Record {
 }
 
 func fromRecord(rec Record) ([]byte, error) {
-	cc := ""
 	if rec.Deleted == HARD {
 		return nil, fmt.Errorf("cannot put HARD delete in the database")
 	}
-	if rec.Deleted == SOFT {
-		cc = "DELETED"
-	}
-	if len(rec.Hash) == 32 {
-		cc += "HASH" + rec.Hash
+	return json.Marshal(rec)
+}
+
+// EncodeRecord serializes a record for Index implementations that store
+// records as opaque values
+func EncodeRecord(rec Record) ([]byte, error) {
+	return fromRecord(rec)
+}
+
+// DecodeRecord deserializes a record encoded with EncodeRecord
+func DecodeRecord(data []byte) Record {
+	return toRecord(data)
+}
+
+// PrefixEnd returns the smallest key that sorts after every key starting with
+// prefix, or an empty string if there is no such key
+func PrefixEnd(prefix []byte) string {
+	end := []byte(string(prefix))
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
 	}
-	return []byte(cc), nil
+	return ""
 }
 
 func KeyToPath(key []byte) string {
@@ -51,3 +138,144 @@ func KeyToPath(key []byte) string {
 	// optimized for 2^24 = 16M files in the volume
 	return fmt.Sprintf("/%02x/%02x/%s", hexkey[0], hexkey[1], hexkey)
 }
+
+// NewLevelDBIndex opens or creates a LevelDB backed Index at path
+func NewLevelDBIndex(path string) (*LevelDBIndex, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LevelDBIndex{db: db}, nil
+}
+
+// LevelDBIndex is the default Index. LevelDB holds a lock on its directory,
+// so only one process can use it at a time.
+type LevelDBIndex struct {
+	db      *leveldb.DB
+	nonceMu sync.Mutex
+	refMu   sync.Mutex
+}
+
+// Get implements the Index interface
+func (l *LevelDBIndex) Get(key []byte) (Record, error) {
+	data, err := l.db.Get(key, nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return Record{Deleted: HARD}, ErrNotFound
+		}
+		return Record{Deleted: HARD}, err
+	}
+	return toRecord(data), nil
+}
+
+// Put implements the Index interface
+func (l *LevelDBIndex) Put(key []byte, rec Record) error {
+	data, err := fromRecord(rec)
+	if err != nil {
+		return err
+	}
+	return l.db.Put(key, data, nil)
+}
+
+// Delete implements the Index interface
+func (l *LevelDBIndex) Delete(key []byte) error {
+	return l.db.Delete(key, nil)
+}
+
+// Iterate implements the Index interface
+func (l *LevelDBIndex) Iterate(prefix, start []byte, fn func(key []byte, rec Record) bool) error {
+	slice := util.BytesPrefix(prefix)
+	if len(start) > 0 {
+		slice.Start = start
+	}
+	// Nonces, audit entries and reference counts sort before every key, so
+	// skip past them
+	if noncesEnd := []byte(PrefixEnd(noncePrefix)); bytes.Compare(slice.Start, noncesEnd) < 0 {
+		slice.Start = noncesEnd
+	}
+	iter := l.db.NewIterator(slice, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !fn(iter.Key(), toRecord(iter.Value())) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+// noncePrefix is the prefix the nonces of single-use URLs are stored under.
+// It sorts before any key that can be uploaded, since the API rejects keys
+// with control bytes.
+var noncePrefix = []byte("\x00nonce:")
+
+// UseNonce implements the NonceIndex interface
+func (l *LevelDBIndex) UseNonce(nonce string, expiresAt time.Time) (bool, error) {
+	key := append(append([]byte(nil), noncePrefix...), nonce...)
+	// Checking and setting the nonce has to be atomic
+	l.nonceMu.Lock()
+	defer l.nonceMu.Unlock()
+	if ok, err := l.db.Has(key, nil); err != nil || ok {
+		return false, err
+	}
+	value, err := expiresAt.MarshalText()
+	if err != nil {
+		return false, err
+	}
+	return true, l.db.Put(key, value, nil)
+}
+
+// RemoveExpiredNonces implements the NonceIndex interface
+func (l *LevelDBIndex) RemoveExpiredNonces() (int, error) {
+	l.nonceMu.Lock()
+	defer l.nonceMu.Unlock()
+	iter := l.db.NewIterator(util.BytesPrefix(noncePrefix), nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	now := time.Now()
+	for iter.Next() {
+		var expiresAt time.Time
+		if err := expiresAt.UnmarshalText(iter.Value()); err != nil || expiresAt.Before(now) {
+			batch.Delete(iter.Key())
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	return batch.Len(), l.db.Write(batch, nil)
+}
+
+// refPrefix is the prefix the reference counts of deduplicated blobs are
+// stored under. It sorts before noncePrefix.
+var refPrefix = []byte("\x00blobrefs:")
+
+// AddRef implements the RefIndex interface
+func (l *LevelDBIndex) AddRef(blob string, delta int) (int, error) {
+	key := append(append([]byte(nil), refPrefix...), blob...)
+	// Reading and writing the count has to be atomic
+	l.refMu.Lock()
+	defer l.refMu.Unlock()
+	refs := 0
+	data, err := l.db.Get(key, nil)
+	if err == nil {
+		refs, _ = strconv.Atoi(string(data))
+	} else if err != leveldb.ErrNotFound {
+		return 0, err
+	}
+	refs += delta
+	if refs <= 0 {
+		return 0, l.db.Delete(key, nil)
+	}
+	return refs, l.db.Put(key, []byte(strconv.Itoa(refs)), nil)
+}
+
+// DB returns the database the index is stored in, so other data like the
+// audit log can be stored alongside it under a prefix that sorts before
+// noncePrefix
+func (l *LevelDBIndex) DB() *leveldb.DB {
+	return l.db
+}
+
+// Close implements the Index interface
+func (l *LevelDBIndex) Close() error {
+	return l.db.Close()
+}
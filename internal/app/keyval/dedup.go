@@ -0,0 +1,113 @@
+package keyval
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"sync"
+)
+
+// ContentPrefix is the prefix of the storage keys deduplicated blobs are kept
+// under. Keys starting with it can't be written, so they can't replace a
+// blob shared by other keys.
+const ContentPrefix = ".cas/"
+
+// contentLockStripes is how many locks content keys are spread over
+const contentLockStripes = 64
+
+var errRefsUnsupported = errors.New("index does not support deduplicated blobs")
+
+// RefIndex is implemented by Index backends that can count the references to
+// deduplicated blobs
+type RefIndex interface {
+	// AddRef adds delta to the number of records referring to blob and
+	// returns the new number
+	AddRef(blob string, delta int) (int, error)
+}
+
+// ContentKey returns the storage key of the deduplicated blob with the hex
+// encoded SHA-256 digest sum
+func ContentKey(sum string) string {
+	return ContentPrefix + "sha256/" + sum
+}
+
+// tempContentKey returns a storage key to write a blob to before its digest
+// is known
+func tempContentKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return ContentPrefix + "tmp/" + hex.EncodeToString(b)
+}
+
+// contentLocks serialize counting the references to a blob with storing and
+// deleting it
+type contentLocks [contentLockStripes]sync.Mutex
+
+func (l *contentLocks) lock(blob string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(blob))
+	mu := &l[h.Sum32()%contentLockStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// storeContent adds a reference to the blob with the digest sum and returns
+// its storage key. The blob written to tmp becomes it if it isn't stored yet,
+// otherwise tmp is discarded.
+func (k *KeyVal) storeContent(ctx context.Context, tmp, sum string) (string, error) {
+	defer k.storage.Delete(context.WithoutCancel(ctx), tmp)
+	if k.refs == nil {
+		return "", errRefsUnsupported
+	}
+	blob := ContentKey(sum)
+	unlock := k.contentLocks.lock(blob)
+	defer unlock()
+	refs, err := k.refs.AddRef(blob, 1)
+	if err != nil {
+		return "", err
+	}
+	if refs == 1 {
+		if err := CopyBlob(ctx, k.storage, tmp, blob); err != nil {
+			k.refs.AddRef(blob, -1)
+			return "", err
+		}
+	}
+	return blob, nil
+}
+
+// addRef adds a reference to the deduplicated blob of rec, for a copy of it
+func (k *KeyVal) addRef(rec Record) error {
+	if k.refs == nil {
+		return errRefsUnsupported
+	}
+	unlock := k.contentLocks.lock(rec.Blob)
+	defer unlock()
+	_, err := k.refs.AddRef(rec.Blob, 1)
+	return err
+}
+
+// releaseBlob deletes the blob of rec, the record of key. Deduplicated blobs
+// are only deleted once no other record refers to them.
+func (k *KeyVal) releaseBlob(ctx context.Context, key []byte, rec Record) error {
+	if rec.Blob == "" {
+		if err := k.storage.Delete(ctx, string(key)); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+	if k.refs == nil {
+		return errRefsUnsupported
+	}
+	unlock := k.contentLocks.lock(rec.Blob)
+	defer unlock()
+	refs, err := k.refs.AddRef(rec.Blob, -1)
+	if err != nil || refs > 0 {
+		return err
+	}
+	if err := k.storage.Delete(ctx, rec.Blob); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
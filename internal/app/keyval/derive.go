@@ -0,0 +1,53 @@
+package keyval
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+// Deriver renders presets of a blob ahead of time, so the first request for
+// them doesn't wait for the image to be processed
+type Deriver interface {
+	// HasPreset returns true if a preset with the name exists
+	HasPreset(name string) bool
+	// Derive renders the presets of the blob at key in the background and
+	// returns the ID of the job rendering them. The key doesn't include the
+	// tenant's namespace.
+	Derive(tenant, key string, presets []string) string
+}
+
+// SetDeriver sets what renders the presets of the x-derive header of an
+// upload. It must be called before the server starts.
+func (k *KeyVal) SetDeriver(d Deriver) {
+	k.deriver = d
+}
+
+// parseDerive parses an x-derive header, a comma-separated list of presets
+// to render once the upload is stored, e.g. thumb,card,og. It returns false
+// if any of them doesn't exist.
+func (k *KeyVal) parseDerive(s string) ([]string, bool) {
+	var presets []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if k.deriver == nil || !k.deriver.HasPreset(name) {
+			return nil, false
+		}
+		presets = append(presets, name)
+	}
+	return presets, true
+}
+
+// derive renders the presets of a blob that was just uploaded, and sets the
+// x-derive-job header to the ID of the job rendering them
+func (k *KeyVal) derive(c fiber.Ctx, key []byte, presets []string) {
+	if len(presets) == 0 {
+		return
+	}
+	ns := namespace(c)
+	c.Set("x-derive-job", k.deriver.Derive(mw.GetTenant(c), string(key[len(ns):]), presets))
+}
@@ -0,0 +1,44 @@
+package keyval
+
+import (
+	"github.com/jaredLunde/railway-image-service/internal/pkg/events"
+)
+
+// Event types
+const (
+	// EventBlobCreated is emitted when a blob is uploaded, copied or moved to
+	// a key that doesn't have one
+	EventBlobCreated = "blob.created"
+	// EventBlobOverwritten is emitted when a blob replaces an existing one
+	EventBlobOverwritten = "blob.overwritten"
+	// EventBlobUpdated is emitted when the metadata or ACL of a blob changes
+	EventBlobUpdated = "blob.updated"
+	// EventBlobDeleted is emitted when a blob is deleted, unlinked or expires
+	EventBlobDeleted = "blob.deleted"
+	// EventBlobRestored is emitted when an unlinked blob is restored
+	EventBlobRestored = "blob.restored"
+	// EventBlobQuarantined is emitted when an upload is rejected because
+	// it's infected with malware
+	EventBlobQuarantined = "blob.quarantined"
+)
+
+// emit sends an event about key to the webhook URLs, the event queue and the
+// event streams. The object of the event is the ListObject of the blob. Keys
+// of tenants are prefixed with the tenant's name, except in the streams of
+// the tenant.
+func (k *KeyVal) emit(eventType string, key []byte, rec Record) {
+	event := events.New(eventType, newListObject(string(key), rec))
+	k.sendWebhooks(event, key)
+	k.events.Push(event, string(key))
+	k.streams.send(event, string(key), rec)
+	for _, fn := range k.listeners {
+		fn(eventType, string(key))
+	}
+}
+
+// OnChange calls fn with the type of every event and the key it's about. Keys
+// of tenants are prefixed with the tenant's name. It must be called before
+// the server starts.
+func (k *KeyVal) OnChange(fn func(eventType, key string)) {
+	k.listeners = append(k.listeners, fn)
+}
@@ -0,0 +1,127 @@
+package keyval
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// expireBatchSize is the most expired keys removed per scan of the index
+const expireBatchSize = 1000
+
+// parseExpireAfter parses an x-expire-after header, either a number of
+// seconds or a duration like 1h30m. An empty value never expires.
+func parseExpireAfter(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		d = time.Duration(seconds) * time.Second
+	}
+	if d <= 0 {
+		return time.Time{}, false
+	}
+	return time.Now().Add(d).UTC(), true
+}
+
+// RunExpiry removes expired keys, and the nonces of expired single-use URLs,
+// every interval until ctx is done
+func (k *KeyVal) RunExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := k.RemoveExpired(ctx)
+			if err != nil {
+				k.log.Error("failed to remove expired keys", "error", err)
+			} else if n > 0 {
+				k.log.Info("removed expired keys", "count", n)
+			}
+			k.removeExpiredNonces()
+		}
+	}
+}
+
+// RemoveExpired deletes the blob and record of every key whose ExpiresAt time
+// has passed and returns the number of keys removed. Keys that are locked are
+// left for the next run.
+func (k *KeyVal) RemoveExpired(ctx context.Context) (int, error) {
+	removed := 0
+	var start []byte
+	for {
+		var expired [][]byte
+		var next []byte
+		err := k.db.Iterate(nil, start, func(key []byte, rec Record) bool {
+			if len(expired) == expireBatchSize {
+				next = append([]byte(nil), key...)
+				return false
+			}
+			if rec.Expired() {
+				expired = append(expired, append([]byte(nil), key...))
+			}
+			return true
+		})
+		if err != nil {
+			return removed, err
+		}
+
+		for _, key := range expired {
+			if ctx.Err() != nil {
+				return removed, ctx.Err()
+			}
+			ok, err := k.removeExpired(ctx, key)
+			if err != nil {
+				// Try the rest, this key is retried on the next run
+				k.log.Error("failed to remove expired key", "key", string(key), "error", err)
+				continue
+			}
+			if ok {
+				removed++
+			}
+		}
+
+		if next == nil {
+			return removed, nil
+		}
+		start = next
+	}
+}
+
+func (k *KeyVal) removeExpired(ctx context.Context, key []byte) (bool, error) {
+	if !k.LockKey(key) {
+		return false, nil
+	}
+	defer k.UnlockKey(key)
+
+	// The key may have been written again since the scan
+	rec, err := k.db.Get(key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !rec.Expired() {
+		return false, nil
+	}
+	if err := k.releaseBlob(ctx, key, rec); err != nil {
+		return false, err
+	}
+	if err := k.db.Delete(key); err != nil {
+		return false, err
+	}
+	k.updateQuotaUsage(key, rec, Record{Deleted: HARD})
+	if rec.Deleted == NO {
+		k.emit(EventBlobDeleted, key, rec)
+	}
+	return true, nil
+}
@@ -0,0 +1,116 @@
+package keyval
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+// ExportHandler streams the files under the prefix query parameter, or
+// matching the glob parameter, as a gzipped tar archive. Each file is stored
+// under its key with its modification time. Keys are listed a page at a time,
+// so an export doesn't hold the whole listing in memory.
+//
+// The status is sent before the first file is read, so an error part way
+// through ends the response early. The archive is then incomplete and gzip
+// reports it as truncated.
+func (k *KeyVal) ExportHandler(c fiber.Ctx) error {
+	// The query outlives the handler, so it can't point into fiber's buffers
+	opts := ListOptions{
+		Namespace: namespace(c),
+		Prefix:    strings.Clone(c.Query("prefix")),
+		Glob:      strings.Clone(c.Query("glob")),
+	}
+	if opts.Glob != "" {
+		if _, err := path.Match(opts.Glob, ""); err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+	}
+	mw.SetAuditKeys(c, opts.Prefix)
+
+	ctx := c.Context()
+	conn := ctx.Conn()
+	c.Set(fiber.HeaderContentType, "application/gzip")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="export.tar.gz"`)
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		gw := gzip.NewWriter(deadlineWriter{w, conn})
+		tw := tar.NewWriter(gw)
+		for {
+			objects, next, err := k.List(opts)
+			if err != nil {
+				k.log.Error("failed to iterate records", "error", err)
+				return
+			}
+			for _, obj := range objects {
+				if err := k.exportObject(ctx, tw, opts.Namespace, obj); err != nil {
+					k.log.Error("failed to export blob", "key", obj.Key, "error", err)
+					return
+				}
+			}
+			if next == "" {
+				break
+			}
+			opts.StartingAt = next
+		}
+		if err := tw.Close(); err != nil {
+			return
+		}
+		if err := gw.Close(); err != nil {
+			return
+		}
+		w.Flush()
+	})
+	return nil
+}
+
+// exportObject writes the blob of obj to tw. Blobs deleted since they were
+// listed are skipped.
+func (k *KeyVal) exportObject(ctx context.Context, tw *tar.Writer, ns string, obj ListObject) error {
+	key := ns + obj.Key
+	r, stat, err := k.storage.Get(ctx, k.GetRecord([]byte(key)).StorageKey(key))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer r.Close()
+	size := obj.Size
+	if stat != nil {
+		size = stat.Size
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     obj.Key,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  obj.ModifiedTime,
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, r, size)
+	return err
+}
+
+// deadlineWriter extends the write deadline of a connection before each
+// write. The server's write timeout only covers the start of the response.
+type deadlineWriter struct {
+	w    io.Writer
+	conn net.Conn
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return w.w.Write(p)
+}
@@ -0,0 +1,101 @@
+package keyval
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/ssrf"
+)
+
+const fetchUserAgent = "RailwayImagesClient/1.0 (Platform: Linux; Architecture: x64)"
+
+var errSourceNotAllowed = errors.New("redirected to a source that isn't allowed")
+
+type FetchRequest struct {
+	// URL is the remote file to fetch. The scheme defaults to https.
+	URL string `json:"url"`
+	// Key is where the file is stored
+	Key string `json:"key"`
+}
+
+// FetchHandler downloads a remote file and stores it under a key, so clients
+// don't have to proxy the bytes through their own backend. Only hosts
+// matching the allowed HTTP sources can be fetched from.
+func (k *KeyVal) FetchHandler(c fiber.Ctx) error {
+	var req FetchRequest
+	if err := json.Unmarshal(c.Body(), &req); err != nil || req.URL == "" || req.Key == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	rawURL := req.URL
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if !k.isSourceAllowed(u) {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+
+	mw.SetAuditKeys(c, req.Key)
+	key := []byte(namespace(c) + req.Key)
+	if !k.LockKey(key) {
+		return c.SendStatus(fiber.StatusConflict)
+	}
+	defer k.UnlockKey(key)
+
+	ctx := c.Context()
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	r.Header.Set("Accept", "image/*")
+	r.Header.Set("User-Agent", fetchUserAgent)
+	res, err := k.httpClient.Do(r)
+	if err != nil {
+		k.log.Error("failed to fetch file", "url", u.String(), "error", err)
+		if errors.Is(err, ssrf.ErrBlocked) || errors.Is(err, errSourceNotAllowed) {
+			return c.SendStatus(fiber.StatusForbidden)
+		}
+		return c.SendStatus(fiber.StatusBadGateway)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		if res.StatusCode == http.StatusNotFound {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return c.SendStatus(fiber.StatusBadGateway)
+	}
+
+	if status := k.Write(ctx, key, res.Body, int(res.ContentLength), WriteOptions{DeclaredContentType: res.Header.Get("Content-Type")}); status != fiber.StatusCreated {
+		return c.SendStatus(status)
+	}
+
+	rec := k.GetRecord(key)
+	return c.Status(fiber.StatusCreated).JSON(newListObject(req.Key, rec))
+}
+
+// isSourceAllowed reports whether u matches one of the allowed HTTP source
+// patterns, e.g. *.foobar.com or https://my.foobar.com:8443
+func (k *KeyVal) isSourceAllowed(u *url.URL) bool {
+	return k.allowedHTTPSources.Load().Match(u)
+}
+
+// checkRedirect only follows redirects to allowed HTTP sources
+func (k *KeyVal) checkRedirect(r *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if !k.isSourceAllowed(r.URL) {
+		return errSourceNotAllowed
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package keyval
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NewFileStorage creates a Storage backend that keeps blobs on the local
+// filesystem under root
+func NewFileStorage(root string) *FileStorage {
+	return &FileStorage{
+		Root:            root,
+		MkdirPermission: 0755,
+	}
+}
+
+// FileStorage stores blobs on the local filesystem. Keys are hex encoded and
+// fanned out into two levels of directories, see KeyToPath.
+type FileStorage struct {
+	Root            string
+	MkdirPermission os.FileMode
+}
+
+// LocalPath returns the path of the file backing key
+func (s *FileStorage) LocalPath(key string) string {
+	return filepath.Join(s.Root, KeyToPath([]byte(key)))
+}
+
+// Get implements the Storage interface
+func (s *FileStorage) Get(_ context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	f, err := os.Open(s.LocalPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, &ObjectInfo{Key: key, Size: stat.Size(), ModifiedTime: stat.ModTime()}, nil
+}
+
+// Put implements the Storage interface. The blob is written to a temporary
+// file first and renamed into place once it has been synced to disk.
+func (s *FileStorage) Put(_ context.Context, key string, r io.Reader, _ int64) error {
+	fp := s.LocalPath(key)
+	if err := os.MkdirAll(filepath.Dir(fp), s.MkdirPermission); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(fp), "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name()) // Clean up temp file on any error
+	defer tmpFile.Close()
+
+	buf := make([]byte, 32*1024)
+	if _, err := io.CopyBuffer(tmpFile, r, buf); err != nil {
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), fp)
+}
+
+// Copy implements the Copier interface. Blobs are never modified in place, so
+// the copy is a hard link to the same file when the filesystem supports it.
+func (s *FileStorage) Copy(ctx context.Context, src, dst string) error {
+	srcPath := s.LocalPath(src)
+	if _, err := os.Stat(srcPath); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	dstPath := s.LocalPath(dst)
+	if err := os.MkdirAll(filepath.Dir(dstPath), s.MkdirPermission); err != nil {
+		return err
+	}
+
+	// Link to a temporary name first, since os.Link won't replace dst
+	tmpPath := filepath.Join(filepath.Dir(dstPath), "tmp-"+filepath.Base(dstPath))
+	_ = os.Remove(tmpPath)
+	if err := os.Link(srcPath, tmpPath); err != nil {
+		f, err := os.Open(srcPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return s.Put(ctx, dst, f, -1)
+	}
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// Delete implements the Storage interface
+func (s *FileStorage) Delete(_ context.Context, key string) error {
+	if err := os.Remove(s.LocalPath(key)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// Stat implements the Storage interface
+func (s *FileStorage) Stat(_ context.Context, key string) (*ObjectInfo, error) {
+	stat, err := os.Stat(s.LocalPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: stat.Size(), ModifiedTime: stat.ModTime()}, nil
+}
+
+// List implements the Storage interface. Keys are recovered from the hex
+// encoded file names, so this walks the entire volume regardless of prefix.
+func (s *FileStorage) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), "tmp-") {
+			return nil
+		}
+		key, err := hex.DecodeString(d.Name())
+		if err != nil || !strings.HasPrefix(string(key), prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{Key: string(key), Size: info.Size(), ModifiedTime: info.ModTime()})
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,249 @@
+package gcloudstorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+const apiURL = "https://storage.googleapis.com"
+
+// GCloudStorage stores blobs in a Google Cloud Storage bucket using the JSON
+// API. It implements the keyval.Storage interface.
+type GCloudStorage struct {
+	// Bucket is the name of the bucket blobs are stored in
+	Bucket string
+	// PathPrefix is prepended to every key
+	PathPrefix string
+	// TokenSource provides access tokens for every request
+	TokenSource TokenSource
+	// Client is the HTTP client used to talk to the storage API
+	Client *http.Client
+
+	credentialsJSON []byte
+}
+
+// Option GCloudStorage option
+type Option func(s *GCloudStorage)
+
+// New creates GCloudStorage. Requests are authenticated with the metadata
+// server, i.e. workload identity, unless WithCredentialsJSON is given.
+func New(bucket string, options ...Option) (*GCloudStorage, error) {
+	s := &GCloudStorage{
+		Bucket: bucket,
+		Client: http.DefaultClient,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	if len(s.credentialsJSON) > 0 {
+		ts, err := NewServiceAccountTokenSource(s.credentialsJSON, s.Client)
+		if err != nil {
+			return nil, err
+		}
+		s.TokenSource = ts
+	}
+	if s.TokenSource == nil {
+		s.TokenSource = NewMetadataTokenSource(s.Client)
+	}
+	return s, nil
+}
+
+// WithCredentialsJSON with service account JSON key option
+func WithCredentialsJSON(credentialsJSON []byte) Option {
+	return func(s *GCloudStorage) {
+		s.credentialsJSON = credentialsJSON
+	}
+}
+
+// WithPathPrefix with key prefix option
+func WithPathPrefix(prefix string) Option {
+	return func(s *GCloudStorage) {
+		s.PathPrefix = strings.Trim(prefix, "/")
+	}
+}
+
+// WithHTTPClient with custom HTTP client option
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *GCloudStorage) {
+		if client != nil {
+			s.Client = client
+		}
+	}
+}
+
+// Get implements keyval.Storage interface
+func (s *GCloudStorage) Get(ctx context.Context, key string) (io.ReadCloser, *keyval.ObjectInfo, error) {
+	res, err := s.do(ctx, http.MethodGet, s.objectURL(key)+"?alt=media", nil, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	size, _ := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return res.Body, &keyval.ObjectInfo{Key: key, Size: size, ModifiedTime: modTime}, nil
+}
+
+// Put implements keyval.Storage interface
+func (s *GCloudStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	q := url.Values{}
+	q.Set("uploadType", "media")
+	q.Set("name", s.objectKey(key))
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", apiURL, url.PathEscape(s.Bucket), q.Encode())
+	res, err := s.do(ctx, http.MethodPost, u, r, size)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Delete implements keyval.Storage interface
+func (s *GCloudStorage) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, s.objectURL(key), nil, -1)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Copy implements keyval.Copier interface
+func (s *GCloudStorage) Copy(ctx context.Context, src, dst string) error {
+	token := ""
+	for {
+		// Large objects may take more than one call to rewrite
+		u := s.objectURL(src) + "/rewriteTo" + strings.TrimPrefix(s.objectURL(dst), apiURL+"/storage/v1")
+		if token != "" {
+			u += "?rewriteToken=" + url.QueryEscape(token)
+		}
+		res, err := s.do(ctx, http.MethodPost, u, nil, -1)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Done         bool   `json:"done"`
+			RewriteToken string `json:"rewriteToken"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&result)
+		_ = res.Body.Close()
+		if err != nil {
+			return err
+		}
+		if result.Done {
+			return nil
+		}
+		token = result.RewriteToken
+	}
+}
+
+// Stat implements keyval.Storage interface
+func (s *GCloudStorage) Stat(ctx context.Context, key string) (*keyval.ObjectInfo, error) {
+	res, err := s.do(ctx, http.MethodGet, s.objectURL(key), nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var obj object
+	if err := json.NewDecoder(res.Body).Decode(&obj); err != nil {
+		return nil, err
+	}
+	info := obj.info(s.PathPrefix)
+	return &info, nil
+}
+
+// List implements keyval.Storage interface
+func (s *GCloudStorage) List(ctx context.Context, prefix string, fn func(keyval.ObjectInfo) error) error {
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("prefix", s.objectKey(prefix))
+		q.Set("fields", "items(name,size,updated),nextPageToken")
+		if token != "" {
+			q.Set("pageToken", token)
+		}
+		u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", apiURL, url.PathEscape(s.Bucket), q.Encode())
+		res, err := s.do(ctx, http.MethodGet, u, nil, -1)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Items         []object `json:"items"`
+			NextPageToken string   `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&result)
+		_ = res.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, obj := range result.Items {
+			if err := fn(obj.info(s.PathPrefix)); err != nil {
+				return err
+			}
+		}
+		if result.NextPageToken == "" {
+			return nil
+		}
+		token = result.NextPageToken
+	}
+}
+
+func (s *GCloudStorage) objectKey(key string) string {
+	if s.PathPrefix == "" {
+		return key
+	}
+	return s.PathPrefix + "/" + key
+}
+
+func (s *GCloudStorage) objectURL(key string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", apiURL, url.PathEscape(s.Bucket), url.PathEscape(s.objectKey(key)))
+}
+
+func (s *GCloudStorage) do(ctx context.Context, method, u string, body io.Reader, size int64) (*http.Response, error) {
+	token, err := s.TokenSource.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		_ = res.Body.Close()
+		return nil, keyval.ErrNotFound
+	}
+	if res.StatusCode >= 300 {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("gcloudstorage: %s %s: %s", method, req.URL.Path, res.Status)
+	}
+	return res, nil
+}
+
+type object struct {
+	Name    string    `json:"name"`
+	Size    string    `json:"size"`
+	Updated time.Time `json:"updated"`
+}
+
+func (o object) info(prefix string) keyval.ObjectInfo {
+	size, _ := strconv.ParseInt(o.Size, 10, 64)
+	key := o.Name
+	if prefix != "" {
+		key = strings.TrimPrefix(key, prefix+"/")
+	}
+	return keyval.ObjectInfo{Key: key, Size: size, ModifiedTime: o.Updated}
+}
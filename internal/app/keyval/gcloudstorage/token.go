@@ -0,0 +1,164 @@
+package gcloudstorage
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	storageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+	metadataURL  = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// TokenSource returns OAuth2 access tokens for the storage API
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// ServiceAccount is the subset of a service account JSON key file needed to
+// mint access tokens
+type ServiceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// NewServiceAccountTokenSource creates a TokenSource that exchanges a JWT
+// signed with the service account's private key for access tokens
+func NewServiceAccountTokenSource(credentialsJSON []byte, client *http.Client) (TokenSource, error) {
+	var sa ServiceAccount
+	if err := json.Unmarshal(credentialsJSON, &sa); err != nil {
+		return nil, fmt.Errorf("invalid service account credentials: %w", err)
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, errors.New("invalid service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("invalid service account private key: %w", err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service account private key is not an RSA key")
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &cachedTokenSource{fetch: func(ctx context.Context) (*tokenResponse, error) {
+		assertion, err := signJWT(sa, key)
+		if err != nil {
+			return nil, err
+		}
+		form := url.Values{}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, sa.TokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return doTokenRequest(client, req)
+	}}, nil
+}
+
+// NewMetadataTokenSource creates a TokenSource that fetches tokens from the
+// GCE metadata server. This is how workload identity is consumed on GKE and
+// Cloud Run.
+func NewMetadataTokenSource(client *http.Client) TokenSource {
+	return &cachedTokenSource{fetch: func(ctx context.Context) (*tokenResponse, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		return doTokenRequest(client, req)
+	}}
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type cachedTokenSource struct {
+	fetch   func(ctx context.Context) (*tokenResponse, error)
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (s *cachedTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Refresh a minute early so in-flight requests don't race the expiry
+	if s.token != "" && time.Now().Add(time.Minute).Before(s.expires) {
+		return s.token, nil
+	}
+	res, err := s.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	s.token = res.AccessToken
+	s.expires = time.Now().Add(time.Duration(res.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+func doTokenRequest(client *http.Client, req *http.Request) (*tokenResponse, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gcloudstorage: token request failed: %s", res.Status)
+	}
+	var token tokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func signJWT(sa ServiceAccount, key *rsa.PrivateKey) (string, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": sa.PrivateKeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss":   sa.ClientEmail,
+		"scope": storageScope,
+		"aud":   sa.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
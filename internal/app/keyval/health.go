@@ -0,0 +1,50 @@
+package keyval
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// healthKeyPrefix is the prefix of the blobs CheckStorage writes. Tenants
+// can't reach it, and the random suffix keeps it from clashing with uploads.
+const healthKeyPrefix = ".health/"
+
+// CheckIndex reads a key from the index to check that it's reachable
+func (k *KeyVal) CheckIndex(ctx context.Context) error {
+	if _, err := k.db.Get([]byte(healthKeyPrefix)); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// CheckStorage writes a blob, reads it back and deletes it to check that the
+// storage backend is writable
+func (k *KeyVal) CheckStorage(ctx context.Context) error {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	key := healthKeyPrefix + hex.EncodeToString(suffix)
+	data := []byte("ok")
+
+	if err := k.storage.Put(ctx, key, bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	defer k.storage.Delete(context.WithoutCancel(ctx), key)
+	r, _, err := k.storage.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if !bytes.Equal(got, data) {
+		return errors.New("read: blob doesn't match what was written")
+	}
+	return nil
+}
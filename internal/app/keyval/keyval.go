@@ -1,65 +1,247 @@
 package keyval
 
 import (
+	"fmt"
 	"log/slog"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/events"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/metrics"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/scan"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/sourceauth"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/ssrf"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/tracing"
 )
 
 type Config struct {
-	UploadPath       string
-	LevelDBPath      string
-	SoftDelete       bool
-	SignSecret       string
-	BasePath         string
-	MaxSize          int
+	// Storage is the backend blobs are stored in. Defaults to a FileStorage
+	// rooted at UploadPath.
+	Storage Storage
+	// Index is where the record of every key is kept. Defaults to a LevelDB
+	// database at LevelDBPath.
+	Index       Index
+	UploadPath  string
+	LevelDBPath string
+	SoftDelete  bool
+	SignSecret  string
+	BasePath    string
+	MaxSize     int
+	// AllowedMimeTypes are the prefixes of the content types that can be
+	// stored, e.g. image/ or application/pdf
 	AllowedMimeTypes []string
-	Logger           *slog.Logger
-	Debug            bool
+	// MimeTypeRules replace AllowedMimeTypes for the keys under their
+	// prefixes
+	MimeTypeRules []MimeTypeRule
+	// ContentTypeMismatch is what's done with uploads whose content isn't
+	// the type they were declared with: ContentTypeMismatchReject, the
+	// default, or ContentTypeMismatchRewrite
+	ContentTypeMismatch string
+	Logger              *slog.Logger
+	Debug               bool
+	// FormField is the name of the multipart/form-data field files are
+	// uploaded in. Defaults to "file".
+	FormField string
+	// TusPath is the directory unfinished tus uploads are kept in
+	TusPath string
+	// TusExpiry is how long a tus upload can take to finish
+	TusExpiry time.Duration
+	// AllowedHTTPSources is a comma-separated list of host patterns files
+	// can be fetched from. Fetching is disabled if it's empty.
+	AllowedHTTPSources string
+	// BlockNetworks are the networks files can't be fetched from, whatever
+	// the host names of AllowedHTTPSources resolve to
+	BlockNetworks []*net.IPNet
+	// SourceAuth are the credentials sent to AllowedHTTPSources. They can be
+	// replaced while the service is running.
+	SourceAuth *atomic.Pointer[sourceauth.Rules]
+	// SourceProxy returns the proxy files are fetched through, if any
+	SourceProxy func(*http.Request) (*url.URL, error)
+	// RequestTimeout is how long fetching a remote file can take
+	RequestTimeout time.Duration
+	// Quotas limit how much can be stored under key prefixes
+	Quotas []Quota
+	// DefaultACL is the ACL of blobs uploaded without an x-acl header.
+	// Defaults to ACLPrivate.
+	DefaultACL string
+	// WebhookURLs are sent a signed POST when a blob is created, overwritten,
+	// deleted or restored
+	WebhookURLs []string
+	// WebhookSecret is the secret webhooks are signed with. Required if there
+	// are WebhookURLs.
+	WebhookSecret string
+	// Events publishes every change to a blob to a message broker
+	Events *events.Queue
+	// Metrics records upload sizes, the storage totals and LevelDB stats
+	Metrics *metrics.Registry
+	// Tracer records a span for every call to Storage
+	Tracer *tracing.Tracer
+	// Dedup stores blobs once under their content hash, so keys with the
+	// same content share a blob. The Index has to be a RefIndex.
+	Dedup bool
+	// CacheTagHeaders are the response headers blobs are tagged with, so a
+	// CDN can purge them. See cdn.Tag.
+	CacheTagHeaders []string
+	// Scanner checks uploads for malware before they're stored. Infected
+	// uploads are rejected and quarantined. Uploads aren't scanned if it's
+	// nil.
+	Scanner scan.Scanner
+	// Moderation sends uploaded images to a classifier
+	Moderation Moderation
 }
 
 func New(cfg Config) (*KeyVal, error) {
 	rand.New(rand.NewSource(time.Now().UnixNano()))
-	db, err := leveldb.OpenFile(cfg.LevelDBPath, nil)
+	db := cfg.Index
+	if db == nil {
+		ldb, err := NewLevelDBIndex(cfg.LevelDBPath)
+		if err != nil {
+			return nil, err
+		}
+		db = ldb
+	}
+
+	storage := cfg.Storage
+	if storage == nil {
+		storage = NewFileStorage(cfg.UploadPath)
+	}
+	if cfg.Tracer != nil {
+		storage = traceStorage(storage, cfg.Tracer)
+	}
+
+	defaultACL := cfg.DefaultACL
+	if defaultACL == "" {
+		defaultACL = ACLPrivate
+	}
+	if _, ok := parseACL(defaultACL); !ok {
+		return nil, fmt.Errorf("invalid default ACL %q, expected public or private", defaultACL)
+	}
+
+	contentTypeMismatch, ok := parseContentTypeMismatch(cfg.ContentTypeMismatch)
+	if !ok {
+		return nil, fmt.Errorf("invalid content type mismatch %q, expected reject or rewrite", cfg.ContentTypeMismatch)
+	}
+
+	moderationAction, ok := parseModerationAction(cfg.Moderation.Action)
+	if !ok {
+		return nil, fmt.Errorf("invalid moderation action %q, expected block, flag or quarantine", cfg.Moderation.Action)
+	}
+
+	if len(cfg.WebhookURLs) > 0 && cfg.WebhookSecret == "" {
+		return nil, fmt.Errorf("a webhook secret is required to send webhooks")
+	}
+
+	formField := cfg.FormField
+	if formField == "" {
+		formField = "file"
+	}
+
+	refs, _ := db.(RefIndex)
+	if cfg.Dedup && refs == nil {
+		return nil, fmt.Errorf("deduplication needs an index that counts references, like leveldb")
+	}
+
+	tus, err := newTusStore(cfg.TusPath, cfg.TusExpiry)
 	if err != nil {
 		return nil, err
 	}
 
-	return &KeyVal{
-		db:               db,
-		lock:             map[string]struct{}{},
-		softDelete:       cfg.SoftDelete,
-		volume:           cfg.UploadPath,
-		signSecret:       cfg.SignSecret,
-		basePath:         cfg.BasePath,
-		maxFileSize:      cfg.MaxSize,
-		allowedMimeTypes: cfg.AllowedMimeTypes,
-		log:              cfg.Logger,
-		debug:            cfg.Debug,
-	}, nil
+	k := &KeyVal{
+		db:                  db,
+		lock:                map[string]struct{}{},
+		softDelete:          cfg.SoftDelete,
+		storage:             storage,
+		tus:                 tus,
+		formField:           formField,
+		signSecret:          cfg.SignSecret,
+		basePath:            cfg.BasePath,
+		maxFileSize:         cfg.MaxSize,
+		allowedMimeTypes:    cfg.AllowedMimeTypes,
+		mimeTypeRules:       cfg.MimeTypeRules,
+		contentTypeMismatch: contentTypeMismatch,
+		log:                 cfg.Logger,
+		debug:               cfg.Debug,
+		httpClient:          &http.Client{Timeout: cfg.RequestTimeout, Transport: ssrf.NewGuard(cfg.BlockNetworks...).Transport(cfg.SourceProxy)},
+		quotas:              cfg.Quotas,
+		defaultACL:          defaultACL,
+		webhooks:            newWebhooks(cfg.WebhookURLs, cfg.WebhookSecret, cfg.RequestTimeout),
+		events:              cfg.Events,
+		dedup:               cfg.Dedup,
+		refs:                refs,
+		cacheTagHeaders:     cfg.CacheTagHeaders,
+		scanner:             cfg.Scanner,
+		moderation:          cfg.Moderation,
+	}
+	k.moderation.Action = moderationAction
+	if k.moderation.Classifier != nil && k.moderation.Async {
+		k.moderationQueue = make(chan moderationJob, moderationQueueSize)
+	}
+	k.SetAllowedHTTPSources(cfg.AllowedHTTPSources)
+	k.httpClient.CheckRedirect = k.checkRedirect
+	if cfg.SourceAuth != nil {
+		k.httpClient.Transport = sourceauth.NewTransport(cfg.SourceAuth, k.httpClient.Transport)
+	}
+	k.metrics = k.registerMetrics(cfg.Metrics)
+	return k, nil
 }
 
 type KeyVal struct {
-	db               *leveldb.DB
-	mlock            sync.Mutex
-	lock             map[string]struct{}
-	log              *slog.Logger
-	signSecret       string
-	volume           string
-	basePath         string
-	maxFileSize      int
-	allowedMimeTypes []string
-	softDelete       bool
-	debug            bool
+	db                  Index
+	mlock               sync.Mutex
+	lock                map[string]struct{}
+	log                 *slog.Logger
+	storage             Storage
+	tus                 *tusStore
+	formField           string
+	signSecret          string
+	basePath            string
+	maxFileSize         int
+	allowedMimeTypes    []string
+	mimeTypeRules       []MimeTypeRule
+	contentTypeMismatch string
+	softDelete          bool
+	debug               bool
+	httpClient          *http.Client
+	allowedHTTPSources  atomic.Pointer[ssrf.Sources]
+	quotas              []Quota
+	quotaUsage          quotaUsages
+	defaultACL          string
+	webhooks            *webhooks
+	events              *events.Queue
+	streams             streams
+	listeners           []func(eventType, key string)
+	deriver             Deriver
+	metrics             *keyvalMetrics
+	dedup               bool
+	refs                RefIndex
+	contentLocks        contentLocks
+	cacheTagHeaders     []string
+	scanner             scan.Scanner
+	moderation          Moderation
+	moderationQueue     chan moderationJob
+}
+
+// SetAllowedHTTPSources replaces the comma-separated list of host patterns
+// files can be fetched from
+func (k *KeyVal) SetAllowedHTTPSources(sources string) {
+	parsed := ssrf.ParseSources(sources)
+	k.allowedHTTPSources.Store(&parsed)
 }
 
 func (k *KeyVal) Close() error {
 	return k.db.Close()
 }
 
+// Storage returns the backend blobs are stored in
+func (k *KeyVal) Storage() Storage {
+	return k.storage
+}
+
 func (k *KeyVal) UnlockKey(key []byte) {
 	k.mlock.Lock()
 	delete(k.lock, string(key))
@@ -77,18 +259,38 @@ func (k *KeyVal) LockKey(key []byte) bool {
 }
 
 func (k *KeyVal) GetRecord(key []byte) Record {
-	data, err := k.db.Get(key, nil)
-	rec := Record{HARD, ""}
-	if err != leveldb.ErrNotFound {
-		rec = toRecord(data)
+	rec, err := k.db.Get(key)
+	if err != nil {
+		if err != ErrNotFound {
+			k.log.Error("failed to get record", "error", err)
+		}
+		return Record{Deleted: HARD}
+	}
+	if rec.Expired() {
+		return Record{Deleted: HARD}
 	}
 	return rec
 }
 
-func (k *KeyVal) PutRecord(key []byte, rec Record) error {
-	data, err := fromRecord(rec)
+// storedRecord returns the record of key even if it has expired. Expired
+// records read as hard deleted, but their blobs still have to be released
+// when the key is written again.
+func (k *KeyVal) storedRecord(key []byte) Record {
+	rec, err := k.db.Get(key)
 	if err != nil {
-		return err
+		if err != ErrNotFound {
+			k.log.Error("failed to get record", "error", err)
+		}
+		return Record{Deleted: HARD}
 	}
-	return k.db.Put(key, data, nil)
+	return rec
+}
+
+func (k *KeyVal) PutRecord(key []byte, rec Record) error {
+	return k.db.Put(key, rec)
+}
+
+// Index returns the index the record of every key is kept in
+func (k *KeyVal) Index() Index {
+	return k.db
 }
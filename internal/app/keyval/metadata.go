@@ -0,0 +1,112 @@
+package keyval
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+const (
+	// MAX_METADATA_SIZE is the most bytes of metadata keys and values a blob
+	// can have
+	MAX_METADATA_SIZE = 2048
+	// metadataHeaderPrefix is the prefix of the headers metadata is read from
+	// and returned in
+	metadataHeaderPrefix = "x-meta-"
+)
+
+// metadataFromHeaders returns the metadata in the x-meta-* headers of the
+// request. Names are case-insensitive, so they are lowercased.
+func metadataFromHeaders(c fiber.Ctx) (map[string]string, bool) {
+	var metadata map[string]string
+	c.Request().Header.VisitAll(func(key, value []byte) {
+		name := strings.ToLower(string(key))
+		if !strings.HasPrefix(name, metadataHeaderPrefix) {
+			return
+		}
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata[strings.TrimPrefix(name, metadataHeaderPrefix)] = string(value)
+	})
+	return metadata, validMetadata(metadata)
+}
+
+// setMetadataHeaders returns the metadata of a blob in x-meta-* headers
+func setMetadataHeaders(c fiber.Ctx, metadata map[string]string) {
+	for name, value := range metadata {
+		c.Set(metadataHeaderPrefix+name, value)
+	}
+}
+
+// validMetadata reports whether every name and value can be sent as a header
+// and the metadata isn't larger than MAX_METADATA_SIZE
+func validMetadata(metadata map[string]string) bool {
+	size := 0
+	for name, value := range metadata {
+		if name == "" {
+			return false
+		}
+		for _, r := range name {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+		for _, r := range value {
+			if r < ' ' || r > '~' {
+				return false
+			}
+		}
+		size += len(name) + len(value)
+	}
+	return size <= MAX_METADATA_SIZE
+}
+
+// UpdateMetadata applies a JSON merge patch (RFC 7396) to the metadata of a
+// blob, e.g. {"alt": "A gopher", "owner": null} sets alt and removes owner.
+// The ACL of the blob is changed as well unless acl is empty, in which case
+// the patch can be empty too. The key must be locked by the caller.
+func (k *KeyVal) UpdateMetadata(key []byte, patch []byte, acl string) (Record, int) {
+	var changes map[string]*string
+	if len(patch) > 0 || acl == "" {
+		if err := json.Unmarshal(patch, &changes); err != nil {
+			return Record{}, fiber.StatusBadRequest
+		}
+	}
+
+	rec := k.GetRecord(key)
+	if rec.Deleted != NO {
+		return rec, fiber.StatusNotFound
+	}
+
+	metadata := make(map[string]string, len(rec.Metadata)+len(changes))
+	for name, value := range rec.Metadata {
+		metadata[name] = value
+	}
+	for name, value := range changes {
+		name = strings.ToLower(name)
+		if value == nil {
+			delete(metadata, name)
+		} else {
+			metadata[name] = *value
+		}
+	}
+	if !validMetadata(metadata) {
+		return rec, fiber.StatusBadRequest
+	}
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+
+	rec.Metadata = metadata
+	if acl != "" {
+		rec.ACL = acl
+	}
+	if err := k.PutRecord(key, rec); err != nil {
+		k.log.Error("failed to put record", "error", err)
+		return rec, fiber.StatusInternalServerError
+	}
+	k.emit(EventBlobUpdated, key, rec)
+	return rec, fiber.StatusOK
+}
@@ -0,0 +1,115 @@
+package keyval
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/internal/pkg/metrics"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// storageStatsInterval is how often the storage totals are counted again.
+// Counting them iterates over every record in the index.
+const storageStatsInterval = time.Minute
+
+type keyvalMetrics struct {
+	uploadSizes *metrics.Histogram
+
+	objects        *metrics.Gauge
+	bytes          *metrics.Gauge
+	deletedObjects *metrics.Gauge
+	deletedBytes   *metrics.Gauge
+	mu             sync.Mutex
+	countedAt      time.Time
+
+	levelDBReadBytes   *metrics.Counter
+	levelDBWriteBytes  *metrics.Counter
+	levelDBWriteDelays *metrics.Counter
+	levelDBOpenTables  *metrics.Gauge
+	levelDBLevelSizes  *metrics.Gauge
+	levelDBLevelTables *metrics.Gauge
+}
+
+// registerMetrics adds the metrics of the service to registry. It returns
+// nil if registry is nil.
+func (k *KeyVal) registerMetrics(registry *metrics.Registry) *keyvalMetrics {
+	if registry == nil {
+		return nil
+	}
+	m := &keyvalMetrics{
+		uploadSizes:    registry.NewHistogram("blob_upload_size_bytes", "The size of uploaded blobs", metrics.SizeBuckets),
+		objects:        registry.NewGauge("blob_storage_objects", "The number of blobs that are served"),
+		bytes:          registry.NewGauge("blob_storage_bytes", "The total size of the blobs that are served"),
+		deletedObjects: registry.NewGauge("blob_storage_deleted_objects", "The number of soft deleted blobs that still take up space"),
+		deletedBytes:   registry.NewGauge("blob_storage_deleted_bytes", "The total size of the soft deleted blobs"),
+	}
+	registry.OnScrape(k.collectStorageStats)
+
+	if _, ok := k.db.(*LevelDBIndex); ok {
+		m.levelDBReadBytes = registry.NewCounter("leveldb_io_read_bytes_total", "The number of bytes LevelDB has read")
+		m.levelDBWriteBytes = registry.NewCounter("leveldb_io_write_bytes_total", "The number of bytes LevelDB has written")
+		m.levelDBWriteDelays = registry.NewCounter("leveldb_write_delays_total", "The number of writes LevelDB delayed while compacting")
+		m.levelDBOpenTables = registry.NewGauge("leveldb_open_tables", "The number of tables LevelDB has open")
+		m.levelDBLevelSizes = registry.NewGauge("leveldb_level_size_bytes", "The size of each LevelDB level", "level")
+		m.levelDBLevelTables = registry.NewGauge("leveldb_level_tables", "The number of tables in each LevelDB level", "level")
+		registry.OnScrape(k.collectLevelDBStats)
+	}
+	return m
+}
+
+// observeUpload records the size of an uploaded blob
+func (k *KeyVal) observeUpload(size int64) {
+	if k.metrics == nil {
+		return
+	}
+	k.metrics.uploadSizes.Observe(float64(size))
+}
+
+// collectStorageStats counts the blobs in the index, at most once every
+// storageStatsInterval
+func (k *KeyVal) collectStorageStats() {
+	m := k.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.countedAt) < storageStatsInterval {
+		return
+	}
+
+	var stats StorageStats
+	err := k.db.Iterate(nil, nil, func(key []byte, rec Record) bool {
+		// Keys reserved by writes in progress don't have a blob yet
+		if !rec.Expired() && rec.Hash != "" {
+			stats.add(rec)
+		}
+		return true
+	})
+	if err != nil {
+		k.log.Error("failed to iterate records", "error", err)
+		return
+	}
+	m.countedAt = time.Now()
+	m.objects.Set(float64(stats.Objects))
+	m.bytes.Set(float64(stats.Bytes))
+	m.deletedObjects.Set(float64(stats.DeletedObjects))
+	m.deletedBytes.Set(float64(stats.DeletedBytes))
+}
+
+func (k *KeyVal) collectLevelDBStats() {
+	var stats leveldb.DBStats
+	if err := k.db.(*LevelDBIndex).db.Stats(&stats); err != nil {
+		k.log.Error("failed to get LevelDB stats", "error", err)
+		return
+	}
+	m := k.metrics
+	m.levelDBReadBytes.Set(float64(stats.IORead))
+	m.levelDBWriteBytes.Set(float64(stats.IOWrite))
+	m.levelDBWriteDelays.Set(float64(stats.WriteDelayCount))
+	m.levelDBOpenTables.Set(float64(stats.OpenedTablesCount))
+	for level, size := range stats.LevelSizes {
+		m.levelDBLevelSizes.Set(float64(size), strconv.Itoa(level))
+	}
+	for level, tables := range stats.LevelTablesCounts {
+		m.levelDBLevelTables.Set(float64(tables), strconv.Itoa(level))
+	}
+}
@@ -0,0 +1,69 @@
+package keyval
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// MimeTypeRule replaces the MIME types that can be stored under a prefix
+type MimeTypeRule struct {
+	// Prefix the rule applies to. A * segment matches any segment, e.g.
+	// users/*/docs/.
+	Prefix string
+	// MimeTypes are the prefixes of the content types that can be stored
+	// under it, e.g. application/pdf or image/
+	MimeTypes []string
+}
+
+// ParseMimeTypes parses a comma-separated list of the prefixes of MIME
+// types, e.g. image/,application/pdf
+func ParseMimeTypes(s string) []string {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// ParseMimeTypeRules parses a semicolon-separated list of prefix=types
+// rules, where types are a comma-separated list of the prefixes of MIME
+// types, e.g. docs/=application/pdf,text/plain;avatars/=image/png
+func ParseMimeTypeRules(s string) ([]MimeTypeRule, error) {
+	var rules []MimeTypeRule
+	for _, rule := range strings.Split(s, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		prefix, types, ok := strings.Cut(rule, "=")
+		prefix = strings.TrimSpace(prefix)
+		if !ok || !strings.HasSuffix(prefix, "/") {
+			return nil, fmt.Errorf("invalid MIME type rule %q, expected prefix/=types", rule)
+		}
+		if _, err := path.Match(prefix, ""); err != nil {
+			return nil, fmt.Errorf("invalid MIME type rule prefix %q: %w", prefix, err)
+		}
+		mimeTypes := ParseMimeTypes(types)
+		if len(mimeTypes) == 0 {
+			return nil, fmt.Errorf("MIME type rule %q doesn't allow any types", rule)
+		}
+		rules = append(rules, MimeTypeRule{Prefix: prefix, MimeTypes: mimeTypes})
+	}
+	return rules, nil
+}
+
+// allowedMimeTypesOf returns the prefixes of the MIME types that can be
+// stored at key. The rule with the longest prefix that matches key applies,
+// or the allowed MIME types if none do.
+func (k *KeyVal) allowedMimeTypesOf(key []byte) []string {
+	allowed, longest := k.allowedMimeTypes, -1
+	for _, rule := range k.mimeTypeRules {
+		if prefix, ok := matchPrefix(rule.Prefix, string(key)); ok && len(prefix) > longest {
+			allowed, longest = rule.MimeTypes, len(prefix)
+		}
+	}
+	return allowed
+}
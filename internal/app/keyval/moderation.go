@@ -0,0 +1,217 @@
+package keyval
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/moderation"
+)
+
+// What's done with the images a classifier flags
+const (
+	// ModerationBlock rejects flagged uploads. Flagged blobs are unlinked in
+	// async mode, so they can still be restored.
+	ModerationBlock = "block"
+	// ModerationFlag stores flagged images with their labels in the
+	// moderation metadata field
+	ModerationFlag = "flag"
+	// ModerationQuarantine rejects flagged uploads and keeps them under
+	// QuarantinePrefix
+	ModerationQuarantine = "quarantine"
+)
+
+const (
+	// moderationMetadata is the metadata field the labels of flagged images
+	// are stored in
+	moderationMetadata = "moderation"
+	// moderationQueueSize is how many blobs can wait to be classified in
+	// async mode before new ones are skipped
+	moderationQueueSize = 1024
+	// moderationWorkers is how many blobs are classified at once in async
+	// mode
+	moderationWorkers = 4
+)
+
+var (
+	errFlagged          = errors.New("upload was flagged")
+	errModerationFailed = errors.New("upload couldn't be classified")
+)
+
+// Moderation sends uploaded images to a classifier, and blocks, flags or
+// quarantines the ones it flags
+type Moderation struct {
+	// Classifier decides whether images are acceptable. Images aren't
+	// moderated if it's nil.
+	Classifier moderation.Classifier
+	// Action is what's done with flagged images: ModerationBlock, the
+	// default, ModerationFlag or ModerationQuarantine
+	Action string
+	// Async classifies images after they're stored instead of before, so
+	// uploads don't wait on slow classifiers. Flagged images are served
+	// until they're classified.
+	Async bool
+}
+
+// parseModerationAction parses a moderation action. An empty value means
+// ModerationBlock.
+func parseModerationAction(v string) (string, bool) {
+	switch v {
+	case "":
+		return ModerationBlock, true
+	case ModerationBlock, ModerationFlag, ModerationQuarantine:
+		return v, true
+	}
+	return "", false
+}
+
+// moderates returns true if uploads of contentType are classified
+func (m *Moderation) moderates(contentType string) bool {
+	return m.Classifier != nil && strings.HasPrefix(contentType, "image/")
+}
+
+// moderate classifies a spooled upload before it's stored and rewinds it.
+// Flagged uploads fail with errFlagged, unless the action is ModerationFlag,
+// in which case the metadata they're stored with is returned with their
+// labels.
+func (k *KeyVal) moderate(ctx context.Context, key []byte, f io.ReadSeeker, size int64, contentType string, metadata map[string]string) (map[string]string, error) {
+	verdict, err := k.moderation.Classifier.Classify(ctx, f, contentType)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return metadata, fmt.Errorf("%w: %w", errModerationFailed, err)
+	}
+	if !verdict.Flagged {
+		return metadata, nil
+	}
+	labels := moderationLabels(verdict)
+	k.log.Warn("moderation flagged an upload", "key", string(key), "labels", labels, "action", k.moderation.Action)
+	switch k.moderation.Action {
+	case ModerationFlag:
+		flagged := make(map[string]string, len(metadata)+1)
+		for name, value := range metadata {
+			flagged[name] = value
+		}
+		flagged[moderationMetadata] = labels
+		return flagged, nil
+	case ModerationQuarantine:
+		k.quarantine(ctx, key, f, size, contentType, map[string]string{moderationMetadata: labels})
+	}
+	return metadata, errFlagged
+}
+
+// moderationLabels returns the labels of a verdict as a metadata value
+func moderationLabels(verdict moderation.Verdict) string {
+	labels := make([]string, 0, len(verdict.Labels))
+	for _, label := range verdict.Labels {
+		// Metadata values are printable ASCII
+		label = strings.Map(func(r rune) rune {
+			if r < ' ' || r > '~' || r == ',' {
+				return -1
+			}
+			return r
+		}, strings.TrimSpace(label))
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) == 0 {
+		return "flagged"
+	}
+	return strings.Join(labels, ",")
+}
+
+type moderationJob struct {
+	key []byte
+	rec Record
+}
+
+// moderateLater queues a stored blob to be classified in async mode. It
+// never blocks, blobs are left unmoderated if the queue is full.
+func (k *KeyVal) moderateLater(key []byte, rec Record) {
+	select {
+	case k.moderationQueue <- moderationJob{key: bytes.Clone(key), rec: rec}:
+	default:
+		k.log.Error("moderation queue is full, skipping blob", "key", string(key))
+	}
+}
+
+// RunModeration classifies the blobs queued in async mode until ctx is done.
+// Blobs still in the queue when it's done aren't moderated.
+func (k *KeyVal) RunModeration(ctx context.Context) {
+	if k.moderationQueue == nil {
+		return
+	}
+	for i := 0; i < moderationWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-k.moderationQueue:
+					if err := k.moderateStored(ctx, job.key, job.rec); err != nil {
+						k.log.Error("failed to moderate blob", "key", string(job.key), "error", err)
+					}
+				}
+			}
+		}()
+	}
+	<-ctx.Done()
+}
+
+// moderateStored classifies a stored blob, and flags, unlinks or quarantines
+// it if it's flagged. Nothing is done if it was replaced in the meantime.
+func (k *KeyVal) moderateStored(ctx context.Context, key []byte, rec Record) error {
+	r, _, err := k.storage.Get(ctx, rec.StorageKey(string(key)))
+	if err != nil {
+		return err
+	}
+	verdict, err := k.moderation.Classifier.Classify(ctx, r, rec.ContentType)
+	r.Close()
+	if err != nil || !verdict.Flagged {
+		return err
+	}
+	labels := moderationLabels(verdict)
+
+	if err := k.waitLockKey(key); err != nil {
+		return err
+	}
+	defer k.UnlockKey(key)
+	current := k.GetRecord(key)
+	if current.Deleted != NO || current.Hash != rec.Hash {
+		return nil
+	}
+	k.log.Warn("moderation flagged a blob", "key", string(key), "labels", labels, "action", k.moderation.Action)
+	switch k.moderation.Action {
+	case ModerationFlag:
+		patch, _ := json.Marshal(map[string]string{moderationMetadata: labels})
+		if _, status := k.UpdateMetadata(key, patch, ""); status != fiber.StatusOK {
+			return fmt.Errorf("failed to flag blob: status %d", status)
+		}
+		return nil
+	case ModerationQuarantine:
+		r, _, err := k.storage.Get(ctx, current.StorageKey(string(key)))
+		if err != nil {
+			return err
+		}
+		k.quarantine(ctx, key, r, current.Size, current.ContentType, map[string]string{moderationMetadata: labels})
+		r.Close()
+		if status := k.Delete(ctx, key, true); status != fiber.StatusNoContent {
+			return fmt.Errorf("failed to unlink blob: status %d", status)
+		}
+		if status := k.Delete(ctx, key, false); status != fiber.StatusNoContent {
+			return fmt.Errorf("failed to delete blob: status %d", status)
+		}
+		return nil
+	}
+	if status := k.Delete(ctx, key, true); status != fiber.StatusNoContent {
+		return fmt.Errorf("failed to unlink blob: status %d", status)
+	}
+	return nil
+}
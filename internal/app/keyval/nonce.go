@@ -0,0 +1,46 @@
+package keyval
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoncesUnsupported = errors.New("index does not support single-use URLs")
+
+// NonceIndex is implemented by Index backends that can record the nonces of
+// single-use signed URLs
+type NonceIndex interface {
+	// UseNonce records that nonce has been used until expiresAt. It returns
+	// false if the nonce had already been used.
+	UseNonce(nonce string, expiresAt time.Time) (bool, error)
+	// RemoveExpiredNonces forgets the nonces whose URLs have expired and
+	// returns how many were removed
+	RemoveExpiredNonces() (int, error)
+}
+
+// UseNonce records the nonce of a single-use signed URL in the index. It
+// returns false if the URL has been used before.
+func (k *KeyVal) UseNonce(nonce string, expiresAt time.Time) (bool, error) {
+	nonces, ok := k.db.(NonceIndex)
+	if !ok {
+		return false, errNoncesUnsupported
+	}
+	ok, err := nonces.UseNonce(nonce, expiresAt)
+	if err != nil {
+		k.log.Error("failed to use nonce", "error", err)
+	}
+	return ok, err
+}
+
+func (k *KeyVal) removeExpiredNonces() {
+	nonces, ok := k.db.(NonceIndex)
+	if !ok {
+		return
+	}
+	n, err := nonces.RemoveExpiredNonces()
+	if err != nil {
+		k.log.Error("failed to remove expired nonces", "error", err)
+	} else if n > 0 {
+		k.log.Info("removed expired nonces", "count", n)
+	}
+}
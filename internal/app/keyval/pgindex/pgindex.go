@@ -0,0 +1,174 @@
+package pgindex
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	_ "github.com/lib/pq"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS keyval_records (
+	key          TEXT COLLATE "C" PRIMARY KEY,
+	deleted      SMALLINT NOT NULL DEFAULT 0,
+	size         BIGINT NOT NULL DEFAULT 0,
+	content_type TEXT NOT NULL DEFAULT '',
+	modified_at  TIMESTAMPTZ,
+	record       JSONB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS keyval_nonces (
+	nonce      TEXT PRIMARY KEY,
+	expires_at TIMESTAMPTZ NOT NULL
+)`
+
+// iterateBatchSize is the number of rows fetched per query while iterating,
+// so long iterations never hold a cursor open on the database
+const iterateBatchSize = 500
+
+// PGIndex keeps the keyval index in Postgres. Unlike LevelDB it can be shared
+// by any number of replicas. It implements the keyval.Index interface.
+type PGIndex struct {
+	db *sql.DB
+}
+
+// New connects to the Postgres database at dsn and creates the records and
+// nonces tables if they don't exist
+func New(dsn string) (*PGIndex, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PGIndex{db: db}, nil
+}
+
+// Get implements keyval.Index interface
+func (p *PGIndex) Get(key []byte) (keyval.Record, error) {
+	var data []byte
+	err := p.db.QueryRow(`SELECT record FROM keyval_records WHERE key = $1`, string(key)).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return keyval.Record{Deleted: keyval.HARD}, keyval.ErrNotFound
+		}
+		return keyval.Record{Deleted: keyval.HARD}, err
+	}
+	return keyval.DecodeRecord(data), nil
+}
+
+// Put implements keyval.Index interface
+func (p *PGIndex) Put(key []byte, rec keyval.Record) error {
+	data, err := keyval.EncodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	var modifiedAt *time.Time
+	if !rec.ModifiedTime.IsZero() {
+		modifiedAt = &rec.ModifiedTime
+	}
+	_, err = p.db.Exec(`
+		INSERT INTO keyval_records (key, deleted, size, content_type, modified_at, record)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (key) DO UPDATE SET
+			deleted = EXCLUDED.deleted,
+			size = EXCLUDED.size,
+			content_type = EXCLUDED.content_type,
+			modified_at = EXCLUDED.modified_at,
+			record = EXCLUDED.record`,
+		string(key), rec.Deleted, rec.Size, rec.ContentType, modifiedAt, data,
+	)
+	return err
+}
+
+// Delete implements keyval.Index interface
+func (p *PGIndex) Delete(key []byte) error {
+	_, err := p.db.Exec(`DELETE FROM keyval_records WHERE key = $1`, string(key))
+	return err
+}
+
+// Iterate implements keyval.Index interface
+func (p *PGIndex) Iterate(prefix, start []byte, fn func(key []byte, rec keyval.Record) bool) error {
+	from := string(prefix)
+	if string(start) > from {
+		from = string(start)
+	}
+	// Keys are ordered bytewise by the "C" collation, so every key with the
+	// prefix sorts before the prefix with its last byte incremented
+	to := keyval.PrefixEnd(prefix)
+	op := ">="
+	for {
+		rows, err := p.db.Query(`
+			SELECT key, record FROM keyval_records
+			WHERE key `+op+` $1 AND ($2 = '' OR key < $2)
+			ORDER BY key
+			LIMIT $3`,
+			from, to, iterateBatchSize,
+		)
+		if err != nil {
+			return err
+		}
+		n := 0
+		stopped := false
+		for rows.Next() {
+			var key string
+			var data []byte
+			if err := rows.Scan(&key, &data); err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+			from = key
+			if !fn([]byte(key), keyval.DecodeRecord(data)) {
+				stopped = true
+				break
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if stopped || n < iterateBatchSize {
+			return nil
+		}
+		op = ">"
+	}
+}
+
+// UseNonce implements keyval.NonceIndex interface
+func (p *PGIndex) UseNonce(nonce string, expiresAt time.Time) (bool, error) {
+	// A nonce that's expired but hasn't been removed yet can be reused
+	res, err := p.db.Exec(`
+		INSERT INTO keyval_nonces (nonce, expires_at) VALUES ($1, $2)
+		ON CONFLICT (nonce) DO UPDATE SET expires_at = EXCLUDED.expires_at
+		WHERE keyval_nonces.expires_at < now()`,
+		nonce, expiresAt,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// RemoveExpiredNonces implements keyval.NonceIndex interface
+func (p *PGIndex) RemoveExpiredNonces() (int, error) {
+	res, err := p.db.Exec(`DELETE FROM keyval_nonces WHERE expires_at < now()`)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Close implements keyval.Index interface
+func (p *PGIndex) Close() error {
+	return p.db.Close()
+}
@@ -0,0 +1,42 @@
+package keyval
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// placeholderLockAttempts and placeholderLockDelay are how long
+	// waitLockKey waits for a key written to be unlocked
+	placeholderLockAttempts = 50
+	placeholderLockDelay    = 100 * time.Millisecond
+)
+
+var errKeyLocked = errors.New("key is locked")
+
+// SetPlaceholder stores the placeholder of the blob at key in its record. It's
+// dropped if the blob was replaced since it had the given hash.
+func (k *KeyVal) SetPlaceholder(key []byte, hash, placeholder string) error {
+	if err := k.waitLockKey(key); err != nil {
+		return err
+	}
+	defer k.UnlockKey(key)
+
+	rec := k.GetRecord(key)
+	if rec.Deleted != NO || rec.Hash != hash || rec.Placeholder == placeholder {
+		return nil
+	}
+	rec.Placeholder = placeholder
+	return k.PutRecord(key, rec)
+}
+
+// waitLockKey locks key once the write that has it locked is done
+func (k *KeyVal) waitLockKey(key []byte) error {
+	for attempt := 1; !k.LockKey(key); attempt++ {
+		if attempt == placeholderLockAttempts {
+			return errKeyLocked
+		}
+		time.Sleep(placeholderLockDelay)
+	}
+	return nil
+}
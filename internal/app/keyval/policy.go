@@ -0,0 +1,110 @@
+package keyval
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+// maxPolicyFieldSize is the largest form field, other than the file, read
+// from a policy upload
+const maxPolicyFieldSize = 64 << 10
+
+// PolicyUploadHandler stores a file POSTed to the base path in a
+// multipart/form-data body with an upload policy signed by sign.SignPolicy,
+// like an S3 POST policy. The form has key, policy and x-signature fields,
+// plus x-tenant for policies signed for a tenant and an optional x-acl,
+// followed by the file. Any ${filename} in the key is replaced with the name
+// of the uploaded file. Fields after the file are ignored, since the body is
+// streamed.
+func (k *KeyVal) PolicyUploadHandler(verifier *mw.SignatureVerifier) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		mediaType, params, err := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+		if err != nil || mediaType != fiber.MIMEMultipartForm || params["boundary"] == "" {
+			return c.SendStatus(fiber.StatusUnsupportedMediaType)
+		}
+
+		var body io.Reader
+		if stream := c.Request().BodyStream(); stream != nil {
+			body = stream
+		} else {
+			body = bytes.NewReader(c.Body())
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		fields := map[string]string{}
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				// Either the body is malformed or the file is missing
+				return c.SendStatus(fiber.StatusBadRequest)
+			}
+			if part.FormName() == k.formField && part.FileName() != "" {
+				defer part.Close()
+				return k.writePolicyUpload(c, verifier, fields, part)
+			}
+			value, err := io.ReadAll(io.LimitReader(part, maxPolicyFieldSize+1))
+			part.Close()
+			if err != nil || len(value) > maxPolicyFieldSize {
+				return c.SendStatus(fiber.StatusBadRequest)
+			}
+			fields[part.FormName()] = string(value)
+		}
+	}
+}
+
+func (k *KeyVal) writePolicyUpload(c fiber.Ctx, verifier *mw.SignatureVerifier, fields map[string]string, file *multipart.Part) error {
+	if fields["policy"] == "" {
+		return c.Status(fiber.StatusUnauthorized).SendString("unauthorized")
+	}
+	tenant := fields["x-tenant"]
+	policy, sigErr := verifier.VerifyPolicy(fields["policy"], fields["x-signature"], tenant)
+	if sigErr != nil {
+		return c.Status(sigErr.Status).SendString(sigErr.Message)
+	}
+	c.Locals(mw.CredentialKey, mw.CredentialPolicy)
+	if tenant != "" {
+		c.Locals(mw.TenantKey, tenant)
+	}
+
+	name := strings.TrimPrefix(strings.ReplaceAll(fields["key"], "${filename}", file.FileName()), "/")
+	if name == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	mw.SetAuditKeys(c, name)
+	if !strings.HasPrefix(name, policy.KeyPrefix) {
+		return c.Status(fiber.StatusForbidden).SendString("key not allowed by policy")
+	}
+
+	acl, ok := parseACL(fields["x-acl"])
+	if !ok {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if policy.ACL != "" {
+		if acl != "" && acl != policy.ACL {
+			return c.Status(fiber.StatusForbidden).SendString("acl not allowed by policy")
+		}
+		acl = policy.ACL
+	}
+
+	key := []byte(namespace(c) + name)
+	if !k.LockKey(key) {
+		return c.SendStatus(fiber.StatusConflict)
+	}
+	defer k.UnlockKey(key)
+
+	status := k.Write(c.Context(), key, file, -1, WriteOptions{
+		MaxSize:             policy.MaxSize,
+		ContentType:         policy.ContentType,
+		ACL:                 acl,
+		DeclaredContentType: file.Header.Get("Content-Type"),
+	})
+	if status != fiber.StatusCreated {
+		return c.SendStatus(status)
+	}
+	return c.Status(fiber.StatusCreated).JSON(newListObject(name, k.GetRecord(key)))
+}
@@ -0,0 +1,217 @@
+package keyval
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits the bytes and number of objects stored under a prefix
+type Quota struct {
+	// Prefix the quota applies to. A * segment applies the quota to every
+	// prefix matching it separately, e.g. users/*/ gives each user their own
+	// quota.
+	Prefix string
+	// MaxBytes is the most bytes the prefix can hold. Zero is unlimited.
+	MaxBytes int64
+	// MaxObjects is the most keys the prefix can hold. Zero is unlimited.
+	MaxObjects int64
+}
+
+// ParseQuotas parses a comma-separated list of prefix:bytes:objects quotas,
+// e.g. users/*/:524288000:1000,public/:1073741824:0
+func ParseQuotas(s string) ([]Quota, error) {
+	var quotas []Quota
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		parts := strings.Split(rule, ":")
+		if len(parts) != 3 || !strings.HasSuffix(parts[0], "/") {
+			return nil, fmt.Errorf("invalid quota %q, expected prefix/:bytes:objects", rule)
+		}
+		if _, err := path.Match(parts[0], ""); err != nil {
+			return nil, fmt.Errorf("invalid quota prefix %q: %w", parts[0], err)
+		}
+		maxBytes, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || maxBytes < 0 {
+			return nil, fmt.Errorf("invalid quota bytes %q", parts[1])
+		}
+		maxObjects, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || maxObjects < 0 {
+			return nil, fmt.Errorf("invalid quota objects %q", parts[2])
+		}
+		quotas = append(quotas, Quota{Prefix: parts[0], MaxBytes: maxBytes, MaxObjects: maxObjects})
+	}
+	return quotas, nil
+}
+
+// match returns the prefix of key the quota applies to, with any wildcard
+// segments filled in
+func (q Quota) match(key string) (string, bool) {
+	return matchPrefix(q.Prefix, key)
+}
+
+// matchPrefix returns the prefix of key that matches a prefix pattern like
+// users/*/, with any wildcard segments filled in
+func matchPrefix(prefix, key string) (string, bool) {
+	patterns := strings.Split(strings.TrimSuffix(prefix, "/"), "/")
+	segments := strings.SplitN(key, "/", len(patterns)+1)
+	// The last segment is the rest of the key, which has to exist
+	if len(segments) <= len(patterns) {
+		return "", false
+	}
+	for i, pattern := range patterns {
+		if ok, _ := path.Match(pattern, segments[i]); !ok {
+			return "", false
+		}
+	}
+	return strings.Join(segments[:len(patterns)], "/") + "/", true
+}
+
+// quotaRecountInterval is how often the usage of a quota prefix is counted
+// again from the index. In between, the writes and deletes of this instance
+// keep it up to date, and those of other instances sharing the index are
+// picked up by the next count.
+const quotaRecountInterval = time.Minute
+
+// quotaUsage is what's stored under a quota prefix
+type quotaUsage struct {
+	objects   int64
+	bytes     int64
+	countedAt time.Time
+}
+
+// counts reports whether rec is part of the usage. Records that expired since
+// the usage was counted are part of it until they're removed.
+func (u *quotaUsage) counts(rec Record) bool {
+	return rec.Deleted == NO && (rec.ExpiresAt.IsZero() || rec.ExpiresAt.After(u.countedAt))
+}
+
+// quotaUsages caches the usage of the prefixes quotas apply to, so writes
+// don't iterate over every key under them
+type quotaUsages struct {
+	mu     sync.Mutex
+	usages map[string]*quotaUsage
+}
+
+// quotaPrefixes returns the prefixes of key that quotas apply to
+func (k *KeyVal) quotaPrefixes(key []byte) []string {
+	var prefixes []string
+	for _, quota := range k.quotas {
+		if prefix, ok := quota.match(string(key)); ok && !slices.Contains(prefixes, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// quotaUsageOf returns the usage of prefix, counting it again if it's older
+// than quotaRecountInterval
+func (k *KeyVal) quotaUsageOf(prefix string) (quotaUsage, error) {
+	u := &k.quotaUsage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if usage, ok := u.usages[prefix]; ok && time.Since(usage.countedAt) < quotaRecountInterval {
+		return *usage, nil
+	}
+
+	usage := &quotaUsage{countedAt: time.Now()}
+	err := k.db.Iterate([]byte(prefix), nil, func(key []byte, rec Record) bool {
+		if usage.counts(rec) {
+			usage.objects++
+			usage.bytes += rec.Size
+		}
+		return true
+	})
+	if err != nil {
+		return quotaUsage{}, err
+	}
+	// Prefixes that haven't been written to lately would be counted again
+	// anyway
+	for other, stale := range u.usages {
+		if time.Since(stale.countedAt) >= quotaRecountInterval {
+			delete(u.usages, other)
+		}
+	}
+	if u.usages == nil {
+		u.usages = make(map[string]*quotaUsage)
+	}
+	u.usages[prefix] = usage
+	return *usage, nil
+}
+
+// updateQuotaUsage accounts for the record of key changing from before to
+// after in the usage of the quotas it's under. Prefixes that haven't been
+// counted yet are left to be counted when they're needed.
+func (k *KeyVal) updateQuotaUsage(key []byte, before, after Record) {
+	if len(k.quotas) == 0 {
+		return
+	}
+	u := &k.quotaUsage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, prefix := range k.quotaPrefixes(key) {
+		usage, ok := u.usages[prefix]
+		if !ok {
+			continue
+		}
+		if usage.counts(before) {
+			usage.objects--
+			usage.bytes -= before.Size
+		}
+		if after.Deleted == NO && !after.Expired() {
+			usage.objects++
+			usage.bytes += after.Size
+		}
+	}
+}
+
+// quotaRemaining returns how many more bytes can be written to key before a
+// quota is exceeded, or -1 if there's no limit. Writing over key replaces it,
+// so its current size isn't counted. Uploads racing each other to the same
+// prefix, or written through other instances since it was last counted, can
+// overshoot a quota.
+func (k *KeyVal) quotaRemaining(key []byte) (int64, int) {
+	if len(k.quotas) == 0 {
+		return -1, 0
+	}
+	remaining := int64(-1)
+	stored := k.storedRecord(key)
+	for _, quota := range k.quotas {
+		prefix, ok := quota.match(string(key))
+		if !ok {
+			continue
+		}
+		usage, err := k.quotaUsageOf(prefix)
+		if err != nil {
+			k.log.Error("failed to iterate records", "error", err)
+			return 0, fiber.StatusInternalServerError
+		}
+		objects, bytes := usage.objects, usage.bytes
+		if usage.counts(stored) {
+			objects--
+			bytes -= stored.Size
+		}
+		if quota.MaxObjects > 0 && objects >= quota.MaxObjects {
+			return 0, fiber.StatusInsufficientStorage
+		}
+		if quota.MaxBytes > 0 {
+			left := max(quota.MaxBytes-bytes, 0)
+			if remaining < 0 || left < remaining {
+				remaining = left
+			}
+		}
+	}
+	return remaining, 0
+}
@@ -0,0 +1,298 @@
+package s3storage
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/sigv4"
+)
+
+// S3Storage stores blobs in an S3 compatible bucket, e.g. AWS S3, MinIO or
+// Cloudflare R2. It implements the keyval.Storage interface.
+type S3Storage struct {
+	// Bucket is the name of the bucket blobs are stored in
+	Bucket string
+	// Endpoint is the S3 API endpoint. Defaults to the AWS endpoint for Region.
+	Endpoint *url.URL
+	// Region of the bucket. R2 expects "auto".
+	Region string
+	// Credentials used to sign requests
+	Credentials sigv4.Credentials
+	// ForcePathStyle addresses the bucket as a path segment instead of a
+	// subdomain. MinIO and most self-hosted implementations need this.
+	ForcePathStyle bool
+	// PathPrefix is prepended to every key
+	PathPrefix string
+	// Client is the HTTP client used to talk to S3
+	Client *http.Client
+}
+
+// Option S3Storage option
+type Option func(s *S3Storage)
+
+// New creates S3Storage
+func New(bucket string, options ...Option) *S3Storage {
+	s := &S3Storage{
+		Bucket: bucket,
+		Region: "us-east-1",
+		Client: http.DefaultClient,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	if s.Endpoint == nil {
+		s.Endpoint = &url.URL{Scheme: "https", Host: fmt.Sprintf("s3.%s.amazonaws.com", s.Region)}
+	}
+	return s
+}
+
+// WithEndpoint with custom S3 API endpoint option
+func WithEndpoint(endpoint string) Option {
+	return func(s *S3Storage) {
+		if endpoint != "" {
+			if u, err := url.Parse(endpoint); err == nil {
+				s.Endpoint = u
+			}
+		}
+	}
+}
+
+// WithRegion with bucket region option
+func WithRegion(region string) Option {
+	return func(s *S3Storage) {
+		if region != "" {
+			s.Region = region
+		}
+	}
+}
+
+// WithCredentials with static credentials option
+func WithCredentials(accessKeyID, secretAccessKey, sessionToken string) Option {
+	return func(s *S3Storage) {
+		s.Credentials = sigv4.Credentials{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: secretAccessKey,
+			SessionToken:    sessionToken,
+		}
+	}
+}
+
+// WithForcePathStyle with path style bucket addressing option
+func WithForcePathStyle(enabled bool) Option {
+	return func(s *S3Storage) {
+		s.ForcePathStyle = enabled
+	}
+}
+
+// WithPathPrefix with key prefix option
+func WithPathPrefix(prefix string) Option {
+	return func(s *S3Storage) {
+		s.PathPrefix = strings.Trim(prefix, "/")
+	}
+}
+
+// WithHTTPClient with custom HTTP client option
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *S3Storage) {
+		if client != nil {
+			s.Client = client
+		}
+	}
+}
+
+// Get implements keyval.Storage interface
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, *keyval.ObjectInfo, error) {
+	res, err := s.do(ctx, http.MethodGet, s.objectPath(key), nil, nil, nil, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.Body, objectInfo(key, res), nil
+}
+
+// Put implements keyval.Storage interface
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if size < 0 {
+		// S3 needs to know the content length up front, so spool the body
+		// to disk when the caller doesn't know it.
+		tmp, err := os.CreateTemp("", "s3storage-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if size, err = io.Copy(tmp, r); err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r = tmp
+	}
+	res, err := s.do(ctx, http.MethodPut, s.objectPath(key), nil, nil, r, size)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Delete implements keyval.Storage interface
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, s.objectPath(key), nil, nil, nil, -1)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Copy implements keyval.Copier interface
+func (s *S3Storage) Copy(ctx context.Context, src, dst string) error {
+	h := http.Header{}
+	h.Set("X-Amz-Copy-Source", sigv4.EscapePath("/"+s.Bucket+"/"+s.objectKey(src)))
+	res, err := s.do(ctx, http.MethodPut, s.objectPath(dst), nil, h, nil, -1)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// A copy can fail after S3 has already responded with 200 OK, in which
+	// case the error is in the body
+	var e s3Error
+	if err := xml.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&e); err == nil && e.Code != "" {
+		return fmt.Errorf("s3: copy %s: %s", src, e.Code)
+	}
+	return nil
+}
+
+// Stat implements keyval.Storage interface
+func (s *S3Storage) Stat(ctx context.Context, key string) (*keyval.ObjectInfo, error) {
+	res, err := s.do(ctx, http.MethodHead, s.objectPath(key), nil, nil, nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	_ = res.Body.Close()
+	return objectInfo(key, res), nil
+}
+
+// List implements keyval.Storage interface
+func (s *S3Storage) List(ctx context.Context, prefix string, fn func(keyval.ObjectInfo) error) error {
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", s.objectKey(prefix))
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		res, err := s.do(ctx, http.MethodGet, s.bucketPath(), q, nil, nil, -1)
+		if err != nil {
+			return err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		_ = res.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, obj := range result.Contents {
+			key := obj.Key
+			if s.PathPrefix != "" {
+				key = strings.TrimPrefix(key, s.PathPrefix+"/")
+			}
+			if err := fn(keyval.ObjectInfo{Key: key, Size: obj.Size, ModifiedTime: obj.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Storage) objectKey(key string) string {
+	if s.PathPrefix == "" {
+		return key
+	}
+	return s.PathPrefix + "/" + key
+}
+
+func (s *S3Storage) bucketPath() string {
+	if s.ForcePathStyle {
+		return "/" + s.Bucket + "/"
+	}
+	return "/"
+}
+
+func (s *S3Storage) objectPath(key string) string {
+	return s.bucketPath() + s.objectKey(key)
+}
+
+func (s *S3Storage) do(ctx context.Context, method, p string, q url.Values, h http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := *s.Endpoint
+	if !s.ForcePathStyle {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	u.Path = p
+	u.RawPath = sigv4.EscapePath(p)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range h {
+		req.Header[name] = values
+	}
+	payloadHash := sigv4.EmptyPayload
+	if body != nil {
+		payloadHash = sigv4.UnsignedPayload
+		req.ContentLength = size
+	}
+	sigv4.Sign(req, s.Credentials, s.Region, "s3", payloadHash, time.Now())
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		_ = res.Body.Close()
+		return nil, keyval.ErrNotFound
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		var e s3Error
+		if method != http.MethodHead {
+			_ = xml.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&e)
+		}
+		return nil, fmt.Errorf("s3: %s %s: %s %s", method, p, res.Status, e.Code)
+	}
+	return res, nil
+}
+
+func objectInfo(key string, res *http.Response) *keyval.ObjectInfo {
+	size, _ := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &keyval.ObjectInfo{Key: key, Size: size, ModifiedTime: modTime}
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3Error struct {
+	Code string `xml:"Code"`
+}
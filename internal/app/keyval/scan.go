@@ -0,0 +1,87 @@
+package keyval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// QuarantinePrefix is the prefix of the storage keys infected uploads are
+// kept under. They aren't in the index, so they can't be read through the
+// API, and keys starting with it can't be written.
+const QuarantinePrefix = ".quarantine/"
+
+var (
+	errInfected   = errors.New("upload is infected")
+	errScanFailed = errors.New("upload couldn't be scanned")
+)
+
+// spoolUpload copies an upload to a temporary file, so it can be checked as
+// a whole before it's stored. The file is returned rewound with its size,
+// and has to be removed with removeSpool.
+func spoolUpload(r io.Reader) (*os.File, int64, error) {
+	f, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeSpool(f)
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+func removeSpool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// scan scans a spooled upload for malware and rewinds it. Infected uploads
+// are quarantined and fail with errInfected.
+func (k *KeyVal) scan(ctx context.Context, key []byte, f *os.File, size int64, contentType string) error {
+	result, err := k.scanner.Scan(ctx, f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", errScanFailed, err)
+	}
+	if result.Infected {
+		k.log.Warn("rejected an infected upload", "key", string(key), "signature", result.Signature)
+		k.quarantine(ctx, key, f, size, contentType, map[string]string{"signature": result.Signature})
+		return errInfected
+	}
+	return nil
+}
+
+// quarantine stores a rejected upload under QuarantinePrefix and emits
+// EventBlobQuarantined. The metadata of the event's object is why it was
+// rejected, along with the storage key it was kept under.
+func (k *KeyVal) quarantine(ctx context.Context, key []byte, r io.Reader, size int64, contentType string, reason map[string]string) {
+	now := time.Now().UTC()
+	quarantineKey := fmt.Sprintf("%s%d/%s", QuarantinePrefix, now.UnixNano(), key)
+	if err := k.storage.Put(ctx, quarantineKey, r, size); err != nil {
+		k.log.Error("failed to quarantine upload", "key", string(key), "error", err)
+		quarantineKey = ""
+	}
+	metadata := make(map[string]string, len(reason)+1)
+	for name, value := range reason {
+		metadata[name] = value
+	}
+	if quarantineKey != "" {
+		metadata["quarantine_key"] = quarantineKey
+	}
+	k.emit(EventBlobQuarantined, key, Record{
+		Size:         size,
+		ContentType:  contentType,
+		ModifiedTime: now,
+		Metadata:     metadata,
+	})
+}
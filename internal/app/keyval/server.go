@@ -1,42 +1,94 @@
 package keyval
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"path"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/gofiber/fiber/v3"
-	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/cdn"
 	"github.com/jaredLunde/railway-image-service/internal/pkg/ptr"
-	"github.com/syndtr/goleveldb/leveldb/util"
 	"github.com/valyala/fasthttp"
 )
 
 type ListResponse struct {
-	Keys     []string `json:"keys"`
-	HasMore  bool     `json:"has_more"`
-	NextPage string   `json:"next_page,omitempty"`
+	Keys       []string     `json:"keys"`
+	Objects    []ListObject `json:"objects"`
+	HasMore    bool         `json:"has_more"`
+	NextPage   string       `json:"next_page,omitempty"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+type ListObject struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	ContentType  string            `json:"content_type"`
+	ModifiedTime time.Time         `json:"modified_time"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	ACL          string            `json:"acl,omitempty"`
+	Placeholder  string            `json:"placeholder,omitempty"`
+}
+
+func newListObject(key string, rec Record) ListObject {
+	return ListObject{
+		Key:          key,
+		Size:         rec.Size,
+		ContentType:  rec.ContentType,
+		ModifiedTime: rec.ModifiedTime,
+		Metadata:     rec.Metadata,
+		ACL:          rec.ACL,
+		Placeholder:  rec.Placeholder,
+	}
 }
 
 const (
 	MAX_QUERY_LIMIT = 1000
 )
 
+// ListHandler lists keys in the index. It is served at the base path and can
+// be mounted at any other path as an alias.
+func (k *KeyVal) ListHandler(c fiber.Ctx) error {
+	k.QueryHandler([]byte(c.Query("prefix", "")), c)
+	return nil
+}
+
 func (k *KeyVal) QueryHandler(key []byte, c fiber.Ctx) {
+	_, unlinked := c.Queries()["unlinked"]
+	k.query(key, c, unlinked)
+}
+
+// query lists the keys starting with key. If unlinked is true, the keys that
+// have been soft deleted are listed instead.
+func (k *KeyVal) query(key []byte, c fiber.Ctx, unlinkedOpOk bool) {
 	m := c.Queries()
-	// operation is first query parameter (e.g. ?limit=10)
-	_, unlinkedOpOk := m["unlinked"]
 	start := m["starting_at"]
+	if cursor := m["cursor"]; cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return
+		}
+		start = string(decoded)
+	}
 	limit := 0
-	qlimit := m["limit"]
-	if qlimit != "" {
+	if qlimit := m["limit"]; qlimit != "" {
 		nlimit, err := strconv.Atoi(qlimit)
 		if err != nil {
 			c.Status(fiber.StatusBadRequest)
@@ -45,40 +97,44 @@ func (k *KeyVal) QueryHandler(key []byte, c fiber.Ctx) {
 		limit = nlimit
 	}
 
-	slice := util.BytesPrefix(key)
-	if start != "" {
-		slice.Start = []byte(start)
+	objects, next, err := k.List(ListOptions{
+		Namespace:  namespace(c),
+		Prefix:     string(key),
+		Glob:       m["glob"],
+		StartingAt: start,
+		Limit:      limit,
+		Unlinked:   unlinkedOpOk,
+	})
+	if errors.Is(err, ErrInvalidGlob) {
+		c.Status(fiber.StatusBadRequest)
+		return
+	} else if err != nil {
+		k.log.Error("failed to iterate records", "error", err)
+		c.Status(fiber.StatusInternalServerError)
+		return
 	}
-	iter := k.db.NewIterator(slice, nil)
-	defer iter.Release()
-	keys := make([]string, 0)
-	next := ""
-	for iter.Next() {
-		rec := toRecord(iter.Value())
-		if (rec.Deleted != NO) ||
-			(rec.Deleted != SOFT && unlinkedOpOk) {
-			continue
-		}
-		if len(keys) > MAX_QUERY_LIMIT {
-			c.Status(fiber.StatusRequestEntityTooLarge)
-			return
-		}
-		keys = append(keys, string(iter.Key()))
-		if limit > 0 && len(keys) > limit { // limit results returned
-			next = string(iter.Key())
-			keys = keys[:limit]
-			break
-		}
+
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		keys[i] = obj.Key
 	}
 
 	nextURI := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(nextURI)
 	c.Request().URI().CopyTo(nextURI)
+	// The list may have been requested through an alias, but only the base
+	// path can be signed
+	nextURI.SetPath(k.basePath)
+	if unlinkedOpOk {
+		nextURI.QueryArgs().SetNoValue("unlinked")
+	}
 	nextPage := ""
+	nextCursor := ""
 	if next != "" {
-		nextURI.QueryArgs().Set("starting_at", next)
-		nextPage = nextURI.String()
-	} else {
+		nextCursor = base64.RawURLEncoding.EncodeToString([]byte(next))
 		nextURI.QueryArgs().Del("starting_at")
+		nextURI.QueryArgs().Set("cursor", nextCursor)
+		nextPage = nextURI.String()
 	}
 
 	signedURL := ptr.String("")
@@ -88,7 +144,7 @@ func (k *KeyVal) QueryHandler(key []byte, c fiber.Ctx) {
 			c.Status(fiber.StatusInternalServerError)
 			return
 		}
-		signedURL, err = sign.SignURL(nextPageURL, k.signSecret)
+		signedURL, err = k.signURL(c, nextPageURL)
 		if err != nil {
 			c.Status(fiber.StatusInternalServerError)
 			return
@@ -97,10 +153,111 @@ func (k *KeyVal) QueryHandler(key []byte, c fiber.Ctx) {
 
 	c.Status(fiber.StatusOK)
 	c.Set("Content-Type", "application/json")
-	c.JSON(ListResponse{NextPage: *signedURL, HasMore: next != "", Keys: keys})
+	c.JSON(ListResponse{
+		NextPage:   *signedURL,
+		NextCursor: nextCursor,
+		HasMore:    next != "",
+		Keys:       keys,
+		Objects:    objects,
+	})
+}
+
+// ErrInvalidGlob is returned when a list is filtered by a malformed pattern
+var ErrInvalidGlob = errors.New("invalid glob")
+
+// ListOptions filter and page a List
+type ListOptions struct {
+	// Namespace is prepended to the prefix, pattern and starting key, and
+	// removed from the keys listed, e.g. a tenant's tenant/ prefix
+	Namespace string
+	// Prefix only lists keys starting with it
+	Prefix string
+	// Glob only lists keys matching a path.Match pattern
+	Glob string
+	// StartingAt is the first key that can be listed
+	StartingAt string
+	// Limit is the most keys to list, up to MAX_QUERY_LIMIT. Zero is the
+	// maximum.
+	Limit int
+	// Unlinked lists the keys that have been soft deleted instead
+	Unlinked bool
+}
+
+// List returns the objects matching opts in order of their keys, and the key
+// the next page starts at if there are more
+func (k *KeyVal) List(opts ListOptions) ([]ListObject, string, error) {
+	ns := opts.Namespace
+	key := []byte(ns + opts.Prefix)
+	start := ""
+	if opts.StartingAt != "" {
+		start = ns + opts.StartingAt
+	}
+	glob := opts.Glob
+	matchable := true
+	if glob != "" {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, "", ErrInvalidGlob
+		}
+		glob = ns + glob
+		// Only keys starting with the literal part of the pattern can match,
+		// so narrow the range of the index we scan
+		literal := globPrefix(glob)
+		switch {
+		case strings.HasPrefix(literal, string(key)):
+			key = []byte(literal)
+		case !strings.HasPrefix(string(key), literal):
+			matchable = false
+		}
+	}
+	limit := MAX_QUERY_LIMIT
+	if opts.Limit > 0 && opts.Limit < MAX_QUERY_LIMIT {
+		limit = opts.Limit
+	}
+
+	objects := make([]ListObject, 0)
+	next := ""
+	if !matchable {
+		return objects, next, nil
+	}
+	err := k.db.Iterate(key, []byte(start), func(key []byte, rec Record) bool {
+		if rec.Expired() ||
+			(opts.Unlinked && rec.Deleted != SOFT) ||
+			(!opts.Unlinked && rec.Deleted != NO) {
+			return true
+		}
+		// Keys reserved by writes in progress are soft deleted as well,
+		// but they don't have a blob yet
+		if opts.Unlinked && rec.Hash == "" {
+			return true
+		}
+		if glob != "" {
+			if ok, _ := path.Match(glob, string(key)); !ok {
+				return true
+			}
+		}
+		if len(objects) == limit { // limit results returned
+			next = string(key[len(ns):])
+			return false
+		}
+		objects = append(objects, newListObject(string(key[len(ns):]), rec))
+		return true
+	})
+	return objects, next, err
+}
+
+// globPrefix returns the part of a path.Match pattern before its first
+// special character
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
 }
 
-func (k *KeyVal) Delete(key []byte, unlink bool) int {
+func (k *KeyVal) Delete(ctx context.Context, key []byte, unlink bool) int {
+	if reservedKey(key) {
+		return fiber.StatusBadRequest
+	}
 	// delete the key, first locally
 	rec := k.GetRecord(key)
 	if rec.Deleted == HARD || (unlink && rec.Deleted == SOFT) {
@@ -112,34 +269,98 @@ func (k *KeyVal) Delete(key []byte, unlink bool) int {
 	}
 
 	// mark as deleted
-	if err := k.PutRecord(key, Record{SOFT, rec.Hash}); err != nil {
+	before := rec
+	wasLinked := rec.Deleted == NO
+	rec.Deleted = SOFT
+	if err := k.PutRecord(key, rec); err != nil {
 		k.log.Error("failed to put record", "error", err)
 		return fiber.StatusInternalServerError
 	}
+	k.updateQuotaUsage(key, before, rec)
 
 	if !unlink {
-		if err := os.Remove(filepath.Join(k.volume, KeyToPath(key))); err != nil {
-			k.log.Error("failed to delete file", "error", err)
+		if err := k.releaseBlob(ctx, key, rec); err != nil {
+			k.log.Error("failed to delete blob", "error", err)
 			return fiber.StatusInternalServerError
 		}
 
 		// this is a hard delete in the database, aka nothing
-		k.db.Delete(key, nil)
+		if err := k.db.Delete(key); err != nil {
+			k.log.Error("failed to delete record", "error", err)
+			return fiber.StatusInternalServerError
+		}
 	}
 
+	// Purging an unlinked blob isn't an event, it was deleted when it was
+	// unlinked
+	if wasLinked {
+		k.emit(EventBlobDeleted, key, rec)
+	}
 	// 204, all good
 	return fiber.StatusNoContent
 }
 
-func (k *KeyVal) Write(key []byte, value io.Reader, valueLen int) int {
-	if valueLen > k.maxFileSize {
+// WriteOptions are the optional parts of a Write
+type WriteOptions struct {
+	// Metadata is stored with the blob
+	Metadata map[string]string
+	// MD5 and SHA256 are the expected digests of the blob. The write fails
+	// with 400 Bad Request if the blob doesn't match them.
+	MD5    []byte
+	SHA256 []byte
+	// ExpiresAt is when the blob is deleted automatically. Zero means never.
+	ExpiresAt time.Time
+	// MaxSize lowers the maximum size of the blob in bytes. Zero means the
+	// configured maximum.
+	MaxSize int64
+	// ContentType is the prefix the detected content type has to start with
+	// on top of the allowed MIME types, e.g. image/png
+	ContentType string
+	// DeclaredContentType is the type the client said the blob is, like the
+	// Content-Type of the request. It's checked against the detected type.
+	DeclaredContentType string
+	// ACL is who can read the blob. Empty means the default ACL.
+	ACL string
+	// ModifiedTime is when the blob was last modified. Zero means now.
+	ModifiedTime time.Time
+}
+
+// reservedKey returns true if key can't be written to through the API: the
+// blobs of deduplicated and quarantined uploads, and keys with control bytes,
+// which the index keeps nonces and reference counts under
+func reservedKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(ContentPrefix)) || bytes.HasPrefix(key, []byte(QuarantinePrefix)) || bytes.ContainsFunc(key, unicode.IsControl)
+}
+
+func (k *KeyVal) Write(ctx context.Context, key []byte, value io.Reader, valueLen int, opts WriteOptions) int {
+	if _, ok := parseACL(opts.ACL); !ok || !validMetadata(opts.Metadata) || reservedKey(key) {
+		return fiber.StatusBadRequest
+	}
+	maxSize := int64(k.maxFileSize)
+	if opts.MaxSize > 0 && opts.MaxSize < maxSize {
+		maxSize = opts.MaxSize
+	}
+	if int64(valueLen) > maxSize {
 		return fiber.StatusRequestEntityTooLarge
 	}
+	quotaRemaining, status := k.quotaRemaining(key)
+	if status != 0 {
+		return status
+	}
+	if quotaRemaining >= 0 && int64(valueLen) > quotaRemaining {
+		return fiber.StatusInsufficientStorage
+	}
 
 	succeeded := false
-	recordNotFound := k.GetRecord(key).Deleted == HARD
+	stored := k.storedRecord(key)
+	prev := stored
+	if prev.Expired() {
+		prev = Record{Deleted: HARD}
+	}
+	// Expired records are left in place, so their blobs are released below
+	recordNotFound := stored.Deleted == HARD
 	if recordNotFound {
-		if err := k.PutRecord(key, Record{SOFT, ""}); err != nil {
+		if err := k.PutRecord(key, Record{Deleted: SOFT}); err != nil {
 			k.log.Error("failed to put record", "error", err)
 			return fiber.StatusInternalServerError
 		}
@@ -147,85 +368,317 @@ func (k *KeyVal) Write(key []byte, value io.Reader, valueLen int) int {
 
 	defer func() {
 		if !succeeded && recordNotFound {
-			k.db.Delete(key, nil)
+			k.db.Delete(key)
 		}
 	}()
 
-	fp := filepath.Join(k.volume, KeyToPath(key))
-	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
-		k.log.Error("failed to create directory", "error", err)
-		return fiber.StatusInternalServerError
+	limitedReader := &maxSizeReader{r: value, n: maxSize}
+	if quotaRemaining >= 0 && quotaRemaining < limitedReader.n {
+		limitedReader.n = quotaRemaining
+		limitedReader.err = errQuotaExceeded
 	}
-
-	tmpFile, err := os.CreateTemp(filepath.Dir(fp), "tmp-*")
-	if err != nil {
-		k.log.Error("failed to create temp file", "error", err)
-		return fiber.StatusInternalServerError
-	}
-	defer os.Remove(tmpFile.Name()) // Clean up temp file on any error
-	defer tmpFile.Close()
-
-	h := md5.New()
-	buf := make([]byte, 32*1024)
-	limitedReader := io.LimitReader(value, int64(k.maxFileSize+1))
-	teeReader := io.TeeReader(limitedReader, h)
+	checksums := newChecksumReader(limitedReader, opts.MD5, opts.SHA256)
 	prefix := make([]byte, 512)
-	n, _ := io.ReadFull(teeReader, prefix)
+	n, _ := io.ReadFull(checksums, prefix)
 	if n == 0 {
 		return fiber.StatusBadRequest
 	}
 
 	mtype := mimetype.Detect(prefix[:n])
 	var validType bool
-	for _, allowed := range k.allowedMimeTypes {
+	for _, allowed := range k.allowedMimeTypesOf(key) {
 		if strings.HasPrefix(mtype.String(), allowed) {
 			validType = true
 			break
 		}
 	}
-	if !validType {
+	if !validType || !strings.HasPrefix(mtype.String(), opts.ContentType) {
 		return fiber.StatusUnsupportedMediaType
 	}
+	if !declaredMatches(mtype, opts.DeclaredContentType) {
+		if k.contentTypeMismatch == ContentTypeMismatchReject {
+			return fiber.StatusUnsupportedMediaType
+		}
+		// What's detected is stored either way, whatever was declared
+		k.log.Debug("stored an upload as its detected content type", "key", string(key), "declared", opts.DeclaredContentType, "detected", mtype.String())
+	}
 
 	// Combine the prefix we read with the remaining stream
-	combined := io.MultiReader(bytes.NewReader(prefix[:n]), teeReader)
-	written, err := io.CopyBuffer(tmpFile, combined, buf)
-	if err != nil {
-		if err != io.EOF {
-			return fiber.StatusInternalServerError
+	var combined io.Reader = io.MultiReader(bytes.NewReader(prefix[:n]), checksums)
+	size := int64(valueLen)
+	var err error
+	if mtype.Is(svgMimeType) {
+		// SVGs are sanitized as a whole, so what's stored is measured and
+		// hashed again
+		var svg []byte
+		if svg, err = sanitizeSVG(combined); err == nil {
+			size = int64(len(svg))
+			limitedReader = &maxSizeReader{r: bytes.NewReader(svg), n: size}
+			checksums = newChecksumReader(limitedReader, nil, nil)
+			combined = checksums
 		}
 	}
-
-	// Check if we hit the size limit
-	if written >= int64(k.maxFileSize) {
-		return fiber.StatusRequestEntityTooLarge
+	// Deduplicated blobs are moved under their content hash once it's known
+	storageKey := string(key)
+	if k.dedup {
+		storageKey = tempContentKey()
 	}
-
-	hash := fmt.Sprintf("%x", h.Sum(nil))
-
-	// Sync temporary file to disk
-	if err := tmpFile.Sync(); err != nil {
-		k.log.Error("failed to sync temp file", "error", err)
+	moderateNow := k.moderation.moderates(mtype.String()) && !k.moderation.Async
+	if err == nil && (k.scanner != nil || moderateNow) {
+		// Uploads are checked as a whole before anything is stored
+		var spool *os.File
+		if spool, size, err = spoolUpload(combined); err == nil {
+			defer removeSpool(spool)
+			combined = spool
+			if k.scanner != nil {
+				err = k.scan(ctx, key, spool, size, mtype.String())
+			}
+			if err == nil && moderateNow {
+				opts.Metadata, err = k.moderate(ctx, key, spool, size, mtype.String(), opts.Metadata)
+			}
+		}
+	}
+	if err == nil {
+		err = k.storage.Put(ctx, storageKey, combined, size)
+	}
+	if err != nil {
+		if errors.Is(err, errMaxSizeExceeded) {
+			return fiber.StatusRequestEntityTooLarge
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			return fiber.StatusInsufficientStorage
+		}
+		if errors.Is(err, errChecksumMismatch) || errors.Is(err, errInvalidSVG) {
+			return fiber.StatusBadRequest
+		}
+		if errors.Is(err, errInfected) || errors.Is(err, errFlagged) {
+			return fiber.StatusUnprocessableEntity
+		}
+		if errors.Is(err, errScanFailed) || errors.Is(err, errModerationFailed) {
+			k.log.Error("failed to check upload", "error", err)
+			return fiber.StatusServiceUnavailable
+		}
+		k.log.Error("failed to put blob", "error", err)
 		return fiber.StatusInternalServerError
 	}
 
-	tmpFile.Close()
-	if err := os.Rename(tmpFile.Name(), fp); err != nil {
-		k.log.Error("failed to move temp file", "error", err)
-		return fiber.StatusInternalServerError
+	hash := fmt.Sprintf("%x", checksums.md5.Sum(nil))
+	modifiedTime := time.Now().UTC()
+	if !opts.ModifiedTime.IsZero() {
+		modifiedTime = opts.ModifiedTime.UTC()
 	}
 
-	// Push to leveldb as existing
-	if err := k.PutRecord(key, Record{NO, hash}); err != nil {
+	// Push to the index as existing
+	rec := Record{
+		Deleted:      NO,
+		Hash:         hash,
+		SHA256:       fmt.Sprintf("%x", checksums.sha256.Sum(nil)),
+		Size:         limitedReader.read,
+		ContentType:  mtype.String(),
+		ModifiedTime: modifiedTime,
+		Metadata:     opts.Metadata,
+		ExpiresAt:    opts.ExpiresAt,
+		ACL:          opts.ACL,
+	}
+	if k.dedup {
+		if rec.Blob, err = k.storeContent(ctx, storageKey, rec.SHA256); err != nil {
+			k.log.Error("failed to store deduplicated blob", "error", err)
+			return fiber.StatusInternalServerError
+		}
+	}
+	if err := k.PutRecord(key, rec); err != nil {
 		k.log.Error("failed to put record", "error", err)
+		if rec.Blob != "" {
+			k.releaseBlob(ctx, key, rec)
+		}
 		return fiber.StatusInternalServerError
 	}
+	k.updateQuotaUsage(key, stored, rec)
 
 	succeeded = true
+	// The previous blob is gone unless it was overwritten in place
+	if stored.Hash != "" && (stored.Blob != "" || rec.Blob != "") {
+		if err := k.releaseBlob(ctx, key, stored); err != nil {
+			k.log.Error("failed to delete previous blob", "error", err)
+		}
+	}
+	k.observeUpload(rec.Size)
+	if prev.Deleted == NO {
+		k.emit(EventBlobOverwritten, key, rec)
+	} else {
+		k.emit(EventBlobCreated, key, rec)
+	}
+	if k.moderation.Async && k.moderation.moderates(rec.ContentType) {
+		k.moderateLater(key, rec)
+	}
 	// 201, all good
 	return fiber.StatusCreated
 }
 
+// writeForm stores the file in the configured field of a multipart/form-data
+// body. The body is streamed, so the file is never buffered in memory.
+func (k *KeyVal) writeForm(c fiber.Ctx, key []byte) int {
+	mediaType, params, err := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	if err != nil || mediaType != fiber.MIMEMultipartForm || params["boundary"] == "" {
+		return fiber.StatusUnsupportedMediaType
+	}
+	metadata, ok := metadataFromHeaders(c)
+	if !ok {
+		return fiber.StatusBadRequest
+	}
+	expiresAt, ok := parseExpireAfter(c.Get("x-expire-after"))
+	if !ok {
+		return fiber.StatusBadRequest
+	}
+	acl, ok := parseACL(c.Get("x-acl"))
+	if !ok {
+		return fiber.StatusBadRequest
+	}
+	derive, ok := k.parseDerive(c.Get("x-derive"))
+	if !ok {
+		return fiber.StatusBadRequest
+	}
+
+	var body io.Reader
+	if stream := c.Request().BodyStream(); stream != nil {
+		body = stream
+	} else {
+		body = bytes.NewReader(c.Body())
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			// Either the body is malformed or the field is missing
+			return fiber.StatusBadRequest
+		}
+		if part.FormName() != k.formField || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		defer part.Close()
+		status := k.Write(c.Context(), key, part, -1, WriteOptions{
+			Metadata:            metadata,
+			ExpiresAt:           expiresAt,
+			ACL:                 acl,
+			DeclaredContentType: part.Header.Get("Content-Type"),
+		})
+		if status == fiber.StatusCreated {
+			k.derive(c, key, derive)
+		}
+		return status
+	}
+}
+
+// setBlobHeaders sets the validators and content type of a blob from its
+// record. Records written before they tracked modification times fall back to
+// modTime from the storage backend.
+func setBlobHeaders(c fiber.Ctx, rec Record, modTime time.Time) {
+	// A key can be overwritten at any time, so caches have to revalidate
+	// before reusing a response
+	c.Set("Cache-Control", "no-cache")
+	if rec.Hash != "" {
+		c.Set("ETag", `"`+rec.Hash+`"`)
+	}
+	if !rec.ModifiedTime.IsZero() {
+		modTime = rec.ModifiedTime
+	}
+	if !modTime.IsZero() {
+		c.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if rec.ContentType != "" {
+		c.Set("Content-Type", rec.ContentType)
+		// Browsers mustn't guess a type other than the detected one, like
+		// HTML for an image
+		c.Set("X-Content-Type-Options", "nosniff")
+	}
+	if rec.SHA256 != "" {
+		c.Set("x-checksum-sha256", rec.SHA256)
+	}
+	if rec.ACL != "" {
+		c.Set("x-acl", rec.ACL)
+	}
+	if rec.Placeholder != "" {
+		c.Set("x-placeholder", rec.Placeholder)
+	}
+	if rec.ContentType == svgMimeType {
+		// SVGs stored before uploads were sanitized may still have scripts
+		c.Set("Content-Security-Policy", "script-src 'none'")
+	}
+	setMetadataHeaders(c, rec.Metadata)
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since against a blob.
+// As per RFC 9110, If-Modified-Since is ignored when If-None-Match is present.
+// fiber.Ctx.Fresh isn't used because it treats every If-Modified-Since
+// request without an If-None-Match as fresh.
+func notModified(c fiber.Ctx, rec Record, modTime time.Time) bool {
+	if noneMatch := c.Get(fiber.HeaderIfNoneMatch); noneMatch != "" {
+		if strings.TrimSpace(noneMatch) == "*" {
+			return true
+		}
+		if rec.Hash == "" {
+			return false
+		}
+		for _, etag := range strings.Split(noneMatch, ",") {
+			// Weak comparison, so W/ prefixes added by proxies still match
+			etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+			if etag == `"`+rec.Hash+`"` {
+				return true
+			}
+		}
+		return false
+	}
+
+	modifiedSince := c.Get(fiber.HeaderIfModifiedSince)
+	if modifiedSince == "" {
+		return false
+	}
+	if !rec.ModifiedTime.IsZero() {
+		modTime = rec.ModifiedTime
+	}
+	since, err := http.ParseTime(modifiedSince)
+	if err != nil || modTime.IsZero() {
+		return false
+	}
+	// Last-Modified only has second precision
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+var errMaxSizeExceeded = errors.New("max size exceeded")
+
+// maxSizeReader fails with errMaxSizeExceeded, or err if it's set, as soon as
+// more than n bytes have been read from r, so backends abort the write instead
+// of storing a truncated blob.
+type maxSizeReader struct {
+	r    io.Reader
+	n    int64
+	read int64
+	err  error
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.read += int64(n)
+	if m.read > m.n {
+		if m.err != nil {
+			return n, m.err
+		}
+		return n, errMaxSizeExceeded
+	}
+	return n, err
+}
+
+// blobKey returns the key of the blob in the path of the request, in the
+// namespace of the tenant making it
+func (k *KeyVal) blobKey(c fiber.Ctx) []byte {
+	key := bytes.Replace(c.Request().URI().Path(), []byte(k.basePath), []byte(""), 1)
+	if bytes.HasPrefix(key, []byte("/")) {
+		key = key[1:]
+	}
+	return append([]byte(namespace(c)), key...)
+}
+
 func (k *KeyVal) ServeHTTP(c fiber.Ctx) error {
 	url := c.Request().URI()
 	method := c.Method()
@@ -234,17 +687,19 @@ func (k *KeyVal) ServeHTTP(c fiber.Ctx) error {
 
 	// List query
 	if string(key) == k.basePath && method == fiber.MethodGet {
-		k.QueryHandler([]byte(c.Query("prefix", "")), c)
-		return nil
+		return k.ListHandler(c)
 	}
 
-	key = bytes.Replace(key, []byte(k.basePath), []byte(""), 1)
-	if bytes.HasPrefix(key, []byte("/")) {
-		key = key[1:]
+	ns := namespace(c)
+	key = k.blobKey(c)
+	// Keys with control bytes belong to the index, e.g. nonces
+	if reservedKey(key) {
+		c.Status(fiber.StatusBadRequest)
+		return nil
 	}
 
-	// Lock the key while a PUT or DELETE is in progress
-	if method == fiber.MethodPost || method == fiber.MethodPut || method == fiber.MethodDelete {
+	// Lock the key while a PUT, PATCH or DELETE is in progress
+	if method == fiber.MethodPost || method == fiber.MethodPut || method == fiber.MethodPatch || method == fiber.MethodDelete {
 		if !k.LockKey(key) {
 			// Retry later
 			c.Status(fiber.StatusConflict)
@@ -256,30 +711,102 @@ func (k *KeyVal) ServeHTTP(c fiber.Ctx) error {
 	switch method {
 	case fiber.MethodGet, fiber.MethodHead:
 		rec := k.GetRecord(key)
-		var fp string
 		if len(rec.Hash) != 0 {
 			// note that the hash is always of the whole file, not the content requested
 			c.Set("Content-Md5", rec.Hash)
 		}
+		for _, header := range k.cacheTagHeaders {
+			c.Set(header, cdn.Tag(string(key)))
+		}
 		if rec.Deleted == SOFT || rec.Deleted == HARD {
 			c.Set("Content-Length", "0")
 			c.Status(fiber.StatusNotFound)
 			return nil
 		}
 
-		// check if the file exists
-		if _, err := os.Stat(filepath.Join(k.volume, KeyToPath(key))); err != nil {
-			c.Set("Content-Length", "0")
-			c.Status(fiber.StatusNotFound)
+		c.Status(fiber.StatusOK)
+		if ls, ok := k.storage.(localStorage); ok {
+			// check if the file exists
+			fp := ls.LocalPath(rec.StorageKey(string(key)))
+			stat, err := os.Stat(fp)
+			if err != nil {
+				c.Set("Content-Length", "0")
+				c.Status(fiber.StatusNotFound)
+				return nil
+			}
+			setBlobHeaders(c, rec, stat.ModTime())
+			if notModified(c, rec, stat.ModTime()) {
+				c.Status(fiber.StatusNotModified)
+				return nil
+			}
+			if method == fiber.MethodGet {
+				// fasthttp would otherwise evaluate If-Modified-Since on its
+				// own, even when If-None-Match says the file has changed
+				c.Request().Header.Del(fiber.HeaderIfModifiedSince)
+				c.SendFile(fp)
+			} else {
+				c.Response().Header.SetContentLength(int(stat.Size()))
+			}
 			return nil
 		}
 
-		c.Status(fiber.StatusOK)
-		if method == "GET" {
-			fp = filepath.Join(k.volume, KeyToPath(key))
-			c.SendFile(fp)
+		if method == fiber.MethodHead {
+			info, err := k.storage.Stat(c.Context(), rec.StorageKey(string(key)))
+			if err != nil {
+				c.Set("Content-Length", "0")
+				if errors.Is(err, ErrNotFound) {
+					c.Status(fiber.StatusNotFound)
+				} else {
+					k.log.Error("failed to stat blob", "error", err)
+					c.Status(fiber.StatusInternalServerError)
+				}
+				return nil
+			}
+			setBlobHeaders(c, rec, info.ModifiedTime)
+			if notModified(c, rec, info.ModifiedTime) {
+				c.Status(fiber.StatusNotModified)
+				return nil
+			}
+			c.Response().Header.SetContentLength(int(info.Size))
+			return nil
+		}
+
+		// The record alone is enough to revalidate, so there's no need to open
+		// the blob unless it predates modification times being recorded
+		if !rec.ModifiedTime.IsZero() && notModified(c, rec, rec.ModifiedTime) {
+			setBlobHeaders(c, rec, rec.ModifiedTime)
+			c.Status(fiber.StatusNotModified)
+			return nil
 		}
 
+		r, info, err := k.storage.Get(c.Context(), rec.StorageKey(string(key)))
+		if err != nil {
+			c.Set("Content-Length", "0")
+			if errors.Is(err, ErrNotFound) {
+				c.Status(fiber.StatusNotFound)
+			} else {
+				k.log.Error("failed to get blob", "error", err)
+				c.Status(fiber.StatusInternalServerError)
+			}
+			return nil
+		}
+		setBlobHeaders(c, rec, info.ModifiedTime)
+		if notModified(c, rec, info.ModifiedTime) {
+			r.Close()
+			c.Status(fiber.StatusNotModified)
+			return nil
+		}
+		// fasthttp closes the body stream once it has been written
+		br := bufio.NewReader(r)
+		if rec.ContentType == "" {
+			head, _ := br.Peek(512)
+			c.Set("Content-Type", mimetype.Detect(head).String())
+		}
+		return c.SendStream(struct {
+			io.Reader
+			io.Closer
+		}{br, r}, int(info.Size))
+
 	case fiber.MethodPut:
 		contentLength := c.Request().Header.ContentLength()
 		if contentLength == 0 {
@@ -287,12 +814,53 @@ func (k *KeyVal) ServeHTTP(c fiber.Ctx) error {
 			return nil
 		}
 
-		status := k.Write(key, c.Request().BodyStream(), contentLength)
+		metadata, ok := metadataFromHeaders(c)
+		if !ok {
+			c.Status(fiber.StatusBadRequest)
+			return nil
+		}
+		md5Sum, md5Ok := parseChecksum(c.Get("Content-MD5"), md5.Size)
+		sha256Sum, sha256Ok := parseChecksum(c.Get("x-checksum-sha256"), sha256.Size)
+		expiresAt, expiresOk := parseExpireAfter(c.Get("x-expire-after"))
+		acl, aclOk := parseACL(c.Get("x-acl"))
+		derive, deriveOk := k.parseDerive(c.Get("x-derive"))
+		if !md5Ok || !sha256Ok || !expiresOk || !aclOk || !deriveOk {
+			c.Status(fiber.StatusBadRequest)
+			return nil
+		}
+		status := k.Write(c.Context(), key, c.Request().BodyStream(), contentLength, WriteOptions{
+			Metadata:            metadata,
+			MD5:                 md5Sum,
+			SHA256:              sha256Sum,
+			ExpiresAt:           expiresAt,
+			ACL:                 acl,
+			DeclaredContentType: c.Get(fiber.HeaderContentType),
+		})
+		if status == fiber.StatusCreated {
+			k.derive(c, key, derive)
+		}
+		c.Status(status)
+
+	case fiber.MethodPatch:
+		acl, ok := parseACL(c.Get("x-acl"))
+		if !ok {
+			c.Status(fiber.StatusBadRequest)
+			return nil
+		}
+		rec, status := k.UpdateMetadata(key, c.Body(), acl)
+		if status != fiber.StatusOK {
+			c.Status(status)
+			return nil
+		}
+		return c.Status(fiber.StatusOK).JSON(newListObject(string(key[len(ns):]), rec))
+
+	case fiber.MethodPost:
+		status := k.writeForm(c, key)
 		c.Status(status)
 
 	case fiber.MethodDelete:
 		_, unlink := m["unlink"]
-		status := k.Delete(key, unlink)
+		status := k.Delete(c.Context(), key, unlink)
 		c.Status(status)
 	}
 
@@ -0,0 +1,105 @@
+package keyval
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/dhash"
+)
+
+const (
+	// DefaultSimilarDistance is how many bits the hashes of similar images
+	// differ by at most, unless a request says otherwise
+	DefaultSimilarDistance = 10
+	// maxSimilarDistance is the most they can differ by, beyond which images
+	// aren't alike at all
+	maxSimilarDistance = 32
+)
+
+type SimilarResponse struct {
+	Key     string          `json:"key"`
+	Similar []SimilarObject `json:"similar"`
+}
+
+type SimilarObject struct {
+	ListObject
+	// Distance is how many bits the hashes of the images differ by, from 0
+	// for images that look the same
+	Distance int `json:"distance"`
+}
+
+// SetDHash stores the difference hash of the image at key in its record. It's
+// dropped if the blob was replaced since it had the given hash.
+func (k *KeyVal) SetDHash(key []byte, hash, dHash string) error {
+	if err := k.waitLockKey(key); err != nil {
+		return err
+	}
+	defer k.UnlockKey(key)
+
+	rec := k.GetRecord(key)
+	if rec.Deleted != NO || rec.Hash != hash || rec.DHash == dHash {
+		return nil
+	}
+	rec.DHash = dHash
+	return k.PutRecord(key, rec)
+}
+
+// SimilarHandler lists the images that look like the image at key, closest
+// first, e.g. GET {basePath}/similar?key={key}&distance=10. Images are
+// hashed shortly after they're uploaded, so it responds with 409 Conflict
+// until the image at key is.
+func (k *KeyVal) SimilarHandler(c fiber.Ctx) error {
+	key := c.Query("key")
+	if key == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	distance := DefaultSimilarDistance
+	if q := c.Query("distance"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 0 || n > maxSimilarDistance {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		distance = n
+	}
+
+	ns := namespace(c)
+	rec := k.GetRecord([]byte(ns + key))
+	if rec.Deleted != NO || rec.Expired() {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if rec.DHash == "" {
+		return c.Status(fiber.StatusConflict).SendString("image hasn't been hashed")
+	}
+	hash, err := dhash.Parse(rec.DHash)
+	if err != nil {
+		k.log.Error("invalid image hash", "key", key, "error", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	similar := make([]SimilarObject, 0)
+	err = k.db.Iterate([]byte(ns), nil, func(bkey []byte, other Record) bool {
+		if other.DHash == "" || other.Deleted != NO || other.Expired() || string(bkey) == ns+key {
+			return true
+		}
+		otherHash, err := dhash.Parse(other.DHash)
+		if err != nil {
+			return true
+		}
+		if d := dhash.Distance(hash, otherHash); d <= distance {
+			similar = append(similar, SimilarObject{ListObject: newListObject(string(bkey[len(ns):]), other), Distance: d})
+		}
+		return true
+	})
+	if err != nil {
+		k.log.Error("failed to find similar images", "error", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	sort.SliceStable(similar, func(i, j int) bool {
+		return similar[i].Distance < similar[j].Distance
+	})
+	if len(similar) > MAX_QUERY_LIMIT {
+		similar = similar[:MAX_QUERY_LIMIT]
+	}
+	return c.JSON(SimilarResponse{Key: key, Similar: similar})
+}
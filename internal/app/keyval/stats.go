@@ -0,0 +1,86 @@
+package keyval
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+type StorageStats struct {
+	// Objects is the number of keys that are served
+	Objects int64 `json:"objects"`
+	// Bytes is the total size of the keys that are served
+	Bytes int64 `json:"bytes"`
+	// DeletedObjects is the number of keys that are soft deleted and still
+	// take up space in storage
+	DeletedObjects int64 `json:"deleted_objects"`
+	// DeletedBytes is the total size of the soft deleted keys
+	DeletedBytes int64 `json:"deleted_bytes"`
+}
+
+// add counts rec in the stats
+func (s *StorageStats) add(rec Record) {
+	switch rec.Deleted {
+	case NO:
+		s.Objects++
+		s.Bytes += rec.Size
+	case SOFT:
+		s.DeletedObjects++
+		s.DeletedBytes += rec.Size
+	}
+}
+
+type StorageStatsResponse struct {
+	StorageStats
+	// Prefixes breaks the totals down by the next path segment after the
+	// requested prefix, e.g. avatars/ and uploads/. Keys without another
+	// segment are only counted in the totals.
+	Prefixes []PrefixStats `json:"prefixes"`
+}
+
+type PrefixStats struct {
+	Prefix string `json:"prefix"`
+	StorageStats
+}
+
+// StatsHandler reports how many objects and bytes are stored under the prefix
+// query parameter, or in total if there is none
+func (k *KeyVal) StatsHandler(c fiber.Ctx) error {
+	ns := namespace(c)
+	prefix := ns + c.Query("prefix")
+	var res StorageStatsResponse
+	prefixes := map[string]*StorageStats{}
+	err := k.db.Iterate([]byte(prefix), nil, func(key []byte, rec Record) bool {
+		// Keys reserved by writes in progress don't have a blob yet
+		if rec.Expired() || rec.Hash == "" {
+			return true
+		}
+		stats := []*StorageStats{&res.StorageStats}
+		rest := string(key[len(prefix):])
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			p := prefix + rest[:i+1]
+			if prefixes[p] == nil {
+				prefixes[p] = &StorageStats{}
+			}
+			stats = append(stats, prefixes[p])
+		}
+		for _, s := range stats {
+			s.add(rec)
+		}
+		return true
+	})
+	if err != nil {
+		k.log.Error("failed to iterate records", "error", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	res.Prefixes = make([]PrefixStats, 0, len(prefixes))
+	for p, stats := range prefixes {
+		res.Prefixes = append(res.Prefixes, PrefixStats{Prefix: p[len(ns):], StorageStats: *stats})
+	}
+	sort.Slice(res.Prefixes, func(i, j int) bool {
+		return res.Prefixes[i].Prefix < res.Prefixes[j].Prefix
+	})
+	return c.Status(fiber.StatusOK).JSON(res)
+}
@@ -0,0 +1,67 @@
+package keyval
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// Storage is implemented by blob storage backends. The keyval HTTP layer and
+// the LevelDB index only ever talk to blobs through this interface, so new
+// backends can be added without touching either of them.
+type Storage interface {
+	// Get opens the blob stored under key for reading. The caller is
+	// responsible for closing the returned reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	// Put stores the contents of r under key, replacing any existing blob.
+	// size is the expected length of r, or -1 if it is unknown. Backends must
+	// not leave a partially written blob behind if r returns an error.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Delete removes the blob stored under key.
+	Delete(ctx context.Context, key string) error
+	// Stat returns information about the blob stored under key.
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// List calls fn for every blob whose key starts with prefix. Iteration
+	// stops at the first error returned by fn.
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+// ObjectInfo describes a blob held by a Storage backend
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ModifiedTime time.Time
+}
+
+// ErrNotFound is returned by Storage backends when a blob does not exist
+var ErrNotFound = errors.New("blob not found")
+
+// localStorage is implemented by backends that keep blobs on the local
+// filesystem. The HTTP layer uses it to serve files directly, which gives us
+// range requests and sendfile for free.
+type localStorage interface {
+	LocalPath(key string) string
+}
+
+// Copier is implemented by backends that can copy a blob without streaming it
+// through this server
+type Copier interface {
+	// Copy copies the blob stored under src to dst, replacing any existing
+	// blob at dst.
+	Copy(ctx context.Context, src, dst string) error
+}
+
+// CopyBlob copies the blob stored under src to dst. Backends that aren't a
+// Copier have the blob read back and written again.
+func CopyBlob(ctx context.Context, storage Storage, src, dst string) error {
+	if c, ok := storage.(Copier); ok {
+		return c.Copy(ctx, src, dst)
+	}
+	r, info, err := storage.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return storage.Put(ctx, dst, r, info.Size)
+}
@@ -0,0 +1,122 @@
+package keyval
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/events"
+)
+
+const (
+	// streamBuffer is how many events a stream can fall behind before it's
+	// closed
+	streamBuffer = 256
+	// streamHeartbeat is how often a comment is sent to an idle stream, so
+	// proxies keep it open and disconnected clients are noticed
+	streamHeartbeat = 15 * time.Second
+	// streamWriteTimeout is how long writing an event to a stream can take
+	streamWriteTimeout = 10 * time.Second
+)
+
+// stream is a client following changes to the blobs under a prefix
+type stream struct {
+	// namespace is stripped from the keys of events, see namespace()
+	namespace string
+	prefix    string
+	events    chan events.Event
+}
+
+// streams are the clients following changes with GET /events
+type streams struct {
+	mu      sync.Mutex
+	streams map[*stream]struct{}
+}
+
+func (s *streams) subscribe(namespace, prefix string) *stream {
+	st := &stream{namespace: namespace, prefix: prefix, events: make(chan events.Event, streamBuffer)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams == nil {
+		s.streams = map[*stream]struct{}{}
+	}
+	s.streams[st] = struct{}{}
+	return st
+}
+
+func (s *streams) unsubscribe(st *stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, st)
+}
+
+// send sends an event about key to the streams following it. Streams that
+// can't keep up are closed, so their clients know to catch up by listing.
+func (s *streams) send(event events.Event, key string, rec Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for st := range s.streams {
+		if !strings.HasPrefix(key, st.namespace+st.prefix) {
+			continue
+		}
+		e := event
+		e.Object = newListObject(key[len(st.namespace):], rec)
+		select {
+		case st.events <- e:
+		default:
+			delete(s.streams, st)
+			close(st.events)
+		}
+	}
+}
+
+// EventsHandler streams the changes to blobs under the prefix query parameter
+// as server-sent events until the client disconnects
+func (k *KeyVal) EventsHandler(c fiber.Ctx) error {
+	// The prefix outlives the handler, so it can't point into fiber's buffers
+	st := k.streams.subscribe(namespace(c), strings.Clone(c.Query("prefix")))
+	// Closed when the server is shutting down
+	done := c.Context().Done()
+	conn := c.Context().Conn()
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	// Stops nginx from buffering the stream
+	c.Set("X-Accel-Buffering", "no")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer k.streams.unsubscribe(st)
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		// Clients ignore comments. This one sends the headers right away.
+		w.WriteString(": connected\n\n")
+		for {
+			// The server's write timeout only covers the start of the response
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := w.Flush(); err != nil {
+				return
+			}
+			select {
+			case <-done:
+				return
+			case <-heartbeat.C:
+				w.WriteString(": ping\n\n")
+			case event, ok := <-st.events:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					k.log.Error("failed to encode event", "error", err)
+					continue
+				}
+				fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,172 @@
+package keyval
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const svgMimeType = "image/svg+xml"
+
+var errInvalidSVG = errors.New("invalid svg")
+
+// svgUnsafeElements are dropped from SVGs along with everything inside them.
+// They run scripts, embed HTML or load other documents.
+var svgUnsafeElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"audio":         true,
+	"video":         true,
+	"handler":       true,
+	"listener":      true,
+}
+
+var (
+	// svgEntityPattern matches the internal entities of a DOCTYPE, which
+	// editors like Illustrator use for namespaces. Entities that refer to
+	// other entities aren't expanded, so they can't blow up.
+	svgEntityPattern = regexp.MustCompile(`<!ENTITY\s+([A-Za-z_][\w.-]*)\s+(?:"([^"&<%]*)"|'([^'&<%]*)')\s*>`)
+	// cssImportPattern and cssURLPattern match the parts of stylesheets that
+	// load other documents. References to fragments of the SVG are kept.
+	cssImportPattern = regexp.MustCompile(`(?i)@import[^;]*;?`)
+	cssURLPattern    = regexp.MustCompile(`(?i)url\(\s*['"]?\s*[^#'"\s)][^)]*\)`)
+
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "\n", "&#xA;", "\r", "&#xD;", "\t", "&#x9;")
+)
+
+// sanitizeSVG reads an SVG and returns it without scripts, event handlers,
+// embedded documents or references to anything outside of it, so it's as
+// safe to serve as any other image
+func sanitizeSVG(r io.Reader) ([]byte, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	dec := xml.NewDecoder(bytes.NewReader(src))
+	dec.Entity = map[string]string{}
+	var out bytes.Buffer
+	// RawToken doesn't check that elements are closed in order
+	var open []string
+	skip := 0
+	inStyle := false
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errInvalidSVG
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			open = append(open, qualifiedName(t.Name))
+			if len(open) == 1 && t.Name.Local != "svg" {
+				return nil, errInvalidSVG
+			}
+			if skip > 0 || svgUnsafeElements[strings.ToLower(t.Name.Local)] {
+				skip++
+				continue
+			}
+			inStyle = t.Name.Local == "style"
+			out.WriteString("<" + qualifiedName(t.Name))
+			for _, attr := range t.Attr {
+				if value, ok := sanitizeSVGAttr(attr); ok {
+					out.WriteString(" " + qualifiedName(attr.Name) + `="` + attrEscaper.Replace(value) + `"`)
+				}
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1] != qualifiedName(t.Name) {
+				return nil, errInvalidSVG
+			}
+			open = open[:len(open)-1]
+			if skip > 0 {
+				skip--
+				continue
+			}
+			inStyle = false
+			out.WriteString("</" + qualifiedName(t.Name) + ">")
+		case xml.CharData:
+			if skip > 0 {
+				continue
+			}
+			text := string(t)
+			if inStyle {
+				text = sanitizeCSS(text)
+			}
+			out.WriteString(textEscaper.Replace(text))
+		case xml.ProcInst:
+			// Stylesheet instructions load other documents
+			if t.Target == "xml" {
+				out.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		case xml.Directive:
+			// DOCTYPEs are dropped once their entities are known
+			for _, m := range svgEntityPattern.FindAllStringSubmatch(string(t), -1) {
+				dec.Entity[m[1]] = m[2] + m[3]
+			}
+		}
+	}
+	if len(open) > 0 || out.Len() == 0 {
+		return nil, errInvalidSVG
+	}
+	return out.Bytes(), nil
+}
+
+// sanitizeSVGAttr returns the value an attribute is kept with, or false if
+// it's dropped
+func sanitizeSVGAttr(attr xml.Attr) (string, bool) {
+	name := strings.ToLower(attr.Name.Local)
+	value := attr.Value
+	compact := strings.ToLower(strings.Join(strings.Fields(value), ""))
+	switch {
+	case strings.HasPrefix(name, "on"):
+		// Event handlers
+		return "", false
+	case strings.Contains(compact, "javascript:") || strings.Contains(compact, "vbscript:"):
+		return "", false
+	case attr.Name.Space == "xml" && name == "base":
+		return "", false
+	case name == "href":
+		// Only fragments of the SVG and embedded raster images can be
+		// referred to
+		if strings.HasPrefix(compact, "#") {
+			return value, true
+		}
+		if strings.HasPrefix(compact, "data:image/") && !strings.HasPrefix(compact, "data:image/svg") {
+			return value, true
+		}
+		return "", false
+	case name == "style":
+		return sanitizeCSS(value), true
+	}
+	if strings.Contains(compact, "url(") {
+		return sanitizeCSS(value), true
+	}
+	return value, true
+}
+
+// sanitizeCSS removes imports and external URLs from a stylesheet
+func sanitizeCSS(css string) string {
+	css = cssImportPattern.ReplaceAllString(css, "")
+	return cssURLPattern.ReplaceAllStringFunc(css, func(u string) string {
+		if strings.Contains(strings.ToLower(u), "data:image/") && !strings.Contains(strings.ToLower(u), "data:image/svg") {
+			return u
+		}
+		return "none"
+	})
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
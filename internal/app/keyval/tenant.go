@@ -0,0 +1,32 @@
+package keyval
+
+import (
+	"net/url"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+// namespace returns the prefix the keys of the tenant making the request are
+// stored under. Tenants only see keys relative to it, so it's added to keys
+// coming in and stripped from keys going out.
+func namespace(c fiber.Ctx) string {
+	if tenant := mw.GetTenant(c); tenant != "" {
+		return tenant + "/"
+	}
+	return ""
+}
+
+// signURL signs u for the tenant making the request, or with the signature
+// secret key if there isn't one
+func (k *KeyVal) signURL(c fiber.Ctx, u *url.URL) (*string, error) {
+	tenant := mw.GetTenant(c)
+	if tenant == "" {
+		return sign.SignURL(u, k.signSecret)
+	}
+	q := u.Query()
+	q.Set("x-tenant", tenant)
+	u.RawQuery = q.Encode()
+	return sign.SignURL(u, sign.TenantSecret(k.signSecret, tenant))
+}
@@ -0,0 +1,352 @@
+package tieredstorage
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+// lockStripes is how many locks keys are spread over
+const lockStripes = 64
+
+// TieredStorage keeps recently read blobs in a hot storage backend, usually
+// the local volume, and offloads the rest to a cold one, usually a bucket.
+// Blobs are written to the hot tier and pulled back from the cold tier when
+// they're read, so offloading is invisible to clients. It implements the
+// keyval.Storage interface.
+type TieredStorage struct {
+	// Hot is where blobs are written and read from
+	Hot keyval.Storage
+	// Cold is where blobs are offloaded to
+	Cold keyval.Storage
+	// ColdAfter is how long a blob can go unread before it's offloaded. Zero
+	// only offloads blobs to stay under MaxHotBytes.
+	ColdAfter time.Duration
+	// MaxHotBytes is the most bytes kept in Hot. The blobs read least
+	// recently are offloaded above it, and blobs aren't pulled back when
+	// there's no room for them. Zero means no limit.
+	MaxHotBytes int64
+	Logger      *slog.Logger
+
+	locks    [lockStripes]sync.Mutex
+	hotBytes atomic.Int64
+	mu       sync.Mutex
+	// accessed is when blobs were last read or written since the server
+	// started. The modification time of blobs is used for the others.
+	accessed map[string]time.Time
+}
+
+// Option TieredStorage option
+type Option func(s *TieredStorage)
+
+// New creates TieredStorage
+func New(hot, cold keyval.Storage, options ...Option) *TieredStorage {
+	s := &TieredStorage{
+		Hot:      hot,
+		Cold:     cold,
+		Logger:   slog.Default(),
+		accessed: map[string]time.Time{},
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// WithColdAfter with how long blobs go unread before they're offloaded option
+func WithColdAfter(d time.Duration) Option {
+	return func(s *TieredStorage) {
+		s.ColdAfter = d
+	}
+}
+
+// WithMaxHotBytes with the most bytes kept in the hot tier option
+func WithMaxHotBytes(n int64) Option {
+	return func(s *TieredStorage) {
+		s.MaxHotBytes = n
+	}
+}
+
+// WithLogger with logger option
+func WithLogger(log *slog.Logger) Option {
+	return func(s *TieredStorage) {
+		s.Logger = log
+	}
+}
+
+// Get implements the Storage interface. Blobs in the cold tier are pulled back
+// into the hot tier if there's room for them, otherwise they're read from the
+// cold tier directly.
+func (s *TieredStorage) Get(ctx context.Context, key string) (io.ReadCloser, *keyval.ObjectInfo, error) {
+	r, info, err := s.Hot.Get(ctx, key)
+	if err == nil {
+		s.touch(key)
+		return r, info, nil
+	} else if !errors.Is(err, keyval.ErrNotFound) {
+		return nil, nil, err
+	}
+
+	unlock := s.lock(key)
+	defer unlock()
+	// It may have been pulled back while waiting for the lock
+	if r, info, err := s.Hot.Get(ctx, key); !errors.Is(err, keyval.ErrNotFound) {
+		if err == nil {
+			s.touch(key)
+		}
+		return r, info, err
+	}
+	r, info, err = s.Cold.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info == nil || (s.MaxHotBytes > 0 && s.hotBytes.Load()+info.Size > s.MaxHotBytes) {
+		return r, info, nil
+	}
+	err = s.Hot.Put(ctx, key, r, info.Size)
+	r.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	s.hotBytes.Add(info.Size)
+	s.touch(key)
+	return s.Hot.Get(ctx, key)
+}
+
+// Put implements the Storage interface. Blobs are always written to the hot
+// tier, a stale copy in the cold tier is replaced when it's offloaded again.
+func (s *TieredStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	unlock := s.lock(key)
+	defer unlock()
+	prev, _ := s.Hot.Stat(ctx, key)
+	if err := s.Hot.Put(ctx, key, r, size); err != nil {
+		return err
+	}
+	if info, err := s.Hot.Stat(ctx, key); err == nil {
+		if prev != nil {
+			s.hotBytes.Add(-prev.Size)
+		}
+		s.hotBytes.Add(info.Size)
+	}
+	s.touch(key)
+	return nil
+}
+
+// Delete implements the Storage interface. The blob is deleted from both
+// tiers.
+func (s *TieredStorage) Delete(ctx context.Context, key string) error {
+	unlock := s.lock(key)
+	defer unlock()
+	info, _ := s.Hot.Stat(ctx, key)
+	hotErr := s.Hot.Delete(ctx, key)
+	if hotErr == nil && info != nil {
+		s.hotBytes.Add(-info.Size)
+	}
+	coldErr := s.Cold.Delete(ctx, key)
+	s.forget(key)
+	if errors.Is(hotErr, keyval.ErrNotFound) && errors.Is(coldErr, keyval.ErrNotFound) {
+		return keyval.ErrNotFound
+	}
+	if hotErr != nil && !errors.Is(hotErr, keyval.ErrNotFound) {
+		return hotErr
+	}
+	if coldErr != nil && !errors.Is(coldErr, keyval.ErrNotFound) {
+		return coldErr
+	}
+	return nil
+}
+
+// Copy implements the keyval.Copier interface. Blobs in the hot tier are
+// copied within it, and blobs in the cold tier within the cold tier.
+func (s *TieredStorage) Copy(ctx context.Context, src, dst string) error {
+	if info, err := s.Hot.Stat(ctx, src); err == nil {
+		unlock := s.lock(dst)
+		defer unlock()
+		prev, _ := s.Hot.Stat(ctx, dst)
+		if err := keyval.CopyBlob(ctx, s.Hot, src, dst); err != nil {
+			return err
+		}
+		if prev != nil {
+			s.hotBytes.Add(-prev.Size)
+		}
+		s.hotBytes.Add(info.Size)
+		s.touch(dst)
+		return nil
+	} else if !errors.Is(err, keyval.ErrNotFound) {
+		return err
+	}
+
+	unlock := s.lock(dst)
+	defer unlock()
+	if err := keyval.CopyBlob(ctx, s.Cold, src, dst); err != nil {
+		return err
+	}
+	// A stale copy of dst in the hot tier would be read instead
+	info, _ := s.Hot.Stat(ctx, dst)
+	if err := s.Hot.Delete(ctx, dst); err == nil && info != nil {
+		s.hotBytes.Add(-info.Size)
+	}
+	s.forget(dst)
+	return nil
+}
+
+// Stat implements the Storage interface
+func (s *TieredStorage) Stat(ctx context.Context, key string) (*keyval.ObjectInfo, error) {
+	info, err := s.Hot.Stat(ctx, key)
+	if errors.Is(err, keyval.ErrNotFound) {
+		return s.Cold.Stat(ctx, key)
+	}
+	return info, err
+}
+
+// List implements the Storage interface. The keys in the hot tier are kept in
+// memory to leave them out of the listing of the cold tier.
+func (s *TieredStorage) List(ctx context.Context, prefix string, fn func(keyval.ObjectInfo) error) error {
+	hot := map[string]struct{}{}
+	err := s.Hot.List(ctx, prefix, func(obj keyval.ObjectInfo) error {
+		hot[obj.Key] = struct{}{}
+		return fn(obj)
+	})
+	if err != nil {
+		return err
+	}
+	return s.Cold.List(ctx, prefix, func(obj keyval.ObjectInfo) error {
+		if _, ok := hot[obj.Key]; ok {
+			return nil
+		}
+		return fn(obj)
+	})
+}
+
+// RunOffload offloads cold blobs right away and then every interval until
+// ctx is done
+func (s *TieredStorage) RunOffload(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		blobs, bytes, err := s.Offload(ctx)
+		if err != nil {
+			s.Logger.Error("failed to offload blobs", "error", err)
+		} else if blobs > 0 {
+			s.Logger.Info("offloaded blobs", "blobs", blobs, "bytes", bytes, "hot_bytes", s.hotBytes.Load())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Offload moves the blobs that haven't been read for ColdAfter to the cold
+// tier, and then the blobs read least recently until the hot tier is under
+// MaxHotBytes. It returns how many blobs and bytes were offloaded.
+func (s *TieredStorage) Offload(ctx context.Context) (int, int64, error) {
+	type blob struct {
+		key      string
+		size     int64
+		accessed time.Time
+	}
+	var blobs []blob
+	var total int64
+	err := s.Hot.List(ctx, "", func(obj keyval.ObjectInfo) error {
+		blobs = append(blobs, blob{obj.Key, obj.Size, s.lastAccess(obj)})
+		total += obj.Size
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	s.hotBytes.Store(total)
+
+	slices.SortFunc(blobs, func(a, b blob) int {
+		return a.accessed.Compare(b.accessed)
+	})
+	coldBefore := time.Now().Add(-s.ColdAfter)
+	n := 0
+	var offloaded int64
+	for _, b := range blobs {
+		cold := s.ColdAfter > 0 && b.accessed.Before(coldBefore)
+		full := s.MaxHotBytes > 0 && total-offloaded > s.MaxHotBytes
+		if !cold && !full {
+			// The rest were read more recently
+			break
+		}
+		ok, err := s.offload(ctx, b.key, b.accessed)
+		if err != nil {
+			if ctx.Err() != nil {
+				return n, offloaded, ctx.Err()
+			}
+			s.Logger.Error("failed to offload blob", "key", b.key, "error", err)
+			continue
+		}
+		if ok {
+			n++
+			offloaded += b.size
+		}
+	}
+	return n, offloaded, nil
+}
+
+// offload moves key to the cold tier, unless it's been read since accessed
+func (s *TieredStorage) offload(ctx context.Context, key string, accessed time.Time) (bool, error) {
+	unlock := s.lock(key)
+	defer unlock()
+	r, info, err := s.Hot.Get(ctx, key)
+	if errors.Is(err, keyval.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	if s.lastAccess(*info).After(accessed) {
+		return false, nil
+	}
+	if err := s.Cold.Put(ctx, key, r, info.Size); err != nil {
+		return false, err
+	}
+	if err := s.Hot.Delete(ctx, key); err != nil {
+		return false, err
+	}
+	s.hotBytes.Add(-info.Size)
+	s.forget(key)
+	return true, nil
+}
+
+// lock locks key for writing and returns the function that unlocks it
+func (s *TieredStorage) lock(key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &s.locks[h.Sum32()%lockStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (s *TieredStorage) touch(key string) {
+	s.mu.Lock()
+	s.accessed[key] = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *TieredStorage) forget(key string) {
+	s.mu.Lock()
+	delete(s.accessed, key)
+	s.mu.Unlock()
+}
+
+// lastAccess returns when obj was last read or written
+func (s *TieredStorage) lastAccess(obj keyval.ObjectInfo) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.accessed[obj.Key]; ok {
+		return t
+	}
+	return obj.ModifiedTime
+}
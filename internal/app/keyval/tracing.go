@@ -0,0 +1,109 @@
+package keyval
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/jaredLunde/railway-image-service/internal/pkg/tracing"
+)
+
+// tracedStorage records a span for every call to its storage
+type tracedStorage struct {
+	Storage
+	tracer *tracing.Tracer
+}
+
+// tracedLocalStorage is a tracedStorage of a backend with blobs on disk,
+// which are served with sendfile instead of through the storage
+type tracedLocalStorage struct {
+	*tracedStorage
+}
+
+func (s tracedLocalStorage) LocalPath(key string) string {
+	return s.Storage.(localStorage).LocalPath(key)
+}
+
+// traceStorage wraps storage so its calls are traced, keeping the optional
+// interfaces it implements
+func traceStorage(storage Storage, tracer *tracing.Tracer) Storage {
+	traced := &tracedStorage{Storage: storage, tracer: tracer}
+	if _, ok := storage.(localStorage); ok {
+		return tracedLocalStorage{traced}
+	}
+	return traced
+}
+
+func (s *tracedStorage) start(ctx context.Context, name, key string) (context.Context, *tracing.Span) {
+	ctx, span := s.tracer.Start(ctx, name)
+	span.SetAttribute("blob.key", key)
+	return ctx, span
+}
+
+// Get implements the Storage interface. The span ends when the blob is
+// opened, not when it's done being read.
+func (s *tracedStorage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	ctx, span := s.start(ctx, "storage.get", key)
+	defer span.End()
+	r, info, err := s.Storage.Get(ctx, key)
+	span.RecordError(ignoreNotFound(err))
+	return r, info, err
+}
+
+// Put implements the Storage interface
+func (s *tracedStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	ctx, span := s.start(ctx, "storage.put", key)
+	defer span.End()
+	span.SetAttribute("blob.size", size)
+	err := s.Storage.Put(ctx, key, r, size)
+	span.RecordError(err)
+	return err
+}
+
+// Delete implements the Storage interface
+func (s *tracedStorage) Delete(ctx context.Context, key string) error {
+	ctx, span := s.start(ctx, "storage.delete", key)
+	defer span.End()
+	err := s.Storage.Delete(ctx, key)
+	span.RecordError(ignoreNotFound(err))
+	return err
+}
+
+// Stat implements the Storage interface
+func (s *tracedStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	ctx, span := s.start(ctx, "storage.stat", key)
+	defer span.End()
+	info, err := s.Storage.Stat(ctx, key)
+	span.RecordError(ignoreNotFound(err))
+	return info, err
+}
+
+// List implements the Storage interface
+func (s *tracedStorage) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	ctx, span := s.tracer.Start(ctx, "storage.list")
+	defer span.End()
+	span.SetAttribute("blob.prefix", prefix)
+	err := s.Storage.List(ctx, prefix, fn)
+	span.RecordError(err)
+	return err
+}
+
+// Copy implements the Copier interface. Backends that aren't a Copier still
+// have the blob read back and written again.
+func (s *tracedStorage) Copy(ctx context.Context, src, dst string) error {
+	ctx, span := s.start(ctx, "storage.copy", src)
+	defer span.End()
+	span.SetAttribute("blob.destination", dst)
+	err := CopyBlob(ctx, s.Storage, src, dst)
+	span.RecordError(err)
+	return err
+}
+
+// ignoreNotFound returns nil if err is ErrNotFound. Missing blobs are an
+// answer, not a failure.
+func ignoreNotFound(err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package keyval
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// TrashHandler lists the keys that have been soft deleted and can still be
+// restored. It takes the same parameters as the list endpoint.
+func (k *KeyVal) TrashHandler(c fiber.Ctx) error {
+	k.query([]byte(c.Query("prefix", "")), c, true)
+	return nil
+}
+
+// RestoreHandler brings back a soft deleted key, e.g. POST
+// {basePath}/restore/{key}
+func (k *KeyVal) RestoreHandler(c fiber.Ctx) error {
+	key := strings.TrimPrefix(c.Path(), k.basePath+"/restore/")
+	if key == "" || key == c.Path() {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	bkey := []byte(namespace(c) + key)
+	if !k.LockKey(bkey) {
+		return c.SendStatus(fiber.StatusConflict)
+	}
+	defer k.UnlockKey(bkey)
+
+	rec, status := k.Restore(c.Context(), bkey)
+	if status != fiber.StatusOK {
+		return c.SendStatus(status)
+	}
+	return c.Status(fiber.StatusOK).JSON(newListObject(key, rec))
+}
+
+// Restore undoes a soft delete of key. The key must be locked by the caller.
+func (k *KeyVal) Restore(ctx context.Context, key []byte) (Record, int) {
+	if reservedKey(key) {
+		return Record{}, fiber.StatusBadRequest
+	}
+	rec := k.GetRecord(key)
+	if rec.Deleted == NO {
+		return rec, fiber.StatusConflict
+	}
+	if rec.Deleted != SOFT || rec.Hash == "" {
+		return rec, fiber.StatusNotFound
+	}
+
+	// The record may outlive its blob if the blob was removed from storage
+	// by something other than this service
+	if _, err := k.storage.Stat(ctx, rec.StorageKey(string(key))); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return rec, fiber.StatusNotFound
+		}
+		k.log.Error("failed to stat blob", "error", err)
+		return rec, fiber.StatusInternalServerError
+	}
+
+	before := rec
+	rec.Deleted = NO
+	if err := k.PutRecord(key, rec); err != nil {
+		k.log.Error("failed to put record", "error", err)
+		return rec, fiber.StatusInternalServerError
+	}
+	k.updateQuotaUsage(key, before, rec)
+	k.emit(EventBlobRestored, key, rec)
+	return rec, fiber.StatusOK
+}
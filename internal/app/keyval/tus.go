@@ -0,0 +1,404 @@
+package keyval
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,expiration,termination"
+	// tusContentType is the only content type PATCH requests may have
+	tusContentType = "application/offset+octet-stream"
+)
+
+// tusStore keeps unfinished tus uploads on the local disk. Every upload is an
+// info file describing it and a data file the chunks are appended to.
+type tusStore struct {
+	dir    string
+	expiry time.Duration
+	mu     sync.Mutex
+	locked map[string]struct{}
+}
+
+type tusUpload struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key"`
+	Length    int64     `json:"length"`
+	Metadata  string    `json:"metadata,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// ACL is the x-acl the upload was created with
+	ACL string `json:"acl,omitempty"`
+}
+
+func newTusStore(dir string, expiry time.Duration) (*tusStore, error) {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "tus")
+	}
+	if expiry <= 0 {
+		expiry = 24 * time.Hour
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &tusStore{dir: dir, expiry: expiry, locked: map[string]struct{}{}}, nil
+}
+
+func (s *tusStore) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.locked[id]; ok {
+		return false
+	}
+	s.locked[id] = struct{}{}
+	return true
+}
+
+func (s *tusStore) unlock(id string) {
+	s.mu.Lock()
+	delete(s.locked, id)
+	s.mu.Unlock()
+}
+
+func (s *tusStore) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".info")
+}
+
+func (s *tusStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+func (s *tusStore) create(key string, length int64, metadata, acl string) (*tusUpload, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	upload := &tusUpload{
+		ID:        hex.EncodeToString(b),
+		Key:       key,
+		Length:    length,
+		Metadata:  metadata,
+		ExpiresAt: time.Now().Add(s.expiry).UTC(),
+		ACL:       acl,
+	}
+	f, err := os.Create(s.dataPath(upload.ID))
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(s.infoPath(upload.ID), data, 0644); err != nil {
+		os.Remove(s.dataPath(upload.ID))
+		return nil, err
+	}
+	return upload, nil
+}
+
+// get returns the upload with id and the number of bytes received so far
+func (s *tusStore) get(id string) (*tusUpload, int64, error) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, 0, ErrNotFound
+	}
+	data, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, ErrNotFound
+		}
+		return nil, 0, err
+	}
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, 0, err
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		s.remove(id)
+		return nil, 0, ErrNotFound
+	}
+	stat, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, ErrNotFound
+		}
+		return nil, 0, err
+	}
+	return &upload, stat.Size(), nil
+}
+
+// append writes at most upload.Length-offset bytes of r to the end of the
+// upload and returns the new offset. Whatever was written before r failed is
+// kept, so the client can resume from there.
+func (s *tusStore) append(upload *tusUpload, offset int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.dataPath(upload.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+	n, err := io.Copy(f, io.LimitReader(r, upload.Length-offset))
+	if syncErr := f.Sync(); err == nil {
+		err = syncErr
+	}
+	return offset + n, err
+}
+
+func (s *tusStore) remove(id string) {
+	os.Remove(s.dataPath(id))
+	os.Remove(s.infoPath(id))
+}
+
+// removeExpired deletes every upload that expired before it was finished
+func (s *tusStore) removeExpired() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".info")
+		if !ok {
+			continue
+		}
+		// get removes the upload if it has expired
+		s.get(id)
+	}
+}
+
+// TusHandler implements the core, creation, creation-with-upload, expiration
+// and termination parts of the tus 1.0 resumable upload protocol, see
+// https://tus.io/protocols/resumable-upload. Uploads are created with a POST
+// to {basePath}/tus/{key} and the blob is written to key once the last chunk
+// has been received.
+func (k *KeyVal) TusHandler(c fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Cache-Control", "no-store")
+	if c.Method() == fiber.MethodOptions {
+		c.Set("Tus-Version", tusVersion)
+		c.Set("Tus-Extension", tusExtensions)
+		c.Set("Tus-Max-Size", strconv.Itoa(k.maxFileSize))
+		c.Status(fiber.StatusNoContent)
+		return nil
+	}
+	if c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		c.Status(fiber.StatusPreconditionFailed)
+		return nil
+	}
+
+	key := strings.TrimPrefix(c.Path(), k.basePath+"/tus/")
+	if key == "" || key == c.Path() {
+		c.Status(fiber.StatusNotFound)
+		return nil
+	}
+	key = namespace(c) + key
+
+	if c.Method() == fiber.MethodPost {
+		return k.tusCreate(c, key)
+	}
+
+	id := c.Query("upload_id")
+	if !k.tus.lock(id) {
+		c.Status(fiber.StatusConflict)
+		return nil
+	}
+	defer k.tus.unlock(id)
+	upload, offset, err := k.tus.get(id)
+	if err != nil || upload.Key != key {
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			k.log.Error("failed to get upload", "error", err)
+			c.Status(fiber.StatusInternalServerError)
+			return nil
+		}
+		c.Status(fiber.StatusNotFound)
+		return nil
+	}
+
+	switch c.Method() {
+	case fiber.MethodHead:
+		c.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		c.Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+		if upload.Metadata != "" {
+			c.Set("Upload-Metadata", upload.Metadata)
+		}
+		c.Status(fiber.StatusOK)
+		return nil
+
+	case fiber.MethodPatch:
+		if c.Get(fiber.HeaderContentType) != tusContentType {
+			c.Status(fiber.StatusUnsupportedMediaType)
+			return nil
+		}
+		clientOffset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return nil
+		}
+		if clientOffset != offset {
+			c.Status(fiber.StatusConflict)
+			return nil
+		}
+		c.Status(k.tusAppend(c, upload, offset))
+		return nil
+
+	case fiber.MethodDelete:
+		k.tus.remove(upload.ID)
+		c.Status(fiber.StatusNoContent)
+		return nil
+	}
+
+	c.Status(fiber.StatusMethodNotAllowed)
+	return nil
+}
+
+func (k *KeyVal) tusCreate(c fiber.Ctx, key string) error {
+	if c.Get("Upload-Defer-Length") != "" {
+		c.Status(fiber.StatusBadRequest)
+		return nil
+	}
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		c.Status(fiber.StatusBadRequest)
+		return nil
+	}
+	if length > int64(k.maxFileSize) {
+		c.Status(fiber.StatusRequestEntityTooLarge)
+		return nil
+	}
+	acl, ok := parseACL(c.Get("x-acl"))
+	if !ok {
+		c.Status(fiber.StatusBadRequest)
+		return nil
+	}
+	// The quota is checked again once the upload is finished, but there's no
+	// point in receiving a file that can't fit
+	quotaRemaining, status := k.quotaRemaining([]byte(key))
+	if status != 0 {
+		c.Status(status)
+		return nil
+	}
+	if quotaRemaining >= 0 && length > quotaRemaining {
+		c.Status(fiber.StatusInsufficientStorage)
+		return nil
+	}
+
+	// Creating uploads is rare enough to be a good time to clean up
+	// abandoned ones
+	go k.tus.removeExpired()
+
+	upload, err := k.tus.create(key, length, c.Get("Upload-Metadata"), acl)
+	if err != nil {
+		k.log.Error("failed to create upload", "error", err)
+		c.Status(fiber.StatusInternalServerError)
+		return nil
+	}
+
+	// The upload URL has the same path as this one, so a signed URL to create
+	// the upload authorizes its chunks as well
+	q := url.Values{}
+	q.Set("upload_id", upload.ID)
+	for _, param := range []string{"x-signature", "x-expire", "x-tenant"} {
+		if v := c.Query(param); v != "" {
+			q.Set(param, v)
+		}
+	}
+	c.Set(fiber.HeaderLocation, c.Path()+"?"+q.Encode())
+	c.Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+
+	if c.Get(fiber.HeaderContentType) == tusContentType {
+		if !k.tus.lock(upload.ID) {
+			c.Status(fiber.StatusConflict)
+			return nil
+		}
+		defer k.tus.unlock(upload.ID)
+		if status := k.tusAppend(c, upload, 0); status != fiber.StatusNoContent {
+			c.Status(status)
+			return nil
+		}
+	} else {
+		c.Set("Upload-Offset", "0")
+	}
+	c.Status(fiber.StatusCreated)
+	return nil
+}
+
+// tusAppend writes the body of the request to the upload and stores the blob
+// once every byte has been received
+func (k *KeyVal) tusAppend(c fiber.Ctx, upload *tusUpload, offset int64) int {
+	var body io.Reader
+	if stream := c.Request().BodyStream(); stream != nil {
+		body = stream
+	} else {
+		body = bytes.NewReader(c.Body())
+	}
+
+	offset, err := k.tus.append(upload, offset, body)
+	c.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	if err != nil {
+		k.log.Error("failed to append to upload", "error", err)
+		return fiber.StatusInternalServerError
+	}
+	if offset < upload.Length {
+		return fiber.StatusNoContent
+	}
+
+	key := []byte(upload.Key)
+	if !k.LockKey(key) {
+		// Every byte is here, so the client can retry with an empty PATCH
+		return fiber.StatusConflict
+	}
+	defer k.UnlockKey(key)
+
+	f, err := os.Open(k.tus.dataPath(upload.ID))
+	if err != nil {
+		k.log.Error("failed to open upload", "error", err)
+		return fiber.StatusInternalServerError
+	}
+	defer f.Close()
+	status := k.Write(c.Context(), key, f, int(upload.Length), WriteOptions{
+		ACL:                 upload.ACL,
+		DeclaredContentType: tusMetadataValue(upload.Metadata, "filetype"),
+	})
+	if status == fiber.StatusInternalServerError {
+		// Keep the upload so the client can retry storing it
+		return status
+	}
+	k.tus.remove(upload.ID)
+	if status != fiber.StatusCreated {
+		return status
+	}
+	return fiber.StatusNoContent
+}
+
+// tusMetadataValue returns the value of name in an Upload-Metadata header,
+// a comma-separated list of names followed by their base64 encoded values
+func tusMetadataValue(metadata, name string) string {
+	for _, pair := range strings.Split(metadata, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key != name {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return ""
+		}
+		return string(decoded)
+	}
+	return ""
+}
@@ -0,0 +1,131 @@
+package keyval
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/events"
+)
+
+const (
+	// webhookQueueSize is how many events can wait to be sent before new
+	// ones are dropped
+	webhookQueueSize = 1024
+	// webhookWorkers is how many events are sent at once
+	webhookWorkers = 4
+	// webhookMaxAttempts is how many times an event is sent to a URL before
+	// giving up on it
+	webhookMaxAttempts = 5
+	// webhookBackoff is how long to wait before the first retry. It doubles
+	// with every attempt.
+	webhookBackoff = time.Second
+)
+
+type webhooks struct {
+	urls   []string
+	secret string
+	client *http.Client
+	queue  chan events.Event
+}
+
+func newWebhooks(urls []string, secret string, timeout time.Duration) *webhooks {
+	if len(urls) == 0 {
+		return nil
+	}
+	return &webhooks{
+		urls:   urls,
+		secret: secret,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan events.Event, webhookQueueSize),
+	}
+}
+
+// sendWebhooks queues an event to be sent to the webhook URLs. It never
+// blocks, events are dropped if the queue is full.
+func (k *KeyVal) sendWebhooks(event events.Event, key []byte) {
+	if k.webhooks == nil {
+		return
+	}
+	select {
+	case k.webhooks.queue <- event:
+	default:
+		k.log.Error("webhook queue is full, dropping event", "type", event.Type, "key", string(key))
+	}
+}
+
+// RunWebhooks sends queued webhook events until ctx is done. Events still in
+// the queue when it's done are dropped.
+func (k *KeyVal) RunWebhooks(ctx context.Context) {
+	if k.webhooks == nil {
+		return
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case event := <-k.webhooks.queue:
+					k.sendWebhook(ctx, event)
+				}
+			}
+		}()
+	}
+	<-ctx.Done()
+}
+
+// sendWebhook POSTs event to every webhook URL, retrying with exponential
+// backoff until it's accepted with a 2xx status
+func (k *KeyVal) sendWebhook(ctx context.Context, event events.Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		k.log.Error("failed to encode webhook event", "error", err)
+		return
+	}
+	for _, url := range k.webhooks.urls {
+		backoff := webhookBackoff
+		for attempt := 1; ; attempt++ {
+			err := k.webhooks.post(ctx, url, event.ID, body)
+			if err == nil {
+				break
+			}
+			if attempt == webhookMaxAttempts {
+				k.log.Error("failed to send webhook", "url", url, "type", event.Type, "id", event.ID, "error", err)
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+}
+
+func (w *webhooks) post(ctx context.Context, url, id string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-webhook-id", id)
+	req.Header.Set("x-webhook-timestamp", timestamp)
+	req.Header.Set("x-webhook-signature", sign.SignWebhook(timestamp, body, w.secret))
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package openapi
+
+import (
+	_ "embed"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// Endpoint is where the OpenAPI specification is served
+const Endpoint = "/openapi.json"
+
+//go:embed openapi.json
+var spec []byte
+
+// Handler serves the OpenAPI 3 specification of the service's API
+func Handler(c fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	c.Set(fiber.HeaderCacheControl, "public, max-age=3600")
+	return c.Send(spec)
+}
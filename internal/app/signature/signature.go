@@ -1,10 +1,23 @@
 package signature
 
 import (
+	"errors"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+const (
+	// DefaultUploadExpiry is how long a presigned upload URL is valid for
+	// when the request doesn't say
+	DefaultUploadExpiry = time.Hour
+	// MaxUploadExpiry is the longest a presigned upload URL can be valid for
+	MaxUploadExpiry = 7 * 24 * time.Hour
 )
 
 func New(secret string) *Signature {
@@ -21,9 +34,176 @@ func (s *Signature) ServeHTTP(c fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString("invalid request")
 	}
 
-	uri, err := sign.SignURL(u, s.secret)
-	if err != nil {
+	// URLs are valid for an hour, but /serve URLs only expire when an
+	// expires_in duration is requested or they're single-use
+	opts := sign.Options{ExpireAt: time.Now().Add(time.Hour)}
+	q := u.Query()
+	if v := q.Get("expires_in"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("invalid expires_in")
+		}
+		opts.ExpireServe = true
+		opts.ExpireAt = time.Now().Add(d)
+		q.Del("expires_in")
+	}
+	opts.SingleUse = q.Get("single_use") == "true"
+	opts.IP = q.Get("ip")
+	q.Del("single_use")
+	q.Del("ip")
+	u.RawQuery = q.Encode()
+
+	uri, err := s.signURL(c, u, opts)
+	if errors.Is(err, sign.ErrInvalidIP) {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid ip")
+	} else if err != nil {
 		return c.Status(fiber.StatusBadRequest).SendString("invalid request")
 	}
 	return c.SendString(*uri)
 }
+
+type PresignedUpload struct {
+	// URL is the signed URL to upload the file to
+	URL string `json:"url"`
+	// Method is the HTTP method to upload the file with
+	Method string `json:"method"`
+	// Headers are the headers the upload request has to include
+	Headers map[string]string `json:"headers"`
+	// ExpiresAt is when the URL stops being accepted
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UploadHandler returns a presigned URL for uploading a file to the key in
+// the path, e.g. /sign/upload/avatars/me.png. The URL lets a browser upload
+// straight to blob storage without being given the API key. The URL is valid
+// for an hour unless an expires_in duration is requested, can only be used
+// once if single_use=true and only from the IP address or CIDR in ip if it's
+// set.
+func (s *Signature) UploadHandler(c fiber.Ctx) error {
+	key := strings.TrimPrefix(c.Path(), "/sign/upload/")
+	if key == "" || key == c.Path() {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid request")
+	}
+
+	expiresIn := DefaultUploadExpiry
+	if v := c.Query("expires_in"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > MaxUploadExpiry {
+			return c.Status(fiber.StatusBadRequest).SendString("invalid expires_in")
+		}
+		expiresIn = d
+	}
+
+	u, err := url.Parse(string(c.Request().URI().FullURI()))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid request")
+	}
+	u.Path = "/blob/" + key
+	u.RawPath = ""
+	u.RawQuery = ""
+	expiresAt := time.Now().Add(expiresIn)
+	uri, err := s.signURL(c, u, sign.Options{
+		ExpireAt:  expiresAt,
+		SingleUse: c.Query("single_use") == "true",
+		IP:        c.Query("ip"),
+	})
+	if errors.Is(err, sign.ErrInvalidIP) {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid ip")
+	} else if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid request")
+	}
+
+	headers := map[string]string{}
+	if contentType := c.Query("content_type"); contentType != "" {
+		headers[fiber.HeaderContentType] = contentType
+	}
+	return c.JSON(PresignedUpload{
+		URL:       *uri,
+		Method:    fiber.MethodPut,
+		Headers:   headers,
+		ExpiresAt: time.UnixMilli(expiresAt.UnixMilli()).UTC(),
+	})
+}
+
+type PresignedPolicy struct {
+	// URL is where the form is POSTed to
+	URL string `json:"url"`
+	// Fields are the form fields to send before the file
+	Fields map[string]string `json:"fields"`
+	// ExpiresAt is when the policy stops being accepted
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PolicyHandler returns a signed upload policy a browser can POST a form to
+// /blob with. The key_prefix, max_size, content_type and acl parameters
+// constrain the upload, and the policy is valid for an hour unless an
+// expires_in duration is requested.
+func (s *Signature) PolicyHandler(c fiber.Ctx) error {
+	expiresIn := DefaultUploadExpiry
+	if v := c.Query("expires_in"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > MaxUploadExpiry {
+			return c.Status(fiber.StatusBadRequest).SendString("invalid expires_in")
+		}
+		expiresIn = d
+	}
+	var maxSize int64
+	if v := c.Query("max_size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("invalid max_size")
+		}
+		maxSize = n
+	}
+	acl := c.Query("acl")
+	if acl != "" && acl != "public" && acl != "private" {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid acl")
+	}
+	policy := sign.UploadPolicy{
+		Expiration:  time.UnixMilli(time.Now().Add(expiresIn).UnixMilli()).UTC(),
+		KeyPrefix:   strings.TrimPrefix(c.Query("key_prefix"), "/"),
+		MaxSize:     maxSize,
+		ContentType: c.Query("content_type"),
+		ACL:         acl,
+	}
+
+	secret := s.secret
+	fields := map[string]string{}
+	if tenant := mw.GetTenant(c); tenant != "" {
+		secret = sign.TenantSecret(s.secret, tenant)
+		fields["x-tenant"] = tenant
+	}
+	encoded, signature, err := sign.SignPolicy(policy, secret)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid request")
+	}
+	fields["key"] = policy.KeyPrefix + "${filename}"
+	fields["policy"] = encoded
+	fields["x-signature"] = signature
+
+	u, err := url.Parse(string(c.Request().URI().FullURI()))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid request")
+	}
+	u.Path = "/blob"
+	u.RawPath = ""
+	u.RawQuery = ""
+	return c.JSON(PresignedPolicy{
+		URL:       u.String(),
+		Fields:    fields,
+		ExpiresAt: policy.Expiration,
+	})
+}
+
+// signURL signs u for the tenant making the request, so it only reaches the
+// tenant's keys, or with the signature secret key if there isn't one
+func (s *Signature) signURL(c fiber.Ctx, u *url.URL, opts sign.Options) (*string, error) {
+	tenant := mw.GetTenant(c)
+	if tenant == "" {
+		return sign.SignURLWithOptions(u, s.secret, opts)
+	}
+	q := u.Query()
+	q.Set("x-tenant", tenant)
+	u.RawQuery = q.Encode()
+	return sign.SignURLWithOptions(u, sign.TenantSecret(s.secret, tenant), opts)
+}
@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// MaxQueryLimit is the most entries a query returns at once
+const MaxQueryLimit = 1000
+
+// Entry is an authenticated request that changed, or tried to change, blobs
+type Entry struct {
+	// ID sorts in the order entries were recorded
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Credential is what authenticated the request: the ID of an API key,
+	// "signature" for a signed URL or "policy" for a signed upload policy
+	Credential string `json:"credential"`
+	Tenant     string `json:"tenant,omitempty"`
+	IP         string `json:"ip"`
+	Method     string `json:"method"`
+	Route      string `json:"route"`
+	Path       string `json:"path"`
+	// Keys are the blobs the request was about, relative to the tenant
+	Keys      []string `json:"keys,omitempty"`
+	Status    int      `json:"status"`
+	RequestID string   `json:"request_id,omitempty"`
+}
+
+// NewID returns an ID for an entry recorded at t
+func NewID(t time.Time) string {
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	return idPrefix(t) + hex.EncodeToString(suffix[:])
+}
+
+// idPrefix is the start of the IDs of entries recorded at t
+func idPrefix(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%016x", t.UnixNano())
+}
+
+// Query selects entries from a Log
+type Query struct {
+	// Key only matches entries about this blob
+	Key string
+	// Tenant only matches entries of this tenant, since the keys of each
+	// tenant are relative to it
+	Tenant string
+	// Since only matches entries recorded at or after this time
+	Since time.Time
+	// Cursor continues a query after the entry with this ID
+	Cursor string
+	// Limit is the most entries returned, up to MaxQueryLimit
+	Limit int
+}
+
+func (q Query) matches(e Entry) bool {
+	if e.ID <= q.Cursor || e.Time.Before(q.Since) || (q.Tenant != "" && e.Tenant != q.Tenant) {
+		return false
+	}
+	if q.Key == "" {
+		return true
+	}
+	for _, key := range e.Keys {
+		if key == q.Key {
+			return true
+		}
+	}
+	return false
+}
+
+func (q Query) limit() int {
+	if q.Limit > 0 && q.Limit < MaxQueryLimit {
+		return q.Limit
+	}
+	return MaxQueryLimit
+}
+
+// Log is an append-only record of entries
+type Log interface {
+	// Append records e
+	Append(e Entry) error
+	// Query returns the entries matching q in the order they were recorded.
+	// hasMore is true if the limit was reached before the end of the log.
+	Query(q Query) (entries []Entry, hasMore bool, err error)
+	// Close releases any resources held by the log
+	Close() error
+}
@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// FileLog appends entries to a file as JSON lines. Queries read the whole
+// file, so rotate it with a tool like logrotate's copytruncate if it grows
+// large.
+type FileLog struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileLog opens or creates a FileLog at path
+func NewFileLog(path string) (*FileLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLog{path: path, file: file}, nil
+}
+
+// Append implements the Log interface
+func (l *FileLog) Append(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+// Query implements the Log interface
+func (l *FileLog) Query(q Query) ([]Entry, bool, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer file.Close()
+
+	limit := q.limit()
+	entries := make([]Entry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		// A line can be cut short if the process died while writing it
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || !q.matches(e) {
+			continue
+		}
+		if len(entries) == limit {
+			return entries, true, nil
+		}
+		entries = append(entries, e)
+	}
+	return entries, false, scanner.Err()
+}
+
+// Close implements the Log interface
+func (l *FileLog) Close() error {
+	return l.file.Close()
+}
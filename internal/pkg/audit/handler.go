@@ -0,0 +1,50 @@
+package audit
+
+import (
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// QueryResponse is the body of a response from QueryHandler
+type QueryResponse struct {
+	Entries    []Entry `json:"entries"`
+	NextCursor string  `json:"next_cursor"`
+	HasMore    bool    `json:"has_more"`
+}
+
+// QueryHandler returns the entries of log, filtered by the key, tenant and
+// since query parameters, e.g. GET /audit?key=avatars/1.jpg&since=2024-01-01T00:00:00Z.
+// Pages after the first are fetched with the cursor parameter.
+func QueryHandler(log Log, logger *slog.Logger) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		q := Query{Key: c.Query("key"), Tenant: c.Query("tenant"), Cursor: c.Query("cursor")}
+		if since := c.Query("since"); since != "" {
+			t, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString("invalid since, expected an RFC 3339 timestamp")
+			}
+			q.Since = t
+		}
+		if limit := c.Query("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil {
+				return c.SendStatus(fiber.StatusBadRequest)
+			}
+			q.Limit = n
+		}
+
+		entries, hasMore, err := log.Query(q)
+		if err != nil {
+			logger.Error("failed to query audit log", "error", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		res := QueryResponse{Entries: entries, HasMore: hasMore}
+		if hasMore {
+			res.NextCursor = entries[len(entries)-1].ID
+		}
+		return c.JSON(res)
+	}
+}
@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"encoding/json"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LevelDBPrefix is the prefix entries are stored under in LevelDB. It sorts
+// before any key that can be uploaded.
+var LevelDBPrefix = []byte("\x00audit:")
+
+// LevelDBLog stores entries under LevelDBPrefix in a LevelDB database shared
+// with the index
+type LevelDBLog struct {
+	db *leveldb.DB
+}
+
+func NewLevelDBLog(db *leveldb.DB) *LevelDBLog {
+	return &LevelDBLog{db: db}
+}
+
+// Append implements the Log interface
+func (l *LevelDBLog) Append(e Entry) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return l.db.Put(append(append([]byte(nil), LevelDBPrefix...), e.ID...), value, nil)
+}
+
+// Query implements the Log interface
+func (l *LevelDBLog) Query(q Query) ([]Entry, bool, error) {
+	// IDs start with the time, so the query can skip to the later of since
+	// and the cursor. The cursor itself is skipped by matches.
+	start := q.Cursor
+	if since := idPrefix(q.Since); since > start {
+		start = since
+	}
+	slice := util.BytesPrefix(LevelDBPrefix)
+	slice.Start = append(append([]byte(nil), LevelDBPrefix...), start...)
+	iter := l.db.NewIterator(slice, nil)
+	defer iter.Release()
+
+	limit := q.limit()
+	entries := make([]Entry, 0)
+	for iter.Next() {
+		var e Entry
+		if err := json.Unmarshal(iter.Value(), &e); err != nil || !q.matches(e) {
+			continue
+		}
+		if len(entries) == limit {
+			return entries, true, nil
+		}
+		entries = append(entries, e)
+	}
+	return entries, false, iter.Error()
+}
+
+// Close implements the Log interface. The database is closed by the index.
+func (l *LevelDBLog) Close() error {
+	return nil
+}
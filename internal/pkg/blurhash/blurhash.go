@@ -0,0 +1,115 @@
+// Package blurhash encodes images as BlurHash strings, compact placeholders
+// that can be rendered before an image loads. See https://blurha.sh.
+package blurhash
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+const characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Encode returns the BlurHash of img with x horizontal and y vertical
+// components, each between 1 and 9. More components keep more detail.
+func Encode(img image.Image, x, y int) (string, error) {
+	if x < 1 || x > 9 || y < 1 || y > 9 {
+		return "", fmt.Errorf("components must be between 1 and 9, got %dx%d", x, y)
+	}
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return "", fmt.Errorf("image is empty")
+	}
+
+	factors := make([][3]float64, 0, x*y)
+	for j := 0; j < y; j++ {
+		for i := 0; i < x; i++ {
+			factors = append(factors, factor(img, i, j))
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encode83((x-1)+(y-1)*9, 1))
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		hash.WriteString(encode83(quantisedMax, 1))
+	} else {
+		hash.WriteString(encode83(0, 1))
+	}
+	hash.WriteString(encode83(encodeDC(dc), 4))
+	for _, f := range ac {
+		hash.WriteString(encode83(encodeAC(f, maxValue), 2))
+	}
+	return hash.String(), nil
+}
+
+// factor returns the weight of the cosine component i, j in each channel
+func factor(img image.Image, i, j int) [3]float64 {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	var r, g, b float64
+	for py := 0; py < h; py++ {
+		for px := 0; px < w; px++ {
+			basis := math.Cos(math.Pi*float64(i)*float64(px)/float64(w)) *
+				math.Cos(math.Pi*float64(j)*float64(py)/float64(h))
+			cr, cg, cb, _ := img.At(bounds.Min.X+px, bounds.Min.Y+py).RGBA()
+			r += basis * srgbToLinear(cr>>8)
+			g += basis * srgbToLinear(cg>>8)
+			b += basis * srgbToLinear(cb>>8)
+		}
+	}
+	normalisation := 2.0
+	if i == 0 && j == 0 {
+		normalisation = 1
+	}
+	scale := normalisation / float64(w*h)
+	return [3]float64{r * scale, g * scale, b * scale}
+}
+
+func encodeDC(f [3]float64) int {
+	return linearToSRGB(f[0])<<16 + linearToSRGB(f[1])<<8 + linearToSRGB(f[2])
+}
+
+func encodeAC(f [3]float64, maxValue float64) int {
+	quant := func(v float64) int {
+		return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+	}
+	return quant(f[0])*19*19 + quant(f[1])*19 + quant(f[2])
+}
+
+func encode83(value, length int) string {
+	var s strings.Builder
+	for i := 1; i <= length; i++ {
+		digit := value / int(math.Pow(83, float64(length-i))) % 83
+		s.WriteByte(characters[digit])
+	}
+	return s.String()
+}
+
+func srgbToLinear(v uint32) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	c := math.Max(0, math.Min(1, v))
+	if c <= 0.0031308 {
+		return int(c*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(c, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,66 @@
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Bunny purges the cache of a BunnyCDN pull zone by cache tag. It implements
+// the Purger interface.
+type Bunny struct {
+	// Endpoint is the bunny.net API the purges are sent to
+	Endpoint   string
+	pullZoneID string
+	accessKey  string
+	client     *http.Client
+}
+
+// NewBunny purges the pull zone pullZoneID with the API key of the account
+func NewBunny(pullZoneID, accessKey string, timeout time.Duration) *Bunny {
+	return &Bunny{
+		Endpoint:   "https://api.bunny.net",
+		pullZoneID: pullZoneID,
+		accessKey:  accessKey,
+		client:     &http.Client{Timeout: timeout},
+	}
+}
+
+// Purge implements Purger interface. The API purges one tag at a time.
+func (b *Bunny) Purge(ctx context.Context, tags []string) error {
+	for _, tag := range tags {
+		body, err := json.Marshal(map[string]string{"CacheTag": tag})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.Endpoint+"/pullzone/"+url.PathEscape(b.pullZoneID)+"/purgeCache", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("AccessKey", b.accessKey)
+		res, err := b.client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+		}
+	}
+	return nil
+}
+
+// MaxTags implements Purger interface
+func (b *Bunny) MaxTags() int {
+	return 1
+}
+
+// TagHeader implements Purger interface
+func (b *Bunny) TagHeader() string {
+	return "CDN-Tag"
+}
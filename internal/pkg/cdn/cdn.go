@@ -0,0 +1,130 @@
+package cdn
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"log/slog"
+	"time"
+)
+
+const (
+	// SurrogateKeyHeader is the response header blobs and the images
+	// processed from them are tagged with
+	SurrogateKeyHeader = "Surrogate-Key"
+	// queueSize is how many purges can wait to be sent before new ones are
+	// dropped
+	queueSize = 1024
+	// maxAttempts is how many times a purge is sent before giving up
+	maxAttempts = 5
+	// backoff is how long to wait before the first retry. It doubles with
+	// every attempt.
+	backoff = time.Second
+)
+
+// Purger invalidates cached responses on a CDN by their tags
+type Purger interface {
+	// Purge invalidates the responses tagged with any of tags
+	Purge(ctx context.Context, tags []string) error
+	// MaxTags is how many tags can be purged in one call
+	MaxTags() int
+	// TagHeader is the response header the CDN reads tags from
+	TagHeader() string
+}
+
+// Tag returns the tag of the responses for the blob at key and the images
+// processed from it. Keys can contain characters that aren't allowed in
+// tags, so it's the hex encoded SHA-1 digest of the key.
+func Tag(key string) string {
+	digest := sha1.Sum([]byte(key))
+	return hex.EncodeToString(digest[:])
+}
+
+// TagHeaders returns the response headers tags are sent in. It's always
+// Surrogate-Key, and the header purger reads them from if that's another.
+func TagHeaders(purger Purger) []string {
+	headers := []string{SurrogateKeyHeader}
+	if purger != nil && purger.TagHeader() != SurrogateKeyHeader {
+		headers = append(headers, purger.TagHeader())
+	}
+	return headers
+}
+
+// Queue purges blobs in the background, so the requests that change them
+// don't wait on the CDN. Purges queued at about the same time are sent
+// together and failures are retried with exponential backoff.
+type Queue struct {
+	purger Purger
+	log    *slog.Logger
+	queue  chan string
+}
+
+// NewQueue creates a queue that purges blobs with purger
+func NewQueue(purger Purger, log *slog.Logger) *Queue {
+	return &Queue{
+		purger: purger,
+		log:    log,
+		queue:  make(chan string, queueSize),
+	}
+}
+
+// Push queues a purge of the blob at key. It never blocks, purges are dropped
+// if the queue is full. A nil Queue drops every purge.
+func (q *Queue) Push(key string) {
+	if q == nil {
+		return
+	}
+	select {
+	case q.queue <- Tag(key):
+	default:
+		q.log.Error("CDN purge queue is full, dropping purge", "key", key)
+	}
+}
+
+// Run sends queued purges until ctx is done. Purges still in the queue when
+// it's done are dropped.
+func (q *Queue) Run(ctx context.Context) {
+	for {
+		var tag string
+		select {
+		case <-ctx.Done():
+			return
+		case tag = <-q.queue:
+		}
+		tags := []string{tag}
+		seen := map[string]bool{tag: true}
+	batch:
+		for len(tags) < q.purger.MaxTags() {
+			select {
+			case tag := <-q.queue:
+				if !seen[tag] {
+					seen[tag] = true
+					tags = append(tags, tag)
+				}
+			default:
+				break batch
+			}
+		}
+		q.purge(ctx, tags)
+	}
+}
+
+func (q *Queue) purge(ctx context.Context, tags []string) {
+	wait := backoff
+	for attempt := 1; ; attempt++ {
+		err := q.purger.Purge(ctx, tags)
+		if err == nil {
+			return
+		}
+		if attempt == maxAttempts {
+			q.log.Error("failed to purge CDN cache", "tags", len(tags), "error", err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
@@ -0,0 +1,78 @@
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Cloudflare purges the cache of a Cloudflare zone by cache tag. Purging by
+// tag needs an Enterprise zone. It implements the Purger interface.
+type Cloudflare struct {
+	// Endpoint is the Cloudflare API the purges are sent to
+	Endpoint string
+	zoneID   string
+	token    string
+	client   *http.Client
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// NewCloudflare purges the zone zoneID with an API token that has the Cache
+// Purge permission
+func NewCloudflare(zoneID, token string, timeout time.Duration) *Cloudflare {
+	return &Cloudflare{
+		Endpoint: "https://api.cloudflare.com/client/v4",
+		zoneID:   zoneID,
+		token:    token,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// Purge implements Purger interface
+func (c *Cloudflare) Purge(ctx context.Context, tags []string) error {
+	body, err := json.Marshal(map[string][]string{"tags": tags})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint+"/zones/"+url.PathEscape(c.zoneID)+"/purge_cache", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// Errors are described in the body, whatever the status code
+	var result cloudflareResponse
+	json.NewDecoder(res.Body).Decode(&result)
+	if res.StatusCode < 200 || res.StatusCode > 299 || !result.Success {
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("unexpected status code: %d: %s", res.StatusCode, result.Errors[0].Message)
+		}
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// MaxTags implements Purger interface
+func (c *Cloudflare) MaxTags() int {
+	return 30
+}
+
+// TagHeader implements Purger interface
+func (c *Cloudflare) TagHeader() string {
+	return "Cache-Tag"
+}
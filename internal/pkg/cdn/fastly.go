@@ -0,0 +1,61 @@
+package cdn
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Fastly purges the cache of a Fastly service by surrogate key. It implements
+// the Purger interface.
+type Fastly struct {
+	// Endpoint is the Fastly API the purges are sent to
+	Endpoint  string
+	serviceID string
+	token     string
+	client    *http.Client
+}
+
+// NewFastly purges the service serviceID with an API token that has the
+// purge_select scope
+func NewFastly(serviceID, token string, timeout time.Duration) *Fastly {
+	return &Fastly{
+		Endpoint:  "https://api.fastly.com",
+		serviceID: serviceID,
+		token:     token,
+		client:    &http.Client{Timeout: timeout},
+	}
+}
+
+// Purge implements Purger interface
+func (f *Fastly) Purge(ctx context.Context, tags []string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.Endpoint+"/service/"+url.PathEscape(f.serviceID)+"/purge", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Fastly-Key", f.token)
+	req.Header.Set(SurrogateKeyHeader, strings.Join(tags, " "))
+	res, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// MaxTags implements Purger interface
+func (f *Fastly) MaxTags() int {
+	return 256
+}
+
+// TagHeader implements Purger interface
+func (f *Fastly) TagHeader() string {
+	return SurrogateKeyHeader
+}
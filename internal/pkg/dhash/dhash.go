@@ -0,0 +1,83 @@
+// Package dhash computes difference hashes of images, perceptual hashes that
+// stay the same when an image is resized, recompressed or slightly edited, so
+// near-duplicates can be found by comparing them
+package dhash
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"strconv"
+)
+
+const (
+	// width and height of the grid an image is reduced to. Each row compares
+	// width-1 neighbours, so a hash has 64 bits.
+	width  = 9
+	height = 8
+)
+
+// Hash returns the difference hash of img: one bit per pair of neighbouring
+// cells of a grid of its brightness, set when the left cell is brighter
+func Hash(img image.Image) (uint64, error) {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return 0, fmt.Errorf("image is empty")
+	}
+	var grid [height][width]float64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			grid[y][x] = brightness(img, bounds, x, y)
+		}
+	}
+	var hash uint64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width-1; x++ {
+			hash <<= 1
+			if grid[y][x] > grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// brightness returns the average luma of the pixels in a cell of the grid
+func brightness(img image.Image, bounds image.Rectangle, x, y int) float64 {
+	x0 := bounds.Min.X + x*bounds.Dx()/width
+	x1 := max(bounds.Min.X+(x+1)*bounds.Dx()/width, x0+1)
+	y0 := bounds.Min.Y + y*bounds.Dy()/height
+	y1 := max(bounds.Min.Y+(y+1)*bounds.Dy()/height, y0+1)
+	var sum float64
+	n := 0
+	for py := y0; py < y1 && py < bounds.Max.Y; py++ {
+		for px := x0; px < x1 && px < bounds.Max.X; px++ {
+			r, g, b, _ := img.At(px, py).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+// Distance returns the number of bits two hashes differ by, from 0 for
+// images that look the same to 64
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Format encodes a hash as 16 hex digits
+func Format(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// Parse decodes a hash encoded by Format
+func Parse(s string) (uint64, error) {
+	if len(s) != 16 {
+		return 0, fmt.Errorf("invalid hash %q", s)
+	}
+	return strconv.ParseUint(s, 16, 64)
+}
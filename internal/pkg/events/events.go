@@ -0,0 +1,135 @@
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+const (
+	// queueSize is how many events can wait to be published before new ones
+	// are dropped
+	queueSize = 1024
+	// workers is how many events are published at once
+	workers = 4
+	// maxAttempts is how many times an event is published before giving up
+	maxAttempts = 5
+	// backoff is how long to wait before the first retry. It doubles with
+	// every attempt.
+	backoff = time.Second
+)
+
+// Event is something that happened to a blob or an image
+type Event struct {
+	// ID is unique to the event, so consumers can ignore ones they've
+	// already handled
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	// Object is what the event is about
+	Object any `json:"object"`
+}
+
+// New creates an event of eventType about object
+func New(eventType string, object any) Event {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return Event{
+		ID:        "evt_" + hex.EncodeToString(id),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Object:    object,
+	}
+}
+
+// Publisher pushes events to a message broker like NATS or Kafka
+type Publisher interface {
+	// Publish sends data to topic. Key identifies what the event is about,
+	// so brokers that partition topics can keep its events in order.
+	Publish(ctx context.Context, topic, key string, data []byte) error
+	Close() error
+}
+
+// Queue publishes events in the background, so the requests that cause them
+// don't wait on the broker. Failures are retried with exponential backoff.
+type Queue struct {
+	publisher Publisher
+	prefix    string
+	log       *slog.Logger
+	queue     chan queued
+}
+
+type queued struct {
+	event Event
+	key   string
+}
+
+// NewQueue creates a queue that publishes each event to the topic named
+// prefix followed by its type, e.g. image-service.blob.created
+func NewQueue(publisher Publisher, prefix string, log *slog.Logger) *Queue {
+	return &Queue{
+		publisher: publisher,
+		prefix:    prefix,
+		log:       log,
+		queue:     make(chan queued, queueSize),
+	}
+}
+
+// Push queues an event about key. It never blocks, events are dropped if the
+// queue is full. A nil Queue drops every event.
+func (q *Queue) Push(event Event, key string) {
+	if q == nil {
+		return
+	}
+	select {
+	case q.queue <- queued{event: event, key: key}:
+	default:
+		q.log.Error("event queue is full, dropping event", "type", event.Type, "key", key)
+	}
+}
+
+// Run publishes queued events until ctx is done. Events still in the queue
+// when it's done are dropped.
+func (q *Queue) Run(ctx context.Context) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case e := <-q.queue:
+					q.publish(ctx, e)
+				}
+			}
+		}()
+	}
+	<-ctx.Done()
+}
+
+func (q *Queue) publish(ctx context.Context, e queued) {
+	data, err := json.Marshal(e.event)
+	if err != nil {
+		q.log.Error("failed to encode event", "error", err)
+		return
+	}
+	wait := backoff
+	for attempt := 1; ; attempt++ {
+		err := q.publisher.Publish(ctx, q.prefix+e.event.Type, e.key, data)
+		if err == nil {
+			return
+		}
+		if attempt == maxAttempts {
+			q.log.Error("failed to publish event", "type", e.event.Type, "id", e.event.ID, "error", err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
@@ -0,0 +1,87 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// checkTimeout is how long each check can take before it's failed
+const checkTimeout = 5 * time.Second
+
+// Check probes a dependency of the service. It returns an error if the
+// dependency isn't working.
+type Check func(ctx context.Context) error
+
+// Status is the result of a check
+type Status struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Response is the body of a response from ReadyHandler
+type Response struct {
+	Status     string            `json:"status"`
+	Components map[string]Status `json:"components,omitempty"`
+}
+
+// Checker reports whether the service is ready to handle requests
+type Checker struct {
+	checks   map[string]Check
+	draining atomic.Bool
+}
+
+// New creates a Checker that runs checks to find out if the service is ready
+func New(checks map[string]Check) *Checker {
+	return &Checker{checks: checks}
+}
+
+// Drain makes the service stop being ready for good, so load balancers stop
+// sending it requests before it shuts down
+func (h *Checker) Drain() {
+	h.draining.Store(true)
+}
+
+// ReadyHandler runs every check at once and responds with the status of each
+// one. The response is 503 Service Unavailable if any of them failed, or if
+// the service is draining.
+func (h *Checker) ReadyHandler(c fiber.Ctx) error {
+	if h.draining.Load() {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(Response{Status: "draining"})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	res := Response{Status: "ok", Components: make(map[string]Status, len(h.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range h.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := check(ctx)
+			status := Status{Status: "ok", Duration: time.Since(start).String()}
+			if err != nil {
+				status.Status = "error"
+				status.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			res.Components[name] = status
+			if err != nil {
+				res.Status = "error"
+			}
+		}()
+	}
+	wg.Wait()
+
+	if res.Status != "ok" {
+		c.Status(fiber.StatusServiceUnavailable)
+	}
+	return c.JSON(res)
+}
@@ -0,0 +1,136 @@
+package http3
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+)
+
+type Config struct {
+	// Addr is the UDP address the server listens on
+	Addr string
+	// GetCertificate returns the TLS certificate of the server
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	App            *fiber.App
+	Logger         *slog.Logger
+}
+
+// NewAltSvc is a middleware that tells clients of TLS requests they can
+// switch to HTTP/3 on port
+func NewAltSvc(port int) func(c fiber.Ctx) error {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=86400`, port)
+	return func(c fiber.Ctx) error {
+		if c.Context().IsTLS() {
+			c.Set(fiber.HeaderAltSvc, altSvc)
+		}
+		return c.Next()
+	}
+}
+
+// hopHeaders are the response headers of HTTP/1.1 connections, which
+// HTTP/3 doesn't allow
+var hopHeaders = map[string]bool{
+	fiber.HeaderConnection:       true,
+	fiber.HeaderTransferEncoding: true,
+	fiber.HeaderKeepAlive:        true,
+	fiber.HeaderUpgrade:          true,
+}
+
+// Handler serves app's routes to HTTP/3 requests. Unlike adaptor.FiberApp,
+// request and response bodies are streamed, so uploads aren't buffered in
+// memory and /events works.
+func Handler(app *fiber.App, log *slog.Logger) http.Handler {
+	handler := app.Handler()
+	logger := printfLogger{log}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+		req.Header.SetMethod(r.Method)
+		req.SetRequestURI(r.RequestURI)
+		req.Header.SetHost(r.Host)
+		for key, values := range r.Header {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+
+		conn := streamConn{remoteAddr: &net.TCPAddr{}}
+		if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			conn.remoteAddr = net.TCPAddrFromAddrPort(addr)
+		}
+		var ctx fasthttp.RequestCtx
+		ctx.Init2(conn, logger, true)
+		req.CopyTo(&ctx.Request)
+		if r.Body != nil && r.Body != http.NoBody {
+			// The stream has to be set on the copy of the request
+			ctx.Request.SetBodyStream(r.Body, int(r.ContentLength))
+		}
+		handler(&ctx)
+		defer ctx.Response.CloseBodyStream() //nolint:errcheck
+
+		ctx.Response.Header.VisitAll(func(key, value []byte) {
+			if k := string(key); !hopHeaders[k] {
+				w.Header().Add(k, string(value))
+			}
+		})
+		w.WriteHeader(ctx.Response.StatusCode())
+		if r.Method == fiber.MethodHead {
+			return
+		}
+		if !ctx.Response.IsBodyStream() {
+			w.Write(ctx.Response.Body()) //nolint:errcheck
+			return
+		}
+		// Streams like /events are flushed as they're written
+		flusher, _ := w.(http.Flusher)
+		ctx.Response.BodyWriteTo(flushWriter{w, flusher}) //nolint:errcheck
+	})
+}
+
+// streamConn is the connection handlers see for an HTTP/3 request. The QUIC
+// stream has its own timeouts, so handlers that extend the write deadline of
+// their connection, like /events, don't need to.
+type streamConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c streamConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c streamConn) LocalAddr() net.Addr { return &net.TCPAddr{} }
+
+func (streamConn) SetDeadline(time.Time) error { return nil }
+
+func (streamConn) SetReadDeadline(time.Time) error { return nil }
+
+func (streamConn) SetWriteDeadline(time.Time) error { return nil }
+
+// printfLogger logs the errors of fasthttp
+type printfLogger struct {
+	log *slog.Logger
+}
+
+func (l printfLogger) Printf(format string, args ...any) {
+	l.log.Error(fmt.Sprintf(format, args...))
+}
+
+type flushWriter struct {
+	io.Writer
+	flusher http.Flusher
+}
+
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err == nil && w.flusher != nil {
+		w.flusher.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,49 @@
+//go:build http3
+
+package http3
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Supported is true when the service is built with the http3 tag
+const Supported = true
+
+// Server serves a Fiber app over HTTP/3
+type Server struct {
+	server *http3.Server
+	cfg    Config
+}
+
+func New(cfg Config) (*Server, error) {
+	if cfg.GetCertificate == nil {
+		return nil, errors.New("HTTP/3 needs a TLS certificate")
+	}
+	return &Server{
+		server: &http3.Server{
+			Addr:      cfg.Addr,
+			Handler:   Handler(cfg.App, cfg.Logger),
+			TLSConfig: http3.ConfigureTLSConfig(&tls.Config{GetCertificate: cfg.GetCertificate}),
+		},
+		cfg: cfg,
+	}, nil
+}
+
+// Serve accepts requests until Close is called
+func (s *Server) Serve() error {
+	s.cfg.Logger.Info("starting HTTP/3 server", "address", s.cfg.Addr)
+	err := s.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close closes the server's connections
+func (s *Server) Close() error {
+	return s.server.Close()
+}
@@ -0,0 +1,25 @@
+//go:build !http3
+
+package http3
+
+import "errors"
+
+// Supported is true when the service is built with the http3 tag
+const Supported = false
+
+// Server serves a Fiber app over HTTP/3
+type Server struct{}
+
+func New(Config) (*Server, error) {
+	return nil, errors.New("HTTP/3 isn't supported by this build, build it with -tags http3")
+}
+
+// Serve accepts requests until Close is called
+func (s *Server) Serve() error {
+	return nil
+}
+
+// Close closes the server's connections
+func (s *Server) Close() error {
+	return nil
+}
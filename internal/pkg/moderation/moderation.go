@@ -0,0 +1,65 @@
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Verdict is what a classifier decided about an image
+type Verdict struct {
+	// Flagged is true if the image shouldn't be served as is
+	Flagged bool
+	// Labels are why it was flagged, e.g. nsfw or violence
+	Labels []string
+}
+
+// Classifier decides whether images are acceptable, e.g. whether they're
+// NSFW
+type Classifier interface {
+	// Classify reads the image in r to the end and returns the verdict on it
+	Classify(ctx context.Context, r io.Reader, contentType string) (Verdict, error)
+}
+
+// HTTP classifies images with an external service. Images are POSTed to it
+// as the body of the request, and it responds with a JSON object like
+// {"flagged":true,"labels":["nsfw"]}. It implements the Classifier interface.
+type HTTP struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTP classifies images with the service at url
+func NewHTTP(url string, timeout time.Duration) *HTTP {
+	return &HTTP{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+type httpVerdict struct {
+	Flagged bool     `json:"flagged"`
+	Labels  []string `json:"labels"`
+}
+
+// Classify implements Classifier interface
+func (h *HTTP) Classify(ctx context.Context, r io.Reader, contentType string) (Verdict, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, r)
+	if err != nil {
+		return Verdict{}, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	res, err := h.client.Do(req)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return Verdict{}, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	var verdict httpVerdict
+	if err := json.NewDecoder(res.Body).Decode(&verdict); err != nil {
+		return Verdict{}, fmt.Errorf("invalid verdict: %w", err)
+	}
+	return Verdict{Flagged: verdict.Flagged, Labels: verdict.Labels}, nil
+}
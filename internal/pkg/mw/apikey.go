@@ -1,45 +1,227 @@
 package mw
 
 import (
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
-	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofiber/fiber/v3"
-	"github.com/jaredLunde/railway-image-service/client/sign"
 )
 
-func NewVerifyAPIKey(secretKey string) func(c fiber.Ctx) error {
+// Scope is a set of things an API key is allowed to do
+type Scope uint8
+
+const (
+	// ScopeRead allows getting and listing blobs and processing images
+	ScopeRead Scope = 1 << iota
+	// ScopeWrite allows uploading, copying, restoring and updating blobs
+	ScopeWrite
+	// ScopeDelete allows deleting blobs
+	ScopeDelete
+	// ScopeSign allows creating signed URLs. A signed URL grants access to
+	// its path regardless of the scopes of the key that signed it.
+	ScopeSign
+	// ScopeAdmin allows everything
+	ScopeAdmin
+)
+
+var scopeNames = map[string]Scope{
+	"read":   ScopeRead,
+	"write":  ScopeWrite,
+	"delete": ScopeDelete,
+	"sign":   ScopeSign,
+	"admin":  ScopeAdmin,
+}
+
+// ParseScopes parses a +-separated list of scopes, e.g. read+sign
+func ParseScopes(s string) (Scope, error) {
+	var scopes Scope
+	for _, name := range strings.Split(s, "+") {
+		scope, ok := scopeNames[strings.TrimSpace(name)]
+		if !ok {
+			return 0, fmt.Errorf("invalid scope %q, expected read, write, delete, sign or admin", name)
+		}
+		scopes |= scope
+	}
+	return scopes, nil
+}
+
+// Has returns true if s includes every scope in scope
+func (s Scope) Has(scope Scope) bool {
+	return s&ScopeAdmin != 0 || s&scope == scope
+}
+
+// APIKey is a key that can be sent in the x-api-key header
+type APIKey struct {
+	Key string
+	// Tenant is the tenant the key belongs to. Requests made with it only
+	// reach the tenant's keys. Keys without a tenant reach every key.
+	Tenant string
+	Scopes Scope
+	// ExpiresAt is when the key stops being accepted, so a key that's being
+	// rotated out keeps working until clients have switched to the new one.
+	// Keys with a zero ExpiresAt never expire.
+	ExpiresAt time.Time
+}
+
+// Expired returns true if the key is no longer accepted
+func (k APIKey) Expired() bool {
+	return !k.ExpiresAt.IsZero() && time.Now().After(k.ExpiresAt)
+}
+
+// ID identifies the key without revealing it. It's the first 16 hex digits
+// of the key's SHA-256 digest, prefixed with key_.
+func (k APIKey) ID() string {
+	sum := sha256.Sum256([]byte(k.Key))
+	return "key_" + hex.EncodeToString(sum[:8])
+}
+
+// APIKeys are all of the keys that can access the service
+type APIKeys []APIKey
+
+// ParseAPIKeys parses a comma-separated list of apikey:scopes or
+// apikey:scopes:expires_at keys, e.g.
+// sk_reader:read,sk_uploader:read+write:2025-01-01T00:00:00Z. The expiry is
+// an RFC 3339 timestamp.
+func ParseAPIKeys(s string) (APIKeys, error) {
+	var keys APIKeys
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 3)
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid API key #%d, expected apikey:scopes", len(keys)+1)
+		}
+		scope, err := ParseScopes(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid API key #%d: %w", len(keys)+1, err)
+		}
+		var expiresAt time.Time
+		if len(parts) == 3 {
+			if expiresAt, err = time.Parse(time.RFC3339, parts[2]); err != nil {
+				return nil, fmt.Errorf("invalid API key #%d expiry: %w", len(keys)+1, err)
+			}
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("duplicate API key #%d", len(keys)+1)
+		}
+		seen[parts[0]] = true
+		keys = append(keys, APIKey{Key: parts[0], Scopes: scope, ExpiresAt: expiresAt})
+	}
+	return keys, nil
+}
+
+// Find returns the API key matching key, unless it has expired
+func (keys APIKeys) Find(key string) (APIKey, bool) {
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 && !k.Expired() {
+			return k, true
+		}
+	}
+	return APIKey{}, false
+}
+
+// HasTenant returns true if one of the keys belongs to the tenant
+func (keys APIKeys) HasTenant(name string) bool {
+	for _, k := range keys {
+		if k.Tenant != "" && k.Tenant == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys finds the API keys requests are made with. It's implemented by
+// APIKeys and KeyRing.
+type Keys interface {
+	Find(key string) (APIKey, bool)
+	HasTenant(name string) bool
+}
+
+// KeyRing holds the API keys of the service, so they can be replaced while
+// it's running
+type KeyRing struct {
+	keys atomic.Pointer[APIKeys]
+}
+
+func NewKeyRing(keys APIKeys) *KeyRing {
+	r := &KeyRing{}
+	r.Store(keys)
+	return r
+}
+
+// Store replaces the keys. Requests that were already authorized aren't
+// affected.
+func (r *KeyRing) Store(keys APIKeys) {
+	r.keys.Store(&keys)
+}
+
+// Find implements Keys interface
+func (r *KeyRing) Find(key string) (APIKey, bool) {
+	return r.keys.Load().Find(key)
+}
+
+// HasTenant implements Keys interface
+func (r *KeyRing) HasTenant(name string) bool {
+	return r.keys.Load().HasTenant(name)
+}
+
+func NewVerifyAPIKey(keys Keys, scope Scope) func(c fiber.Ctx) error {
 	return func(c fiber.Ctx) error {
-		apiKey := c.Get("x-api-key")
-		if subtle.ConstantTimeCompare([]byte(apiKey), []byte(secretKey)) != 1 {
+		apiKey, ok := keys.Find(c.Get("x-api-key"))
+		if !ok {
 			return c.Status(fiber.StatusUnauthorized).SendString("unauthorized")
 		}
+		c.Locals(CredentialKey, apiKey.ID())
+		if !apiKey.Scopes.Has(scope) {
+			return c.Status(fiber.StatusForbidden).SendString("forbidden")
+		}
+		if apiKey.Tenant != "" {
+			c.Locals(TenantKey, apiKey.Tenant)
+		}
+		return c.Next()
+	}
+}
+
+// NewTrustInternal authorizes every request, for listeners that are only
+// reachable on a private network
+func NewTrustInternal() func(c fiber.Ctx) error {
+	return func(c fiber.Ctx) error {
+		c.Locals(CredentialKey, CredentialInternal)
 		return c.Next()
 	}
 }
 
-func NewVerifyAccess(secretKey, signSecret string) func(c fiber.Ctx) error {
+func NewVerifyAccess(verifier *SignatureVerifier, scope Scope) func(c fiber.Ctx) error {
 	return func(c fiber.Ctx) error {
-		apiKey := c.Get("x-api-key")
-		hasValidAPIKey := subtle.ConstantTimeCompare([]byte(apiKey), []byte(secretKey)) == 1
-		signature := c.Query("x-signature")
-		expireAt := c.Query("x-expire")
-		hasValidSignature := signSecret == ""
-		if signature != "" && expireAt != "" {
-			expireAtMillis, err := strconv.ParseInt(expireAt, 10, 64)
-			if err != nil {
-				return c.Status(fiber.StatusBadRequest).SendString("invalid expire time")
+		if apiKey, ok := verifier.Keys.Find(c.Get("x-api-key")); ok {
+			c.Locals(CredentialKey, apiKey.ID())
+			if !apiKey.Scopes.Has(scope) {
+				return c.Status(fiber.StatusForbidden).SendString("forbidden")
 			}
-			if time.Now().UnixMilli() > expireAtMillis {
-				return c.Status(fiber.StatusUnauthorized).SendString("signature expired")
+			if apiKey.Tenant != "" {
+				c.Locals(TenantKey, apiKey.Tenant)
 			}
-			signatureB := sign.Sign(fmt.Sprintf("%s:%s", c.Path(), expireAt), signSecret)
-			hasValidSignature = subtle.ConstantTimeCompare([]byte(signature), []byte(signatureB)) == 1
+			return c.Next()
 		}
-		if !hasValidAPIKey && !hasValidSignature {
-			return c.Status(fiber.StatusUnauthorized).SendString("unauthorized")
+
+		// Signatures of /blob URLs always expire
+		tenant, err := verifier.Verify(c.Path(), GetRealIP(c), func(key string) string {
+			return c.Query(key)
+		}, true)
+		if err != nil {
+			return c.Status(err.Status).SendString(err.Message)
+		}
+		c.Locals(CredentialKey, CredentialSignature)
+		if tenant != "" {
+			c.Locals(TenantKey, tenant)
 		}
 		return c.Next()
 	}
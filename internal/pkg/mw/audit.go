@@ -0,0 +1,73 @@
+package mw
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/audit"
+)
+
+// NewAudit is a middleware that records every authenticated request that
+// changes blobs in log, whether it succeeded or not. It has to come after
+// RealIP, Logger and the request ID middleware.
+func NewAudit(log audit.Log) func(fiber.Ctx) error {
+	return func(c fiber.Ctx) error {
+		switch c.Method() {
+		case fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete:
+		default:
+			return c.Next()
+		}
+
+		err := c.Next()
+		credential, _ := c.Locals(CredentialKey).(string)
+		// Requests rejected before they were authenticated aren't recorded
+		if credential == "" {
+			return err
+		}
+		status := responseStatus(c, err)
+		keys, ok := c.Locals(AuditKeysKey).([]string)
+		if !ok && c.Params("*") != "" {
+			keys = []string{c.Params("*")}
+		}
+		now := time.Now()
+		entry := audit.Entry{
+			ID:         audit.NewID(now),
+			Time:       now,
+			Credential: credential,
+			Tenant:     GetTenant(c),
+			IP:         GetRealIP(c),
+			Method:     c.Method(),
+			Route:      matchedRoute(c, status),
+			Path:       c.Path(),
+			Keys:       keys,
+			Status:     status,
+			RequestID:  c.GetRespHeader(fiber.HeaderXRequestID),
+		}
+		if err := log.Append(entry); err != nil {
+			GetLogger(c).Error("failed to append to audit log", "error", err)
+		}
+		return err
+	}
+}
+
+// SetAuditKeys sets the blobs a request is about, for requests whose keys
+// aren't in their path
+func SetAuditKeys(c fiber.Ctx, keys ...string) {
+	c.Locals(AuditKeysKey, keys)
+}
+
+// Credentials of requests that weren't made with an API key
+const (
+	CredentialSignature = "signature"
+	CredentialPolicy    = "policy"
+	CredentialInternal  = "internal"
+)
+
+const (
+	// CredentialKey is the key used to store what authenticated the request
+	// in the context
+	CredentialKey = "credential"
+	// AuditKeysKey is the key used to store the blobs a request is about in
+	// the context
+	AuditKeysKey = "audit_keys"
+)
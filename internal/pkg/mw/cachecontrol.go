@@ -0,0 +1,81 @@
+package mw
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// CacheControlRule sets the Cache-Control header of the responses to the
+// paths that match a pattern
+type CacheControlRule struct {
+	// Pattern is the path the rule applies to. A * matches any characters,
+	// including slashes.
+	Pattern string
+	// Value is the Cache-Control header, e.g. public, max-age=31536000
+	Value   string
+	pattern *regexp.Regexp
+}
+
+// CacheControlRules are tried in order, the first rule that matches a path
+// applies
+type CacheControlRules []CacheControlRule
+
+// ParseCacheControlRules parses a semicolon-separated list of pattern=value
+// rules, e.g. /serve/preset/thumb/*=public, max-age=31536000, immutable;/blob/*=no-store
+func ParseCacheControlRules(s string) (CacheControlRules, error) {
+	var rules CacheControlRules
+	for _, rule := range strings.Split(s, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		pattern, value, ok := strings.Cut(rule, "=")
+		pattern, value = strings.TrimSpace(pattern), strings.TrimSpace(value)
+		if !ok || !strings.HasPrefix(pattern, "/") || value == "" {
+			return nil, fmt.Errorf("invalid cache control rule %q, expected /path/*=value", rule)
+		}
+		parts := strings.Split(pattern, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		rules = append(rules, CacheControlRule{
+			Pattern: pattern,
+			Value:   value,
+			pattern: regexp.MustCompile("^" + strings.Join(parts, ".*") + "$"),
+		})
+	}
+	return rules, nil
+}
+
+// Match returns the Cache-Control header of the first rule that matches path
+func (r CacheControlRules) Match(path string) (string, bool) {
+	for _, rule := range r {
+		if rule.pattern.MatchString(path) {
+			return rule.Value, true
+		}
+	}
+	return "", false
+}
+
+// NewCacheControl is a middleware that replaces the Cache-Control header of
+// responses with the one of the first rule that matches their path. Error
+// responses keep theirs, so a failure isn't cached like the file would be.
+// The rules can be replaced while the server is running.
+func NewCacheControl(rules *atomic.Pointer[CacheControlRules]) func(fiber.Ctx) error {
+	return func(c fiber.Ctx) error {
+		if err := c.Next(); err != nil {
+			return err
+		}
+		if c.Response().StatusCode() >= fiber.StatusBadRequest {
+			return nil
+		}
+		if value, ok := rules.Load().Match(c.Path()); ok {
+			c.Set(fiber.HeaderCacheControl, value)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,68 @@
+package mw
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// IPNetworks is a list of networks client IPs are matched against
+type IPNetworks []*net.IPNet
+
+// ParseIPNetworks parses a comma-separated list of IP addresses and CIDRs,
+// e.g. 10.0.0.0/8,203.0.113.7
+func ParseIPNetworks(s string) (IPNetworks, error) {
+	var networks IPNetworks
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", v)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Contains returns true if ip is in one of the networks
+func (n IPNetworks) Contains(ip net.IP) bool {
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewIPFilter is a middleware that rejects requests from client IPs in
+// blocked, or outside of allowed unless it's empty, with 403 Forbidden. It
+// has to come after RealIP. Health checks are always let through.
+func NewIPFilter(allowed, blocked IPNetworks) func(fiber.Ctx) error {
+	return func(c fiber.Ctx) error {
+		if isHealthCheck(c) {
+			return c.Next()
+		}
+		ip := net.ParseIP(GetRealIP(c))
+		if ip == nil || blocked.Contains(ip) || (len(allowed) > 0 && !allowed.Contains(ip)) {
+			return c.Status(fiber.StatusForbidden).SendString("forbidden")
+		}
+		return c.Next()
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/tracing"
 )
 
 func NewLogger(logger *slog.Logger, level ...slog.Level) func(fiber.Ctx) error {
@@ -15,7 +16,7 @@ func NewLogger(logger *slog.Logger, level ...slog.Level) func(fiber.Ctx) error {
 	}
 
 	return func(c fiber.Ctx) error {
-		if c.Path() == HealthCheckEndpoint {
+		if isHealthCheck(c) {
 			return c.Next()
 		}
 
@@ -24,12 +25,16 @@ func NewLogger(logger *slog.Logger, level ...slog.Level) func(fiber.Ctx) error {
 			return err
 		}
 
-		logger.Log(c.Context(), logLevel,
-			fmt.Sprintf("%s %s", c.Method(), c.Path()),
+		attrs := []any{
 			"status", c.Response().StatusCode(),
 			"ip", GetRealIP(c),
 			"duration", time.Since(c.Context().Time()).String(),
-		)
+		}
+		// Lets slow requests in the log be found in the tracing backend
+		if span, ok := c.Locals(tracing.SpanKey).(*tracing.Span); ok && span != nil {
+			attrs = append(attrs, "trace_id", span.TraceID())
+		}
+		logger.Log(c.Context(), logLevel, fmt.Sprintf("%s %s", c.Method(), c.Path()), attrs...)
 
 		return nil
 	}
@@ -0,0 +1,57 @@
+package mw
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/metrics"
+)
+
+// NewMetrics is a middleware that counts requests and how long they take by
+// method, route and status. Routes are the paths they're registered with,
+// e.g. /blob/*, so keys don't end up in labels.
+func NewMetrics(registry *metrics.Registry) func(fiber.Ctx) error {
+	requests := registry.NewCounter("http_requests_total", "The number of HTTP requests served", "method", "route", "status")
+	durations := registry.NewHistogram("http_request_duration_seconds", "How long HTTP requests take to serve", metrics.DurationBuckets, "method", "route")
+
+	return func(c fiber.Ctx) error {
+		if isHealthCheck(c) {
+			return c.Next()
+		}
+
+		err := c.Next()
+		status := responseStatus(c, err)
+		route := matchedRoute(c, status)
+		requests.Inc(c.Method(), route, strconv.Itoa(status))
+		durations.Observe(time.Since(c.Context().Time()).Seconds(), c.Method(), route)
+		return err
+	}
+}
+
+// responseStatus returns the status of the response to a request once the
+// handlers after a middleware have returned err
+func responseStatus(c fiber.Ctx, err error) int {
+	if err == nil {
+		return c.Response().StatusCode()
+	}
+	// The error handler sets the status after the middleware returns
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return fiberErr.Code
+	}
+	return fiber.StatusInternalServerError
+}
+
+// matchedRoute returns the path of the route that handled a request, or an
+// empty string if none did
+func matchedRoute(c fiber.Ctx, status int) string {
+	route := c.Route().Path
+	if status == fiber.StatusNotFound && route == "/" {
+		// Requests that didn't match a route are left with the route of the
+		// middleware
+		return ""
+	}
+	return route
+}
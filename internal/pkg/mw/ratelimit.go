@@ -0,0 +1,231 @@
+package mw
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// RateLimit is a token bucket that refills at Rate requests a second and
+// holds at most Burst of them
+type RateLimit struct {
+	// Rate is how many requests a second are allowed on average. Zero means
+	// unlimited.
+	Rate float64
+	// Burst is how many requests can be made at once. It defaults to Rate
+	// rounded up.
+	Burst int
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// RateLimitStore keeps the buckets and upload counts of a RateLimiter, so
+// replicas can share them. The limits it's passed always have a Burst.
+type RateLimitStore interface {
+	// Take removes a token from the bucket of id. If it's empty, it returns
+	// how long until there is one.
+	Take(ctx context.Context, id string, limit RateLimit) (time.Duration, error)
+	// AcquireUpload counts an upload by id, unless it already has max
+	// uploads in progress
+	AcquireUpload(ctx context.Context, id string, max int) (bool, error)
+	// ReleaseUpload stops counting an upload acquired by id
+	ReleaseUpload(ctx context.Context, id string) error
+}
+
+// RateLimiterConfig configures the limits of a RateLimiter
+type RateLimiterConfig struct {
+	// Keys are used to tell requests made with an API key apart. Requests
+	// without a valid key are limited by their client IP.
+	Keys Keys
+	// IP limits the requests of each client IP
+	IP RateLimit
+	// APIKey limits the requests made with each API key
+	APIKey RateLimit
+	// Uploads is how many uploads each API key or client IP can make at
+	// once. Zero means unlimited.
+	Uploads int
+	// Store keeps the state of the limits. It's kept in memory by default,
+	// so each replica enforces its own limits.
+	Store RateLimitStore
+}
+
+// RateLimiter limits how fast each API key and client IP can make requests,
+// and how many uploads they can make at once. Requests over a limit are
+// rejected with 429 Too Many Requests and a Retry-After header. If the store
+// fails, requests are let through rather than failing with it.
+type RateLimiter struct {
+	cfg atomic.Pointer[RateLimiterConfig]
+}
+
+func NewRateLimiter(cfg RateLimiterConfig) *RateLimiter {
+	cfg.IP.Burst = int(cfg.IP.burst())
+	cfg.APIKey.Burst = int(cfg.APIKey.burst())
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryRateLimitStore()
+	}
+	l := &RateLimiter{}
+	l.cfg.Store(&cfg)
+	return l
+}
+
+// SetLimits replaces the limits of the rate limiter. The state of the limits
+// is kept, so clients don't get a full bucket and uploads in progress are
+// still counted.
+func (l *RateLimiter) SetLimits(ip, apiKey RateLimit, uploads int) {
+	cfg := *l.cfg.Load()
+	cfg.IP = RateLimit{Rate: ip.Rate, Burst: int(ip.burst())}
+	cfg.APIKey = RateLimit{Rate: apiKey.Rate, Burst: int(apiKey.burst())}
+	cfg.Uploads = uploads
+	l.cfg.Store(&cfg)
+}
+
+// Limit is a middleware that limits the rate of requests
+func (l *RateLimiter) Limit(c fiber.Ctx) error {
+	cfg := l.cfg.Load()
+	id, limit := cfg.identify(c)
+	if limit.Rate <= 0 {
+		return c.Next()
+	}
+	wait, err := cfg.Store.Take(c.Context(), id, limit)
+	if err != nil {
+		GetLogger(c).Error("failed to check rate limit", "error", err)
+	} else if wait > 0 {
+		return tooManyRequests(c, wait)
+	}
+	return c.Next()
+}
+
+// LimitUploads is a middleware that limits how many uploads can be made at
+// once
+func (l *RateLimiter) LimitUploads(c fiber.Ctx) error {
+	cfg := l.cfg.Load()
+	if cfg.Uploads <= 0 {
+		return c.Next()
+	}
+	id, _ := cfg.identify(c)
+	ok, err := cfg.Store.AcquireUpload(c.Context(), id, cfg.Uploads)
+	if err != nil {
+		GetLogger(c).Error("failed to check upload limit", "error", err)
+		return c.Next()
+	}
+	if !ok {
+		return tooManyRequests(c, time.Second)
+	}
+	defer func() {
+		// Release the upload even if the server is shutting down
+		if err := cfg.Store.ReleaseUpload(context.Background(), id); err != nil {
+			GetLogger(c).Error("failed to release upload limit", "error", err)
+		}
+	}()
+	return c.Next()
+}
+
+// identify returns who a request is limited as and the rate limit that
+// applies to them
+func (cfg *RateLimiterConfig) identify(c fiber.Ctx) (string, RateLimit) {
+	if apiKey, ok := cfg.Keys.Find(c.Get("x-api-key")); ok {
+		return "key:" + apiKey.Key, cfg.APIKey
+	}
+	return "ip:" + GetRealIP(c), cfg.IP
+}
+
+func tooManyRequests(c fiber.Ctx, wait time.Duration) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return c.Status(fiber.StatusTooManyRequests).SendString("too many requests")
+}
+
+// MemoryRateLimitStore keeps rate limits in memory. It implements the
+// RateLimitStore interface.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	uploads   map[string]int
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will have refilled
+	full time.Time
+}
+
+// rateLimitSweepInterval is how often full buckets are forgotten
+const rateLimitSweepInterval = time.Minute
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets:   map[string]*bucket{},
+		uploads:   map[string]int{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Take implements RateLimitStore interface
+func (s *MemoryRateLimitStore) Take(ctx context.Context, id string, limit RateLimit) (time.Duration, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) >= rateLimitSweepInterval {
+		s.sweep(now)
+	}
+
+	burst := float64(limit.Burst)
+	b, ok := s.buckets[id]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		s.buckets[id] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	} else {
+		b.tokens--
+	}
+	b.full = now.Add(time.Duration((burst - b.tokens) / limit.Rate * float64(time.Second)))
+	return wait, nil
+}
+
+// AcquireUpload implements RateLimitStore interface
+func (s *MemoryRateLimitStore) AcquireUpload(ctx context.Context, id string, max int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.uploads[id] >= max {
+		return false, nil
+	}
+	s.uploads[id]++
+	return true, nil
+}
+
+// ReleaseUpload implements RateLimitStore interface
+func (s *MemoryRateLimitStore) ReleaseUpload(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.uploads[id]--; s.uploads[id] <= 0 {
+		delete(s.uploads, id)
+	}
+	return nil
+}
+
+// sweep forgets the buckets that have refilled since they were last used,
+// which behave the same as new ones
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	for id, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, id)
+		}
+	}
+	s.lastSweep = now
+}
@@ -91,4 +91,18 @@ const (
 	// RealIPKey is the key used to store the real IP in the context
 	RealIPKey           = "real_ip"
 	HealthCheckEndpoint = "/health"
+	// LiveCheckEndpoint is the same as HealthCheckEndpoint
+	LiveCheckEndpoint = "/health/live"
+	// ReadyCheckEndpoint probes the dependencies of the service
+	ReadyCheckEndpoint = "/health/ready"
 )
+
+// isHealthCheck returns true if the request is to one of the health check
+// endpoints, which are left out of logs, metrics and traces
+func isHealthCheck(c fiber.Ctx) bool {
+	switch c.Path() {
+	case HealthCheckEndpoint, LiveCheckEndpoint, ReadyCheckEndpoint:
+		return true
+	}
+	return false
+}
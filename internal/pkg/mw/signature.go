@@ -0,0 +1,160 @@
+package mw
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/client/sign"
+)
+
+// SignatureError is why a signed URL was rejected
+type SignatureError struct {
+	// Status is the status code to respond with
+	Status  int
+	Message string
+}
+
+func (e *SignatureError) Error() string {
+	return e.Message
+}
+
+var (
+	errInvalidSignature = &SignatureError{Status: fiber.StatusUnauthorized, Message: "unauthorized"}
+	errSignatureExpired = &SignatureError{Status: fiber.StatusUnauthorized, Message: "signature expired"}
+	errSignatureUsed    = &SignatureError{Status: fiber.StatusUnauthorized, Message: "signature already used"}
+	errWrongIP          = &SignatureError{Status: fiber.StatusUnauthorized, Message: "signature not valid for this IP"}
+	errInvalidExpire    = &SignatureError{Status: fiber.StatusBadRequest, Message: "invalid expire time"}
+	errNonceFailed      = &SignatureError{Status: fiber.StatusInternalServerError, Message: "failed to verify signature"}
+	errInvalidPolicy    = &SignatureError{Status: fiber.StatusBadRequest, Message: "invalid policy"}
+)
+
+// NonceStore records the nonces of single-use signed URLs
+type NonceStore interface {
+	// UseNonce records that nonce has been used until expiresAt. It returns
+	// false if the nonce had already been used.
+	UseNonce(nonce string, expiresAt time.Time) (bool, error)
+}
+
+// SignatureVerifier checks signed URLs
+type SignatureVerifier struct {
+	// Keys are the API keys of the service. Tenants sign with their own
+	// secret.
+	Keys Keys
+	// Secret is the signature secret key. Signatures aren't required
+	// without one.
+	Secret string
+	// Nonces records the nonces of single-use URLs. Single-use URLs are
+	// rejected without it.
+	Nonces NonceStore
+}
+
+// Verify checks a URL signed for path and requested from clientIP. The
+// signature, when it expires, its nonce, the IP address or CIDR it's bound to
+// and the tenant it was signed for are read from the x-signature, x-expire,
+// x-nonce, x-ip and x-tenant parameters with param. Signatures without an
+// expiry are rejected if requireExpiry is true. It returns the tenant the URL
+// was signed for, if any.
+func (v *SignatureVerifier) Verify(path, clientIP string, param func(key string) string, requireExpiry bool) (string, *SignatureError) {
+	// URLs signed for a tenant name it, and are only valid with its secret
+	tenant := param("x-tenant")
+	secret := v.Secret
+	if tenant != "" {
+		if !v.Keys.HasTenant(tenant) {
+			return "", errInvalidSignature
+		}
+		secret = sign.TenantSecret(v.Secret, tenant)
+	}
+	if v.Secret == "" {
+		return tenant, nil
+	}
+
+	signature := param("x-signature")
+	expireAt := param("x-expire")
+	nonce := param("x-nonce")
+	// Nonces are only kept until their URL expires
+	if signature == "" || ((requireExpiry || nonce != "") && expireAt == "") {
+		return "", errInvalidSignature
+	}
+	var expireAtMillis int64
+	if expireAt != "" {
+		var err error
+		expireAtMillis, err = strconv.ParseInt(expireAt, 10, 64)
+		if err != nil {
+			return "", errInvalidExpire
+		}
+		if time.Now().UnixMilli() > expireAtMillis {
+			return "", errSignatureExpired
+		}
+	}
+	ip := param("x-ip")
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(sign.URLSignature(path, expireAt, nonce, ip, secret))) != 1 {
+		return "", errInvalidSignature
+	}
+	// Checked before the nonce is used, so a leaked single-use URL can't be
+	// used up from somewhere else
+	if ip != "" && !ipMatches(ip, clientIP) {
+		return "", errWrongIP
+	}
+
+	if nonce != "" {
+		if v.Nonces == nil {
+			return "", errInvalidSignature
+		}
+		// The nonce is scoped to the tenant, since it's their secret that
+		// signed it
+		ok, err := v.Nonces.UseNonce(tenant+":"+nonce, time.UnixMilli(expireAtMillis))
+		if err != nil {
+			return "", errNonceFailed
+		}
+		if !ok {
+			return "", errSignatureUsed
+		}
+	}
+	return tenant, nil
+}
+
+// VerifyPolicy checks an upload policy signed with sign.SignPolicy for the
+// tenant, if any, and returns it
+func (v *SignatureVerifier) VerifyPolicy(policy, signature, tenant string) (sign.UploadPolicy, *SignatureError) {
+	var p sign.UploadPolicy
+	secret := v.Secret
+	if tenant != "" {
+		if !v.Keys.HasTenant(tenant) {
+			return p, errInvalidSignature
+		}
+		secret = sign.TenantSecret(v.Secret, tenant)
+	}
+	// Policies are checked even without a signature secret key, since they're
+	// what constrains the upload
+	if v.Secret != "" && subtle.ConstantTimeCompare([]byte(signature), []byte(sign.Sign(sign.PolicyPayload(policy), secret))) != 1 {
+		return p, errInvalidSignature
+	}
+	data, err := base64.RawURLEncoding.DecodeString(policy)
+	if err != nil || json.Unmarshal(data, &p) != nil || p.Expiration.IsZero() {
+		return p, errInvalidPolicy
+	}
+	if time.Now().After(p.Expiration) {
+		return p, errSignatureExpired
+	}
+	return p, nil
+}
+
+// ipMatches returns true if clientIP is the IP address ip, or is in the CIDR
+// ip
+func ipMatches(ip, clientIP string) bool {
+	addr := net.ParseIP(clientIP)
+	if addr == nil {
+		return false
+	}
+	if strings.Contains(ip, "/") {
+		_, network, err := net.ParseCIDR(ip)
+		return err == nil && network.Contains(addr)
+	}
+	return addr.Equal(net.ParseIP(ip))
+}
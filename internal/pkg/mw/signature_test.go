@@ -0,0 +1,321 @@
+package mw
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/client/sign"
+)
+
+// nonceStore is a NonceStore kept in memory
+type nonceStore struct {
+	used map[string]bool
+	err  error
+}
+
+func (s *nonceStore) UseNonce(nonce string, expiresAt time.Time) (bool, error) {
+	if s.err != nil {
+		return false, s.err
+	}
+	if s.used[nonce] {
+		return false, nil
+	}
+	if s.used == nil {
+		s.used = map[string]bool{}
+	}
+	s.used[nonce] = true
+	return true, nil
+}
+
+// signedParams returns the parameters of a URL for path signed with secret
+func signedParams(path, expireAt, nonce, ip, secret string) map[string]string {
+	return map[string]string{
+		"x-signature": sign.URLSignature(path, expireAt, nonce, ip, secret),
+		"x-expire":    expireAt,
+		"x-nonce":     nonce,
+		"x-ip":        ip,
+	}
+}
+
+func TestSignatureVerifierVerify(t *testing.T) {
+	const secret = "secret"
+	const path = "/blob/photo.jpg"
+	expireAt := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	expiredAt := strconv.FormatInt(time.Now().Add(-time.Minute).UnixMilli(), 10)
+	laterAt := strconv.FormatInt(time.Now().Add(2*time.Hour).UnixMilli(), 10)
+	tenantSecret := sign.TenantSecret(secret, "acme")
+
+	// with returns params with the parameter key set to value
+	with := func(params map[string]string, key, value string) map[string]string {
+		changed := map[string]string{key: value}
+		for k, v := range params {
+			if k != key {
+				changed[k] = v
+			}
+		}
+		return changed
+	}
+
+	tests := []struct {
+		name          string
+		secret        string
+		path          string
+		params        map[string]string
+		clientIP      string
+		requireExpiry bool
+		wantTenant    string
+		wantErr       *SignatureError
+	}{
+		{
+			name:   "no secret",
+			path:   path,
+			params: map[string]string{},
+		},
+		{
+			name:   "signed",
+			secret: secret,
+			path:   path,
+			params: signedParams(path, "", "", "", secret),
+		},
+		{
+			name:    "unsigned",
+			secret:  secret,
+			path:    path,
+			params:  map[string]string{},
+			wantErr: errInvalidSignature,
+		},
+		{
+			name:    "wrong secret",
+			secret:  secret,
+			path:    path,
+			params:  signedParams(path, "", "", "", "other"),
+			wantErr: errInvalidSignature,
+		},
+		{
+			name:    "tampered path",
+			secret:  secret,
+			path:    "/blob/other.jpg",
+			params:  signedParams(path, "", "", "", secret),
+			wantErr: errInvalidSignature,
+		},
+		{
+			name:          "expiry required",
+			secret:        secret,
+			path:          path,
+			params:        signedParams(path, "", "", "", secret),
+			requireExpiry: true,
+			wantErr:       errInvalidSignature,
+		},
+		{
+			name:          "expires",
+			secret:        secret,
+			path:          path,
+			params:        signedParams(path, expireAt, "", "", secret),
+			requireExpiry: true,
+		},
+		{
+			name:    "expired",
+			secret:  secret,
+			path:    path,
+			params:  signedParams(path, expiredAt, "", "", secret),
+			wantErr: errSignatureExpired,
+		},
+		{
+			name:    "tampered expiry",
+			secret:  secret,
+			path:    path,
+			params:  with(signedParams(path, expireAt, "", "", secret), "x-expire", laterAt),
+			wantErr: errInvalidSignature,
+		},
+		{
+			name:    "expiry removed",
+			secret:  secret,
+			path:    path,
+			params:  with(signedParams(path, expireAt, "", "", secret), "x-expire", ""),
+			wantErr: errInvalidSignature,
+		},
+		{
+			name:    "invalid expiry",
+			secret:  secret,
+			path:    path,
+			params:  with(signedParams(path, expireAt, "", "", secret), "x-expire", "tomorrow"),
+			wantErr: errInvalidExpire,
+		},
+		{
+			name:   "nonce",
+			secret: secret,
+			path:   path,
+			params: signedParams(path, expireAt, "n1", "", secret),
+		},
+		{
+			name:    "nonce without expiry",
+			secret:  secret,
+			path:    path,
+			params:  signedParams(path, "", "n1", "", secret),
+			wantErr: errInvalidSignature,
+		},
+		{
+			name:    "tampered nonce",
+			secret:  secret,
+			path:    path,
+			params:  with(signedParams(path, expireAt, "n1", "", secret), "x-nonce", "n2"),
+			wantErr: errInvalidSignature,
+		},
+		{
+			name:    "nonce removed",
+			secret:  secret,
+			path:    path,
+			params:  with(signedParams(path, expireAt, "n1", "", secret), "x-nonce", ""),
+			wantErr: errInvalidSignature,
+		},
+		{
+			name:     "IP",
+			secret:   secret,
+			path:     path,
+			params:   signedParams(path, "", "", "203.0.113.7", secret),
+			clientIP: "203.0.113.7",
+		},
+		{
+			name:     "CIDR",
+			secret:   secret,
+			path:     path,
+			params:   signedParams(path, expireAt, "", "203.0.113.0/24", secret),
+			clientIP: "203.0.113.7",
+		},
+		{
+			name:     "wrong IP",
+			secret:   secret,
+			path:     path,
+			params:   signedParams(path, "", "", "203.0.113.7", secret),
+			clientIP: "198.51.100.1",
+			wantErr:  errWrongIP,
+		},
+		{
+			name:     "outside CIDR",
+			secret:   secret,
+			path:     path,
+			params:   signedParams(path, expireAt, "", "203.0.113.0/24", secret),
+			clientIP: "198.51.100.1",
+			wantErr:  errWrongIP,
+		},
+		{
+			name:     "tampered IP",
+			secret:   secret,
+			path:     path,
+			params:   with(signedParams(path, "", "", "203.0.113.7", secret), "x-ip", "198.51.100.1"),
+			clientIP: "198.51.100.1",
+			wantErr:  errInvalidSignature,
+		},
+		{
+			name:     "IP removed",
+			secret:   secret,
+			path:     path,
+			params:   with(signedParams(path, "", "", "203.0.113.7", secret), "x-ip", ""),
+			clientIP: "198.51.100.1",
+			wantErr:  errInvalidSignature,
+		},
+		{
+			name:     "expiry, nonce and IP",
+			secret:   secret,
+			path:     path,
+			params:   signedParams(path, expireAt, "n1", "203.0.113.7", secret),
+			clientIP: "203.0.113.7",
+		},
+		{
+			name:       "tenant",
+			secret:     secret,
+			path:       path,
+			params:     with(signedParams(path, expireAt, "", "", tenantSecret), "x-tenant", "acme"),
+			wantTenant: "acme",
+		},
+		{
+			name:       "tenant without a secret",
+			path:       path,
+			params:     map[string]string{"x-tenant": "acme"},
+			wantTenant: "acme",
+		},
+		{
+			name:    "tenant signed with the secret",
+			secret:  secret,
+			path:    path,
+			params:  with(signedParams(path, expireAt, "", "", secret), "x-tenant", "acme"),
+			wantErr: errInvalidSignature,
+		},
+		{
+			name:    "tampered tenant",
+			secret:  secret,
+			path:    path,
+			params:  with(signedParams(path, expireAt, "", "", tenantSecret), "x-tenant", "globex"),
+			wantErr: errInvalidSignature,
+		},
+		{
+			name:    "unknown tenant",
+			secret:  secret,
+			path:    path,
+			params:  with(signedParams(path, expireAt, "", "", sign.TenantSecret(secret, "initech")), "x-tenant", "initech"),
+			wantErr: errInvalidSignature,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &SignatureVerifier{
+				Keys:   APIKeys{{Key: "sk_acme", Tenant: "acme"}, {Key: "sk_globex", Tenant: "globex"}},
+				Secret: tt.secret,
+				Nonces: &nonceStore{},
+			}
+			param := func(key string) string { return tt.params[key] }
+			tenant, err := v.Verify(tt.path, tt.clientIP, param, tt.requireExpiry)
+			if err != tt.wantErr {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if tenant != tt.wantTenant {
+				t.Errorf("Verify() tenant = %q, want %q", tenant, tt.wantTenant)
+			}
+		})
+	}
+}
+
+func TestSignatureVerifierVerifyNonce(t *testing.T) {
+	const secret = "secret"
+	const path = "/blob/photo.jpg"
+	expireAt := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	params := signedParams(path, expireAt, "n1", "203.0.113.7", secret)
+	param := func(key string) string { return params[key] }
+
+	t.Run("used once", func(t *testing.T) {
+		v := &SignatureVerifier{Secret: secret, Nonces: &nonceStore{}}
+		if _, err := v.Verify(path, "203.0.113.7", param, false); err != nil {
+			t.Fatalf("Verify() error = %v", err)
+		}
+		if _, err := v.Verify(path, "203.0.113.7", param, false); err != errSignatureUsed {
+			t.Fatalf("Verify() error = %v, want %v", err, errSignatureUsed)
+		}
+	})
+
+	t.Run("not used up from the wrong IP", func(t *testing.T) {
+		v := &SignatureVerifier{Secret: secret, Nonces: &nonceStore{}}
+		if _, err := v.Verify(path, "198.51.100.1", param, false); err != errWrongIP {
+			t.Fatalf("Verify() error = %v, want %v", err, errWrongIP)
+		}
+		if _, err := v.Verify(path, "203.0.113.7", param, false); err != nil {
+			t.Fatalf("Verify() error = %v", err)
+		}
+	})
+
+	t.Run("without a nonce store", func(t *testing.T) {
+		v := &SignatureVerifier{Secret: secret}
+		if _, err := v.Verify(path, "203.0.113.7", param, false); err != errInvalidSignature {
+			t.Fatalf("Verify() error = %v, want %v", err, errInvalidSignature)
+		}
+	})
+
+	t.Run("nonce store failing", func(t *testing.T) {
+		v := &SignatureVerifier{Secret: secret, Nonces: &nonceStore{err: errors.New("unavailable")}}
+		if _, err := v.Verify(path, "203.0.113.7", param, false); err != errNonceFailed {
+			t.Fatalf("Verify() error = %v, want %v", err, errNonceFailed)
+		}
+	})
+}
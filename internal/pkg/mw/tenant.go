@@ -0,0 +1,82 @@
+package mw
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// DefaultTenantScopes are the scopes of a tenant's API key when TENANTS
+// doesn't list any
+const DefaultTenantScopes = ScopeRead | ScopeWrite | ScopeDelete | ScopeSign
+
+// ParseTenants parses a comma-separated list of name:apikey tenants, e.g.
+// acme:sk_acme,globex:sk_globex. The API key can be followed by its scopes
+// and an RFC 3339 expiry, e.g. acme:sk_acme:read+write:2025-01-01T00:00:00Z.
+// Each tenant's keys are stored under its name and only reachable with its
+// API keys or URLs signed for it. A tenant can be listed more than once to
+// give it several API keys, e.g. while rotating them.
+func ParseTenants(s string) (APIKeys, error) {
+	var keys APIKeys
+	apiKeys := map[string]bool{}
+	for _, tenant := range strings.Split(s, ",") {
+		tenant = strings.TrimSpace(tenant)
+		if tenant == "" {
+			continue
+		}
+		parts := strings.SplitN(tenant, ":", 4)
+		name := parts[0]
+		if len(parts) < 2 || name == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid tenant %q, expected name:apikey", name)
+		}
+		if !validTenantName(name) {
+			return nil, fmt.Errorf("invalid tenant name %q, only a-z, 0-9, - and _ are allowed", name)
+		}
+		scopes := DefaultTenantScopes
+		if len(parts) >= 3 {
+			var err error
+			if scopes, err = ParseScopes(parts[2]); err != nil {
+				return nil, fmt.Errorf("invalid tenant %q: %w", name, err)
+			}
+			if scopes.Has(ScopeAdmin) {
+				return nil, fmt.Errorf("invalid tenant %q: tenants can't have the admin scope", name)
+			}
+		}
+		var expiresAt time.Time
+		if len(parts) == 4 {
+			var err error
+			if expiresAt, err = time.Parse(time.RFC3339, parts[3]); err != nil {
+				return nil, fmt.Errorf("invalid tenant %q expiry: %w", name, err)
+			}
+		}
+		if apiKeys[parts[1]] {
+			return nil, fmt.Errorf("duplicate API key for tenant %q", name)
+		}
+		apiKeys[parts[1]] = true
+		keys = append(keys, APIKey{Key: parts[1], Tenant: name, Scopes: scopes, ExpiresAt: expiresAt})
+	}
+	return keys, nil
+}
+
+func validTenantName(name string) bool {
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// GetTenant returns the name of the tenant that made the request, or an empty
+// string if it wasn't made by a tenant
+func GetTenant(c fiber.Ctx) string {
+	tenant, _ := c.Locals(TenantKey).(string)
+	return tenant
+}
+
+const (
+	// TenantKey is the key used to store the request's tenant in the context
+	TenantKey = "tenant"
+)
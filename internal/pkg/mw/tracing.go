@@ -0,0 +1,43 @@
+package mw
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/tracing"
+)
+
+// NewTracing is a middleware that records a span for every request. The span
+// continues the trace of the caller if it sent a traceparent header. It has
+// to come after RealIP.
+func NewTracing(tracer *tracing.Tracer) func(fiber.Ctx) error {
+	return func(c fiber.Ctx) error {
+		if isHealthCheck(c) {
+			return c.Next()
+		}
+
+		// Spans outlive the request, so strings that point into fasthttp's
+		// buffers are copied
+		method := strings.Clone(c.Method())
+		span := tracer.StartServer(c.Get("traceparent"), method)
+		defer span.End()
+		c.Locals(tracing.SpanKey, span)
+
+		err := c.Next()
+		status := responseStatus(c, err)
+		route := matchedRoute(c, status)
+		if route != "" {
+			span.SetName(method + " " + route)
+		}
+		span.SetAttribute("http.request.method", method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("url.path", strings.Clone(c.Path()))
+		span.SetAttribute("http.response.status_code", status)
+		span.SetAttribute("client.address", strings.Clone(GetRealIP(c)))
+		if status >= fiber.StatusInternalServerError {
+			span.SetError(http.StatusText(status))
+		}
+		return err
+	}
+}
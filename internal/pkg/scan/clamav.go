@@ -0,0 +1,95 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// chunkSize is how many bytes are streamed to clamd at a time. It has to be
+// below clamd's StreamMaxLength.
+const chunkSize = 64 << 10
+
+// ClamAV scans files with clamd's INSTREAM command over TCP. It implements
+// the Scanner interface.
+type ClamAV struct {
+	addr    string
+	timeout time.Duration
+}
+
+// NewClamAV scans files with the clamd listening at addr, e.g. clamav:3310.
+// Scans that take longer than timeout fail.
+func NewClamAV(addr string, timeout time.Duration) *ClamAV {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "3310")
+	}
+	return &ClamAV{addr: addr, timeout: timeout}
+}
+
+// Scan implements Scanner interface
+func (c *ClamAV) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriterSize(conn, chunkSize+4)
+	// The z prefix terminates the command and its reply with a null byte
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return Result{}, err
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			binary.Write(w, binary.BigEndian, uint32(n))
+			w.Write(buf[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	// A zero-length chunk ends the stream
+	binary.Write(w, binary.BigEndian, uint32(0))
+	if err := w.Flush(); err != nil {
+		return Result{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return Result{}, err
+	}
+	return parseReply(string(bytes.TrimRight(reply, "\x00")))
+}
+
+// parseReply parses clamd's reply to INSTREAM, e.g. "stream: OK" or
+// "stream: Win.Test.EICAR_HDB-1 FOUND"
+func parseReply(reply string) (Result, error) {
+	_, status, _ := strings.Cut(strings.TrimSpace(reply), ": ")
+	switch {
+	case status == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	}
+	return Result{}, fmt.Errorf("clamd: %s", reply)
+}
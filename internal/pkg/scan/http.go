@@ -0,0 +1,51 @@
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// HTTP scans files with an external service. Files are POSTed to it as the
+// body of the request, and it responds with a JSON object like
+// {"infected":true,"signature":"Win.Test.EICAR_HDB-1"}. It implements the
+// Scanner interface.
+type HTTP struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTP scans files with the service at url
+func NewHTTP(url string, timeout time.Duration) *HTTP {
+	return &HTTP{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+type httpResult struct {
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature"`
+}
+
+// Scan implements Scanner interface
+func (h *HTTP) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, r)
+	if err != nil {
+		return Result{}, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := h.client.Do(req)
+	if err != nil {
+		return Result{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return Result{}, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	var result httpResult
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return Result{}, fmt.Errorf("invalid scan result: %w", err)
+	}
+	return Result{Infected: result.Infected, Signature: result.Signature}, nil
+}
@@ -0,0 +1,21 @@
+package scan
+
+import (
+	"context"
+	"io"
+)
+
+// Result is what a scanner found in a file
+type Result struct {
+	// Infected is true if the file is malware
+	Infected bool
+	// Signature is the name of the malware, e.g. Win.Test.EICAR_HDB-1
+	Signature string
+}
+
+// Scanner checks files for malware
+type Scanner interface {
+	// Scan reads r to the end and returns what was found in it. It fails if
+	// the file couldn't be scanned, which isn't the same as being clean.
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
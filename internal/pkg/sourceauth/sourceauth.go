@@ -0,0 +1,141 @@
+package sourceauth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/internal/pkg/sigv4"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/ssrf"
+)
+
+// Rule authenticates the requests to the URLs that match a source
+type Rule struct {
+	Source ssrf.Source
+	// Header is set on the requests
+	Header http.Header
+	sigv4  *signer
+}
+
+// signer signs requests with AWS Signature Version 4
+type signer struct {
+	region  string
+	service string
+	creds   sigv4.Credentials
+}
+
+// Rules are the credentials of the HTTP sources. Every rule that matches a
+// URL applies, so a source can be sent several headers.
+type Rules []Rule
+
+// ParseRules parses a semicolon-separated list of source=credentials rules.
+// Sources are [scheme://]host[:port] patterns and credentials are one of:
+//
+//	bearer <token>
+//	basic <user>:<password>
+//	header <name>: <value>
+//	sigv4 <region> <service> <access key ID> <secret access key> [<session token>]
+//
+// e.g. https://api.foobar.com=bearer abc123;mybucket.s3.amazonaws.com=sigv4 us-east-1 s3 AKIA... secret
+func ParseRules(s string) (Rules, error) {
+	var rules Rules
+	for _, rule := range strings.Split(s, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		pattern, creds, ok := strings.Cut(rule, "=")
+		pattern, creds = strings.TrimSpace(pattern), strings.TrimSpace(creds)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid source auth rule, expected source=credentials")
+		}
+		// Credentials are left out of errors, they end up in logs
+		kind, value, _ := strings.Cut(creds, " ")
+		value = strings.TrimSpace(value)
+		r := Rule{Source: ssrf.ParseSource(pattern), Header: http.Header{}}
+		switch strings.ToLower(kind) {
+		case "bearer":
+			if value == "" {
+				return nil, fmt.Errorf("invalid source auth rule for %q, expected bearer <token>", pattern)
+			}
+			r.Header.Set("Authorization", "Bearer "+value)
+		case "basic":
+			if !strings.Contains(value, ":") {
+				return nil, fmt.Errorf("invalid source auth rule for %q, expected basic <user>:<password>", pattern)
+			}
+			r.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(value)))
+		case "header":
+			name, v, ok := strings.Cut(value, ":")
+			if !ok || strings.TrimSpace(name) == "" {
+				return nil, fmt.Errorf("invalid source auth rule for %q, expected header <name>: <value>", pattern)
+			}
+			r.Header.Set(strings.TrimSpace(name), strings.TrimSpace(v))
+		case "sigv4":
+			fields := strings.Fields(value)
+			if len(fields) != 4 && len(fields) != 5 {
+				return nil, fmt.Errorf("invalid source auth rule for %q, expected sigv4 <region> <service> <access key ID> <secret access key> [<session token>]", pattern)
+			}
+			r.sigv4 = &signer{
+				region:  fields[0],
+				service: fields[1],
+				creds:   sigv4.Credentials{AccessKeyID: fields[2], SecretAccessKey: fields[3]},
+			}
+			if len(fields) == 5 {
+				r.sigv4.creds.SessionToken = fields[4]
+			}
+		default:
+			return nil, fmt.Errorf("invalid source auth rule for %q, expected bearer, basic, header or sigv4 credentials", pattern)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Apply adds the credentials of every rule that matches the URL of req to it
+func (r Rules) Apply(req *http.Request) {
+	var s *signer
+	for _, rule := range r {
+		if !rule.Source.Match(req.URL) {
+			continue
+		}
+		for name, values := range rule.Header {
+			req.Header[name] = values
+		}
+		if rule.sigv4 != nil {
+			s = rule.sigv4
+		}
+	}
+	// Signed last, so the signature covers the other headers
+	if s != nil {
+		sigv4.Sign(req, s.creds, s.region, s.service, sigv4.EmptyPayload, time.Now())
+	}
+}
+
+// NewTransport returns a transport that authenticates the requests sent
+// through next with rules. They're added to every request it sends, rather
+// than to the requests of a client, so they aren't sent along to the host of
+// a redirect that doesn't match them. The rules can be replaced while the
+// server is running.
+func NewTransport(rules *atomic.Pointer[Rules], next http.RoundTripper) http.RoundTripper {
+	return &transport{rules: rules, next: next}
+}
+
+type transport struct {
+	rules *atomic.Pointer[Rules]
+	next  http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rules := t.rules.Load()
+	if rules == nil || len(*rules) == 0 {
+		return t.next.RoundTrip(req)
+	}
+	// Transports mustn't modify the requests they're sent
+	req = req.Clone(req.Context())
+	rules.Apply(req)
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,298 @@
+package ssrf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrBlocked is returned when a connection to an address in a blocked
+// network is dialed
+var ErrBlocked = errors.New("address is in a blocked network")
+
+// PrivateNetworks are the networks that aren't reachable from the internet:
+// loopback, private, link-local, carrier-grade NAT, multicast, broadcast and
+// the like. They include the metadata services of cloud providers, e.g.
+// 169.254.169.254, fd00:ec2::254 and 100.100.100.200.
+var PrivateNetworks = mustParseNetworks("0.0.0.0/8,10.0.0.0/8,100.64.0.0/10,127.0.0.0/8,169.254.0.0/16,172.16.0.0/12,192.0.0.0/24,192.168.0.0/16,198.18.0.0/15,224.0.0.0/4,240.0.0.0/4,255.255.255.255/32,::/128,::1/128,64:ff9b::/96,fc00::/7,fe80::/10,ff00::/8")
+
+// ParseNetworks parses a comma-separated list of CIDRs or IP addresses, e.g.
+// 203.0.113.0/24,2001:db8::1
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			cidr = fmt.Sprintf("%s/%d", cidr, bits)
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func mustParseNetworks(s string) []*net.IPNet {
+	networks, err := ParseNetworks(s)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// Guard rejects connections to the addresses of blocked networks. Addresses
+// are checked as they're dialed, after their host name is resolved, so a
+// host name that's allowed can't be rebound to a blocked address.
+type Guard struct {
+	networks []*net.IPNet
+}
+
+// NewGuard blocks connections to networks. Nothing is blocked if there are
+// none.
+func NewGuard(networks ...*net.IPNet) *Guard {
+	return &Guard{networks: networks}
+}
+
+// Blocked returns true if ip is in a blocked network
+func (g *Guard) Blocked(ip net.IP) bool {
+	for _, network := range g.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Control implements a net.Dialer Control function
+func (g *Guard) Control(network, address string, _ syscall.RawConn) error {
+	if len(g.networks) == 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || g.Blocked(ip) {
+		return ErrBlocked
+	}
+	return nil
+}
+
+// proxyKey marks the context of a request that's sent through the proxy at
+// its URL. Only that proxy is dialed whatever network it's in, and only for
+// that request.
+type proxyKey struct{}
+
+// Transport returns an HTTP transport that dials through the guard. Requests
+// are sent through the proxy returned by proxy, if it isn't nil and returns
+// one. A proxy resolves host names itself, so they're resolved and checked
+// before the request is sent to it instead, and the proxy should restrict
+// where it connects to as well.
+func (g *Guard) Transport(proxy func(*http.Request) (*url.URL, error)) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	guarded := &net.Dialer{
+		Timeout:   dialer.Timeout,
+		KeepAlive: dialer.KeepAlive,
+		Control:   g.Control,
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if u, ok := ctx.Value(proxyKey{}).(*url.URL); ok && proxyAddr(u) == addr {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return guarded.DialContext(ctx, network, addr)
+	}
+	transport.Proxy = nil
+	if proxy == nil {
+		return transport
+	}
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		u, _ := req.Context().Value(proxyKey{}).(*url.URL)
+		return u, nil
+	}
+	return &proxyTransport{guard: g, proxy: proxy, next: transport}
+}
+
+// proxyTransport decides which requests are sent through a proxy before
+// they're sent, so the proxy is only dialed unguarded for them
+type proxyTransport struct {
+	guard *Guard
+	proxy func(*http.Request) (*url.URL, error)
+	next  http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := t.proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return t.next.RoundTrip(req)
+	}
+	if err := t.guard.resolve(req); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req.WithContext(context.WithValue(req.Context(), proxyKey{}, u)))
+}
+
+// resolve checks the addresses the host of req resolves to. Hosts that
+// can't be resolved are left to the proxy, it may see names that aren't
+// visible from here.
+func (g *Guard) resolve(req *http.Request) error {
+	if len(g.networks) == 0 {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(req.Context(), req.URL.Hostname())
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if g.Blocked(addr.IP) {
+			return ErrBlocked
+		}
+	}
+	return nil
+}
+
+// proxyAddr is the address a transport dials to connect to the proxy at u
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// ParseProxy returns the proxy of the requests to HTTP sources. It's the
+// proxy at s if it's set, or the one in the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables.
+func ParseProxy(s string) (func(*http.Request) (*url.URL, error), error) {
+	if s == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", s)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL %q, expected an http, https or socks5 URL", s)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// Source is a pattern of the URLs that can be fetched, like *.foobar.com,
+// https://cdn.foobar.com or cdn.foobar.com:8443
+type Source struct {
+	// Scheme is http or https. Both are allowed if it's empty.
+	Scheme string
+	// Host is a glob pattern of host names, e.g. *.foobar.com
+	Host string
+	// Port is the port URLs have to use. Only the default port of their
+	// scheme is allowed if it's empty, and any port if it's *.
+	Port string
+}
+
+// ParseSource parses a [scheme://]host[:port] pattern
+func ParseSource(pattern string) Source {
+	var s Source
+	if scheme, rest, ok := strings.Cut(pattern, "://"); ok {
+		s.Scheme, pattern = strings.ToLower(scheme), rest
+	}
+	if idx := strings.LastIndex(pattern, ":"); idx > -1 && !strings.Contains(pattern[idx:], "]") {
+		pattern, s.Port = pattern[:idx], pattern[idx+1:]
+	}
+	s.Host = strings.ToLower(strings.Trim(pattern, "[]"))
+	return s
+}
+
+// Match returns true if u can be fetched
+func (s Source) Match(u *url.URL) bool {
+	if s.Scheme != "" && s.Scheme != u.Scheme {
+		return false
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(u.Scheme)
+	}
+	switch s.Port {
+	case "*":
+	case "":
+		if port != defaultPort(u.Scheme) {
+			return false
+		}
+	default:
+		if port != s.Port {
+			return false
+		}
+	}
+	matched, err := path.Match(s.Host, strings.ToLower(u.Hostname()))
+	return matched && err == nil
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
+
+// Sources are the patterns of the URLs that can be fetched
+type Sources []Source
+
+// ParseSources parses a comma-separated list of [scheme://]host[:port]
+// patterns, e.g. *.foobar.com,https://my.foobar.com:8443
+func ParseSources(s string) Sources {
+	var sources Sources
+	for _, pattern := range strings.Split(s, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			sources = append(sources, ParseSource(pattern))
+		}
+	}
+	return sources
+}
+
+// Match returns true if u matches any of the sources
+func (s Sources) Match(u *url.URL) bool {
+	for _, source := range s {
+		if source.Match(u) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package tlscert
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reloader serves a certificate and key pair that's loaded again when its
+// files change, so renewing it doesn't need a restart
+type Reloader struct {
+	certFile string
+	keyFile  string
+	log      *slog.Logger
+	cert     atomic.Pointer[tls.Certificate]
+	mu       sync.Mutex
+	// version is the size and modification time of the files last loaded
+	version string
+}
+
+// New loads the certificate and key pair in certFile and keyFile
+func New(certFile, keyFile string, log *slog.Logger) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, log: log}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Reload loads the certificate and key pair again. If they're invalid, the
+// current certificate is kept.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	version, err := r.fileVersion()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls: cannot load key pair from certFile=%q and keyFile=%q: %w", r.certFile, r.keyFile, err)
+	}
+	r.cert.Store(&cert)
+	r.version = version
+	return nil
+}
+
+// Watch reloads the certificate every interval if its files changed, until
+// ctx is done. Renewals that write the certificate and key one after the
+// other may fail to load in between, so they're retried until they load.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		version, err := r.fileVersion()
+		r.mu.Lock()
+		changed := err == nil && version != r.version
+		r.mu.Unlock()
+		if err != nil {
+			r.log.Error("failed to check TLS certificate", "error", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			r.log.Error("failed to reload TLS certificate", "error", err)
+			continue
+		}
+		r.log.Info("reloaded TLS certificate", "cert_file", r.certFile)
+	}
+}
+
+// fileVersion identifies the contents of the certificate and key files.
+// Symlinks are followed, so swapping the files cert-manager mounts counts as
+// a change.
+func (r *Reloader) fileVersion() (string, error) {
+	var version string
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		version += fmt.Sprintf("%d:%d;", info.Size(), info.ModTime().UnixNano())
+	}
+	return version, nil
+}
@@ -0,0 +1,232 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanKey is the key the span of a request is stored under in fiber's
+// locals. Contexts made from the request, like the fasthttp request context
+// and net/http requests made by the adaptor, look it up with it.
+const SpanKey = "span"
+
+type spanKey struct{}
+
+// Span kinds
+const (
+	KindInternal = 1
+	KindServer   = 2
+)
+
+// Tracer records spans and exports them to an OTLP/HTTP collector in the
+// background. A nil Tracer starts nil spans, which ignore everything they're
+// given.
+type Tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+	log         *slog.Logger
+	queue       chan *Span
+}
+
+type Config struct {
+	// Endpoint is the base URL of the collector, e.g. http://localhost:4318.
+	// Spans are POSTed to /v1/traces.
+	Endpoint string
+	// Headers are sent with every export, e.g. for authentication
+	Headers map[string]string
+	// ServiceName identifies this service in traces
+	ServiceName string
+	Logger      *slog.Logger
+}
+
+func New(cfg Config) *Tracer {
+	return &Tracer{
+		endpoint:    strings.TrimSuffix(cfg.Endpoint, "/") + "/v1/traces",
+		headers:     cfg.Headers,
+		serviceName: cfg.ServiceName,
+		client:      &http.Client{Timeout: exportTimeout},
+		log:         cfg.Logger,
+		queue:       make(chan *Span, queueSize),
+	}
+}
+
+// Start starts a span that is a child of the span in ctx, if there is one.
+// The returned context carries the new span.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := t.newSpan(name, KindInternal, SpanFromContext(ctx))
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// StartServer starts a span for a request with the traceparent header given.
+// The span continues the trace of the caller if the header is valid, or
+// starts a new one if it isn't.
+func (t *Tracer) StartServer(traceparent, name string) *Span {
+	if t == nil {
+		return nil
+	}
+	return t.newSpan(name, KindServer, parseTraceparent(traceparent))
+}
+
+func (t *Tracer) newSpan(name string, kind int, parent *Span) *Span {
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now(), sampled: true}
+	if parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+		span.sampled = parent.sampled
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// SpanFromContext returns the span in ctx, or nil if there isn't one
+func SpanFromContext(ctx context.Context) *Span {
+	if span, ok := ctx.Value(spanKey{}).(*Span); ok {
+		return span
+	}
+	span, _ := ctx.Value(SpanKey).(*Span)
+	return span
+}
+
+// Span is an operation in a trace
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	// sampled is false if the caller asked for the trace not to be recorded
+	sampled bool
+	kind    int
+	start   time.Time
+
+	mu            sync.Mutex
+	name          string
+	end           time.Time
+	attributes    []attribute
+	failed        bool
+	statusMessage string
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// SetName renames the span, e.g. once the route of a request is known
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// SetAttribute sets an attribute of the span. Values can be strings, bools,
+// ints or floats.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, attribute{key: key, value: value})
+}
+
+// RecordError marks the span as failed with err, if it isn't nil
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.SetError(err.Error())
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.statusMessage = message
+}
+
+// End ends the span and queues it to be exported. It never blocks, spans are
+// dropped if the queue is full.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	if !s.sampled {
+		return
+	}
+	select {
+	case s.tracer.queue <- s:
+	default:
+	}
+}
+
+// TraceID returns the hex encoded ID of the span's trace
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// Traceparent returns the W3C traceparent header that continues the trace
+// from this span
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", s.traceID, s.spanID, flags)
+}
+
+// parseTraceparent parses a W3C traceparent header, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01, into a remote
+// parent span. It returns nil if the header is invalid.
+func parseTraceparent(header string) *Span {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil
+	}
+	// Later versions can add fields, but version 00 can't
+	if parts[0] == "00" && len(parts) != 4 {
+		return nil
+	}
+	var span Span
+	if _, err := hex.Decode(span.traceID[:], []byte(parts[1])); err != nil || span.traceID == [16]byte{} {
+		return nil
+	}
+	if _, err := hex.Decode(span.spanID[:], []byte(parts[2])); err != nil || span.spanID == [8]byte{} {
+		return nil
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return nil
+	}
+	span.sampled = flags[0]&1 == 1
+	return &span
+}
@@ -1,5 +1,15 @@
 import { describe, it, expect, beforeEach, vi } from "vitest";
-import { ImageServiceClient, imageUrlBuilder, sign, signUrl } from "./server";
+import {
+	ImageServiceClient,
+	imageUrlBuilder,
+	sign,
+	signExpiringUrl,
+	signPolicy,
+	signUrl,
+	signUrlWithOptions,
+	urlSignature,
+	verifyWebhook,
+} from "./server";
 
 describe("sign", () => {
 	it("signs a key with secret", () => {
@@ -15,6 +25,26 @@ describe("sign", () => {
 	});
 });
 
+describe("urlSignature", () => {
+	it("signs the path of URLs without fields", () => {
+		expect(urlSignature("/test.jpg", "", "", "", "secret")).toBe(
+			sign("/test.jpg", "secret"),
+		);
+	});
+
+	it("doesn't let fields run into the path", () => {
+		expect(
+			urlSignature("/test.jpg:1700000000000", "", "", "", "secret"),
+		).not.toBe(urlSignature("/test.jpg", "1700000000000", "", "", "secret"));
+	});
+
+	it("matches the Go client", () => {
+		expect(
+			urlSignature("/blob/a.png", "1700000000000", "", "203.0.113.7", "secret"),
+		).toBe("M7pjrXuNxZLW9QnWQy6HNmaLmqvPecsLHzmhud22PMI");
+	});
+});
+
 describe("signUrl", () => {
 	it("signs serve URL", () => {
 		const url = new URL("http://example.com/serve/test.jpg");
@@ -39,6 +69,95 @@ describe("signUrl", () => {
 	});
 });
 
+describe("signExpiringUrl", () => {
+	it("signs serve URL with expiration", () => {
+		const url = new URL("http://example.com/serve/test.jpg");
+		const signed = signExpiringUrl(url, "secret", 1700000000000);
+		const parsed = new URL(signed);
+		expect(parsed.pathname).toBe("/serve/test.jpg");
+		expect(parsed.searchParams.get("x-expire")).toBe("1700000000000");
+		expect(parsed.searchParams.get("x-signature")).toBe(
+			urlSignature("/test.jpg", "1700000000000", "", "", "secret"),
+		);
+	});
+});
+
+describe("signUrlWithOptions", () => {
+	it("signs single-use serve URL with a nonce", () => {
+		const url = new URL("http://example.com/serve/test.jpg");
+		const signed = signUrlWithOptions(url, "secret", {
+			expireAt: 1700000000000,
+			singleUse: true,
+		});
+		const parsed = new URL(signed);
+		const nonce = parsed.searchParams.get("x-nonce");
+		expect(nonce).toBeTruthy();
+		expect(parsed.searchParams.get("x-expire")).toBe("1700000000000");
+		expect(parsed.searchParams.get("x-signature")).toBe(
+			urlSignature("/test.jpg", "1700000000000", nonce ?? "", "", "secret"),
+		);
+
+		const other = signUrlWithOptions(url, "secret", {
+			expireAt: 1700000000000,
+			singleUse: true,
+		});
+		expect(new URL(other).searchParams.get("x-nonce")).not.toBe(nonce);
+	});
+
+	it("binds URL to an IP address or CIDR", () => {
+		const url = new URL("http://example.com/serve/test.jpg");
+		const signed = signUrlWithOptions(url, "secret", {
+			expireAt: 1700000000000,
+			ip: "203.0.113.0/24",
+		});
+		const parsed = new URL(signed);
+		expect(parsed.searchParams.get("x-ip")).toBe("203.0.113.0/24");
+		expect(parsed.searchParams.get("x-signature")).toBe(
+			urlSignature("/test.jpg", "1700000000000", "", "203.0.113.0/24", "secret"),
+		);
+		expect(() =>
+			signUrlWithOptions(url, "secret", {
+				expireAt: 1700000000000,
+				ip: "localhost",
+			}),
+		).toThrow("invalid IP");
+	});
+});
+
+describe("signPolicy", () => {
+	it("signs an encoded upload policy", () => {
+		const policy = {
+			expiration: "2024-01-02T03:04:05.000Z",
+			key_prefix: "avatars/",
+		};
+		const signed = signPolicy(policy, "secret");
+		expect(
+			JSON.parse(Buffer.from(signed.policy, "base64url").toString()),
+		).toEqual(policy);
+		expect(signed.signature).toBe(sign(`policy:${signed.policy}`, "secret"));
+	});
+});
+
+describe("verifyWebhook", () => {
+	const body = '{"type":"blob.created"}';
+
+	it("verifies a webhook signature", () => {
+		const timestamp = Math.floor(Date.now() / 1000).toString();
+		const signature = sign(`webhook:${timestamp}.${body}`, "secret");
+		expect(verifyWebhook(body, timestamp, signature, "secret")).toBe(true);
+		expect(
+			verifyWebhook(Buffer.from(body), timestamp, signature, "secret"),
+		).toBe(true);
+		expect(verifyWebhook(body, timestamp, signature, "wrong")).toBe(false);
+	});
+
+	it("rejects old webhooks", () => {
+		const timestamp = (Math.floor(Date.now() / 1000) - 600).toString();
+		const signature = sign(`webhook:${timestamp}.${body}`, "secret");
+		expect(verifyWebhook(body, timestamp, signature, "secret")).toBe(false);
+	});
+});
+
 describe("ImageServiceClient", () => {
 	it("constructor validates URL", () => {
 		expect(() => new ImageServiceClient({ url: "", secretKey: "key" })).toThrow(
@@ -57,6 +176,21 @@ describe("ImageServiceClient", () => {
 		expect(signed).toContain("x-signature=");
 	});
 
+	it("scopes locally signed URLs to the tenant", async () => {
+		const client = new ImageServiceClient({
+			url: "http://example.com",
+			secretKey: "key",
+			signatureSecretKey: "tenant-signing-key",
+			tenant: "acme",
+		});
+
+		const signed = new URL(await client.sign("/serve/blob/test.jpg"));
+		expect(signed.searchParams.get("x-tenant")).toBe("acme");
+		expect(signed.searchParams.get("x-signature")).toBe(
+			sign("/blob/test.jpg", "tenant-signing-key"),
+		);
+	});
+
 	it("uses server signing when no signatureSecretKey", async () => {
 		const client = new ImageServiceClient({
 			url: "http://example.com",
@@ -77,6 +211,37 @@ describe("ImageServiceClient", () => {
 		expect(signed).toBe("signed-url");
 	});
 
+	it("events parses server-sent events", async () => {
+		const client = new ImageServiceClient({
+			url: "http://example.com",
+			secretKey: "key",
+		});
+
+		global.fetch = vi.fn().mockImplementation((url: string) => {
+			const parsed = new URL(url);
+			expect(parsed.pathname).toBe("/events");
+			expect(parsed.searchParams.get("prefix")).toBe("users/");
+			return Promise.resolve(
+				new Response(
+					": connected\n\n" +
+						'id: evt_1\nevent: blob.created\ndata: {"id":"evt_1","type":"blob.created"}\n\n' +
+						": ping\n\n" +
+						'id: evt_2\nevent: blob.deleted\ndata: {"id":"evt_2","type":"blob.deleted"}\n\n',
+				),
+			);
+		});
+
+		const events = [];
+		for await (const event of client.events("users/")) {
+			events.push(event);
+		}
+
+		expect(events).toEqual([
+			{ id: "evt_1", type: "blob.created" },
+			{ id: "evt_2", type: "blob.deleted" },
+		]);
+	});
+
 	it("list constructs correct query params", async () => {
 		const client = new ImageServiceClient({
 			url: "http://example.com",
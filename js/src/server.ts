@@ -1,5 +1,7 @@
+import { Buffer } from "node:buffer";
+import { isIP } from "node:net";
 import { URL } from "node:url";
-import { createHmac } from "node:crypto";
+import { createHmac, randomBytes, timingSafeEqual } from "node:crypto";
 
 export type ClientOptions = {
 	/** The URL of your service */
@@ -8,12 +10,18 @@ export type ClientOptions = {
 	secretKey: string;
 	/** If provided, URLs will be signed locally instead of via server */
 	signatureSecretKey?: string;
+	/**
+	 * The tenant your API key belongs to. Required to sign URLs locally as a
+	 * tenant, in which case `signatureSecretKey` is the tenant's secret.
+	 */
+	tenant?: string;
 };
 
 export class ImageServiceClient {
 	baseURL: URL;
 	secretKey: string;
 	signatureSecretKey?: string;
+	tenant?: string;
 
 	constructor(options: ClientOptions) {
 		if (!options.url) {
@@ -22,6 +30,33 @@ export class ImageServiceClient {
 		this.baseURL = new URL(options.url);
 		this.secretKey = options.secretKey;
 		this.signatureSecretKey = options.signatureSecretKey;
+		this.tenant = options.tenant;
+	}
+
+	/**
+	 * Sign a URL with the signature secret key, scoped to the client's tenant
+	 * if it has one.
+	 * @param url - The URL to sign
+	 * @param expireAt - When a signed /blob URL stops being accepted
+	 * @param options - Signed URL options
+	 */
+	signLocally(
+		url: URL,
+		expireAt?: number,
+		options: Omit<SignUrlOptions, "expireAt"> = {},
+	): string {
+		if (!this.signatureSecretKey) {
+			throw new Error(
+				"`signatureSecretKey` is required in your client for local signing",
+			);
+		}
+		if (this.tenant) {
+			url.searchParams.set("x-tenant", this.tenant);
+		}
+		return signUrlWithOptions(url, this.signatureSecretKey, {
+			...options,
+			expireAt: expireAt ?? Date.now() + 60 * 60 * 1000,
+		});
 	}
 
 	private async fetch(path: string, init?: RequestInit) {
@@ -40,14 +75,171 @@ export class ImageServiceClient {
 	 */
 	async sign(path: string): Promise<string> {
 		if (this.signatureSecretKey) {
-			const url = new URL(path, this.baseURL);
-			return signUrl(url, this.signatureSecretKey);
+			return this.signLocally(new URL(path, this.baseURL));
 		}
 
 		const response = await this.fetch(`/sign/${path}`);
 		return response.text();
 	}
 
+	/**
+	 * Get a signed URL for a path that stops being accepted after `expiresIn`.
+	 * Unlike `sign()`, this applies to /serve URLs as well, which otherwise
+	 * never expire.
+	 * @param path - The path to get a signed URL for
+	 * @param expiresIn - How long the URL is valid for in seconds
+	 */
+	async signWithExpiry(path: string, expiresIn: number): Promise<string> {
+		if (expiresIn <= 0) {
+			throw new Error("expiresIn must be positive");
+		}
+		return this.signWithOptions(path, { expiresIn });
+	}
+
+	/**
+	 * Get a signed URL for a path with options.
+	 * @param path - The path to get a signed URL for
+	 * @param options - Signed URL options
+	 */
+	async signWithOptions(
+		path: string,
+		options: SignOptions = {},
+	): Promise<string> {
+		const { expiresIn, singleUse = false, ip } = options;
+		if (this.signatureSecretKey) {
+			const url = new URL(path, this.baseURL);
+			return this.signLocally(
+				url,
+				Date.now() + (expiresIn ?? 60 * 60) * 1000,
+				{ expireServe: expiresIn !== undefined, singleUse, ip },
+			);
+		}
+
+		const params = new URLSearchParams();
+		if (expiresIn !== undefined) {
+			params.set("expires_in", `${expiresIn}s`);
+		}
+		if (singleUse) {
+			params.set("single_use", "true");
+		}
+		if (ip) {
+			params.set("ip", ip);
+		}
+		const query = params.toString();
+		const response = await this.fetch(
+			`/sign/${path}${query ? `?${query}` : ""}`,
+		);
+		return response.text();
+	}
+
+	/**
+	 * Get a presigned URL a browser can upload a file to directly without
+	 * being given your API key.
+	 * @param key - The key the file will be uploaded to
+	 * @param options - Upload URL options
+	 */
+	async signUpload(
+		key: string,
+		options: SignUploadOptions = {},
+	): Promise<PresignedUpload> {
+		const expiresIn = options.expiresIn ?? 60 * 60;
+		if (this.signatureSecretKey) {
+			const url = new URL(`/blob/${key}`, this.baseURL);
+			const expiresAt = Date.now() + expiresIn * 1000;
+			const headers: Record<string, string> = {};
+			if (options.contentType) {
+				headers["Content-Type"] = options.contentType;
+			}
+			return {
+				url: this.signLocally(url, expiresAt, {
+					singleUse: options.singleUse,
+					ip: options.ip,
+				}),
+				method: "PUT",
+				headers,
+				expires_at: new Date(expiresAt).toISOString(),
+			};
+		}
+
+		const params = new URLSearchParams();
+		params.set("expires_in", `${expiresIn}s`);
+		if (options.contentType) {
+			params.set("content_type", options.contentType);
+		}
+		if (options.singleUse) {
+			params.set("single_use", "true");
+		}
+		if (options.ip) {
+			params.set("ip", options.ip);
+		}
+		const response = await this.fetch(
+			`/sign/upload/${key}?${params.toString()}`,
+		);
+		if (response.status !== 200) {
+			throw new Error(`${response.status}: ${response.statusText}`);
+		}
+		return response.json();
+	}
+
+	/**
+	 * Get a signed upload policy that lets a browser POST a form with a file to
+	 * /blob, within the constraints of the policy. The file has to be the last
+	 * field of the form.
+	 * @param options - Upload policy options
+	 */
+	async signPolicy(
+		options: SignPolicyOptions = {},
+	): Promise<PresignedPolicy> {
+		const expiresIn = options.expiresIn ?? 60 * 60;
+		if (this.signatureSecretKey) {
+			const expiration = new Date(Date.now() + expiresIn * 1000);
+			const keyPrefix = (options.keyPrefix ?? "").replace(/^\//, "");
+			const signed = signPolicy(
+				{
+					expiration: expiration.toISOString(),
+					key_prefix: keyPrefix || undefined,
+					max_size: options.maxSize,
+					content_type: options.contentType,
+					acl: options.acl,
+				},
+				this.signatureSecretKey,
+			);
+			const fields: Record<string, string> = {
+				key: `${keyPrefix}\${filename}`,
+				policy: signed.policy,
+				"x-signature": signed.signature,
+			};
+			if (this.tenant) {
+				fields["x-tenant"] = this.tenant;
+			}
+			return {
+				url: new URL("/blob", this.baseURL).toString(),
+				fields,
+				expires_at: expiration.toISOString(),
+			};
+		}
+
+		const params = new URLSearchParams();
+		params.set("expires_in", `${expiresIn}s`);
+		if (options.keyPrefix) {
+			params.set("key_prefix", options.keyPrefix);
+		}
+		if (options.maxSize) {
+			params.set("max_size", options.maxSize.toString());
+		}
+		if (options.contentType) {
+			params.set("content_type", options.contentType);
+		}
+		if (options.acl) {
+			params.set("acl", options.acl);
+		}
+		const response = await this.fetch(`/sign/policy?${params.toString()}`);
+		if (response.status !== 200) {
+			throw new Error(`${response.status}: ${response.statusText}`);
+		}
+		return response.json();
+	}
+
 	/**
 	 * Get a file from blob storage.
 	 * @param key - The key to get from blob storage
@@ -60,21 +252,80 @@ export class ImageServiceClient {
 		return response;
 	}
 
+	/**
+	 * Get the headers of a file in blob storage without its body, e.g. to
+	 * check whether it exists or how large it is.
+	 * @param key - The key to check in blob storage
+	 */
+	async head(key: string): Promise<Response> {
+		return this.fetch(`/blob/${key}`, { method: "HEAD" });
+	}
+
 	/**
 	 * Put a file into blob storage.
 	 * @param key - The key to use in blob storage.
 	 * @param content - The content of the file.
+	 * @param options - Put options
 	 */
 	async put(
 		key: string,
 		content: ReadableStream | Buffer | ArrayBuffer,
+		options: PutOptions = {},
 	): Promise<Response> {
+		const headers: Record<string, string> = {};
+		for (const [name, value] of Object.entries(options.metadata ?? {})) {
+			headers[`x-meta-${name}`] = value;
+		}
+		if (options.expireAfter) {
+			headers["x-expire-after"] = options.expireAfter.toString();
+		}
+		if (options.acl) {
+			headers["x-acl"] = options.acl;
+		}
 		return this.fetch(`/blob/${key}`, {
 			method: "PUT",
+			headers,
 			body: content,
 		});
 	}
 
+	/**
+	 * Update the metadata of a file in blob storage. Set a name to `null` to
+	 * remove it.
+	 * @param key - The key of the file
+	 * @param metadata - The metadata to merge into the file's metadata
+	 */
+	async updateMetadata(
+		key: string,
+		metadata: Record<string, string | null>,
+	): Promise<ListObject> {
+		const response = await this.fetch(`/blob/${key}`, {
+			method: "PATCH",
+			headers: { "Content-Type": "application/merge-patch+json" },
+			body: JSON.stringify(metadata),
+		});
+		if (response.status !== 200) {
+			throw new Error(`${response.status}: ${response.statusText}`);
+		}
+		return response.json();
+	}
+
+	/**
+	 * Change who can read a file in blob storage.
+	 * @param key - The key of the file
+	 * @param acl - `public` to let anyone read it, `private` otherwise
+	 */
+	async setAcl(key: string, acl: Acl): Promise<ListObject> {
+		const response = await this.fetch(`/blob/${key}`, {
+			method: "PATCH",
+			headers: { "x-acl": acl },
+		});
+		if (response.status !== 200) {
+			throw new Error(`${response.status}: ${response.statusText}`);
+		}
+		return response.json();
+	}
+
 	/**
 	 * Delete a file in blob storage.
 	 * @param key - The key to delete in blob storage.
@@ -83,6 +334,171 @@ export class ImageServiceClient {
 		return this.fetch(`/blob/${key}`, { method: "DELETE" });
 	}
 
+	/**
+	 * Copy a file in blob storage to a new key without downloading it.
+	 * @param source - The key to copy from
+	 * @param destination - The key to copy to
+	 * @param options - Copy options
+	 */
+	async copy(
+		source: string,
+		destination: string,
+		options: CopyOptions = {},
+	): Promise<ListObject> {
+		return this.copyTo("/blob/copy", source, destination, options);
+	}
+
+	/**
+	 * Move a file in blob storage to a new key without downloading it.
+	 * @param source - The key to move
+	 * @param destination - The key to move it to
+	 * @param options - Move options
+	 */
+	async move(
+		source: string,
+		destination: string,
+		options: CopyOptions = {},
+	): Promise<ListObject> {
+		return this.copyTo("/blob/move", source, destination, options);
+	}
+
+	private async copyTo(
+		path: string,
+		source: string,
+		destination: string,
+		options: CopyOptions,
+	): Promise<ListObject> {
+		const response = await this.fetch(path, {
+			method: "POST",
+			headers: { "Content-Type": "application/json" },
+			body: JSON.stringify({ source, destination, ...options }),
+		});
+		if (response.status !== 201) {
+			throw new Error(`${response.status}: ${response.statusText}`);
+		}
+		return response.json();
+	}
+
+	/**
+	 * Restore a file that was unlinked (soft deleted). Unlinked files can be
+	 * listed with `list({ unlinked: true })`.
+	 * @param key - The key to restore
+	 */
+	async restore(key: string): Promise<ListObject> {
+		const response = await this.fetch(`/blob/restore/${key}`, {
+			method: "POST",
+		});
+		if (response.status !== 200) {
+			throw new Error(`${response.status}: ${response.statusText}`);
+		}
+		return response.json();
+	}
+
+	/**
+	 * Fetch a remote file and store it in blob storage. The URL's host has to
+	 * be in the service's `SERVE_ALLOWED_HTTP_SOURCES`.
+	 * @param url - The URL of the file to fetch
+	 * @param key - The key to store the file under
+	 */
+	async fetchURL(url: string, key: string): Promise<ListObject> {
+		const response = await this.fetch("/blob/fetch", {
+			method: "POST",
+			headers: { "Content-Type": "application/json" },
+			body: JSON.stringify({ url, key }),
+		});
+		if (response.status !== 201) {
+			throw new Error(`${response.status}: ${response.statusText}`);
+		}
+		return response.json();
+	}
+
+	/**
+	 * Delete many files in blob storage in one request.
+	 * @param options - The keys, or a prefix, to delete
+	 */
+	async batchDelete(options: BatchDeleteOptions): Promise<BatchDeleteResult> {
+		const response = await this.fetch("/blob/batch/delete", {
+			method: "POST",
+			headers: { "Content-Type": "application/json" },
+			body: JSON.stringify(options),
+		});
+		if (response.status !== 200) {
+			throw new Error(`${response.status}: ${response.statusText}`);
+		}
+		return response.json();
+	}
+
+	/**
+	 * Get the number of files and bytes stored under a prefix, or in total.
+	 * @param prefix - The prefix to get stats for
+	 */
+	async stats(prefix?: string): Promise<StorageStatsResult> {
+		const params = new URLSearchParams();
+		if (prefix) {
+			params.set("prefix", prefix);
+		}
+		const response = await this.fetch(`/stats/storage?${params.toString()}`);
+		if (response.status !== 200) {
+			throw new Error(`${response.status}: ${response.statusText}`);
+		}
+		return response.json();
+	}
+
+	/**
+	 * Follow the changes to files under a prefix, or to every file, as they
+	 * happen. Requires an API key with the `read` scope. The stream ends when
+	 * the server restarts or the client falls too far behind.
+	 * @param prefix - The prefix to follow changes to
+	 * @param signal - Aborts the stream
+	 */
+	async *events(
+		prefix?: string,
+		signal?: AbortSignal,
+	): AsyncGenerator<BlobEvent> {
+		const params = new URLSearchParams();
+		if (prefix) {
+			params.set("prefix", prefix);
+		}
+		const response = await this.fetch(`/events?${params.toString()}`, {
+			headers: { Accept: "text/event-stream" },
+			signal,
+		});
+		if (response.status !== 200 || !response.body) {
+			throw new Error(`${response.status}: ${response.statusText}`);
+		}
+
+		const reader = response.body
+			.pipeThrough(new TextDecoderStream())
+			.getReader();
+		let buffer = "";
+		let data: string[] = [];
+		try {
+			while (true) {
+				const { done, value } = await reader.read();
+				if (done) {
+					return;
+				}
+				buffer += value;
+				const lines = buffer.split("\n");
+				buffer = lines.pop() ?? "";
+				for (const line of lines) {
+					if (line === "") {
+						if (data.length > 0) {
+							yield JSON.parse(data.join("\n"));
+							data = [];
+						}
+					} else if (line.startsWith("data:")) {
+						// Lines other than data, like ids and comments, are ignored
+						data.push(line.slice(5).replace(/^ /, ""));
+					}
+				}
+			}
+		} finally {
+			// Closes the connection if the caller stopped iterating early
+			reader.cancel().catch(() => {});
+		}
+	}
+
 	/**
 	 * List keys in blob storage.
 	 * @param options - List options
@@ -96,9 +512,15 @@ export class ImageServiceClient {
 		if (options.prefix) {
 			params.set("prefix", options.prefix);
 		}
+		if (options.glob) {
+			params.set("glob", options.glob);
+		}
 		if (options.startingAt) {
 			params.set("starting_at", options.startingAt);
 		}
+		if (options.cursor) {
+			params.set("cursor", options.cursor);
+		}
 		if (options.unlinked) {
 			params.set("unlinked", "true");
 		}
@@ -108,13 +530,153 @@ export class ImageServiceClient {
 	}
 }
 
+export type PutOptions = {
+	/** Metadata to store with the file, e.g. an owner ID */
+	metadata?: Record<string, string>;
+	/** Delete the file automatically after this many seconds */
+	expireAfter?: number;
+	/** Who can read the file. Defaults to the service's `DEFAULT_ACL`. */
+	acl?: Acl;
+	/** A tiny version of an image as a data URI to show while it loads */
+	placeholder?: string;
+};
+
+/** Public files can be read by anyone, private ones need a key or signed URL */
+export type Acl = "public" | "private";
+
+export type SignOptions = {
+	/**
+	 * How many seconds the URL is valid for. /blob URLs are valid for an hour
+	 * by default and /serve URLs never expire.
+	 */
+	expiresIn?: number;
+	/**
+	 * Only accept the URL once. Single-use /serve URLs expire after an hour
+	 * unless `expiresIn` is set.
+	 */
+	singleUse?: boolean;
+	/**
+	 * Only accept the URL from this IP address or CIDR, e.g. the IP of the
+	 * user it's for.
+	 */
+	ip?: string;
+};
+
+export type SignUploadOptions = {
+	/** How many seconds the URL is valid for. Defaults to an hour, at most 7 days. */
+	expiresIn?: number;
+	/** The content type the file will be uploaded with */
+	contentType?: string;
+	/** Only accept the URL once */
+	singleUse?: boolean;
+	/** Only accept the URL from this IP address or CIDR */
+	ip?: string;
+};
+
+export type SignPolicyOptions = {
+	/** How many seconds the policy is valid for. Defaults to an hour, at most 7 days. */
+	expiresIn?: number;
+	/** The prefix the key of the upload has to start with */
+	keyPrefix?: string;
+	/** The largest file that can be uploaded in bytes */
+	maxSize?: number;
+	/** The prefix the content type of the file has to start with, e.g. `image/` */
+	contentType?: string;
+	/** The ACL the file is uploaded with. The form can choose one if unset. */
+	acl?: Acl;
+};
+
+export type PresignedPolicy = {
+	/** The URL to POST the form to */
+	url: string;
+	/** Form fields to send before the file */
+	fields: Record<string, string>;
+	/** When the policy stops being accepted, as an RFC 3339 timestamp */
+	expires_at: string;
+};
+
+export type PresignedUpload = {
+	/** The signed URL to upload the file to */
+	url: string;
+	/** The HTTP method to upload the file with */
+	method: string;
+	/** Headers the upload request has to include */
+	headers: Record<string, string>;
+	/** When the URL stops being accepted, as an RFC 3339 timestamp */
+	expires_at: string;
+};
+
+export type CopyOptions = {
+	/** If true, replace an existing file at the destination */
+	overwrite?: boolean;
+};
+
+export type BatchDeleteOptions = {
+	/** The keys to delete */
+	keys?: string[];
+	/**
+	 * Delete every key with this prefix instead of `keys`. At most 1000 keys
+	 * are deleted per request, so repeat the request while `has_more` is true.
+	 */
+	prefix?: string;
+	/** If true, soft delete (unlink) the files instead of removing them */
+	unlink?: boolean;
+};
+
+export type BatchDeleteResult = {
+	/** The outcome of deleting each key */
+	results: { key: string; status: number }[];
+	/** The number of keys that were deleted */
+	deleted: number;
+	/** Whether or not more keys match the prefix */
+	has_more: boolean;
+};
+
+export type StorageStats = {
+	/** The number of files that are served */
+	objects: number;
+	/** The total size of the files that are served */
+	bytes: number;
+	/** The number of unlinked files that still take up space */
+	deleted_objects: number;
+	/** The total size of the unlinked files */
+	deleted_bytes: number;
+};
+
+export type StorageStatsResult = StorageStats & {
+	/** The totals broken down by the next path segment after the prefix */
+	prefixes: (StorageStats & { prefix: string })[];
+};
+
+export type BlobEvent = {
+	id: string;
+	type:
+		| "blob.created"
+		| "blob.overwritten"
+		| "blob.updated"
+		| "blob.deleted"
+		| "blob.restored"
+		| "blob.quarantined";
+	/** When the event happened, as an RFC 3339 timestamp */
+	created_at: string;
+	/** The file the event is about */
+	object: ListObject;
+};
+
 export type ListOptions = {
 	/** The maximum number of keys to return */
 	limit?: number;
 	/** A prefix to filter keys by */
 	prefix?: string;
+	/**
+	 * A glob pattern to filter keys by, e.g. `avatars/*.png`. `*` and `?` do
+	 * not match `/`, so `avatars/*` only lists the direct children of `avatars/`.
+	 */
+	glob?: string;
 	/** The key to start listing from */
 	startingAt?: string;
+	/** The `next_cursor` of a previous page to continue listing from */
+	cursor?: string;
 	/** If true, list unlinked (soft deleted) files */
 	unlinked?: boolean;
 };
@@ -122,10 +684,29 @@ export type ListOptions = {
 export type ListResult = {
 	/** The keys of the files */
 	keys: string[];
+	/** The files with their size, MIME type and last modified time */
+	objects: ListObject[];
 	/** A URL to the next page of results */
-	nextPage?: string;
+	next_page?: string;
+	/** An opaque cursor to pass to `list()` to fetch the next page */
+	next_cursor?: string;
 	/** Whether or not there are more results */
-	hasMore: boolean;
+	has_more: boolean;
+};
+
+export type ListObject = {
+	/** The key of the file */
+	key: string;
+	/** The size of the file in bytes */
+	size: number;
+	/** The detected MIME type of the file */
+	content_type: string;
+	/** When the file was last written, as an RFC 3339 timestamp */
+	modified_time: string;
+	/** Metadata set with `x-meta-*` headers */
+	metadata?: Record<string, string>;
+	/** Who can read the file. Unset means the service's `DEFAULT_ACL`. */
+	acl?: Acl;
 };
 
 export function sign(key: string, secret: string): string {
@@ -135,7 +716,78 @@ export function sign(key: string, secret: string): string {
 	return hmac.digest("base64url"); // base64url is the URL-safe version
 }
 
-export function signUrl(url: URL, secret: string): string {
+/**
+ * Get the signature of a URL signed for `path`, e.g. `/blob/gopher.png` or a
+ * /serve path without the /serve prefix, bound to an expiry in milliseconds
+ * since the epoch, a nonce and an IP address or CIDR, any of which can be
+ * empty. Each field is tagged and length-prefixed, and URLs bound to any of
+ * them are signed with a secret of their own, so a signature can't be moved
+ * between fields or into the path.
+ */
+export function urlSignature(
+	path: string,
+	expireAt: string,
+	nonce: string,
+	ip: string,
+	secret: string,
+): string {
+	if (!expireAt && !nonce && !ip) {
+		return sign(path, secret);
+	}
+	path = path.replace(/^\//, "");
+	const field = (value: string) => `${Buffer.byteLength(value)}:${value}`;
+	const payload = `p=${field(path)};e=${field(expireAt)};n=${field(nonce)};ip=${field(ip)}`;
+	return sign(payload, sign("url-fields", secret));
+}
+
+export function signUrl(
+	url: URL,
+	secret: string,
+	expireAt: number = Date.now() + 60 * 60 * 1000, // 1 hour in milliseconds
+): string {
+	return signUrlWithOptions(url, secret, { expireAt });
+}
+
+/**
+ * Sign a URL that stops being accepted at `expireAt`. Unlike `signUrl()`,
+ * this applies to /serve URLs as well.
+ */
+export function signExpiringUrl(
+	url: URL,
+	secret: string,
+	expireAt: number,
+): string {
+	return signUrlWithOptions(url, secret, { expireAt, expireServe: true });
+}
+
+export type SignUrlOptions = {
+	/**
+	 * When the signature stops being accepted, in milliseconds since the
+	 * epoch. Required for /blob URLs and single-use URLs.
+	 */
+	expireAt: number;
+	/** Make /serve signatures expire at `expireAt` as well */
+	expireServe?: boolean;
+	/**
+	 * Only accept the URL once. A random nonce is added to the URL, which the
+	 * service records the first time the URL is used.
+	 */
+	singleUse?: boolean;
+	/**
+	 * Only accept the URL from this IP address or CIDR, e.g. `203.0.113.7` or
+	 * `203.0.113.0/24`, so it can't be replayed from anywhere else.
+	 */
+	ip?: string;
+};
+
+/**
+ * Sign a URL with options.
+ */
+export function signUrlWithOptions(
+	url: URL,
+	secret: string,
+	{ expireAt, expireServe = false, singleUse = false, ip }: SignUrlOptions,
+): string {
 	const nextURI = new URL(url.toString());
 	const path = nextURI.pathname;
 	const p = decodeURIComponent(path.replace(/^\/sign/, ""));
@@ -143,26 +795,112 @@ export function signUrl(url: URL, secret: string): string {
 		throw new Error("invalid path");
 	}
 
-	let signature = "";
 	const query = new URLSearchParams(nextURI.search);
-
+	// /serve signatures don't include the /serve prefix, and only expire when
+	// asked to
+	let payload = p;
+	let expire = true;
 	if (p.startsWith("/serve")) {
-		signature = sign(p.replace(/^\/serve/, ""), secret);
+		payload = p.replace(/^\/serve/, "");
+		expire = expireServe || singleUse;
 	}
-
-	if (p.startsWith("/blob")) {
-		const expireAt = Date.now() + 60 * 60 * 1000; // 1 hour in milliseconds
-		query.set("x-expire", expireAt.toString());
-		nextURI.search = query.toString();
-		signature = sign(`${p}:${expireAt}`, secret);
+	let expireParam = "";
+	let nonce = "";
+	if (expire) {
+		expireParam = expireAt.toString();
+		query.set("x-expire", expireParam);
+	}
+	if (singleUse) {
+		nonce = randomBytes(16).toString("base64url");
+		query.set("x-nonce", nonce);
+	}
+	if (ip) {
+		if (!validIp(ip)) {
+			throw new Error("invalid IP");
+		}
+		query.set("x-ip", ip);
 	}
 
 	nextURI.pathname = p;
-	query.set("x-signature", signature);
+	query.set(
+		"x-signature",
+		urlSignature(payload, expireParam, nonce, ip ?? "", secret),
+	);
 	nextURI.search = query.toString();
 	return nextURI.toString();
 }
 
+export type UploadPolicy = {
+	/** When the policy stops being accepted, as an RFC 3339 timestamp */
+	expiration: string;
+	/** The prefix the key of the upload has to start with */
+	key_prefix?: string;
+	/** The largest file that can be uploaded in bytes */
+	max_size?: number;
+	/** The prefix the detected content type of the file has to start with */
+	content_type?: string;
+	/** The ACL the file is uploaded with */
+	acl?: Acl;
+};
+
+/**
+ * Sign an upload policy. The encoded policy and its signature are sent with
+ * the form in the `policy` and `x-signature` fields.
+ */
+export function signPolicy(
+	policy: UploadPolicy,
+	secret: string,
+): { policy: string; signature: string } {
+	const encoded = Buffer.from(JSON.stringify(policy)).toString("base64url");
+	return { policy: encoded, signature: sign(`policy:${encoded}`, secret) };
+}
+
+/**
+ * Verify a webhook sent by the image service. The timestamp and signature are
+ * sent in the `x-webhook-timestamp` and `x-webhook-signature` headers.
+ * @param body - The raw body of the request
+ * @param timestamp - The `x-webhook-timestamp` header
+ * @param signature - The `x-webhook-signature` header
+ * @param secret - The `WEBHOOK_SECRET` of your image service
+ * @param tolerance - How many seconds old the webhook can be, so it can't be
+ *   replayed later. Defaults to 5 minutes.
+ */
+export function verifyWebhook(
+	body: string | Buffer,
+	timestamp: string,
+	signature: string,
+	secret: string,
+	tolerance = 5 * 60,
+): boolean {
+	if (
+		!/^\d+$/.test(timestamp) ||
+		Math.abs(Date.now() / 1000 - Number(timestamp)) > tolerance
+	) {
+		return false;
+	}
+	const hmac = createHmac("sha256", secret);
+	hmac.update(`webhook:${timestamp}.`);
+	hmac.update(body);
+	const expected = Buffer.from(hmac.digest("base64url"));
+	const actual = Buffer.from(signature);
+	return (
+		actual.length === expected.length && timingSafeEqual(actual, expected)
+	);
+}
+
+function validIp(ip: string): boolean {
+	const [address, bits, ...rest] = ip.split("/");
+	const version = isIP(address);
+	if (version === 0 || rest.length > 0) {
+		return false;
+	}
+	if (bits === undefined) {
+		return true;
+	}
+	const n = Number(bits);
+	return /^\d+$/.test(bits) && n <= (version === 4 ? 32 : 128);
+}
+
 /**
  * A builder class for generating image processing URLs using the thumbor syntax.
  * Enables chaining of image transformations and filters for dynamic image manipulation.
@@ -570,10 +1308,7 @@ class ImageUrlBuilder {
 		}
 
 		const path = this.buildPath();
-		return signUrl(
-			new URL(path, this.client.baseURL),
-			this.client.signatureSecretKey,
-		);
+		return this.client.signLocally(new URL(path, this.client.baseURL));
 	}
 
 	toString(): string {
@@ -0,0 +1,9 @@
+// Package imagesv1 is the generated code of the gRPC API. It's checked in, so
+// the service builds without protoc. After changing images.proto, generate it
+// again with protoc and the versions of protoc-gen-go and protoc-gen-go-grpc
+// in the header of the generated files:
+//
+//	go generate ./proto/...
+package imagesv1
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative images.proto